@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+
+	"github.com/dws33/WB_ZeroProj/internal/model"
+	"github.com/dws33/WB_ZeroProj/internal/storage"
+	"github.com/segmentio/kafka-go"
+)
+
+// Типы событий — значение заголовка Kafka event_type. Сообщение без
+// заголовка — новый заказ, как до появления других событий.
+const (
+	eventOrderCreated  = storage.EventOrderCreated
+	eventRefundCreated = "refund.created"
+	eventItemStatus    = "item_status.updated"
+)
+
+// eventType возвращает тип события сообщения m.
+func eventType(m kafka.Message) string {
+	for _, h := range m.Headers {
+		if h.Key == storage.EventTypeHeader {
+			return string(h.Value)
+		}
+	}
+	return eventOrderCreated
+}
+
+// handleRefund сохраняет возврат из события refund.created: тело —
+// model.Refund; actor по умолчанию — имя экземпляра eventhandler.
+func handleRefund(ctx context.Context, store storage.OrderStore, m kafka.Message) {
+	rs, ok := store.(storage.RefundStore)
+	if !ok {
+		log.Println("refunds are not supported by storage, event skipped")
+		return
+	}
+	refund := new(model.Refund)
+	if err := json.Unmarshal(m.Value, refund); err != nil {
+		log.Println("fail to unmarshal refund", err)
+		return
+	}
+	if refund.Actor == "" {
+		refund.Actor = instance
+	}
+	_, err := rs.CreateRefund(ctx, refund)
+	switch {
+	case errors.Is(err, storage.ErrConflict):
+		log.Println("duplicate refund skipped", refund.OrderUID, refund.RefundID)
+	case errors.Is(err, storage.ErrInvalidArgument), errors.Is(err, storage.ErrNotFound):
+		log.Println("invalid refund", refund.OrderUID, refund.RefundID, err)
+	case err != nil:
+		log.Println("fail to save refund in db", err)
+	default:
+		log.Println("success handle refund")
+	}
+}
+
+// handleItemStatus применяет событие item_status.updated исправлением
+// заказа: смены попадают в историю заказа и статусов товаров. Позиция
+// сообщения в Kafka — ключ идемпотентности: eventhandler читает топик без
+// группы потребителей, и после перезапуска события приходят повторно.
+func handleItemStatus(ctx context.Context, store storage.OrderStore, m kafka.Message) {
+	hs, ok := store.(storage.ItemStatusUpdater)
+	if !ok {
+		log.Println("order corrections are not supported by storage, event skipped")
+		return
+	}
+	event := new(storage.ItemStatusEvent)
+	if err := json.Unmarshal(m.Value, event); err != nil {
+		log.Println("fail to unmarshal item status event", err)
+		return
+	}
+	event.Topic, event.Partition, event.Offset = m.Topic, m.Partition, m.Offset
+	if event.Actor == "" {
+		event.Actor = instance
+	}
+	if event.Reason == "" {
+		event.Reason = eventItemStatus
+	}
+	rev, err := hs.UpdateItemStatuses(ctx, event)
+	switch {
+	case errors.Is(err, storage.ErrInvalidArgument), errors.Is(err, storage.ErrNotFound):
+		log.Println("invalid item status event", event.OrderUID, err)
+	case err != nil:
+		log.Println("fail to update item statuses in db", err)
+	case rev == nil:
+		log.Println("item statuses unchanged or event already applied", event.OrderUID, m.Offset)
+	default:
+		log.Println("success handle item status event", event.OrderUID, rev.Version)
+	}
+}
@@ -3,39 +3,74 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/dws33/WB_ZeroProj/internal/model"
+	"github.com/dws33/WB_ZeroProj/internal/pii"
 	"github.com/dws33/WB_ZeroProj/internal/storage"
-	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/dws33/WB_ZeroProj/internal/storage/migrations"
 	"github.com/segmentio/kafka-go"
 	"log"
 	"net"
 	"os"
+	"time"
 )
 
 func main() {
-
 	ctx := context.Background()
 
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		os.Getenv("POSTGRES_HOST"),
-		os.Getenv("POSTGRES_PORT"),
-		os.Getenv("POSTGRES_USER"),
-		os.Getenv("POSTGRES_PASSWORD"),
-		os.Getenv("POSTGRES_DB"),
-	)
-
-	pgxPool, err := pgxpool.New(ctx, connStr)
+	var opts []storage.Option
+	if cipher := piiCipher(); cipher != nil {
+		opts = append(opts, storage.WithPII(cipher))
+	}
+	store, closeStore, err := storage.Open(ctx, storageDSN(), opts...)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer pgxPool.Close()
+	defer closeStore()
 
-	store, err := storage.New(ctx, pgxPool)
-	if err != nil {
-		log.Fatal(err)
+	if os.Getenv("MIGRATE_ON_START") == "true" {
+		for _, pool := range storage.Pools(store) {
+			if err := migrations.Up(ctx, pool); err != nil {
+				log.Fatal(err)
+			}
+		}
 	}
 
+	// секции заказов и шифрование доставки есть только в нормализованной схеме PostgreSQL
+	var partitioned []*storage.Storage
+	switch s := store.(type) {
+	case *storage.Storage:
+		partitioned = []*storage.Storage{s}
+	case *storage.ShardedStorage:
+		partitioned = s.Shards()
+	}
+	for _, s := range partitioned {
+		go storage.RunPartitionMaintenance(ctx, s.Pool(), partitionPolicy(), partitionInterval())
+	}
+
+	// доставки, зашифрованные не текущим ключом PII_KEY_FILE или
+	// записанные до включения шифрования, перешифровываются в фоне
+	if os.Getenv("PII_KEY_FILE") != "" {
+		for _, s := range partitioned {
+			go storage.RunPIIRotation(ctx, s, envDuration("PII_ROTATION_INTERVAL", time.Hour))
+		}
+	}
+
+	// удаленные заказы окончательно удаляются через ORDER_PURGE_AFTER
+	if ds, ok := store.(storage.DeleteStore); ok {
+		go storage.RunPurge(ctx, ds, envDuration("ORDER_PURGE_AFTER", 30*24*time.Hour), envDuration("ORDER_PURGE_INTERVAL", time.Hour))
+	}
+
+	// журнал изменений нужен кэшам сервисов, пока они не дочитали его;
+	// кэш, остановленный дольше ORDER_CHANGES_RETAIN, перечитывается целиком
+	if feed, ok := store.(storage.ChangeFeed); ok {
+		go storage.RunChangePruning(ctx, feed, envDuration("ORDER_CHANGES_RETAIN", 7*24*time.Hour), time.Hour)
+	}
+
+	archive, _ := store.(storage.RawStore)
+	metaStore, _ := store.(storage.MetaStore)
+
 	// todo add consumer group
 	r := kafka.NewReader(kafka.ReaderConfig{
 		Brokers:  []string{net.JoinHostPort(os.Getenv("KAFKA_HOST"), os.Getenv("KAFKA_PORT"))},
@@ -44,13 +79,33 @@ func main() {
 	})
 	defer r.Close()
 
-	order := new(model.Order)
 	for {
 		m, err := r.ReadMessage(ctx)
 		if err != nil {
 			log.Println("fail to read message", err)
 			continue
 		}
+		// исходное сообщение архивируется до разбора, в том числе невалидное
+		if archive != nil {
+			if err := archive.ArchiveRaw(ctx, rawMessage(m)); err != nil {
+				log.Println("fail to archive message", err)
+			}
+		}
+		switch t := eventType(m); t {
+		case eventOrderCreated:
+		case eventRefundCreated:
+			handleRefund(ctx, store, m)
+			continue
+		case eventItemStatus:
+			handleItemStatus(ctx, store, m)
+			continue
+		default:
+			log.Println("unknown event type skipped", t)
+			continue
+		}
+		// новый заказ на каждое сообщение: Unmarshal в переиспользуемую
+		// структуру оставил бы поля и элементы Items от предыдущего заказа
+		order := new(model.Order)
 		err = json.Unmarshal(m.Value, order)
 		if err != nil {
 			log.Println("fail to unmarshal order", err)
@@ -61,11 +116,77 @@ func main() {
 			log.Println("invalid order", err)
 			continue
 		}
-		err = store.CreateOrder(ctx, &*order)
+		err = store.CreateOrder(ctx, order)
+		if errors.Is(err, storage.ErrConflict) {
+			log.Println("duplicate order skipped", order.OrderUID)
+			continue
+		}
 		if err != nil {
 			log.Println("fail to save order in db", err)
 			continue
 		}
+		if metaStore != nil {
+			if err := metaStore.SaveIngestMeta(ctx, order.OrderUID, ingestMeta(m, order)); err != nil {
+				log.Println("fail to save ingest metadata", order.OrderUID, err)
+			}
+		}
 		log.Println("success handle order")
 	}
 }
+
+// rawMessage готовит сообщение Kafka к архивированию. order_uid берется
+// из сообщения без полного разбора: он нужен и для невалидных заказов.
+func rawMessage(m kafka.Message) *storage.RawMessage {
+	var head struct {
+		OrderUID string `json:"order_uid"`
+	}
+	_ = json.Unmarshal(m.Value, &head)
+
+	headers := make([]storage.RawHeader, len(m.Headers))
+	for i, h := range m.Headers {
+		headers[i] = storage.RawHeader{Key: h.Key, Value: h.Value}
+	}
+	return &storage.RawMessage{
+		OrderUID:   head.OrderUID,
+		Topic:      m.Topic,
+		Partition:  m.Partition,
+		Offset:     m.Offset,
+		Headers:    headers,
+		Payload:    m.Value,
+		ReceivedAt: time.Now(),
+	}
+}
+
+// storageDSN возвращает STORAGE_DSN, а если он не задан — строку
+// подключения к PostgreSQL из POSTGRES_* (с STORAGE_MODE=document —
+// в документном режиме).
+func storageDSN() string {
+	if dsn := os.Getenv("STORAGE_DSN"); dsn != "" {
+		return dsn
+	}
+	var prefix string
+	if os.Getenv("STORAGE_MODE") == "document" {
+		prefix = "document:"
+	}
+	return prefix + fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		os.Getenv("POSTGRES_HOST"),
+		os.Getenv("POSTGRES_PORT"),
+		os.Getenv("POSTGRES_USER"),
+		os.Getenv("POSTGRES_PASSWORD"),
+		os.Getenv("POSTGRES_DB"),
+	)
+}
+
+// piiCipher возвращает шифр персональных данных доставки по файлу ключей
+// PII_KEY_FILE или nil, если файл не задан.
+func piiCipher() *pii.Cipher {
+	path := os.Getenv("PII_KEY_FILE")
+	if path == "" {
+		return nil
+	}
+	keys, indexKey, err := pii.LoadKeyFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return pii.New(keys, indexKey)
+}
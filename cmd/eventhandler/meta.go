@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/dws33/WB_ZeroProj/internal/model"
+	"github.com/dws33/WB_ZeroProj/internal/storage"
+	"github.com/segmentio/kafka-go"
+)
+
+// instance — имя этого экземпляра eventhandler в метаданных заказов.
+var instance = instanceName()
+
+func instanceName() string {
+	if id := os.Getenv("INSTANCE_ID"); id != "" {
+		return id
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+// ingestMeta описывает получение заказа order из сообщения m.
+func ingestMeta(m kafka.Message, order *model.Order) *storage.IngestMeta {
+	var warnings []string
+	for _, f := range unknownFields(m.Value, order) {
+		warnings = append(warnings, "unknown field "+f)
+	}
+	return &storage.IngestMeta{
+		Kafka: &storage.KafkaSource{
+			Topic:     m.Topic,
+			Partition: m.Partition,
+			Offset:    m.Offset,
+		},
+		IngestedAt:    time.Now(),
+		Instance:      instance,
+		SchemaVersion: model.SchemaVersion,
+		Warnings:      warnings,
+	}
+}
+
+// unknownFields возвращает поля сообщения, которых нет в model.Order
+// (например, "payment.fee_id" или "items[].color") — они теряются при разборе
+// и остаются только в архиве исходных сообщений.
+func unknownFields(data []byte, order *model.Order) []string {
+	var got, known any
+	if err := json.Unmarshal(data, &got); err != nil {
+		return nil
+	}
+	b, err := json.Marshal(order)
+	if err != nil {
+		return nil
+	}
+	if err := json.Unmarshal(b, &known); err != nil {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	collectUnknown("", got, known, seen)
+	fields := make([]string, 0, len(seen))
+	for f := range seen {
+		fields = append(fields, f)
+	}
+	slices.Sort(fields)
+	return fields
+}
+
+func collectUnknown(path string, got, known any, seen map[string]bool) {
+	switch g := got.(type) {
+	case map[string]any:
+		k, _ := known.(map[string]any)
+		for key, v := range g {
+			p := key
+			if path != "" {
+				p = path + "." + key
+			}
+			kv, ok := k[key]
+			if !ok {
+				seen[p] = true
+				continue
+			}
+			collectUnknown(p, v, kv, seen)
+		}
+	case []any:
+		k, _ := known.([]any)
+		for i, v := range g {
+			if i < len(k) {
+				collectUnknown(path+"[]", v, k[i], seen)
+			}
+		}
+	}
+}
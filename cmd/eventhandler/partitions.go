@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/dws33/WB_ZeroProj/internal/storage"
+)
+
+// partitionPolicy читает настройки секций заказов из окружения:
+// PARTITION_MONTHS_AHEAD, RETENTION_MONTHS и RETENTION_MODE (archive или drop).
+func partitionPolicy() storage.PartitionPolicy {
+	return storage.PartitionPolicy{
+		Ahead:   envInt("PARTITION_MONTHS_AHEAD", 3),
+		Retain:  envInt("RETENTION_MONTHS", 0),
+		Archive: os.Getenv("RETENTION_MODE") != "drop",
+	}
+}
+
+// partitionInterval — период обслуживания секций, PARTITION_MAINTENANCE_INTERVAL.
+func partitionInterval() time.Duration {
+	return envDuration("PARTITION_MAINTENANCE_INTERVAL", time.Hour)
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	s := os.Getenv(name)
+	if s == "" {
+		return def
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		log.Printf("invalid %s %q, using %s", name, s, def)
+		return def
+	}
+	return d
+}
+
+func envInt(name string, def int) int {
+	s := os.Getenv(name)
+	if s == "" {
+		return def
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		log.Printf("invalid %s %q, using %d", name, s, def)
+		return def
+	}
+	return n
+}
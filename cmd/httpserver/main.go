@@ -4,51 +4,218 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/dws33/WB_ZeroProj/internal/admin"
 	"github.com/dws33/WB_ZeroProj/internal/handler"
+	"github.com/dws33/WB_ZeroProj/internal/model"
+	"github.com/dws33/WB_ZeroProj/internal/pii"
 	"github.com/dws33/WB_ZeroProj/internal/storage"
 	"github.com/dws33/WB_ZeroProj/internal/storage/cache"
-	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/dws33/WB_ZeroProj/internal/storage/migrations"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		os.Getenv("POSTGRES_HOST"),
-		os.Getenv("POSTGRES_PORT"),
-		os.Getenv("POSTGRES_USER"),
-		os.Getenv("POSTGRES_PASSWORD"),
-		os.Getenv("POSTGRES_DB"),
-	)
-
-	pgxPool, err := pgxpool.New(ctx, connStr)
+	cipher := piiCipher()
+	dbStore, closeStore, err := storage.Open(ctx, storageDSN(), storageOptions(cipher)...)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer pgxPool.Close()
+	defer closeStore()
 
-	dbStore, err := storage.New(ctx, pgxPool)
-	if err != nil {
-		log.Fatal(err)
+	if os.Getenv("MIGRATE_ON_START") == "true" {
+		for _, pool := range storage.Pools(dbStore) {
+			if err := migrations.Up(ctx, pool); err != nil {
+				log.Fatal(err)
+			}
+		}
 	}
-	cachedStore, err := cache.New(ctx, dbStore)
+
+	cachedStore, err := cache.New(ctx, dbStore, cacheOptions(cipher)...)
 	if err != nil {
 		log.Fatal(err)
 	}
-	h := handler.New(cachedStore)
+	defer func() {
+		if err := cachedStore.Close(); err != nil {
+			log.Println("fail to close cache:", err)
+		}
+	}()
+	handlerOpts := []handler.Option{handler.WithItemStatuses(itemStatuses())}
+	if cipher != nil {
+		handlerOpts = append(handlerOpts, handler.WithPII(cipher))
+	}
+	h := handler.New(cachedStore, handlerOpts...)
 
 	http.HandleFunc("GET /order/{order_uid}", h.GetOrder)
+	http.HandleFunc("GET /order/{order_uid}/history", h.GetOrderHistory)
+	http.HandleFunc("GET /order/{order_uid}/status", h.GetOrderStatus)
+	http.HandleFunc("GET /order/{order_uid}/items/timeline", h.GetItemTimeline)
+	http.HandleFunc("GET /item-statuses", h.ListItemStatuses)
+	http.HandleFunc("GET /order/{order_uid}/refunds", h.GetRefunds)
+	http.HandleFunc("GET /orders", h.ListOrders)
+	http.HandleFunc("GET /orders/lookup/{field}/{value}", h.FindOrders)
+
+	// исправление, смена статуса, возврат, удаление, журнал и исходные
+	// сообщения (в них персональные данные) — только с ADMIN_TOKEN
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	http.Handle("GET /order/{order_uid}/raw", admin.RequireToken(adminToken, http.HandlerFunc(h.GetRawOrder)))
+	http.Handle("PUT /order/{order_uid}", admin.RequireToken(adminToken, http.HandlerFunc(h.UpdateOrder)))
+	http.Handle("POST /order/{order_uid}/status", admin.RequireToken(adminToken, http.HandlerFunc(h.TransitionOrder)))
+	http.Handle("POST /order/{order_uid}/refunds", admin.RequireToken(adminToken, http.HandlerFunc(h.CreateRefund)))
+	http.Handle("DELETE /order/{order_uid}", admin.RequireToken(adminToken, http.HandlerFunc(h.DeleteOrder)))
+	http.Handle("POST /order/{order_uid}/erase", admin.RequireToken(adminToken, http.HandlerFunc(h.EraseOrder)))
+	http.Handle("GET /order/{order_uid}/audit", admin.RequireToken(adminToken, http.HandlerFunc(h.GetOrderAudit)))
 
 	addr := net.JoinHostPort(
 		os.Getenv("SERVER_HOST"),
 		os.Getenv("SERVER_PORT"))
 
+	if port := os.Getenv("SERVER_ADMIN_PORT"); port != "" {
+		adminAddr := net.JoinHostPort(os.Getenv("SERVER_HOST"), port)
+		admin.ListenAndServe(ctx, adminAddr, adminToken, cachedStore)
+	}
+
+	// позиция WAL записи передается клиенту для чтения из реплик
+	srv := &http.Server{Addr: addr, Handler: handler.ReadYourWrites(http.DefaultServeMux)}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
 	log.Println("HTTP server started on", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil && errors.Is(err, http.ErrServerClosed) {
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalf("server failed: %s", err)
 	}
 }
+
+func cacheOptions(cipher *pii.Cipher) []cache.Option {
+	var opts []cache.Option
+
+	encoding, err := cache.ParseEncoding(os.Getenv("SERVER_CACHE_ENCODING"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	backend, err := cache.NewBackend(os.Getenv("CACHE_BACKEND"),
+		net.JoinHostPort(os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")),
+		os.Getenv("CACHE_REDIS_PREFIX"),
+		encoding, os.Getenv("SERVER_CACHE_GZIP") == "true")
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts = append(opts, cache.WithBackend(backend))
+
+	if path := os.Getenv("SERVER_CACHE_SNAPSHOT"); path != "" {
+		interval, err := time.ParseDuration(os.Getenv("CACHE_SNAPSHOT_INTERVAL"))
+		if err != nil {
+			log.Println("invalid CACHE_SNAPSHOT_INTERVAL, periodic snapshot disabled:", err)
+		}
+		opts = append(opts, cache.WithSnapshot(path, interval))
+		// в снапшоте заказы целиком: с PII_KEY_FILE он шифруется
+		if cipher != nil {
+			opts = append(opts, cache.WithSnapshotCipher(cipher))
+		}
+	}
+	// изменения других сервисов кэш узнает из журнала order_changes
+	if s := os.Getenv("CACHE_SYNC_INTERVAL"); s != "" {
+		interval, err := time.ParseDuration(s)
+		if err != nil {
+			log.Fatalf("invalid CACHE_SYNC_INTERVAL %q: %s", s, err)
+		}
+		opts = append(opts, cache.WithSync(interval))
+	}
+	return opts
+}
+
+// storageDSN возвращает STORAGE_DSN, а если он не задан — строку
+// подключения к PostgreSQL из POSTGRES_* (с STORAGE_MODE=document —
+// в документном режиме).
+func storageDSN() string {
+	if dsn := os.Getenv("STORAGE_DSN"); dsn != "" {
+		return dsn
+	}
+	var prefix string
+	if os.Getenv("STORAGE_MODE") == "document" {
+		prefix = "document:"
+	}
+	return prefix + fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		os.Getenv("POSTGRES_HOST"),
+		os.Getenv("POSTGRES_PORT"),
+		os.Getenv("POSTGRES_USER"),
+		os.Getenv("POSTGRES_PASSWORD"),
+		os.Getenv("POSTGRES_DB"),
+	)
+}
+
+// storageOptions возвращает реплики PostgreSQL для чтения из POSTGRES_REPLICAS
+// (host:port через запятую, пользователь и база — из POSTGRES_*),
+// допустимое отставание REPLICA_MAX_LAG и шифрование персональных данных.
+func storageOptions(cipher *pii.Cipher) []storage.Option {
+	var opts []storage.Option
+	if cipher != nil {
+		opts = append(opts, storage.WithPII(cipher))
+	}
+	for _, addr := range strings.Split(os.Getenv("POSTGRES_REPLICAS"), ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			log.Fatalf("invalid POSTGRES_REPLICAS entry %q: %s", addr, err)
+		}
+		opts = append(opts, storage.WithReplicaDSNs(fmt.Sprintf(
+			"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+			host, port,
+			os.Getenv("POSTGRES_USER"),
+			os.Getenv("POSTGRES_PASSWORD"),
+			os.Getenv("POSTGRES_DB"),
+		)))
+	}
+	if s := os.Getenv("REPLICA_MAX_LAG"); s != "" {
+		lag, err := time.ParseDuration(s)
+		if err != nil {
+			log.Fatalf("invalid REPLICA_MAX_LAG %q: %s", s, err)
+		}
+		opts = append(opts, storage.WithMaxReplicaLag(lag))
+	}
+	return opts
+}
+
+// piiCipher возвращает шифр персональных данных доставки по файлу ключей
+// PII_KEY_FILE или nil, если файл не задан.
+func piiCipher() *pii.Cipher {
+	path := os.Getenv("PII_KEY_FILE")
+	if path == "" {
+		return nil
+	}
+	keys, indexKey, err := pii.LoadKeyFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return pii.New(keys, indexKey)
+}
+
+// itemStatuses возвращает справочник статусов товаров из ITEM_STATUS_FILE
+// или встроенный, если файл не задан.
+func itemStatuses() *model.ItemStatusCatalog {
+	path := os.Getenv("ITEM_STATUS_FILE")
+	if path == "" {
+		return model.DefaultItemStatuses()
+	}
+	catalog, err := model.LoadItemStatusFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return catalog
+}
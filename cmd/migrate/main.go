@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/dws33/WB_ZeroProj/internal/storage"
+	"github.com/dws33/WB_ZeroProj/internal/storage/migrations"
+)
+
+const usage = `usage: migrate [-shards <карта>] <command>
+
+commands:
+  up               применить все новые миграции
+  down [N]         откатить N последних миграций (по умолчанию 1)
+  status           показать список миграций
+  check            показать строки, которые не пройдут проверки новых миграций
+  sync-documents   скопировать в order_documents заказы, записанные
+                   в нормализованные таблицы после миграции 0004
+                   (недоступна с PII_KEY_FILE)
+  partitions       создать секции заказов вперед и применить retention
+                   (PARTITION_MONTHS_AHEAD, RETENTION_MONTHS, RETENTION_MODE)
+  rebalance        перенести заказы в шарды их диапазонов (только с -shards)
+
+С -shards команды выполняются на каждом шарде карты, иначе — на базе POSTGRES_*.
+`
+
+func main() {
+	shardMap := flag.String("shards", "", "карта шардов (JSON): выполнить команду на каждом шарде")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+
+	if *shardMap != "" {
+		m, err := storage.LoadShardMap(*shardMap)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sharded, err := storage.NewSharded(ctx, m)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer sharded.Close()
+
+		if flag.Arg(0) == "rebalance" {
+			moved, err := storage.Rebalance(ctx, sharded)
+			fmt.Printf("moved %d orders\n", moved)
+			if err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		ok := true
+		for _, shard := range sharded.Shards() {
+			cfg := shard.Pool().Config().ConnConfig
+			fmt.Printf("== shard %s:%d/%s\n", cfg.Host, cfg.Port, cfg.Database)
+			ok = run(ctx, shard.Pool()) && ok
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		os.Getenv("POSTGRES_HOST"),
+		os.Getenv("POSTGRES_PORT"),
+		os.Getenv("POSTGRES_USER"),
+		os.Getenv("POSTGRES_PASSWORD"),
+		os.Getenv("POSTGRES_DB"),
+	)
+
+	pgxPool, err := pgxpool.New(ctx, connStr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer pgxPool.Close()
+
+	if !run(ctx, pgxPool) {
+		os.Exit(1)
+	}
+}
+
+// run выполняет команду из аргументов на базе pgxPool. false — команда
+// завершилась ошибкой или check нашел нарушения.
+func run(ctx context.Context, pgxPool *pgxpool.Pool) bool {
+	var err error
+	switch flag.Arg(0) {
+	case "up":
+		err = migrations.Up(ctx, pgxPool)
+	case "down":
+		steps := 1
+		if flag.NArg() > 1 {
+			if steps, err = strconv.Atoi(flag.Arg(1)); err != nil || steps < 1 {
+				log.Fatalf("invalid number of steps %q", flag.Arg(1))
+			}
+		}
+		err = migrations.Down(ctx, pgxPool, steps)
+	case "status":
+		var statuses []migrations.Status
+		statuses, err = migrations.List(ctx, pgxPool)
+		for _, s := range statuses {
+			applied := "pending"
+			if !s.AppliedAt.IsZero() {
+				applied = s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d  %-40s %s\n", s.Version, s.Name, applied)
+		}
+	case "check":
+		var violations []migrations.Violation
+		violations, err = migrations.Check(ctx, pgxPool)
+		for _, v := range violations {
+			fmt.Printf("%04d_%s  %s: %d rows\n", v.Version, v.Name, v.Check, v.Count)
+			for _, key := range v.Sample {
+				fmt.Printf("    %s\n", key)
+			}
+		}
+		if err == nil && len(violations) > 0 {
+			return false
+		}
+	case "sync-documents":
+		// документный режим не шифрует персональные данные: с шифрованием
+		// в нормализованных таблицах документы стали бы их открытой копией
+		if os.Getenv("PII_KEY_FILE") != "" {
+			log.Fatal("sync-documents is disabled while PII_KEY_FILE is set: order_documents would keep PII outside the encrypted tables")
+		}
+		var copied int
+		copied, err = storage.SyncDocuments(ctx, pgxPool)
+		fmt.Printf("copied %d orders\n", copied)
+	case "partitions":
+		err = storage.MaintainPartitions(ctx, pgxPool, storage.PartitionPolicy{
+			Ahead:   envInt("PARTITION_MONTHS_AHEAD", 3),
+			Retain:  envInt("RETENTION_MONTHS", 0),
+			Archive: os.Getenv("RETENTION_MODE") != "drop",
+		})
+	case "rebalance":
+		log.Fatal("rebalance requires -shards")
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
+}
+
+func envInt(name string, def int) int {
+	s := os.Getenv(name)
+	if s == "" {
+		return def
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		log.Fatalf("invalid %s %q", name, s)
+	}
+	return n
+}
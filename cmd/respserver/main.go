@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/dws33/WB_ZeroProj/internal/storage/cache/respserver"
+)
+
+// Локальная замена Redis для общего кэша (CACHE_BACKEND=redis/tiered).
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := respserver.New()
+	addr, err := srv.Start(net.JoinHostPort(os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("RESP server started on", addr)
+
+	<-ctx.Done()
+	srv.Close()
+}
@@ -2,60 +2,118 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/dws33/WB_ZeroProj/internal/admin"
+	"github.com/dws33/WB_ZeroProj/internal/handler"
 	"github.com/dws33/WB_ZeroProj/internal/model"
+	"github.com/dws33/WB_ZeroProj/internal/pii"
 	"github.com/dws33/WB_ZeroProj/internal/storage"
 	"github.com/dws33/WB_ZeroProj/internal/storage/cache"
-	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/dws33/WB_ZeroProj/internal/storage/migrations"
 	"html/template"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		os.Getenv("POSTGRES_HOST"),
-		os.Getenv("POSTGRES_PORT"),
-		os.Getenv("POSTGRES_USER"),
-		os.Getenv("POSTGRES_PASSWORD"),
-		os.Getenv("POSTGRES_DB"),
-	)
-
-	ctx := context.TODO()
-
-	pgxPool, err := pgxpool.New(ctx, connStr)
+	cipher := piiCipher()
+	dbStore, closeStore, err := storage.Open(ctx, storageDSN(), storageOptions(cipher)...)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer pgxPool.Close()
+	defer closeStore()
 
-	dbStore, err := storage.New(ctx, pgxPool)
-	if err != nil {
-		log.Fatal(err)
+	if os.Getenv("MIGRATE_ON_START") == "true" {
+		for _, pool := range storage.Pools(dbStore) {
+			if err := migrations.Up(ctx, pool); err != nil {
+				log.Fatal(err)
+			}
+		}
 	}
-	cachedStore, err := cache.New(ctx, dbStore)
+
+	catalog := itemStatuses()
+
+	cachedStore, err := cache.New(ctx, dbStore, cacheOptions(cipher)...)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer func() {
+		if err := cachedStore.Close(); err != nil {
+			log.Println("fail to close cache:", err)
+		}
+	}()
 
 	http.HandleFunc("/site/order", func(w http.ResponseWriter, r *http.Request) {
 
 		data := struct {
-			Order *model.Order
-			Error string
-		}{}
-
-		orderUID := r.URL.Query().Get("order_uid")
-		if orderUID != "" {
-			order, err := cachedStore.GetOrder(ctx, orderUID)
-			if err != nil {
-				data.Error = fmt.Sprintf("Заказ с order_uid %q не найден", orderUID)
-			} else {
-				data.Order = order
+			Order  *model.Order
+			Meta   *storage.IngestMeta // когда и откуда получен Order, если известно
+			Orders []*model.Order      // несколько совпадений — список для выбора
+			Query  string
+			Field  storage.LookupField
+			Error  string
+			// Tab — вкладка заказа: "" (данные), "items" (статусы товаров)
+			// или "history" (исправления)
+			Tab      string
+			History  []*storage.OrderRevision
+			Status   *storage.StatusReport
+			Timeline []*storage.ItemTimeline
+			Refunds  *storage.RefundSummary
+			Catalog  *model.ItemStatusCatalog
+		}{Catalog: catalog}
+
+		// q — любой идентификатор (order_uid, трек-номер, транзакция, rid,
+		// chrt_id, nm_id, телефон, email); order_uid оставлен для старых ссылок
+		q := strings.TrimSpace(r.URL.Query().Get("q"))
+		if q == "" {
+			q = strings.TrimSpace(r.URL.Query().Get("order_uid"))
+		}
+		data.Query = q
+		switch tab := r.URL.Query().Get("tab"); tab {
+		case "history", "items":
+			data.Tab = tab
+		}
+		if q != "" {
+			orders, field, err := searchOrders(r.Context(), cachedStore, q)
+			if err == nil && cipher != nil {
+				orders, err = openOrders(r.Context(), cipher, orders)
+			}
+			switch {
+			case err == nil && len(orders) == 1:
+				data.Order, data.Field = orders[0], field
+				data.Meta = ingestMeta(r.Context(), cachedStore, data.Order.OrderUID)
+				data.Status = orderStatus(r.Context(), cachedStore, data.Order.OrderUID)
+				data.Refunds = orderRefunds(r.Context(), cachedStore, data.Order.OrderUID)
+				switch data.Tab {
+				case "history":
+					data.History = orderHistory(r.Context(), cachedStore, data.Order.OrderUID)
+				case "items":
+					data.Timeline = itemTimeline(r.Context(), cachedStore, catalog, data.Order)
+				}
+			case err == nil && len(orders) > 1:
+				data.Orders, data.Field = orders, field
+			case err == nil:
+				w.WriteHeader(http.StatusNotFound)
+				data.Error = fmt.Sprintf("Заказ по запросу %q не найден", q)
+			case errors.Is(err, storage.ErrUnavailable):
+				log.Println("storage unavailable:", err)
+				w.WriteHeader(http.StatusServiceUnavailable)
+				data.Error = "Сервис временно недоступен, попробуйте позже"
+			default:
+				log.Println("storage error:", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				data.Error = "Внутренняя ошибка сервера"
 			}
 		}
 
@@ -69,30 +127,213 @@ func main() {
 		os.Getenv("WSSERVER_HOST"),
 		os.Getenv("WSSERVER_PORT"))
 
+	if port := os.Getenv("WSSERVER_ADMIN_PORT"); port != "" {
+		adminAddr := net.JoinHostPort(os.Getenv("WSSERVER_HOST"), port)
+		admin.ListenAndServe(ctx, adminAddr, os.Getenv("ADMIN_TOKEN"), cachedStore)
+	}
+
+	// чтения учитывают позицию WAL последней записи клиента (cookie httpserver)
+	srv := &http.Server{Addr: addr, Handler: handler.ReadYourWrites(http.DefaultServeMux)}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
 	log.Println("HTTP server started on", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil && errors.Is(err, http.ErrServerClosed) {
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalf("server failed: %s", err)
 	}
 }
 
-var tmpl = template.Must(template.New("page").Parse(tpl))
+// searchOrders определяет тип идентификатора и ищет заказы по наиболее
+// вероятным полям, возвращая первое непустое совпадение.
+func searchOrders(ctx context.Context, store *cache.CachedStorage, q string) ([]*model.Order, storage.LookupField, error) {
+	for _, field := range storage.DetectLookupFields(q) {
+		orders, err := store.FindOrders(ctx, field, q)
+		if errors.Is(err, storage.ErrInvalidArgument) {
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if len(orders) > 0 {
+			return orders, field, nil
+		}
+	}
+	return nil, "", nil
+}
+
+// openOrders расшифровывает персональные данные доставки найденных заказов.
+func openOrders(ctx context.Context, cipher *pii.Cipher, orders []*model.Order) ([]*model.Order, error) {
+	opened := make([]*model.Order, len(orders))
+	for i, order := range orders {
+		var err error
+		if opened[i], err = cipher.OpenOrder(ctx, order); err != nil {
+			return nil, err
+		}
+	}
+	return opened, nil
+}
+
+// ingestMeta возвращает метаданные получения заказа; их отсутствие
+// или ошибка чтения не мешают показать сам заказ.
+func ingestMeta(ctx context.Context, store *cache.CachedStorage, uid string) *storage.IngestMeta {
+	meta, err := store.GetIngestMeta(ctx, uid)
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotFound) && !errors.Is(err, errors.ErrUnsupported) {
+			log.Println("fail to get ingest metadata:", err)
+		}
+		return nil
+	}
+	return meta
+}
+
+// orderHistory возвращает исправления заказа; ошибка чтения не мешает
+// показать сам заказ.
+func orderHistory(ctx context.Context, store *cache.CachedStorage, uid string) []*storage.OrderRevision {
+	revisions, err := store.OrderHistory(ctx, uid)
+	if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		log.Println("fail to get order history:", err)
+	}
+	return revisions
+}
+
+// orderStatus возвращает статус заказа или nil, если он недоступен.
+func orderStatus(ctx context.Context, store *cache.CachedStorage, uid string) *storage.StatusReport {
+	report, err := store.OrderStatus(ctx, uid)
+	if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		log.Println("fail to get order status:", err)
+	}
+	return report
+}
+
+// orderRefunds возвращает возвраты заказа или nil, если они недоступны.
+func orderRefunds(ctx context.Context, store *cache.CachedStorage, uid string) *storage.RefundSummary {
+	summary, err := store.Refunds(ctx, uid)
+	if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		log.Println("fail to get refunds:", err)
+	}
+	return summary
+}
+
+// itemTimeline возвращает ленты статусов товаров с подписями на русском
+// или nil, если история статусов недоступна.
+func itemTimeline(ctx context.Context, store *cache.CachedStorage, catalog *model.ItemStatusCatalog, order *model.Order) []*storage.ItemTimeline {
+	changes, err := store.ItemStatusHistory(ctx, order.OrderUID)
+	if err != nil {
+		if !errors.Is(err, errors.ErrUnsupported) {
+			log.Println("fail to get item status history:", err)
+		}
+		return nil
+	}
+	timelines := storage.ItemTimelines(order, changes)
+	for _, t := range timelines {
+		for i := range t.Points {
+			info := catalog.Describe(t.Points[i].Status, "ru")
+			t.Points[i].StatusInfo = &info
+		}
+	}
+	return timelines
+}
+
+func cacheOptions(cipher *pii.Cipher) []cache.Option {
+	backend, err := cache.NewBackend(os.Getenv("CACHE_BACKEND"),
+		net.JoinHostPort(os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")),
+		os.Getenv("CACHE_REDIS_PREFIX"),
+		cache.EncodeNone, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := []cache.Option{cache.WithBackend(backend)}
+
+	if path := os.Getenv("WSSERVER_CACHE_SNAPSHOT"); path != "" {
+		interval, err := time.ParseDuration(os.Getenv("CACHE_SNAPSHOT_INTERVAL"))
+		if err != nil {
+			log.Println("invalid CACHE_SNAPSHOT_INTERVAL, periodic snapshot disabled:", err)
+		}
+		opts = append(opts, cache.WithSnapshot(path, interval))
+		// в снапшоте заказы целиком: с PII_KEY_FILE он шифруется
+		if cipher != nil {
+			opts = append(opts, cache.WithSnapshotCipher(cipher))
+		}
+	}
+	// изменения других сервисов кэш узнает из журнала order_changes
+	if s := os.Getenv("CACHE_SYNC_INTERVAL"); s != "" {
+		interval, err := time.ParseDuration(s)
+		if err != nil {
+			log.Fatalf("invalid CACHE_SYNC_INTERVAL %q: %s", s, err)
+		}
+		opts = append(opts, cache.WithSync(interval))
+	}
+	return opts
+}
+
+var tmpl = template.Must(template.New("page").Funcs(template.FuncMap{
+	// value показывает значение из model.Change так же, как в JSON API
+	"value": func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(b)
+	},
+}).Parse(tpl))
 
 var tpl = `
 <!DOCTYPE html>
 <html lang="ru">
 <head>
     <meta charset="UTF-8">
-    <title>Поиск заказа по order_uid</title>
+    <title>Поиск заказа</title>
 </head>
 <body>
-    <h1>Введите order_uid заказа</h1>
+    <h1>Поиск заказа</h1>
     <form method="GET" action="/site/order">
-        <input type="text" name="order_uid" placeholder="order_uid" required>
+        <input type="text" name="q" value="{{.Query}}" placeholder="order_uid, трек-номер, транзакция, rid, chrt_id или nm_id" size="60" required>
         <input type="submit" value="Найти заказ">
     </form>
 
-    {{if .Order}}
-        <h2>Данные заказа:</h2>
+    {{if .Orders}}
+        <h2>Найдено заказов по {{.Field}}: {{len .Orders}}</h2>
+        <ul>
+        {{range .Orders}}
+            <li><a href="/site/order?q={{.OrderUID}}">{{.OrderUID}}</a> — {{.TrackNumber}}, {{.DateCreated.Format "2006-01-02 15:04"}}</li>
+        {{end}}
+        </ul>
+    {{else if .Order}}
+        <h2>Данные заказа{{if ne .Field "order_uid"}} (найден по {{.Field}}){{end}}:</h2>
+        <p>{{if eq .Tab ""}}<b>Заказ</b>{{else}}<a href="/site/order?q={{.Order.OrderUID}}">Заказ</a>{{end}}
+            | {{if eq .Tab "items"}}<b>Статусы товаров</b>{{else}}<a href="/site/order?q={{.Order.OrderUID}}&tab=items">Статусы товаров</a>{{end}}
+            | {{if eq .Tab "history"}}<b>История</b>{{else}}<a href="/site/order?q={{.Order.OrderUID}}&tab=history">История</a>{{end}}</p>
+        {{with .Status}}<p><b>Статус:</b> {{.Status}}{{if and .Derived (ne .Derived .Status)}} (по товарам: {{.Derived}}){{end}}</p>{{end}}
+        {{if eq .Tab "history"}}
+        {{with .Status}}{{if .History}}
+        <h3>Статусы</h3>
+        <ul>
+        {{range .History}}<li>{{.At.Format "2006-01-02 15:04:05 MST"}}: {{.From}} → {{.To}}, {{.Actor}}: {{.Reason}}</li>{{end}}
+        </ul>
+        {{end}}{{end}}
+        {{range .History}}
+        <h3>Версия {{.Version}}</h3>
+        <p>{{.At.Format "2006-01-02 15:04:05 MST"}}, {{.Actor}}: {{.Reason}}</p>
+        <ul>
+        {{range .Changes}}<li>{{.Path}}: {{value .Old}} → {{value .New}}</li>{{end}}
+        </ul>
+        {{else}}
+        <p>Заказ не исправлялся.</p>
+        {{end}}
+        {{else if eq .Tab "items"}}
+        {{range .Timeline}}
+        <h3>{{with .Name}}{{.}}{{else}}rid {{.RID}}{{end}}{{if .Removed}} (удален из заказа){{end}}</h3>
+        <ol>
+        {{range .Points}}<li>{{.At.Format "2006-01-02 15:04:05 MST"}}: {{with .StatusInfo}}<span title="{{.Description}}">{{.Label}}</span> ({{.Code}}){{else}}{{.Status}}{{end}}{{with .Actor}}, {{.}}{{end}}{{with .Reason}}: {{.}}{{end}}</li>{{end}}
+        </ol>
+        {{else}}
+        <p>История статусов товаров недоступна.</p>
+        {{end}}
+        {{else}}
         <p><b>Order UID:</b> {{.Order.OrderUID}}</p>
         <p><b>Track Number:</b> {{.Order.TrackNumber}}</p>
         <p><b>Entry:</b> {{.Order.Entry}}</p>
@@ -106,15 +347,118 @@ var tpl = `
         <p>Транзакция: {{.Order.Payment.Transaction}}</p>
         <p>Сумма: {{.Order.Payment.Amount}}</p>
         <p>Валюта: {{.Order.Payment.Currency}}</p>
+        {{with .Refunds}}{{if .Refunds}}
+        <p>Возвращено: {{.Refunded}}, остаток: {{.Net}}</p>
+        <ul>
+        {{range .Refunds}}<li>{{.CreatedAt.Format "2006-01-02 15:04:05 MST"}}: {{.Amount}} ({{.Kind}}{{range .Items}}, {{.RID}}: {{.Amount}}{{end}}), {{.Actor}}: {{.Reason}}</li>{{end}}
+        </ul>
+        {{end}}{{end}}
         <h3>Товары</h3>
         <ul>
         {{range .Order.Items}}
-            <li>{{.Name}} (Цена: {{.Price}}, Кол-во: 1, Общая цена: {{.TotalPrice}})</li>
+            <li>{{.Name}} (Цена: {{.Price}}, Кол-во: 1, Общая цена: {{.TotalPrice}}){{with $.Catalog.Describe .Status "ru"}}, статус: <span title="{{.Description}}">{{.Label}}</span> ({{.Code}}){{end}}</li>
         {{end}}
         </ul>
+        {{with .Meta}}
+        <h3>Получение</h3>
+        <p>Получен: {{.IngestedAt.Format "2006-01-02 15:04:05 MST"}}</p>
+        {{with .Kafka}}<p>Источник: Kafka, топик {{.Topic}}, партиция {{.Partition}}, смещение {{.Offset}}</p>{{end}}
+        {{with .HTTPClient}}<p>Источник: HTTP, клиент {{.}}</p>{{end}}
+        <p>Обработчик: {{.Instance}}, версия схемы {{.SchemaVersion}}</p>
+        {{if .Warnings}}
+        <p>Предупреждения:</p>
+        <ul>
+        {{range .Warnings}}<li>{{.}}</li>{{end}}
+        </ul>
+        {{end}}
+        {{end}}
+        {{end}}
     {{else if .Error}}
         <p style="color:red;">{{.Error}}</p>
     {{end}}
 </body>
 </html>
 `
+
+// storageDSN возвращает STORAGE_DSN, а если он не задан — строку
+// подключения к PostgreSQL из POSTGRES_* (с STORAGE_MODE=document —
+// в документном режиме).
+func storageDSN() string {
+	if dsn := os.Getenv("STORAGE_DSN"); dsn != "" {
+		return dsn
+	}
+	var prefix string
+	if os.Getenv("STORAGE_MODE") == "document" {
+		prefix = "document:"
+	}
+	return prefix + fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		os.Getenv("POSTGRES_HOST"),
+		os.Getenv("POSTGRES_PORT"),
+		os.Getenv("POSTGRES_USER"),
+		os.Getenv("POSTGRES_PASSWORD"),
+		os.Getenv("POSTGRES_DB"),
+	)
+}
+
+// storageOptions возвращает реплики PostgreSQL для чтения из POSTGRES_REPLICAS
+// (host:port через запятую, пользователь и база — из POSTGRES_*),
+// допустимое отставание REPLICA_MAX_LAG и шифрование персональных данных.
+func storageOptions(cipher *pii.Cipher) []storage.Option {
+	var opts []storage.Option
+	if cipher != nil {
+		opts = append(opts, storage.WithPII(cipher))
+	}
+	for _, addr := range strings.Split(os.Getenv("POSTGRES_REPLICAS"), ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			log.Fatalf("invalid POSTGRES_REPLICAS entry %q: %s", addr, err)
+		}
+		opts = append(opts, storage.WithReplicaDSNs(fmt.Sprintf(
+			"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+			host, port,
+			os.Getenv("POSTGRES_USER"),
+			os.Getenv("POSTGRES_PASSWORD"),
+			os.Getenv("POSTGRES_DB"),
+		)))
+	}
+	if s := os.Getenv("REPLICA_MAX_LAG"); s != "" {
+		lag, err := time.ParseDuration(s)
+		if err != nil {
+			log.Fatalf("invalid REPLICA_MAX_LAG %q: %s", s, err)
+		}
+		opts = append(opts, storage.WithMaxReplicaLag(lag))
+	}
+	return opts
+}
+
+// piiCipher возвращает шифр персональных данных доставки по файлу ключей
+// PII_KEY_FILE или nil, если файл не задан.
+func piiCipher() *pii.Cipher {
+	path := os.Getenv("PII_KEY_FILE")
+	if path == "" {
+		return nil
+	}
+	keys, indexKey, err := pii.LoadKeyFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return pii.New(keys, indexKey)
+}
+
+// itemStatuses возвращает справочник статусов товаров из ITEM_STATUS_FILE
+// или встроенный, если файл не задан.
+func itemStatuses() *model.ItemStatusCatalog {
+	path := os.Getenv("ITEM_STATUS_FILE")
+	if path == "" {
+		return model.DefaultItemStatuses()
+	}
+	catalog, err := model.LoadItemStatusFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return catalog
+}
@@ -0,0 +1,143 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/dws33/WB_ZeroProj/internal/storage/cache"
+)
+
+type cacheAdmin interface {
+	Stats(ctx context.Context) (cache.Stats, error)
+	Evict(ctx context.Context, uid string) (bool, error)
+	Flush(ctx context.Context) (int, error)
+	Reload(ctx context.Context) error
+}
+
+// Handler — административные эндпоинты кэша:
+//
+//	GET    /admin/cache/stats
+//	DELETE /admin/cache/orders/{order_uid} — вытеснить один заказ
+//	DELETE /admin/cache/orders             — очистить кэш
+//	POST   /admin/cache/reload             — перечитать кэш из БД
+//
+// Все запросы требуют заголовок "Authorization: Bearer <token>".
+type Handler struct {
+	cache cacheAdmin
+	token string
+	mux   *http.ServeMux
+}
+
+// New создает Handler. Пустой token запрещает любой доступ.
+func New(cache cacheAdmin, token string) *Handler {
+	h := &Handler{cache: cache, token: token, mux: http.NewServeMux()}
+	h.mux.HandleFunc("GET /admin/cache/stats", h.stats)
+	h.mux.HandleFunc("DELETE /admin/cache/orders/{order_uid}", h.evict)
+	h.mux.HandleFunc("DELETE /admin/cache/orders", h.flush)
+	h.mux.HandleFunc("POST /admin/cache/reload", h.reload)
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	RequireToken(h.token, h.mux).ServeHTTP(w, r)
+}
+
+// RequireToken пропускает к next только запросы с заголовком
+// "Authorization: Bearer <token>". Пустой token запрещает любой доступ.
+func RequireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func authorized(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+func (h *Handler) stats(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.cache.Stats(r.Context())
+	if err != nil {
+		log.Println("admin: cache stats failed:", err)
+		http.Error(w, "cache unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, stats)
+}
+
+func (h *Handler) evict(w http.ResponseWriter, r *http.Request) {
+	uid := r.PathValue("order_uid")
+	ok, err := h.cache.Evict(r.Context(), uid)
+	if err != nil {
+		log.Println("admin: cache evict failed:", err)
+		http.Error(w, "cache unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if !ok {
+		http.Error(w, "order not in cache", http.StatusNotFound)
+		return
+	}
+	log.Printf("admin: evicted order %q from cache", uid)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) flush(w http.ResponseWriter, r *http.Request) {
+	n, err := h.cache.Flush(r.Context())
+	if err != nil {
+		log.Println("admin: cache flush failed:", err)
+		http.Error(w, "cache unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	log.Printf("admin: flushed cache, %d entries evicted", n)
+	writeJSON(w, map[string]int{"evicted": n})
+}
+
+func (h *Handler) reload(w http.ResponseWriter, r *http.Request) {
+	if err := h.cache.Reload(r.Context()); err != nil {
+		log.Println("admin: cache reload failed:", err)
+		http.Error(w, "reload failed", http.StatusInternalServerError)
+		return
+	}
+	log.Println("admin: cache reloaded from db")
+	h.stats(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("failed to encode response:", err)
+	}
+}
+
+// ListenAndServe запускает админский listener на addr в фоне до отмены ctx.
+// Без token listener не запускается.
+func ListenAndServe(ctx context.Context, addr, token string, cache cacheAdmin) {
+	if token == "" {
+		log.Println("admin listener disabled: ADMIN_TOKEN not set")
+		return
+	}
+	srv := &http.Server{Addr: addr, Handler: New(cache, token)}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		log.Println("admin server started on", addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Println("admin server failed:", err)
+		}
+	}()
+}
@@ -3,48 +3,859 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/dws33/WB_ZeroProj/internal/model"
+	"github.com/dws33/WB_ZeroProj/internal/pii"
+	"github.com/dws33/WB_ZeroProj/internal/storage"
+	"github.com/dws33/WB_ZeroProj/internal/storage/cache"
 	"log"
 	"net/http"
-	//"order-service/internal/storage"
+	"strconv"
+	"strings"
+	"time"
 )
 
-type storage interface {
+type orderStorage interface {
 	CreateOrder(ctx context.Context, order *model.Order) error
 	GetOrder(ctx context.Context, uid string) (*model.Order, error)
+	ListOrders(ctx context.Context, f storage.OrderFilter) (*storage.OrderPage, error)
+	FindOrders(ctx context.Context, field storage.LookupField, value string) ([]*model.Order, error)
+}
+
+// encodedStorage — хранилище, умеющее отдавать готовый JSON заказа
+// (например, cache.CachedStorage с WithEncodedJSON).
+type encodedStorage interface {
+	GetOrderJSON(ctx context.Context, uid string) (body []byte, gzipped bool, err error)
+}
+
+// rawStorage — хранилище с архивом исходных сообщений (storage.RawStore).
+type rawStorage interface {
+	GetRawMessages(ctx context.Context, uid string) ([]*storage.RawMessage, error)
+}
+
+// metaStorage — хранилище с метаданными получения заказов (storage.MetaStore).
+type metaStorage interface {
+	GetIngestMeta(ctx context.Context, uid string) (*storage.IngestMeta, error)
+}
+
+// deleteStorage — хранилище с удалением заказов (storage.DeleteStore).
+type deleteStorage interface {
+	DeleteOrder(ctx context.Context, uid, actor string) error
+	EraseOrderPII(ctx context.Context, uid, actor string) error
+	AuditLog(ctx context.Context, uid string) ([]*storage.AuditRecord, error)
+}
+
+// historyStorage — хранилище с историей исправлений (storage.HistoryStore).
+type historyStorage interface {
+	UpdateOrder(ctx context.Context, order *model.Order, actor, reason string) (*storage.OrderRevision, error)
+	OrderHistory(ctx context.Context, uid string) ([]*storage.OrderRevision, error)
+}
+
+// statusStorage — хранилище с жизненным циклом заказов (storage.StatusStore).
+type statusStorage interface {
+	OrderStatus(ctx context.Context, uid string) (*storage.StatusReport, error)
+	TransitionOrder(ctx context.Context, uid string, to model.OrderStatus, actor, reason string) (*storage.StatusChange, error)
+}
+
+// transitionRequest — тело TransitionOrder.
+type transitionRequest struct {
+	Status model.OrderStatus `json:"status"`
+	Reason string            `json:"reason"`
+}
+
+// maxOrderBody — предельный размер тела UpdateOrder, как у сообщения Kafka.
+const maxOrderBody = 10 << 20
+
+// itemStatusStorage — хранилище с историей статусов товаров (storage.ItemStatusStore).
+type itemStatusStorage interface {
+	ItemStatusHistory(ctx context.Context, uid string) ([]*storage.ItemStatusChange, error)
+}
+
+// refundStorage — хранилище с возвратами (storage.RefundStore).
+type refundStorage interface {
+	CreateRefund(ctx context.Context, refund *model.Refund) (*model.Refund, error)
+	Refunds(ctx context.Context, uid string) (*storage.RefundSummary, error)
+}
+
+// orderView — заказ в ответе; с ?include=item_status у товаров есть поле
+// "status_info" — расшифровка Item.Status по справочнику, с
+// ?include=refunds у заказа есть поле "refunds" — возвраты и остаток оплаты.
+type orderView struct {
+	*model.Order
+	Items   []itemView             `json:"items"`
+	Refunds *storage.RefundSummary `json:"refunds,omitempty"`
+}
+
+type itemView struct {
+	*model.Item
+	StatusInfo *model.ItemStatusInfo `json:"status_info,omitempty"`
+}
+
+// orderWithMeta — ответ GetOrder с ?include=meta: поля заказа и "meta"
+// (null, если метаданных нет).
+type orderWithMeta struct {
+	orderView
+	Meta *storage.IngestMeta `json:"meta"`
 }
 
 // Handler хранит зависимости: БД и кэш.
 type Handler struct {
-	storage storage
+	storage      orderStorage
+	pii          *pii.Cipher
+	itemStatuses *model.ItemStatusCatalog
+}
+
+// Option настраивает Handler.
+type Option func(*Handler)
+
+// WithPII расшифровывает персональные данные доставки перед ответом
+// (хранилище открыто с storage.WithPII). Готовый JSON из кэша при этом
+// не используется: в нем данные зашифрованы.
+func WithPII(c *pii.Cipher) Option {
+	return func(h *Handler) { h.pii = c }
+}
+
+// WithItemStatuses задает справочник статусов товаров вместо встроенного
+// (model.DefaultItemStatuses).
+func WithItemStatuses(c *model.ItemStatusCatalog) Option {
+	return func(h *Handler) { h.itemStatuses = c }
 }
 
 // New создает новый Handler.
-func New(storage storage) *Handler {
-	return &Handler{
+func New(storage orderStorage, opts ...Option) *Handler {
+	h := &Handler{
 		storage: storage,
 	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	if h.itemStatuses == nil {
+		h.itemStatuses = model.DefaultItemStatuses()
+	}
+	return h
+}
+
+// view возвращает заказ для ответа; с withStatus товары дополняются
+// расшифровкой статуса на языке ?lang= (по умолчанию — локали заказа).
+func (h *Handler) view(r *http.Request, order *model.Order, withStatus bool) orderView {
+	v := orderView{Order: order}
+	if order.Items != nil {
+		v.Items = make([]itemView, len(order.Items))
+	}
+	lang := r.URL.Query().Get("lang")
+	if lang == "" {
+		lang = order.Locale
+	}
+	for i, item := range order.Items {
+		v.Items[i].Item = item
+		if withStatus {
+			info := h.itemStatuses.Describe(item.Status, lang)
+			v.Items[i].StatusInfo = &info
+		}
+	}
+	return v
+}
+
+// views — заказы для ответа: сами заказы или, с ?include=item_status,
+// orderView с расшифровкой статусов товаров.
+func (h *Handler) views(r *http.Request, orders []*model.Order) any {
+	if !includes(r, "item_status") {
+		return orders
+	}
+	views := make([]orderView, len(orders))
+	for i, order := range orders {
+		views[i] = h.view(r, order, true)
+	}
+	return views
+}
+
+// open возвращает заказы с расшифрованными персональными данными
+// (копии, если задан WithPII).
+func (h *Handler) open(ctx context.Context, orders []*model.Order) ([]*model.Order, error) {
+	if h.pii == nil {
+		return orders, nil
+	}
+	opened := make([]*model.Order, len(orders))
+	for i, order := range orders {
+		var err error
+		if opened[i], err = h.pii.OpenOrder(ctx, order); err != nil {
+			return nil, err
+		}
+	}
+	return opened, nil
 }
 
 // GetOrder — HTTP-обработчик GET /order/{order_uid}
+//
+// ?include=meta добавляет в ответ поле "meta" — когда и откуда получен заказ,
+// ?include=item_status — поле "status_info" товаров (язык подписи — ?lang=),
+// ?include=refunds — поле "refunds" с возвратами и остатком оплаты (net).
 func (h *Handler) GetOrder(w http.ResponseWriter, r *http.Request) {
 	orderUID := r.PathValue("order_uid")
 	if orderUID == "" {
 		http.Error(w, "order_uid is required", http.StatusBadRequest)
 		return
 	}
+	withMeta := includes(r, "meta")
+	withStatus := includes(r, "item_status")
+	withRefunds := includes(r, "refunds")
+
+	if es, ok := h.storage.(encodedStorage); ok && !withMeta && !withStatus && !withRefunds && h.pii == nil {
+		h.writeEncoded(w, r, es, orderUID)
+		return
+	}
 
 	order, err := h.storage.GetOrder(r.Context(), orderUID)
 	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	if h.pii != nil {
+		if order, err = h.pii.OpenOrder(r.Context(), order); err != nil {
+			writeStorageError(w, err)
+			return
+		}
+	}
+	var resp any = order
+	view := h.view(r, order, withStatus)
+	if withRefunds {
+		if view.Refunds, err = h.refunds(r.Context(), orderUID); err != nil {
+			writeStorageError(w, err)
+			return
+		}
+	}
+	if withStatus || withRefunds {
+		resp = view
+	}
+	if withMeta {
+		meta, err := h.ingestMeta(r.Context(), orderUID)
+		if err != nil {
+			writeStorageError(w, err)
+			return
+		}
+		resp = orderWithMeta{orderView: view, Meta: meta}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println("failed to encode response:", err)
+		return
+	}
+}
+
+// ListOrders — HTTP-обработчик GET /orders
+//
+// Фильтры (query): customer_id, delivery_service, entry, locale,
+// created_from, created_to (RFC 3339), provider, bank, currency, brand.
+// Пагинация: limit и cursor (next_cursor из предыдущего ответа).
+// ?include=item_status — как у GetOrder.
+func (h *Handler) ListOrders(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := storage.OrderFilter{
+		CustomerID:      q.Get("customer_id"),
+		DeliveryService: q.Get("delivery_service"),
+		Entry:           q.Get("entry"),
+		Locale:          q.Get("locale"),
+		PaymentProvider: q.Get("provider"),
+		PaymentBank:     q.Get("bank"),
+		PaymentCurrency: q.Get("currency"),
+		ItemBrand:       q.Get("brand"),
+		Cursor:          q.Get("cursor"),
+	}
+
+	var err error
+	if v := q.Get("created_from"); v != "" {
+		if f.CreatedFrom, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "created_from must be RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("created_to"); v != "" {
+		if f.CreatedTo, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "created_to must be RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit < 1 || f.Limit > storage.MaxListLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", storage.MaxListLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	page, err := h.storage.ListOrders(r.Context(), f)
+	if err == nil {
+		var orders []*model.Order
+		orders, err = h.open(r.Context(), page.Orders)
+		page = &storage.OrderPage{Orders: orders, NextCursor: page.NextCursor}
+	}
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	var resp any = page
+	if includes(r, "item_status") {
+		resp = struct {
+			Orders     any    `json:"orders"`
+			NextCursor string `json:"next_cursor,omitempty"`
+		}{h.views(r, page.Orders), page.NextCursor}
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println("failed to encode response:", err)
+	}
+}
+
+// FindOrders — HTTP-обработчик GET /orders/lookup/{field}/{value}
+//
+// field: order_uid, track_number, transaction, rid, chrt_id, nm_id, phone, email.
+// ?include=item_status — как у GetOrder.
+func (h *Handler) FindOrders(w http.ResponseWriter, r *http.Request) {
+	field := storage.LookupField(r.PathValue("field"))
+	value := r.PathValue("value")
+	if value == "" {
+		http.Error(w, "value is required", http.StatusBadRequest)
+		return
+	}
+
+	orders, err := h.storage.FindOrders(r.Context(), field, value)
+	if err == nil {
+		orders, err = h.open(r.Context(), orders)
+	}
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	if len(orders) == 0 {
 		http.Error(w, "order not found", http.StatusNotFound)
 		return
 	}
 
-	if err := json.NewEncoder(w).Encode(order); err != nil {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{"orders": h.views(r, orders)}); err != nil {
 		log.Println("failed to encode response:", err)
-		http.Error(w, "internal error", http.StatusInternalServerError)
+	}
+}
+
+// ingestMeta возвращает метаданные получения заказа или nil, если их нет
+// либо хранилище их не поддерживает.
+func (h *Handler) ingestMeta(ctx context.Context, uid string) (*storage.IngestMeta, error) {
+	ms, ok := h.storage.(metaStorage)
+	if !ok {
+		return nil, nil
+	}
+	meta, err := ms.GetIngestMeta(ctx, uid)
+	if errors.Is(err, storage.ErrNotFound) || errors.Is(err, errors.ErrUnsupported) {
+		return nil, nil
+	}
+	return meta, err
+}
+
+// includes сообщает, запрошено ли дополнение name в ?include=a,b.
+func includes(r *http.Request, name string) bool {
+	for _, v := range r.URL.Query()["include"] {
+		for _, part := range strings.Split(v, ",") {
+			if strings.TrimSpace(part) == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rawMessageView — сообщение в ответе GetRawOrder. Payload-JSON отдается
+// как есть, иначе (продюсер прислал не JSON) — в payload_base64.
+type rawMessageView struct {
+	*storage.RawMessage
+	EventType     string          `json:"event_type"`
+	Payload       json.RawMessage `json:"payload,omitempty"`
+	PayloadBase64 []byte          `json:"payload_base64,omitempty"`
+}
+
+// GetRawOrder — HTTP-обработчик GET /order/{order_uid}/raw
+//
+// Возвращает все полученные из Kafka сообщения заказа (от старых к новым)
+// с типом события, заголовками, партицией, смещением и временем получения;
+// ?event_type= оставляет сообщения одного типа. Сообщения содержат
+// персональные данные, поэтому маршрут доступен только администратору.
+func (h *Handler) GetRawOrder(w http.ResponseWriter, r *http.Request) {
+	orderUID := r.PathValue("order_uid")
+	if orderUID == "" {
+		http.Error(w, "order_uid is required", http.StatusBadRequest)
+		return
+	}
+	rs, ok := h.storage.(rawStorage)
+	if !ok {
+		http.Error(w, "raw message archive is not supported", http.StatusNotImplemented)
+		return
+	}
+
+	messages, err := rs.GetRawMessages(r.Context(), orderUID)
+	if errors.Is(err, errors.ErrUnsupported) {
+		http.Error(w, "raw message archive is not supported", http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	eventType := r.URL.Query().Get("event_type")
+	views := make([]rawMessageView, 0, len(messages))
+	for _, m := range messages {
+		v := rawMessageView{RawMessage: m, EventType: m.EventType()}
+		if eventType != "" && v.EventType != eventType {
+			continue
+		}
+		if json.Valid(m.Payload) {
+			v.Payload = m.Payload
+		} else {
+			v.PayloadBase64 = m.Payload
+		}
+		views = append(views, v)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{"messages": views}); err != nil {
+		log.Println("failed to encode response:", err)
+	}
+}
+
+// DeleteOrder — HTTP-обработчик DELETE /order/{order_uid}
+//
+// Помечает заказ удаленным; окончательно он удаляется после срока хранения.
+// Заголовок X-Actor (кто удаляет) обязателен и попадает в журнал.
+func (h *Handler) DeleteOrder(w http.ResponseWriter, r *http.Request) {
+	h.changeOrder(w, r, deleteStorage.DeleteOrder)
+}
+
+// EraseOrder — HTTP-обработчик POST /order/{order_uid}/erase
+//
+// Стирает персональные данные заказа (имя, телефон, адрес, email, customer_id),
+// оставляя оплату. Заголовок X-Actor обязателен.
+func (h *Handler) EraseOrder(w http.ResponseWriter, r *http.Request) {
+	h.changeOrder(w, r, deleteStorage.EraseOrderPII)
+}
+
+// GetOrderAudit — HTTP-обработчик GET /order/{order_uid}/audit
+//
+// Журнал удалений и стираний заказа: кто и когда.
+func (h *Handler) GetOrderAudit(w http.ResponseWriter, r *http.Request) {
+	ds, ok := h.storage.(deleteStorage)
+	if !ok {
+		http.Error(w, "order deletion is not supported", http.StatusNotImplemented)
+		return
+	}
+	records, err := ds.AuditLog(r.Context(), r.PathValue("order_uid"))
+	if errors.Is(err, errors.ErrUnsupported) {
+		http.Error(w, "order deletion is not supported", http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	if records == nil {
+		records = []*storage.AuditRecord{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{"records": records}); err != nil {
+		log.Println("failed to encode response:", err)
+	}
+}
+
+// UpdateOrder — HTTP-обработчик PUT /order/{order_uid}
+//
+// Исправляет заказ: тело — заказ целиком в том же формате, что в Kafka.
+// Заголовки X-Actor (кто исправляет) и X-Reason (почему) обязательны и
+// попадают в историю. Ответ — запись истории с изменениями полей или
+// 204, если заказ не изменился.
+func (h *Handler) UpdateOrder(w http.ResponseWriter, r *http.Request) {
+	orderUID := r.PathValue("order_uid")
+	actor := strings.TrimSpace(r.Header.Get("X-Actor"))
+	reason := strings.TrimSpace(r.Header.Get("X-Reason"))
+	switch {
+	case orderUID == "":
+		http.Error(w, "order_uid is required", http.StatusBadRequest)
+		return
+	case actor == "":
+		http.Error(w, "X-Actor header is required", http.StatusBadRequest)
+		return
+	case reason == "":
+		http.Error(w, "X-Reason header is required", http.StatusBadRequest)
+		return
+	}
+	hs, ok := h.storage.(historyStorage)
+	if !ok {
+		http.Error(w, "order history is not supported", http.StatusNotImplemented)
+		return
+	}
+
+	order := new(model.Order)
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxOrderBody)).Decode(order); err != nil {
+		http.Error(w, "invalid order: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if order.OrderUID != orderUID {
+		http.Error(w, "order_uid in body does not match the path", http.StatusBadRequest)
+		return
+	}
+	if err := order.Validate(); err != nil {
+		http.Error(w, "invalid order: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rev, err := hs.UpdateOrder(r.Context(), order, actor, reason)
+	if errors.Is(err, errors.ErrUnsupported) {
+		http.Error(w, "order history is not supported", http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	if rev == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	log.Printf("order %q updated by %q to version %d: %s", orderUID, actor, rev.Version, reason)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rev); err != nil {
+		log.Println("failed to encode response:", err)
+	}
+}
+
+// GetOrderHistory — HTTP-обработчик GET /order/{order_uid}/history
+//
+// Исправления заказа от старых к новым: версия, кто, когда, почему и
+// изменения полей. Значения персональных данных скрыты.
+func (h *Handler) GetOrderHistory(w http.ResponseWriter, r *http.Request) {
+	hs, ok := h.storage.(historyStorage)
+	if !ok {
+		http.Error(w, "order history is not supported", http.StatusNotImplemented)
+		return
+	}
+	revisions, err := hs.OrderHistory(r.Context(), r.PathValue("order_uid"))
+	if errors.Is(err, errors.ErrUnsupported) {
+		http.Error(w, "order history is not supported", http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{"revisions": revisions}); err != nil {
+		log.Println("failed to encode response:", err)
+	}
+}
+
+// GetOrderStatus — HTTP-обработчик GET /order/{order_uid}/status
+//
+// Статус заказа, статус, выведенный из статусов товаров (derived), и
+// история переходов.
+func (h *Handler) GetOrderStatus(w http.ResponseWriter, r *http.Request) {
+	ss, ok := h.storage.(statusStorage)
+	if !ok {
+		http.Error(w, "order status is not supported", http.StatusNotImplemented)
+		return
+	}
+	report, err := ss.OrderStatus(r.Context(), r.PathValue("order_uid"))
+	if errors.Is(err, errors.ErrUnsupported) {
+		http.Error(w, "order status is not supported", http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Println("failed to encode response:", err)
+	}
+}
+
+// TransitionOrder — HTTP-обработчик POST /order/{order_uid}/status
+//
+// Тело: {"status": "shipped", "reason": "..."}; пустой status — перевести
+// в статус, выведенный из товаров. reason и заголовок X-Actor обязательны.
+// Ответ — выполненный переход или 204, если заказ уже в этом статусе;
+// неразрешенный переход — 400.
+func (h *Handler) TransitionOrder(w http.ResponseWriter, r *http.Request) {
+	orderUID := r.PathValue("order_uid")
+	actor := strings.TrimSpace(r.Header.Get("X-Actor"))
+	if orderUID == "" {
+		http.Error(w, "order_uid is required", http.StatusBadRequest)
+		return
+	}
+	if actor == "" {
+		http.Error(w, "X-Actor header is required", http.StatusBadRequest)
+		return
+	}
+	var req transitionRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Reason) == "" {
+		http.Error(w, "reason is required", http.StatusBadRequest)
+		return
+	}
+	ss, ok := h.storage.(statusStorage)
+	if !ok {
+		http.Error(w, "order status is not supported", http.StatusNotImplemented)
+		return
+	}
+
+	change, err := ss.TransitionOrder(r.Context(), orderUID, req.Status, actor, req.Reason)
+	if errors.Is(err, errors.ErrUnsupported) {
+		http.Error(w, "order status is not supported", http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	if change == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	log.Printf("order %q moved by %q: %s -> %s", orderUID, actor, change.From, change.To)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(change); err != nil {
+		log.Println("failed to encode response:", err)
+	}
+}
+
+// refunds возвращает возвраты заказа или nil, если хранилище их не поддерживает.
+func (h *Handler) refunds(ctx context.Context, uid string) (*storage.RefundSummary, error) {
+	rs, ok := h.storage.(refundStorage)
+	if !ok {
+		return nil, nil
+	}
+	summary, err := rs.Refunds(ctx, uid)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil, nil
+	}
+	return summary, err
+}
+
+// GetRefunds — HTTP-обработчик GET /order/{order_uid}/refunds
+//
+// Возвраты заказа от старых к новым, оплата (paid), сумма возвратов
+// (refunded) и остаток (net).
+func (h *Handler) GetRefunds(w http.ResponseWriter, r *http.Request) {
+	rs, ok := h.storage.(refundStorage)
+	if !ok {
+		http.Error(w, "refunds are not supported", http.StatusNotImplemented)
+		return
+	}
+	summary, err := rs.Refunds(r.Context(), r.PathValue("order_uid"))
+	if errors.Is(err, errors.ErrUnsupported) {
+		http.Error(w, "refunds are not supported", http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(summary); err != nil {
+		log.Println("failed to encode response:", err)
+	}
+}
+
+// CreateRefund — HTTP-обработчик POST /order/{order_uid}/refunds
+//
+// Тело — model.Refund: {"refund_id": "...", "kind": "full" | "partial" |
+// "items", "amount": 100, "items": [{"rid": "...", "amount": 50}],
+// "reason": "..."}; заголовок X-Actor обязателен. Ответ 201 — возврат с
+// дополненными суммами; превышение оплаты или стоимости товара — 400,
+// повтор refund_id — 409.
+func (h *Handler) CreateRefund(w http.ResponseWriter, r *http.Request) {
+	orderUID := r.PathValue("order_uid")
+	actor := strings.TrimSpace(r.Header.Get("X-Actor"))
+	if orderUID == "" {
+		http.Error(w, "order_uid is required", http.StatusBadRequest)
+		return
+	}
+	if actor == "" {
+		http.Error(w, "X-Actor header is required", http.StatusBadRequest)
+		return
+	}
+	refund := new(model.Refund)
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(refund); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if refund.OrderUID == "" {
+		refund.OrderUID = orderUID
+	}
+	if refund.OrderUID != orderUID {
+		http.Error(w, "order_uid in body does not match path", http.StatusBadRequest)
+		return
+	}
+	refund.Actor = actor
+	rs, ok := h.storage.(refundStorage)
+	if !ok {
+		http.Error(w, "refunds are not supported", http.StatusNotImplemented)
+		return
+	}
+
+	refund, err := rs.CreateRefund(r.Context(), refund)
+	switch {
+	case errors.Is(err, errors.ErrUnsupported):
+		http.Error(w, "refunds are not supported", http.StatusNotImplemented)
+		return
+	case errors.Is(err, storage.ErrConflict):
+		http.Error(w, "refund already exists", http.StatusConflict)
+		return
+	case err != nil:
+		writeStorageError(w, err)
 		return
 	}
+	log.Printf("order %q refunded %d by %q: %s", orderUID, refund.Amount, actor, refund.Reason)
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(200)
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(refund); err != nil {
+		log.Println("failed to encode response:", err)
+	}
+}
+
+// ListItemStatuses — HTTP-обработчик GET /item-statuses
+//
+// Справочник статусов товаров: коды, имена, описания, признак конечного
+// статуса и подписи по языкам.
+func (h *Handler) ListItemStatuses(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{"statuses": h.itemStatuses.Defs()}); err != nil {
+		log.Println("failed to encode response:", err)
+	}
+}
+
+// GetItemTimeline — HTTP-обработчик GET /order/{order_uid}/items/timeline
+//
+// Ленты статусов товаров заказа (storage.ItemTimelines) с расшифровкой
+// каждого статуса на языке ?lang= (по умолчанию — локали заказа).
+func (h *Handler) GetItemTimeline(w http.ResponseWriter, r *http.Request) {
+	orderUID := r.PathValue("order_uid")
+	is, ok := h.storage.(itemStatusStorage)
+	if !ok {
+		http.Error(w, "item status history is not supported", http.StatusNotImplemented)
+		return
+	}
+	order, err := h.storage.GetOrder(r.Context(), orderUID)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	changes, err := is.ItemStatusHistory(r.Context(), orderUID)
+	if errors.Is(err, errors.ErrUnsupported) {
+		http.Error(w, "item status history is not supported", http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	lang := r.URL.Query().Get("lang")
+	if lang == "" {
+		lang = order.Locale
+	}
+	timelines := storage.ItemTimelines(order, changes)
+	for _, t := range timelines {
+		for i := range t.Points {
+			info := h.itemStatuses.Describe(t.Points[i].Status, lang)
+			t.Points[i].StatusInfo = &info
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{"items": timelines}); err != nil {
+		log.Println("failed to encode response:", err)
+	}
+}
+
+func (h *Handler) changeOrder(w http.ResponseWriter, r *http.Request, change func(deleteStorage, context.Context, string, string) error) {
+	orderUID := r.PathValue("order_uid")
+	if orderUID == "" {
+		http.Error(w, "order_uid is required", http.StatusBadRequest)
+		return
+	}
+	actor := strings.TrimSpace(r.Header.Get("X-Actor"))
+	if actor == "" {
+		http.Error(w, "X-Actor header is required", http.StatusBadRequest)
+		return
+	}
+	ds, ok := h.storage.(deleteStorage)
+	if !ok {
+		http.Error(w, "order deletion is not supported", http.StatusNotImplemented)
+		return
+	}
+
+	err := change(ds, r.Context(), orderUID, actor)
+	if errors.Is(err, errors.ErrUnsupported) {
+		http.Error(w, "order deletion is not supported", http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	log.Printf("order %q changed by %q: %s %s", orderUID, actor, r.Method, r.URL.Path)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeEncoded отдает заранее закодированный JSON без повторной сериализации.
+// Сжатое тело отдается как есть, если клиент принимает gzip.
+func (h *Handler) writeEncoded(w http.ResponseWriter, r *http.Request, es encodedStorage, orderUID string) {
+	body, gzipped, err := es.GetOrderJSON(r.Context(), orderUID)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if gzipped {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r) {
+			w.Header().Set("Content-Encoding", "gzip")
+		} else if body, err = cache.Gunzip(body); err != nil {
+			log.Println("failed to decompress cached response:", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if _, err := w.Write(body); err != nil {
+		log.Println("failed to write response:", err)
+	}
+}
+
+// writeStorageError отвечает статусом, соответствующим ошибке хранилища.
+// В лог пишутся только настоящие сбои, а не отсутствующие заказы.
+func writeStorageError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		http.Error(w, "order not found", http.StatusNotFound)
+	case errors.Is(err, storage.ErrInvalidArgument):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, storage.ErrConflict):
+		http.Error(w, "order already exists", http.StatusConflict)
+	case errors.Is(err, storage.ErrUnavailable):
+		log.Println("storage unavailable:", err)
+		http.Error(w, "service temporarily unavailable", http.StatusServiceUnavailable)
+	default:
+		log.Println("storage error:", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.SplitN(enc, ";", 2)[0]) == "gzip" {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/dws33/WB_ZeroProj/internal/storage"
+)
+
+const (
+	// LSNHeader — позиция WAL primary после записи в запросе. Ответ на
+	// запрос, изменивший заказ, содержит ее в этом заголовке и в cookie
+	// lsnCookie; клиент возвращает ее в заголовке или cookie (браузер —
+	// автоматически), и чтения запроса идут только в реплики, которые уже
+	// проиграли эту запись.
+	LSNHeader = "X-WAL-LSN"
+	lsnCookie = "wal_lsn"
+	// lsnCookieMaxAge — срок cookie: реплика, отстающая не больше
+	// REPLICA_MAX_LAG, к этому времени запись уже проиграла.
+	lsnCookieMaxAge = time.Minute
+)
+
+// ReadYourWrites передает позицию WAL между запросами клиента
+// (storage.TrackWrites, storage.ReadAfter), поэтому клиент видит свои
+// записи, даже если следующий запрос обслуживает другой экземпляр сервиса.
+// Неверное значение заголовка — ошибка 400, неверная cookie игнорируется.
+func ReadYourWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if lsn := r.Header.Get(LSNHeader); lsn != "" {
+			var err error
+			if ctx, err = storage.ReadAfter(ctx, lsn); err != nil {
+				http.Error(w, "invalid "+LSNHeader+" header", http.StatusBadRequest)
+				return
+			}
+		} else if c, err := r.Cookie(lsnCookie); err == nil {
+			if after, err := storage.ReadAfter(ctx, c.Value); err == nil {
+				ctx = after
+			}
+		}
+		ctx = storage.TrackWrites(ctx)
+		next.ServeHTTP(&lsnWriter{ResponseWriter: w, ctx: ctx}, r.WithContext(ctx))
+	})
+}
+
+// lsnWriter добавляет позицию записи к заголовкам ответа: запись
+// в хранилище заканчивается до того, как обработчик начинает отвечать.
+type lsnWriter struct {
+	http.ResponseWriter
+	ctx         context.Context
+	wroteHeader bool
+}
+
+func (w *lsnWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if lsn := storage.WrittenLSN(w.ctx); lsn != "" {
+			w.Header().Set(LSNHeader, lsn)
+			http.SetCookie(w, &http.Cookie{
+				Name:     lsnCookie,
+				Value:    lsn,
+				Path:     "/",
+				MaxAge:   int(lsnCookieMaxAge / time.Second),
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *lsnWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap нужен http.ResponseController.
+func (w *lsnWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,88 @@
+package model
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Change — изменение одного поля заказа. Path — путь в JSON-представлении
+// заказа: "delivery.phone", "items[1].price". Добавленный или удаленный
+// товар — "items[2]" с Old или New, равным nil.
+type Change struct {
+	Path string `json:"path"`
+	Old  any    `json:"old"`
+	New  any    `json:"new"`
+}
+
+// Diff возвращает изменения от заказа a к заказу b по полям в порядке
+// их объявления. Товары сравниваются по позиции.
+func Diff(a, b *Order) []Change {
+	var changes []Change
+	diffValue("", reflect.ValueOf(a), reflect.ValueOf(b), &changes)
+	return changes
+}
+
+var timeType = reflect.TypeFor[time.Time]()
+
+func diffValue(path string, a, b reflect.Value, changes *[]Change) {
+	add := func(old, new any) {
+		*changes = append(*changes, Change{Path: path, Old: old, New: new})
+	}
+	switch {
+	case a.Kind() == reflect.Pointer:
+		if a.IsNil() || b.IsNil() {
+			if a.IsNil() != b.IsNil() {
+				add(valueOf(a), valueOf(b))
+			}
+			return
+		}
+		diffValue(path, a.Elem(), b.Elem(), changes)
+	case a.Type() == timeType:
+		if !a.Interface().(time.Time).Equal(b.Interface().(time.Time)) {
+			add(a.Interface(), b.Interface())
+		}
+	case a.Kind() == reflect.Struct:
+		t := a.Type()
+		for i := range t.NumField() {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if !f.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			if path != "" {
+				name = path + "." + name
+			}
+			diffValue(name, a.Field(i), b.Field(i), changes)
+		}
+	case a.Kind() == reflect.Slice:
+		for i := range max(a.Len(), b.Len()) {
+			p := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= a.Len():
+				*changes = append(*changes, Change{Path: p, New: valueOf(b.Index(i))})
+			case i >= b.Len():
+				*changes = append(*changes, Change{Path: p, Old: valueOf(a.Index(i))})
+			default:
+				diffValue(p, a.Index(i), b.Index(i), changes)
+			}
+		}
+	default:
+		if !a.Equal(b) {
+			add(a.Interface(), b.Interface())
+		}
+	}
+}
+
+// valueOf возвращает значение v; nil-указатель — nil без типа,
+// чтобы в JSON он был null.
+func valueOf(v reflect.Value) any {
+	if v.Kind() == reflect.Pointer && v.IsNil() {
+		return nil
+	}
+	return v.Interface()
+}
@@ -0,0 +1,136 @@
+package model
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+)
+
+// ItemStatusDef — запись справочника статусов товаров: код Item.Status,
+// машинное имя, описание для поддержки, признак конечного статуса и
+// подписи по языкам (ключ — локаль заказа, "ru", "en").
+type ItemStatusDef struct {
+	Code        int               `json:"code"`
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Terminal    bool              `json:"terminal"`
+	Labels      map[string]string `json:"labels"`
+}
+
+// ItemStatusInfo — расшифровка кода Item.Status для ответа: подпись на
+// одном языке и этап заказа (ItemStage). Known — код есть в справочнике.
+type ItemStatusInfo struct {
+	Code        int         `json:"code"`
+	Name        string      `json:"name"`
+	Label       string      `json:"label"`
+	Description string      `json:"description,omitempty"`
+	Terminal    bool        `json:"terminal"`
+	Stage       OrderStatus `json:"stage,omitempty"`
+	Known       bool        `json:"known"`
+}
+
+// ItemStatusCatalog — справочник статусов товаров.
+type ItemStatusCatalog struct {
+	defs   []ItemStatusDef
+	byCode map[int]*ItemStatusDef
+	// fallback — язык подписи, если нужного нет
+	fallback string
+}
+
+//go:embed item_statuses.json
+var defaultItemStatuses []byte
+
+// DefaultItemStatuses возвращает встроенный справочник.
+func DefaultItemStatuses() *ItemStatusCatalog {
+	c, err := ParseItemStatuses(defaultItemStatuses)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// LoadItemStatusFile читает справочник из JSON-файла — массива ItemStatusDef.
+// Справочник из файла заменяет встроенный целиком.
+func LoadItemStatusFile(path string) (*ItemStatusCatalog, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := ParseItemStatuses(b)
+	if err != nil {
+		return nil, fmt.Errorf("item status file %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// ParseItemStatuses разбирает справочник: коды уникальны и попадают
+// в ItemStatusRanges, имена не пусты, признак конечного статуса совпадает
+// с конечностью этапа кода.
+func ParseItemStatuses(data []byte) (*ItemStatusCatalog, error) {
+	var defs []ItemStatusDef
+	if err := json.Unmarshal(data, &defs); err != nil {
+		return nil, err
+	}
+	c := &ItemStatusCatalog{byCode: make(map[int]*ItemStatusDef, len(defs)), fallback: "ru"}
+	slices.SortFunc(defs, func(a, b ItemStatusDef) int { return a.Code - b.Code })
+	c.defs = defs
+	for i := range c.defs {
+		d := &c.defs[i]
+		if d.Name == "" {
+			return nil, fmt.Errorf("item status %d: name is required", d.Code)
+		}
+		if _, ok := c.byCode[d.Code]; ok {
+			return nil, fmt.Errorf("item status %d: duplicate code", d.Code)
+		}
+		stage, ok := ItemStage(d.Code)
+		if !ok {
+			return nil, fmt.Errorf("item status %d: code is outside of item status ranges", d.Code)
+		}
+		if d.Terminal != stage.Terminal() {
+			return nil, fmt.Errorf("item status %d: terminal=%t contradicts stage %s", d.Code, d.Terminal, stage)
+		}
+		c.byCode[d.Code] = d
+	}
+	return c, nil
+}
+
+// Defs возвращает записи справочника по возрастанию кода.
+func (c *ItemStatusCatalog) Defs() []ItemStatusDef {
+	return slices.Clone(c.defs)
+}
+
+// Describe расшифровывает код с подписью на языке locale (если ее нет —
+// на русском, затем машинное имя). Код не из справочника описывается
+// по этапу его диапазона (ItemStatusRanges) с подписью-кодом.
+func (c *ItemStatusCatalog) Describe(code int, locale string) ItemStatusInfo {
+	stage, _ := ItemStage(code)
+	d, ok := c.byCode[code]
+	if !ok {
+		return ItemStatusInfo{
+			Code:     code,
+			Name:     "unknown",
+			Label:    strconv.Itoa(code),
+			Terminal: stage.Terminal(),
+			Stage:    stage,
+		}
+	}
+	label := d.Labels[locale]
+	if label == "" {
+		label = d.Labels[c.fallback]
+	}
+	if label == "" {
+		label = d.Name
+	}
+	return ItemStatusInfo{
+		Code:        code,
+		Name:        d.Name,
+		Label:       label,
+		Description: d.Description,
+		Terminal:    d.Terminal,
+		Stage:       stage,
+		Known:       true,
+	}
+}
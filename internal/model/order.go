@@ -12,6 +12,11 @@ import (
 	"github.com/go-ozzo/ozzo-validation/v4/is"
 )
 
+// SchemaVersion — версия формата Order, которой разбираются входящие заказы.
+// Увеличивается при изменении полей, чтобы по метаданным получения было
+// видно, какие заказы стоит переобработать из архива исходных сообщений.
+const SchemaVersion = 1
+
 type Order struct {
 	OrderUID          string    `json:"order_uid"`
 	TrackNumber       string    `json:"track_number"`
@@ -176,3 +181,29 @@ func (i *Item) Validate() error {
 		val.Field(&i.Status, val.Required),
 	)
 }
+
+// Clone возвращает глубокую копию заказа: изменения копии не затрагивают оригинал.
+func (o *Order) Clone() *Order {
+	if o == nil {
+		return nil
+	}
+	c := *o
+	if o.Delivery != nil {
+		d := *o.Delivery
+		c.Delivery = &d
+	}
+	if o.Payment != nil {
+		p := *o.Payment
+		c.Payment = &p
+	}
+	if o.Items != nil {
+		c.Items = make([]*Item, len(o.Items))
+		for i, item := range o.Items {
+			if item != nil {
+				it := *item
+				c.Items[i] = &it
+			}
+		}
+	}
+	return &c
+}
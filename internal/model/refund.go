@@ -0,0 +1,154 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	val "github.com/go-ozzo/ozzo-validation/v4"
+)
+
+// RefundKind — вид возврата денег.
+type RefundKind string
+
+const (
+	// RefundFull возвращает все, что осталось от оплаты; после него
+	// возвратов по заказу больше нет.
+	RefundFull RefundKind = "full"
+	// RefundPartial возвращает сумму без привязки к товарам (например,
+	// стоимость доставки или компенсацию).
+	RefundPartial RefundKind = "partial"
+	// RefundItems возвращает деньги за товары по rid.
+	RefundItems RefundKind = "items"
+)
+
+// ErrInvalidRefund — возврат превышает оплату или не соответствует заказу.
+var ErrInvalidRefund = errors.New("invalid refund")
+
+// Refund — возврат денег по заказу. RefundID задает отправитель и
+// уникален в пределах заказа: повтор сообщения не создает второй возврат.
+// Суммы — в валюте и единицах Payment.Amount.
+type Refund struct {
+	RefundID  string       `json:"refund_id"`
+	OrderUID  string       `json:"order_uid"`
+	Kind      RefundKind   `json:"kind"`
+	Amount    int          `json:"amount"`
+	Items     []RefundItem `json:"items,omitempty"`
+	Reason    string       `json:"reason"`
+	Actor     string       `json:"actor"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+// RefundItem — возврат за товар rid; Amount 0 — вся его оставшаяся стоимость.
+type RefundItem struct {
+	RID    string `json:"rid"`
+	Amount int    `json:"amount"`
+}
+
+func (r *Refund) Validate() error {
+	if r == nil {
+		return fmt.Errorf("refund == nil (unset)")
+	}
+	return val.ValidateStruct(r,
+		val.Field(&r.RefundID, val.Required),
+		val.Field(&r.OrderUID, val.Required),
+		val.Field(&r.Kind, val.Required, val.In(RefundFull, RefundPartial, RefundItems)),
+		val.Field(&r.Amount, val.Min(0),
+			val.When(r.Kind == RefundPartial, val.Required)),
+		val.Field(&r.Items,
+			val.When(r.Kind == RefundItems, val.Required).Else(val.Empty)),
+		val.Field(&r.Reason, val.Required),
+	)
+}
+
+func (i RefundItem) Validate() error {
+	return val.ValidateStruct(&i,
+		val.Field(&i.RID, val.Required),
+		val.Field(&i.Amount, val.Min(0)),
+	)
+}
+
+// Refunded возвращает сумму возвратов.
+func Refunded(refunds []*Refund) int {
+	var sum int
+	for _, r := range refunds {
+		sum += r.Amount
+	}
+	return sum
+}
+
+// NetAmount возвращает оплату заказа за вычетом возвратов.
+func NetAmount(order *Order, refunds []*Refund) int {
+	if order.Payment == nil {
+		return -Refunded(refunds)
+	}
+	return order.Payment.Amount - Refunded(refunds)
+}
+
+// CheckRefund проверяет возврат r по заказу order с прошлыми возвратами
+// prior и дополняет суммы: у полного возврата Amount 0 — весь остаток
+// оплаты, у возврата товаров — сумма по товарам (RefundItem.Amount 0 —
+// остаток стоимости товара). Ошибка оборачивает ErrInvalidRefund: возвраты
+// не превышают оплату, а возвраты за товар — его TotalPrice.
+func CheckRefund(order *Order, prior []*Refund, r *Refund) error {
+	if order.Payment == nil {
+		return fmt.Errorf("%w: order %q has no payment", ErrInvalidRefund, order.OrderUID)
+	}
+	remaining := order.Payment.Amount - Refunded(prior)
+	for _, p := range prior {
+		if p.Kind == RefundFull {
+			return fmt.Errorf("%w: order %q is already fully refunded", ErrInvalidRefund, order.OrderUID)
+		}
+	}
+
+	switch r.Kind {
+	case RefundFull:
+		if r.Amount == 0 {
+			r.Amount = remaining
+		}
+		if r.Amount != remaining {
+			return fmt.Errorf("%w: full refund must be %d, got %d", ErrInvalidRefund, remaining, r.Amount)
+		}
+	case RefundItems:
+		// остаток стоимости товаров после прошлых возвратов за них
+		left := make(map[string]int, len(order.Items))
+		for _, item := range order.Items {
+			left[item.RID] += item.TotalPrice
+		}
+		for _, p := range prior {
+			for _, pi := range p.Items {
+				left[pi.RID] -= pi.Amount
+			}
+		}
+		var sum int
+		for i := range r.Items {
+			ri := &r.Items[i]
+			rest, ok := left[ri.RID]
+			if !ok {
+				return fmt.Errorf("%w: order %q has no item %q", ErrInvalidRefund, order.OrderUID, ri.RID)
+			}
+			if ri.Amount == 0 {
+				ri.Amount = rest
+			}
+			if ri.Amount <= 0 || ri.Amount > rest {
+				return fmt.Errorf("%w: item %q can be refunded for at most %d, got %d", ErrInvalidRefund, ri.RID, rest, ri.Amount)
+			}
+			left[ri.RID] -= ri.Amount
+			sum += ri.Amount
+		}
+		if r.Amount == 0 {
+			r.Amount = sum
+		}
+		if r.Amount != sum {
+			return fmt.Errorf("%w: amount %d does not match items total %d", ErrInvalidRefund, r.Amount, sum)
+		}
+	}
+
+	if r.Amount <= 0 {
+		return fmt.Errorf("%w: nothing to refund", ErrInvalidRefund)
+	}
+	if r.Amount > remaining {
+		return fmt.Errorf("%w: refunds would exceed payment: %d left, got %d", ErrInvalidRefund, remaining, r.Amount)
+	}
+	return nil
+}
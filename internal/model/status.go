@@ -0,0 +1,153 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// OrderStatus — этап жизненного цикла заказа.
+type OrderStatus string
+
+const (
+	StatusCreated    OrderStatus = "created"
+	StatusPaid       OrderStatus = "paid"
+	StatusAssembling OrderStatus = "assembling"
+	StatusShipped    OrderStatus = "shipped"
+	StatusDelivered  OrderStatus = "delivered"
+	StatusCancelled  OrderStatus = "cancelled"
+	StatusReturned   OrderStatus = "returned"
+)
+
+// ErrInvalidTransition — переход между статусами не разрешен.
+var ErrInvalidTransition = errors.New("invalid status transition")
+
+// orderStatuses — статусы в порядке продвижения заказа; отмена и возврат — в конце.
+var orderStatuses = []OrderStatus{
+	StatusCreated, StatusPaid, StatusAssembling, StatusShipped, StatusDelivered,
+	StatusCancelled, StatusReturned,
+}
+
+// transitions — разрешенные переходы. Отменить можно до отгрузки,
+// вернуть — отгруженный или доставленный заказ.
+var transitions = map[OrderStatus][]OrderStatus{
+	StatusCreated:    {StatusPaid, StatusCancelled},
+	StatusPaid:       {StatusAssembling, StatusCancelled},
+	StatusAssembling: {StatusShipped, StatusCancelled},
+	StatusShipped:    {StatusDelivered, StatusReturned},
+	StatusDelivered:  {StatusReturned},
+}
+
+// Valid сообщает, известен ли статус.
+func (s OrderStatus) Valid() bool {
+	return slices.Contains(orderStatuses, s)
+}
+
+// Terminal сообщает, что из статуса переходов нет.
+func (s OrderStatus) Terminal() bool {
+	return s.Valid() && len(transitions[s]) == 0
+}
+
+// CanTransition сообщает, разрешен ли переход s -> to.
+func (s OrderStatus) CanTransition(to OrderStatus) bool {
+	return slices.Contains(transitions[s], to)
+}
+
+// CanReach сообщает, можно ли дойти из s в to одним или несколькими
+// разрешенными переходами (статус, выведенный из товаров, может
+// пропустить этапы).
+func (s OrderStatus) CanReach(to OrderStatus) bool {
+	seen := map[OrderStatus]bool{s: true}
+	queue := []OrderStatus{s}
+	for len(queue) > 0 {
+		for _, next := range transitions[queue[0]] {
+			if next == to {
+				return true
+			}
+			if !seen[next] {
+				seen[next] = true
+				queue = append(queue, next)
+			}
+		}
+		queue = queue[1:]
+	}
+	return false
+}
+
+// ValidateTransition возвращает ошибку, оборачивающую ErrInvalidTransition,
+// если переход from -> to не разрешен.
+func ValidateTransition(from, to OrderStatus) error {
+	if !to.Valid() {
+		return fmt.Errorf("%w: unknown status %q", ErrInvalidTransition, to)
+	}
+	if !from.CanTransition(to) {
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, from, to)
+	}
+	return nil
+}
+
+// ItemStatusRange — диапазон кодов Item.Status (включительно) и этап
+// заказа, которому соответствует товар с таким кодом.
+type ItemStatusRange struct {
+	From, To int
+	Stage    OrderStatus
+}
+
+// ItemStatusRanges — соответствие кодов статусов товаров этапам заказа
+// для DeriveStatus: сотня кода задает этап. Коды вне диапазонов не учитываются.
+var ItemStatusRanges = []ItemStatusRange{
+	{0, 199, StatusPaid},
+	{200, 299, StatusAssembling},
+	{300, 399, StatusShipped},
+	{400, 499, StatusDelivered},
+	{500, 599, StatusCancelled},
+	{600, 699, StatusReturned},
+}
+
+// ItemStage возвращает этап заказа для кода статуса товара.
+func ItemStage(code int) (OrderStatus, bool) {
+	for _, r := range ItemStatusRanges {
+		if code >= r.From && code <= r.To {
+			return r.Stage, true
+		}
+	}
+	return "", false
+}
+
+// DeriveStatus выводит статус заказа из статусов его товаров: заказ
+// находится на наименее продвинутом этапе среди неотмененных и
+// невозвращенных товаров; если таких нет — возвращен (есть возвраты)
+// или отменен. false — ни один код товара не известен.
+func DeriveStatus(items []*Item) (OrderStatus, bool) {
+	var (
+		active   []OrderStatus
+		known    bool
+		returned bool
+	)
+	for _, item := range items {
+		stage, ok := ItemStage(item.Status)
+		if !ok {
+			continue
+		}
+		known = true
+		switch stage {
+		case StatusCancelled:
+		case StatusReturned:
+			returned = true
+		default:
+			active = append(active, stage)
+		}
+	}
+	switch {
+	case !known:
+		return "", false
+	case len(active) > 0:
+		return slices.MinFunc(active, func(a, b OrderStatus) int {
+			return slices.Index(orderStatuses, a) - slices.Index(orderStatuses, b)
+		}), true
+	case returned:
+		return StatusReturned, true
+	default:
+		return StatusCancelled, true
+	}
+}
@@ -0,0 +1,134 @@
+package pii
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrUnknownKey — ключ, которым зашифровано значение, не найден.
+var ErrUnknownKey = errors.New("pii: unknown key")
+
+// KeyProvider — хранитель ключей шифрования ключей (KEK), как KMS:
+// ключи не покидают провайдера, он только заворачивает и разворачивает
+// ключи данных (DEK).
+type KeyProvider interface {
+	// CurrentKey — id ключа, которым заворачиваются новые DEK.
+	CurrentKey() string
+	Wrap(ctx context.Context, keyID string, dek []byte) ([]byte, error)
+	Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// KeyFile — содержимое файла ключей:
+//
+//	{
+//	  "current": "2024-06",
+//	  "keys": {"2024-01": "<base64, 32 байта>", "2024-06": "<base64, 32 байта>"},
+//	  "index_key": "<base64, 32 байта>"
+//	}
+//
+// Для ротации добавьте ключ и сделайте его current; старые ключи нужны,
+// пока RotatePII не перешифрует все записи. index_key (слепые индексы)
+// не меняется: иначе поиск по старым индексам перестанет работать.
+type KeyFile struct {
+	Current  string            `json:"current"`
+	Keys     map[string][]byte `json:"keys"`
+	IndexKey []byte            `json:"index_key"`
+}
+
+// LocalKeys — KeyProvider на ключах AES-256 из файла.
+type LocalKeys struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// LoadKeyFile читает файл ключей и возвращает провайдер и ключ слепых индексов.
+func LoadKeyFile(path string) (*LocalKeys, []byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var f KeyFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, nil, fmt.Errorf("key file %s: %w", path, err)
+	}
+	if len(f.IndexKey) < 32 {
+		return nil, nil, fmt.Errorf("key file %s: index_key must be at least 32 bytes", path)
+	}
+	keys, err := NewLocalKeys(f.Current, f.Keys)
+	if err != nil {
+		return nil, nil, fmt.Errorf("key file %s: %w", path, err)
+	}
+	return keys, f.IndexKey, nil
+}
+
+// NewLocalKeys создает провайдер из ключей AES-256 по id.
+func NewLocalKeys(current string, keys map[string][]byte) (*LocalKeys, error) {
+	l := &LocalKeys{current: current, keys: make(map[string]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("key id %q must be non-empty and must not contain ':'", id)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %q must be 32 bytes", id)
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		l.keys[id] = aead
+	}
+	if _, ok := l.keys[current]; !ok {
+		return nil, fmt.Errorf("current key %q is not defined", current)
+	}
+	return l, nil
+}
+
+func (l *LocalKeys) CurrentKey() string { return l.current }
+
+func (l *LocalKeys) Wrap(_ context.Context, keyID string, dek []byte) ([]byte, error) {
+	aead, ok := l.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, keyID)
+	}
+	return seal(aead, dek, []byte(keyID))
+}
+
+func (l *LocalKeys) Unwrap(_ context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	aead, ok := l.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, keyID)
+	}
+	return open(aead, wrapped, []byte(keyID))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal шифрует plaintext; результат — nonce || ciphertext.
+func seal(aead cipher.AEAD, plaintext, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func open(aead cipher.AEAD, sealed, aad []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("pii: ciphertext too short")
+	}
+	n := aead.NonceSize()
+	return aead.Open(nil, sealed[:n], sealed[n:], aad)
+}
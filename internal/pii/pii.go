@@ -0,0 +1,282 @@
+// Package pii шифрует персональные данные доставки (имя, телефон, адрес,
+// email) конвертом: значение шифруется AES-GCM случайным ключом данных (DEK),
+// а DEK заворачивается ключом KeyProvider. Зашифрованное значение
+// самодостаточно и хранится в той же текстовой колонке:
+//
+//	pii:v1:<id ключа>:<завернутый DEK, base64>:<nonce||шифротекст, base64>
+//
+// Хранилище и кэш держат зашифрованные значения; расшифровываются они
+// только при ответе клиенту (OpenOrder).
+package pii
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dws33/WB_ZeroProj/internal/model"
+)
+
+const prefix = "pii:v1:"
+
+// Поля доставки, которые шифруются; имя поля — дополнительные данные
+// AES-GCM, поэтому значение нельзя переставить в другое поле.
+const (
+	FieldName    = "name"
+	FieldPhone   = "phone"
+	FieldAddress = "address"
+	FieldEmail   = "email"
+)
+
+// FieldRawPayload — тело исходного сообщения Kafka в архиве (storage.RawStore):
+// оно содержит те же персональные данные, что и доставка.
+const FieldRawPayload = "raw_payload"
+
+// FieldCacheSnapshot — тело снапшота кэша на диске (cache.WithSnapshotCipher).
+const FieldCacheSnapshot = "cache_snapshot"
+
+var b64 = base64.RawStdEncoding
+
+// Cipher шифрует и расшифровывает персональные данные и строит слепые индексы.
+type Cipher struct {
+	keys     KeyProvider
+	indexKey []byte
+}
+
+// New создает Cipher. indexKey — ключ HMAC слепых индексов.
+func New(keys KeyProvider, indexKey []byte) *Cipher {
+	return &Cipher{keys: keys, indexKey: indexKey}
+}
+
+// IsSealed сообщает, зашифровано ли значение.
+func IsSealed(s string) bool {
+	return strings.HasPrefix(s, prefix)
+}
+
+// KeyID возвращает id ключа, которым зашифровано значение, или "" для открытого.
+func KeyID(s string) string {
+	rest, ok := strings.CutPrefix(s, prefix)
+	if !ok {
+		return ""
+	}
+	id, _, _ := strings.Cut(rest, ":")
+	return id
+}
+
+// KeyPrefix — начало значений, зашифрованных ключом keyID: по нему в SQL
+// находятся значения, которые нужно перешифровать.
+func KeyPrefix(keyID string) string {
+	return prefix + keyID + ":"
+}
+
+// CurrentKey — id ключа, которым шифруются новые значения.
+func (c *Cipher) CurrentKey() string {
+	return c.keys.CurrentKey()
+}
+
+// envelope — DEK одного заказа и его завернутая форма.
+type envelope struct {
+	keyID   string
+	dek     []byte
+	wrapped string
+}
+
+func (c *Cipher) newEnvelope(ctx context.Context) (*envelope, error) {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, err
+	}
+	keyID := c.keys.CurrentKey()
+	wrapped, err := c.keys.Wrap(ctx, keyID, dek)
+	if err != nil {
+		return nil, fmt.Errorf("pii: wrap key: %w", err)
+	}
+	return &envelope{keyID: keyID, dek: dek, wrapped: b64.EncodeToString(wrapped)}, nil
+}
+
+func (e *envelope) seal(field, value string) (string, error) {
+	if value == "" || IsSealed(value) {
+		return value, nil
+	}
+	aead, err := newGCM(e.dek)
+	if err != nil {
+		return "", err
+	}
+	ct, err := seal(aead, []byte(value), []byte(field))
+	if err != nil {
+		return "", err
+	}
+	return prefix + e.keyID + ":" + e.wrapped + ":" + b64.EncodeToString(ct), nil
+}
+
+// opener расшифровывает значения, разворачивая каждый DEK один раз.
+type opener struct {
+	c    *Cipher
+	deks map[string][]byte
+}
+
+func (o *opener) open(ctx context.Context, field, value string) (string, error) {
+	rest, ok := strings.CutPrefix(value, prefix)
+	if !ok {
+		return value, nil
+	}
+	parts := strings.Split(rest, ":")
+	if len(parts) != 3 {
+		return "", errors.New("pii: malformed sealed value")
+	}
+	keyID, wrapped, data := parts[0], parts[1], parts[2]
+
+	dek, ok := o.deks[keyID+":"+wrapped]
+	if !ok {
+		w, err := b64.DecodeString(wrapped)
+		if err != nil {
+			return "", fmt.Errorf("pii: malformed wrapped key: %w", err)
+		}
+		if dek, err = o.c.keys.Unwrap(ctx, keyID, w); err != nil {
+			return "", fmt.Errorf("pii: unwrap key: %w", err)
+		}
+		if o.deks == nil {
+			o.deks = make(map[string][]byte)
+		}
+		o.deks[keyID+":"+wrapped] = dek
+	}
+	ct, err := b64.DecodeString(data)
+	if err != nil {
+		return "", fmt.Errorf("pii: malformed ciphertext: %w", err)
+	}
+	aead, err := newGCM(dek)
+	if err != nil {
+		return "", err
+	}
+	pt, err := open(aead, ct, []byte(field))
+	if err != nil {
+		return "", fmt.Errorf("pii: decrypt %s: %w", field, err)
+	}
+	return string(pt), nil
+}
+
+// deliveryFields — шифруемые поля доставки.
+func deliveryFields(d *model.Delivery) []struct {
+	name  string
+	value *string
+} {
+	return []struct {
+		name  string
+		value *string
+	}{
+		{FieldName, &d.Name},
+		{FieldPhone, &d.Phone},
+		{FieldAddress, &d.Address},
+		{FieldEmail, &d.Email},
+	}
+}
+
+// SealDelivery шифрует поля d на месте одним DEK. Пустые и уже
+// зашифрованные значения не меняются.
+func (c *Cipher) SealDelivery(ctx context.Context, d *model.Delivery) error {
+	if d == nil {
+		return nil
+	}
+	env, err := c.newEnvelope(ctx)
+	if err != nil {
+		return err
+	}
+	for _, f := range deliveryFields(d) {
+		if *f.value, err = env.seal(f.name, *f.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OpenDelivery расшифровывает поля d на месте.
+func (c *Cipher) OpenDelivery(ctx context.Context, d *model.Delivery) error {
+	if d == nil {
+		return nil
+	}
+	o := opener{c: c}
+	for _, f := range deliveryFields(d) {
+		v, err := o.open(ctx, f.name, *f.value)
+		if err != nil {
+			return err
+		}
+		*f.value = v
+	}
+	return nil
+}
+
+// Seal шифрует значение поля field собственным DEK. Пустое и уже
+// зашифрованное значение не меняется.
+func (c *Cipher) Seal(ctx context.Context, field, value string) (string, error) {
+	if value == "" || IsSealed(value) {
+		return value, nil
+	}
+	env, err := c.newEnvelope(ctx)
+	if err != nil {
+		return "", err
+	}
+	return env.seal(field, value)
+}
+
+// Open расшифровывает значение поля field; открытое значение
+// возвращается как есть.
+func (c *Cipher) Open(ctx context.Context, field, value string) (string, error) {
+	o := opener{c: c}
+	return o.open(ctx, field, value)
+}
+
+// OpenOrder возвращает копию order с расшифрованной доставкой.
+func (c *Cipher) OpenOrder(ctx context.Context, order *model.Order) (*model.Order, error) {
+	order = order.Clone()
+	if err := c.OpenDelivery(ctx, order.Delivery); err != nil {
+		return nil, fmt.Errorf("order %s: %w", order.OrderUID, err)
+	}
+	return order, nil
+}
+
+// Reseal перешифровывает поля d текущим ключом (для ротации).
+func (c *Cipher) Reseal(ctx context.Context, d *model.Delivery) error {
+	if err := c.OpenDelivery(ctx, d); err != nil {
+		return err
+	}
+	return c.SealDelivery(ctx, d)
+}
+
+// BlindIndex — слепой индекс значения поля field для поиска на равенство:
+// HMAC-SHA256 нормализованного значения. Пустое значение — nil.
+func (c *Cipher) BlindIndex(field, value string) []byte {
+	value = Normalize(field, value)
+	if value == "" {
+		return nil
+	}
+	mac := hmac.New(sha256.New, c.indexKey)
+	mac.Write([]byte(field))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+// Normalize приводит значение к виду, в котором оно индексируется:
+// email — без пробелов по краям и в нижнем регистре, телефон — только
+// цифры и ведущий "+".
+func Normalize(field, value string) string {
+	value = strings.TrimSpace(value)
+	switch field {
+	case FieldEmail:
+		return strings.ToLower(value)
+	case FieldPhone:
+		var b strings.Builder
+		for i, r := range value {
+			if r >= '0' && r <= '9' || r == '+' && i == 0 {
+				b.WriteRune(r)
+			}
+		}
+		return b.String()
+	}
+	return value
+}
@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dws33/WB_ZeroProj/internal/model"
+)
+
+// Backend — место хранения записей кэша. Реализации:
+// Memory (карта в памяти процесса), Redis (общий кэш по протоколу RESP)
+// и Tiered (L1 в процессе поверх общего L2).
+//
+// Get возвращает заказ, который вызывающий может изменять.
+// GetJSON возвращает канонический JSON заказа (gzipped — тело сжато),
+// который вызывающий тоже может изменять; ok == false — заказа в кэше нет.
+type Backend interface {
+	Get(ctx context.Context, uid string) (order *model.Order, ok bool, err error)
+	GetJSON(ctx context.Context, uid string) (body []byte, gzipped bool, ok bool, err error)
+	Set(ctx context.Context, order *model.Order) error
+	Delete(ctx context.Context, uid string) (bool, error)
+	// Replace заменяет все содержимое на orders и возвращает число вытесненных записей.
+	Replace(ctx context.Context, orders []*model.Order) (int, error)
+	All(ctx context.Context) ([]*model.Order, error)
+	// Size — число записей и примерный объем в байтах (-1, если неизвестен).
+	Size(ctx context.Context) (entries int, bytes int64, err error)
+}
+
+// Shared — backend, общий для нескольких процессов (Redis). Он хранит
+// позицию журнала storage.ChangeFeed, до которой его содержимое согласовано
+// с БД: процесс при старте досинхронизирует общий кэш по журналу с этой
+// позиции, а не перезаписывает его, пока им пользуются другие реплики.
+// Позицию записывают несколько процессов, и она может откатиться назад —
+// тогда следующий процесс просто перечитает больше журнала.
+type Shared interface {
+	ChangeCursor(ctx context.Context) (string, error)
+	SetChangeCursor(ctx context.Context, cursor string) error
+}
+
+// sharedOf возвращает общую часть backend-а: сам backend или L2 у Tiered;
+// nil — backend принадлежит одному процессу.
+func sharedOf(b Backend) Shared {
+	if t, ok := b.(*Tiered); ok {
+		b = t.L2
+	}
+	s, _ := b.(Shared)
+	return s
+}
+
+// Tiered — двухуровневый кэш: быстрый L1 в памяти процесса и общий L2
+// (например, Redis), разделяемый несколькими репликами.
+// Запись идет в оба уровня, чтение — из L1, при промахе из L2 с прогревом L1.
+// Изменения, сделанные другими процессами, каждый процесс вытесняет из
+// своего L1 (и из L2) по журналу изменений, см. CachedStorage.Sync.
+type Tiered struct {
+	L1 Backend
+	L2 Backend
+}
+
+func NewTiered(l1, l2 Backend) *Tiered {
+	return &Tiered{L1: l1, L2: l2}
+}
+
+func (t *Tiered) Get(ctx context.Context, uid string) (*model.Order, bool, error) {
+	if order, ok, err := t.L1.Get(ctx, uid); err != nil || ok {
+		return order, ok, err
+	}
+	order, ok, err := t.L2.Get(ctx, uid)
+	if err != nil || !ok {
+		return nil, ok, err
+	}
+	if err := t.L1.Set(ctx, order); err != nil {
+		return nil, false, err
+	}
+	return order, true, nil
+}
+
+func (t *Tiered) GetJSON(ctx context.Context, uid string) ([]byte, bool, bool, error) {
+	if body, gzipped, ok, err := t.L1.GetJSON(ctx, uid); err != nil || ok {
+		return body, gzipped, ok, err
+	}
+	order, ok, err := t.Get(ctx, uid)
+	if err != nil || !ok {
+		return nil, false, ok, err
+	}
+	body, err := encodeOrder(order, false)
+	return body, false, err == nil, err
+}
+
+func (t *Tiered) Set(ctx context.Context, order *model.Order) error {
+	if err := t.L2.Set(ctx, order); err != nil {
+		return err
+	}
+	return t.L1.Set(ctx, order)
+}
+
+func (t *Tiered) Delete(ctx context.Context, uid string) (bool, error) {
+	ok2, err := t.L2.Delete(ctx, uid)
+	if err != nil {
+		return false, err
+	}
+	ok1, err := t.L1.Delete(ctx, uid)
+	return ok1 || ok2, err
+}
+
+func (t *Tiered) Replace(ctx context.Context, orders []*model.Order) (int, error) {
+	n, err := t.L2.Replace(ctx, orders)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := t.L1.Replace(ctx, orders); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// All читает из L2 — в L1 может быть только часть заказов.
+func (t *Tiered) All(ctx context.Context) ([]*model.Order, error) {
+	return t.L2.All(ctx)
+}
+
+// Size возвращает размер L1 — именно он занимает память процесса.
+func (t *Tiered) Size(ctx context.Context) (int, int64, error) {
+	return t.L1.Size(ctx)
+}
+
+// NewBackend создает backend по имени из конфигурации:
+// "memory" (или пусто), "redis" или "tiered" (Memory поверх Redis).
+// mode и compress настраивают Memory, compress — также тело в Redis.
+func NewBackend(kind, redisAddr, prefix string, mode Encoding, compress bool) (Backend, error) {
+	switch kind {
+	case "", "memory":
+		return NewMemory(mode, compress), nil
+	case "redis":
+		return NewRedis(redisAddr, prefix, compress), nil
+	case "tiered":
+		return NewTiered(NewMemory(mode, compress), NewRedis(redisAddr, prefix, compress)), nil
+	}
+	return nil, fmt.Errorf("unknown cache backend %q", kind)
+}
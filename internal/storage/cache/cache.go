@@ -2,74 +2,571 @@ package cache
 
 import (
 	"context"
-	"github.com/dws33/WB_ZeroProj/internal/storage"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/dws33/WB_ZeroProj/internal/model"
+	"github.com/dws33/WB_ZeroProj/internal/pii"
+	"github.com/dws33/WB_ZeroProj/internal/storage"
 )
 
-// CachedStorage — потокобезопасный кэш заказов в памяти.
+// maxReplay — сколько измененных заказов досинхронизируются по одному после
+// загрузки снапшота; при большем числе кэш перечитывается целиком.
+const maxReplay = 10_000
+
+// CachedStorage — потокобезопасный кэш заказов поверх storage.OrderStore.
+// Кэш хранит собственные копии заказов: GetOrder возвращает копию, а CreateOrder
+// сохраняет копию переданного заказа, поэтому изменения на стороне вызывающего
+// не видны другим читателям.
+//
+// Изменения, сделанные мимо кэша (другими процессами), кэш узнает из
+// журнала storage.ChangeFeed, см. Sync. Промахи читаются из primary:
+// реплика может отставать от журнала, и устаревшая копия осталась бы в кэше.
+//
+// Ошибки backend-а не ломают чтение: при недоступном кэше запрос идет в БД.
 type CachedStorage struct {
-	cache   cache
-	Storage *storage.Storage
+	backend Backend
+	Storage storage.OrderStore
+
+	encoding Encoding
+	compress bool
+
+	snapshotPath     string
+	snapshotInterval time.Duration
+	snapshotCipher   *pii.Cipher
+	stop             chan struct{}
+	done             chan struct{}
+
+	// feed — журнал изменений хранилища (nil — хранилище его не ведет);
+	// cursor — позиция в нем, до которой кэш согласован с БД; shared —
+	// общий backend, где позиция хранится для других процессов. syncMu
+	// упорядочивает Sync и полную загрузку, см. sync.go.
+	feed         storage.ChangeFeed
+	shared       Shared
+	cursorMu     sync.Mutex
+	cursor       string
+	syncMu       sync.Mutex
+	syncInterval time.Duration
+	syncStop     chan struct{}
+	syncDone     chan struct{}
+
+	// fillMu и gen — поколение кэша, см. fill.
+	fillMu sync.RWMutex
+	gen    uint64
+
+	counters       counters
+	warmUpMu       sync.Mutex
+	warmUpDuration time.Duration
+	warmedUpAt     time.Time
 }
 
-type cache struct {
-	mu     *sync.RWMutex
-	orders map[string]*model.Order
+// Option настраивает CachedStorage при создании.
+type Option func(*CachedStorage)
+
+// WithSnapshot включает снапшот кэша на диск: при старте кэш загружается
+// из path и досинхронизируется с БД по журналу storage.ChangeFeed, а затем
+// каждые interval перезаписывается. interval <= 0 отключает периодическую
+// запись (снапшот пишется только в Close). Для хранилища без журнала
+// снапшот не используется.
+func WithSnapshot(path string, interval time.Duration) Option {
+	return func(c *CachedStorage) {
+		c.snapshotPath = path
+		c.snapshotInterval = interval
+	}
 }
 
-func (c *cache) Get(uid string) (*model.Order, bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	order, ok := c.orders[uid]
-	return order, ok
+// WithSnapshotCipher шифрует файл снапшота ключами персональных данных:
+// в нем заказы целиком, в том числе доставки, записанные до включения
+// шифрования, и customer_id. Открытый снапшот, записанный раньше, читается
+// и сразу перезаписывается зашифрованным.
+func WithSnapshotCipher(c *pii.Cipher) Option {
+	return func(cs *CachedStorage) {
+		cs.snapshotCipher = c
+	}
 }
 
-func (c *cache) Add(order *model.Order) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.orders[order.OrderUID] = order
+// WithBackend задает место хранения кэша вместо Memory по умолчанию.
+func WithBackend(b Backend) Option {
+	return func(c *CachedStorage) {
+		c.backend = b
+	}
 }
 
 func (c *CachedStorage) CreateOrder(ctx context.Context, order *model.Order) error {
+	gen := c.generation()
 	err := c.Storage.CreateOrder(ctx, order)
 	if err != nil {
 		return err
 	}
-	c.cache.Add(order)
+	c.fill(ctx, order, gen)
 	return nil
 }
 
 func (c *CachedStorage) GetOrder(ctx context.Context, uid string) (*model.Order, error) {
-	order, ok := c.cache.Get(uid)
+	order, ok, err := c.backend.Get(ctx, uid)
+	if err != nil {
+		log.Println("cache get failed, fallback to db:", err)
+	}
 	if ok {
+		c.counters.hits.Add(1)
 		return order, nil
 	}
-	var err error
-	order, err = c.Storage.GetOrder(ctx, uid)
+	c.counters.misses.Add(1)
+	gen := c.generation()
+	order, err = c.Storage.GetOrder(storage.ReadPrimary(ctx), uid)
 	if err != nil {
 		return nil, err
 	}
-	c.cache.Add(order)
+	c.fill(ctx, order, gen) // кэш хранит копию, order остается у вызывающего
 	return order, nil
 }
 
-func New(ctx context.Context, store *storage.Storage) (*CachedStorage, error) {
-	cs := &CachedStorage{
-		cache: cache{
-			mu:     new(sync.RWMutex),
-			orders: make(map[string]*model.Order),
-		},
-		Storage: store,
+// GetOrderJSON возвращает готовый JSON-ответ для заказа; gzipped — тело сжато gzip.
+// Если кэш хранит только структуры, JSON кодируется на лету. Как и GetOrder,
+// отдает собственную копию: ее изменения не видны другим читателям.
+func (c *CachedStorage) GetOrderJSON(ctx context.Context, uid string) (body []byte, gzipped bool, err error) {
+	body, gzipped, ok, err := c.backend.GetJSON(ctx, uid)
+	if err != nil {
+		log.Println("cache get failed, fallback to db:", err)
+	}
+	if ok {
+		c.counters.hits.Add(1)
+		return body, gzipped, nil
+	}
+	c.counters.misses.Add(1)
+	gen := c.generation()
+	order, err := c.Storage.GetOrder(storage.ReadPrimary(ctx), uid)
+	if err != nil {
+		return nil, false, err
+	}
+	c.fill(ctx, order, gen)
+	body, err = encodeOrder(order, false)
+	return body, false, err
+}
+
+// ListOrders выполняется напрямую в БД: кэш не индексирован по фильтрам.
+func (c *CachedStorage) ListOrders(ctx context.Context, f storage.OrderFilter) (*storage.OrderPage, error) {
+	return c.Storage.ListOrders(ctx, f)
+}
+
+// FindOrders ищет по order_uid через кэш, по остальным полям — в БД.
+func (c *CachedStorage) FindOrders(ctx context.Context, field storage.LookupField, value string) ([]*model.Order, error) {
+	if field != storage.ByOrderUID {
+		return c.Storage.FindOrders(ctx, field, value)
+	}
+	order, err := c.GetOrder(ctx, value)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []*model.Order{order}, nil
+}
+
+// GetRawMessages читает архив исходных сообщений напрямую из хранилища:
+// он нужен редко и не кэшируется.
+func (c *CachedStorage) GetRawMessages(ctx context.Context, uid string) ([]*storage.RawMessage, error) {
+	rs, ok := c.Storage.(storage.RawStore)
+	if !ok {
+		return nil, fmt.Errorf("raw message archive: %w", errors.ErrUnsupported)
+	}
+	return rs.GetRawMessages(ctx, uid)
+}
+
+// GetIngestMeta читает метаданные получения заказа напрямую из хранилища.
+func (c *CachedStorage) GetIngestMeta(ctx context.Context, uid string) (*storage.IngestMeta, error) {
+	ms, ok := c.Storage.(storage.MetaStore)
+	if !ok {
+		return nil, fmt.Errorf("ingest metadata: %w", errors.ErrUnsupported)
+	}
+	return ms.GetIngestMeta(ctx, uid)
+}
+
+// DeleteOrder удаляет заказ в хранилище, вытесняет его из кэша и
+// перезаписывает снапшот. Кэши других процессов вытеснят заказ по журналу.
+func (c *CachedStorage) DeleteOrder(ctx context.Context, uid, actor string) error {
+	ds, ok := c.Storage.(storage.DeleteStore)
+	if !ok {
+		return fmt.Errorf("order deletion: %w", errors.ErrUnsupported)
+	}
+	if err := ds.DeleteOrder(ctx, uid, actor); err != nil {
+		return err
+	}
+	c.evict(ctx, uid)
+	c.scrubSnapshot()
+	return nil
+}
+
+// EraseOrderPII стирает персональные данные заказа в хранилище, вытесняет
+// заказ из кэша и перезаписывает снапшот: следующее чтение возьмет из БД
+// уже стертую копию, а в файле снапшота не останется прежней.
+func (c *CachedStorage) EraseOrderPII(ctx context.Context, uid, actor string) error {
+	ds, ok := c.Storage.(storage.DeleteStore)
+	if !ok {
+		return fmt.Errorf("order deletion: %w", errors.ErrUnsupported)
+	}
+	if err := ds.EraseOrderPII(ctx, uid, actor); err != nil {
+		return err
+	}
+	c.evict(ctx, uid)
+	c.scrubSnapshot()
+	return nil
+}
+
+// AuditLog читает журнал удалений заказа напрямую из хранилища.
+func (c *CachedStorage) AuditLog(ctx context.Context, uid string) ([]*storage.AuditRecord, error) {
+	ds, ok := c.Storage.(storage.DeleteStore)
+	if !ok {
+		return nil, fmt.Errorf("order deletion: %w", errors.ErrUnsupported)
 	}
+	return ds.AuditLog(ctx, uid)
+}
 
-	orders, err := cs.Storage.GetAllOrders(ctx)
+// UpdateOrder исправляет заказ в хранилище и вытесняет его из кэша:
+// следующее чтение возьмет из БД исправленную копию.
+func (c *CachedStorage) UpdateOrder(ctx context.Context, order *model.Order, actor, reason string) (*storage.OrderRevision, error) {
+	hs, ok := c.Storage.(storage.HistoryStore)
+	if !ok {
+		return nil, fmt.Errorf("order history: %w", errors.ErrUnsupported)
+	}
+	rev, err := hs.UpdateOrder(ctx, order, actor, reason)
 	if err != nil {
 		return nil, err
 	}
-	for i := 0; i < len(orders); i++ {
-		cs.cache.orders[orders[i].OrderUID] = orders[i]
+	if rev != nil {
+		c.evict(ctx, order.OrderUID)
+	}
+	return rev, nil
+}
+
+// OrderHistory читает историю исправлений заказа напрямую из хранилища.
+func (c *CachedStorage) OrderHistory(ctx context.Context, uid string) ([]*storage.OrderRevision, error) {
+	hs, ok := c.Storage.(storage.HistoryStore)
+	if !ok {
+		return nil, fmt.Errorf("order history: %w", errors.ErrUnsupported)
+	}
+	return hs.OrderHistory(ctx, uid)
+}
+
+// CreateRefund сохраняет возврат в хранилище. Заказ в кэше возвратов
+// не содержит и не вытесняется.
+func (c *CachedStorage) CreateRefund(ctx context.Context, refund *model.Refund) (*model.Refund, error) {
+	rs, ok := c.Storage.(storage.RefundStore)
+	if !ok {
+		return nil, fmt.Errorf("refunds: %w", errors.ErrUnsupported)
+	}
+	return rs.CreateRefund(ctx, refund)
+}
+
+// Refunds читает возвраты заказа напрямую из хранилища.
+func (c *CachedStorage) Refunds(ctx context.Context, uid string) (*storage.RefundSummary, error) {
+	rs, ok := c.Storage.(storage.RefundStore)
+	if !ok {
+		return nil, fmt.Errorf("refunds: %w", errors.ErrUnsupported)
+	}
+	return rs.Refunds(ctx, uid)
+}
+
+// ItemStatusHistory читает смены статусов товаров напрямую из хранилища.
+func (c *CachedStorage) ItemStatusHistory(ctx context.Context, uid string) ([]*storage.ItemStatusChange, error) {
+	is, ok := c.Storage.(storage.ItemStatusStore)
+	if !ok {
+		return nil, fmt.Errorf("item status history: %w", errors.ErrUnsupported)
+	}
+	return is.ItemStatusHistory(ctx, uid)
+}
+
+// OrderStatus читает статус заказа напрямую из хранилища: он не кэшируется.
+func (c *CachedStorage) OrderStatus(ctx context.Context, uid string) (*storage.StatusReport, error) {
+	ss, ok := c.Storage.(storage.StatusStore)
+	if !ok {
+		return nil, fmt.Errorf("order status: %w", errors.ErrUnsupported)
+	}
+	return ss.OrderStatus(ctx, uid)
+}
+
+// TransitionOrder меняет статус заказа в хранилище. Заказ в кэше
+// статуса не содержит и не вытесняется.
+func (c *CachedStorage) TransitionOrder(ctx context.Context, uid string, to model.OrderStatus, actor, reason string) (*storage.StatusChange, error) {
+	ss, ok := c.Storage.(storage.StatusStore)
+	if !ok {
+		return nil, fmt.Errorf("order status: %w", errors.ErrUnsupported)
+	}
+	return ss.TransitionOrder(ctx, uid, to, actor, reason)
+}
+
+// evict вытесняет заказ после изменения в БД. Ошибка только пишется в лог:
+// изменение уже выполнено.
+func (c *CachedStorage) evict(ctx context.Context, uid string) {
+	if _, err := c.Evict(ctx, uid); err != nil {
+		log.Println("fail to evict order from cache:", err)
+	}
+}
+
+// scrubSnapshot перезаписывает снапшот без вытесненного заказа. Ошибка
+// только пишется в лог: изменение уже выполнено, а снапшот перезапишет
+// Sync или следующая периодическая запись.
+func (c *CachedStorage) scrubSnapshot() {
+	if err := c.rewriteSnapshot(true); err != nil {
+		log.Println("fail to rewrite cache snapshot:", err)
+	}
+}
+
+func (c *CachedStorage) set(ctx context.Context, order *model.Order) {
+	if err := c.backend.Set(ctx, order); err != nil {
+		log.Println("fail to put order in cache:", err)
+	}
+}
+
+func New(ctx context.Context, store storage.OrderStore, opts ...Option) (*CachedStorage, error) {
+	cs := &CachedStorage{
+		Storage:      store,
+		syncInterval: defaultSyncInterval,
+	}
+	cs.feed, _ = store.(storage.ChangeFeed)
+	for _, opt := range opts {
+		opt(cs)
+	}
+	if cs.snapshotPath != "" && cs.feed == nil {
+		log.Println("cache snapshot disabled: store has no change feed to reconcile it")
+		cs.snapshotPath = ""
+	}
+	if cs.backend == nil {
+		cs.backend = NewMemory(cs.encoding, cs.compress)
+	}
+	if cs.feed != nil {
+		cs.shared = sharedOf(cs.backend)
+	}
+	if cs.snapshotPath != "" && cs.shared != nil {
+		log.Println("cache snapshot disabled: shared backend is reconciled through the change feed")
+		cs.snapshotPath = ""
+	}
+
+	start := time.Now()
+	if err := cs.warmUp(ctx); err != nil {
+		return nil, err
+	}
+	cs.setWarmUp(start)
+
+	if cs.snapshotPath != "" && cs.snapshotInterval > 0 {
+		cs.stop = make(chan struct{})
+		cs.done = make(chan struct{})
+		go cs.snapshotLoop()
+	}
+	if cs.feed != nil && cs.syncInterval > 0 {
+		cs.syncStop = make(chan struct{})
+		cs.syncDone = make(chan struct{})
+		go cs.syncLoop()
 	}
 	return cs, nil
 }
+
+// warmUp заполняет кэш: общий backend досинхронизируется по журналу
+// изменений, локальный загружается из снапшота, досинхронизированного так
+// же, либо (нет снапшота, он поврежден или устарел) полностью из БД.
+// Чтение идет в primary: реплика может отставать от курсора журнала.
+func (c *CachedStorage) warmUp(ctx context.Context) error {
+	ctx = storage.ReadPrimary(ctx)
+	if c.shared != nil {
+		return c.join(ctx)
+	}
+	if c.snapshotPath != "" {
+		err := c.loadSnapshot(ctx)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Println("cache snapshot ignored, fallback to full load:", err)
+		}
+	}
+	return c.load(ctx)
+}
+
+// join подключает процесс к общему кэшу: его содержимое вытесняется по
+// журналу с позиции, записанной в backend. Целиком из БД (атомарной
+// заменой) общий кэш загружается, только если позиции нет или журнал ее
+// уже не покрывает.
+func (c *CachedStorage) join(ctx context.Context) error {
+	cursor, err := c.shared.ChangeCursor(ctx)
+	if err != nil {
+		return err
+	}
+	if cursor == "" {
+		return c.load(ctx)
+	}
+	c.setCursor(cursor)
+	n, err := c.Sync(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("joined shared cache: %d changes since its cursor applied", n)
+	return nil
+}
+
+// load перечитывает все заказы из БД. Курсор журнала берется до чтения:
+// изменения, зафиксированные во время него, будут прочитаны еще раз.
+func (c *CachedStorage) load(ctx context.Context) error {
+	c.syncMu.Lock()
+	defer c.syncMu.Unlock()
+	return c.loadLocked(ctx)
+}
+
+// loadLocked — load под c.syncMu.
+func (c *CachedStorage) loadLocked(ctx context.Context) error {
+	var cursor string
+	if c.feed != nil {
+		var err error
+		if cursor, err = c.feed.ChangeCursor(ctx); err != nil {
+			return err
+		}
+	}
+	orders, err := c.Storage.GetAllOrders(ctx)
+	if err != nil {
+		return err
+	}
+	c.nextGeneration()
+	if _, err := c.backend.Replace(ctx, orders); err != nil {
+		return err
+	}
+	c.advance(ctx, cursor)
+	return nil
+}
+
+// loadSnapshot загружает снапшот, заменяя заказы, измененные после его
+// курсора, текущими копиями из БД: исправленные перечитываются, удаленные,
+// очищенные и убранные retention выбрасываются, а полученные позже
+// (в том числе с давним date_created) добавляются.
+func (c *CachedStorage) loadSnapshot(ctx context.Context) error {
+	s, err := readSnapshot(c.snapshotPath, c.snapshotCipher)
+	if err != nil {
+		return err
+	}
+	changed, cursor, err := c.changedSince(ctx, s.Cursor, maxReplay)
+	if err != nil {
+		return err
+	}
+	orders := slices.DeleteFunc(s.Orders, func(o *model.Order) bool {
+		_, ok := changed[o.OrderUID]
+		return ok
+	})
+	kept := len(orders)
+	for uid := range changed {
+		order, err := c.Storage.GetOrder(ctx, uid)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		orders = append(orders, order)
+	}
+	c.nextGeneration()
+	if _, err := c.backend.Replace(ctx, orders); err != nil {
+		return err
+	}
+	c.setCursor(cursor)
+	log.Printf("cache loaded from snapshot: %d orders, %d changed since it re-read from db",
+		kept, len(changed))
+	if c.snapshotCipher != nil && !s.sealed {
+		// открытые персональные данные не остаются на диске до следующей записи
+		return c.SaveSnapshot()
+	}
+	return nil
+}
+
+// changedSince возвращает заказы, измененные после cursor, и курсор конца
+// журнала. Больше limit заказов — ошибка: быстрее перечитать все.
+func (c *CachedStorage) changedSince(ctx context.Context, cursor string, limit int) (map[string]struct{}, string, error) {
+	changed := make(map[string]struct{})
+	for {
+		changes, next, err := c.feed.ChangesSince(ctx, cursor, 0)
+		if err != nil {
+			return nil, "", err
+		}
+		cursor = next
+		if len(changes) == 0 {
+			return changed, cursor, nil
+		}
+		for _, ch := range changes {
+			changed[ch.OrderUID] = struct{}{}
+		}
+		if len(changed) > limit {
+			return nil, "", fmt.Errorf("more than %d orders changed since snapshot", limit)
+		}
+	}
+}
+
+// advance сдвигает позицию кэша в журнале после того, как изменения до нее
+// вытеснены, и записывает ее в общий backend. Ошибка записи только пишется
+// в лог: устаревшая позиция приведет лишь к лишнему чтению журнала.
+func (c *CachedStorage) advance(ctx context.Context, cursor string) {
+	c.setCursor(cursor)
+	if c.shared == nil || cursor == "" {
+		return
+	}
+	if err := c.shared.SetChangeCursor(ctx, cursor); err != nil {
+		log.Println("fail to store change cursor in shared cache:", err)
+	}
+}
+
+func (c *CachedStorage) setCursor(cursor string) {
+	c.cursorMu.Lock()
+	defer c.cursorMu.Unlock()
+	c.cursor = cursor
+}
+
+func (c *CachedStorage) changeCursor() string {
+	c.cursorMu.Lock()
+	defer c.cursorMu.Unlock()
+	return c.cursor
+}
+
+// SaveSnapshot записывает текущее содержимое кэша в файл снапшота.
+func (c *CachedStorage) SaveSnapshot() error {
+	if c.snapshotPath == "" {
+		return nil
+	}
+	// курсор берется до чтения: изменения после него досинхронизирует загрузка
+	cursor := c.changeCursor()
+	orders, err := c.backend.All(context.Background())
+	if err != nil {
+		return err
+	}
+	return writeSnapshot(c.snapshotPath, &snapshot{Cursor: cursor, Orders: orders}, c.snapshotCipher)
+}
+
+func (c *CachedStorage) snapshotLoop() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.snapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.SaveSnapshot(); err != nil {
+				log.Println("fail to save cache snapshot:", err)
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Close останавливает синхронизацию и периодическую запись и сохраняет
+// финальный снапшот.
+func (c *CachedStorage) Close() error {
+	if c.syncStop != nil {
+		close(c.syncStop)
+		<-c.syncDone
+	}
+	if c.stop != nil {
+		close(c.stop)
+		<-c.done
+	}
+	return c.SaveSnapshot()
+}
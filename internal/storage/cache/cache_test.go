@@ -0,0 +1,194 @@
+package cache_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/dws33/WB_ZeroProj/internal/model"
+	"github.com/dws33/WB_ZeroProj/internal/storage"
+	"github.com/dws33/WB_ZeroProj/internal/storage/cache"
+	"github.com/dws33/WB_ZeroProj/internal/storage/storagetest"
+)
+
+// backends — варианты кэша, на которых проверяются копии и гонки
+// (тесты рассчитаны на запуск с -race).
+var backends = []struct {
+	name string
+	opts func() []cache.Option
+}{
+	{"memory", func() []cache.Option { return nil }},
+	{"alongside", func() []cache.Option {
+		return []cache.Option{cache.WithEncodedJSON(cache.EncodeAlongside, false)}
+	}},
+	{"only-gzip", func() []cache.Option {
+		return []cache.Option{cache.WithBackend(cache.NewMemory(cache.EncodeOnly, true))}
+	}},
+	{"tiered", func() []cache.Option {
+		return []cache.Option{cache.WithBackend(cache.NewTiered(
+			cache.NewMemory(cache.EncodeAlongside, false),
+			cache.NewMemory(cache.EncodeOnly, true),
+		))}
+	}},
+}
+
+func newCache(t *testing.T, store storage.OrderStore, opts ...cache.Option) *cache.CachedStorage {
+	t.Helper()
+	c, err := cache.New(context.Background(), store, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func orderJSON(t *testing.T, c *cache.CachedStorage, uid string) []byte {
+	t.Helper()
+	body, gzipped, err := c.GetOrderJSON(context.Background(), uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gzipped {
+		if body, err = cache.Gunzip(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return body
+}
+
+// TestCopies проверяет, что изменения полученного заказа и тела
+// JSON-ответа не видны следующим читателям.
+func TestCopies(t *testing.T) {
+	ctx := context.Background()
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			store := storage.NewMemoryStore()
+			if err := store.CreateOrder(ctx, storagetest.NewOrder("a", 0)); err != nil {
+				t.Fatal(err)
+			}
+			c := newCache(t, store, b.opts()...)
+			want := orderJSON(t, c, "a")
+
+			order, err := c.GetOrder(ctx, "a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			order.Delivery.Name = "changed"
+			order.Items[0].Price = -1
+
+			body, _, err := c.GetOrderJSON(ctx, "a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			clear(body)
+
+			if got := orderJSON(t, c, "a"); !bytes.Equal(got, want) {
+				t.Errorf("cached JSON changed by caller:\n got %s\nwant %s", got, want)
+			}
+			got, err := c.GetOrder(ctx, "a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotJSON, _ := json.Marshal(got); !bytes.Equal(append(gotJSON, '\n'), want) {
+				t.Errorf("cached order changed by caller: %s", gotJSON)
+			}
+		})
+	}
+}
+
+// TestConcurrentAccess нагружает кэш параллельными чтениями с изменением
+// полученных копий, записями, исправлениями, вытеснением, перезагрузкой
+// и снапшотом; гонки ловит -race.
+func TestConcurrentAccess(t *testing.T) {
+	const (
+		orders  = 20
+		workers = 8
+		rounds  = 20
+	)
+	ctx := context.Background()
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			store := storage.NewMemoryStore()
+			for i := range orders {
+				if err := store.CreateOrder(ctx, storagetest.NewOrder(fmt.Sprint("o", i), i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			opts := append(b.opts(), cache.WithSnapshot(filepath.Join(t.TempDir(), "cache.snap"), 0))
+			c := newCache(t, store, opts...)
+
+			var wg sync.WaitGroup
+			run := func(fn func(w, i int) error) {
+				for w := range workers {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for i := range rounds {
+							if err := fn(w, i); err != nil {
+								t.Error(err)
+								return
+							}
+						}
+					}()
+				}
+			}
+
+			run(func(w, i int) error {
+				order, err := c.GetOrder(ctx, fmt.Sprint("o", (w+i)%orders))
+				if err != nil {
+					return err
+				}
+				order.Delivery.City = "changed"
+				order.Items = append(order.Items, &model.Item{})
+				return nil
+			})
+			run(func(w, i int) error {
+				body, _, err := c.GetOrderJSON(ctx, fmt.Sprint("o", (w+i)%orders))
+				clear(body)
+				return err
+			})
+			run(func(w, i int) error {
+				return c.CreateOrder(ctx, storagetest.NewOrder(fmt.Sprintf("n%d-%d", w, i), orders+i))
+			})
+			run(func(w, i int) error {
+				order := storagetest.NewOrder(fmt.Sprint("o", w), w)
+				order.Items[0].Status = 300 + i
+				_, err := c.UpdateOrder(ctx, order, "test", "race")
+				return err
+			})
+			run(func(w, i int) error {
+				_, err := c.Evict(ctx, fmt.Sprint("o", (w*i)%orders))
+				return err
+			})
+			run(func(w, i int) error {
+				// перезагрузка перекодирует все заказы, поэтому редкая
+				switch {
+				case w == 0 && i%10 == 0:
+					return c.Reload(ctx)
+				case w == 1 && i%10 == 5:
+					return c.SaveSnapshot()
+				}
+				_, err := c.Stats(ctx)
+				return err
+			})
+			wg.Wait()
+
+			for w := range workers {
+				uid := fmt.Sprint("o", w)
+				got, err := c.GetOrder(ctx, uid)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.Delivery.City == "changed" || len(got.Items) != 1 {
+					t.Errorf("order %s: caller changes leaked into cache", uid)
+				}
+			}
+			if err := c.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/dws33/WB_ZeroProj/internal/model"
+)
+
+// Encoding — что хранит кэш для каждого заказа.
+type Encoding int
+
+const (
+	// EncodeNone — только *model.Order (по умолчанию).
+	EncodeNone Encoding = iota
+	// EncodeAlongside — *model.Order и готовый JSON-ответ.
+	EncodeAlongside
+	// EncodeOnly — только JSON-ответ; структура декодируется при каждом GetOrder.
+	EncodeOnly
+)
+
+// WithEncodedJSON включает хранение канонического JSON-ответа в кэше,
+// compress — хранить его сжатым gzip. Действует на Memory по умолчанию;
+// backend, переданный через WithBackend, настраивается при создании.
+func WithEncodedJSON(mode Encoding, compress bool) Option {
+	return func(c *CachedStorage) {
+		c.encoding = mode
+		c.compress = compress
+	}
+}
+
+// entry — запись кэша. В зависимости от Encoding заполнены order, body или оба.
+type entry struct {
+	order   *model.Order
+	body    []byte
+	gzipped bool
+	size    int64
+}
+
+// encodeOrder возвращает канонический JSON заказа — тот же,
+// что выдает json.Encoder (с завершающим переводом строки).
+func encodeOrder(order *model.Order, compress bool) ([]byte, error) {
+	body, err := json.Marshal(order)
+	if err != nil {
+		return nil, err
+	}
+	body = append(body, '\n')
+	if !compress {
+		return body, nil
+	}
+
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Gunzip распаковывает тело, сжатое кэшем (GetOrderJSON с gzipped),
+// для клиента, не принимающего gzip.
+func Gunzip(body []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// decode возвращает заказ, который вызывающий может свободно изменять:
+// копию хранимой структуры либо заново декодированный JSON.
+func (e *entry) decode() (*model.Order, error) {
+	if e.order != nil {
+		return e.order.Clone(), nil
+	}
+	body := e.body
+	if e.gzipped {
+		var err error
+		body, err = Gunzip(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	order := new(model.Order)
+	if err := json.Unmarshal(body, order); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// ParseEncoding разбирает значение из конфигурации: "", "none", "alongside", "only".
+func ParseEncoding(s string) (Encoding, error) {
+	switch s {
+	case "", "none":
+		return EncodeNone, nil
+	case "alongside":
+		return EncodeAlongside, nil
+	case "only":
+		return EncodeOnly, nil
+	}
+	return EncodeNone, fmt.Errorf("unknown cache encoding %q", s)
+}
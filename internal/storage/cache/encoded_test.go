@@ -0,0 +1,97 @@
+package cache_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/dws33/WB_ZeroProj/internal/model"
+	"github.com/dws33/WB_ZeroProj/internal/storage"
+	"github.com/dws33/WB_ZeroProj/internal/storage/cache"
+	"github.com/dws33/WB_ZeroProj/internal/storage/storagetest"
+)
+
+// benchOrder — заказ с items товарами: размер ответа растет вместе с ними.
+func benchOrder(items int) *model.Order {
+	order := storagetest.NewOrder("bench", 0)
+	item := order.Items[0]
+	order.Items = make([]*model.Item, items)
+	for i := range order.Items {
+		it := *item
+		it.RID = fmt.Sprintf("rid-bench-%d", i)
+		order.Items[i] = &it
+	}
+	return order
+}
+
+func newBenchCache(b *testing.B, order *model.Order, opts ...cache.Option) *cache.CachedStorage {
+	b.Helper()
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	if err := store.CreateOrder(ctx, order); err != nil {
+		b.Fatal(err)
+	}
+	c, err := cache.New(ctx, store, opts...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return c
+}
+
+// BenchmarkGetOrder сравнивает ответ на GET /order/{order_uid}: кодирование
+// структуры при каждом запросе (как handler без WithEncodedJSON) и готовый
+// JSON из кэша, в том числе сжатый — с распаковкой для клиента без gzip и
+// без нее.
+func BenchmarkGetOrder(b *testing.B) {
+	ctx := context.Background()
+	for _, items := range []int{1, 50} {
+		order := benchOrder(items)
+
+		b.Run(fmt.Sprintf("items=%d/encode", items), func(b *testing.B) {
+			c := newBenchCache(b, order)
+			b.ReportAllocs()
+			for range b.N {
+				o, err := c.GetOrder(ctx, order.OrderUID)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := json.NewEncoder(io.Discard).Encode(o); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		for _, tc := range []struct {
+			name     string
+			mode     cache.Encoding
+			compress bool
+			gunzip   bool
+		}{
+			{"alongside", cache.EncodeAlongside, false, false},
+			{"only", cache.EncodeOnly, false, false},
+			{"gzip", cache.EncodeOnly, true, false},
+			{"gzip+gunzip", cache.EncodeOnly, true, true},
+		} {
+			b.Run(fmt.Sprintf("items=%d/pre-encoded/%s", items, tc.name), func(b *testing.B) {
+				c := newBenchCache(b, order, cache.WithEncodedJSON(tc.mode, tc.compress))
+				b.ReportAllocs()
+				for range b.N {
+					body, gzipped, err := c.GetOrderJSON(ctx, order.OrderUID)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if gzipped && tc.gunzip {
+						if body, err = cache.Gunzip(body); err != nil {
+							b.Fatal(err)
+						}
+					}
+					if _, err := io.Discard.Write(body); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
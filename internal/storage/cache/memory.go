@@ -0,0 +1,143 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"sync"
+
+	"github.com/dws33/WB_ZeroProj/internal/model"
+)
+
+// Memory — кэш заказов в карте внутри процесса.
+// Хранит собственные копии заказов, см. CachedStorage.
+type Memory struct {
+	mu     sync.RWMutex
+	orders map[string]*entry
+	bytes  int64 // примерный объем записей, см. entry.approxSize
+
+	encoding Encoding
+	compress bool
+}
+
+// NewMemory создает пустой кэш в памяти; mode и compress — см. WithEncodedJSON.
+func NewMemory(mode Encoding, compress bool) *Memory {
+	return &Memory{
+		orders:   make(map[string]*entry),
+		encoding: mode,
+		compress: compress,
+	}
+}
+
+func (m *Memory) get(uid string) (*entry, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	e, ok := m.orders[uid]
+	return e, ok
+}
+
+func (m *Memory) Get(_ context.Context, uid string) (*model.Order, bool, error) {
+	e, ok := m.get(uid)
+	if !ok {
+		return nil, false, nil
+	}
+	order, err := e.decode()
+	return order, err == nil, err
+}
+
+// GetJSON отдает копию хранимого тела: тело записи общее для всех
+// читателей. Если хранится только структура, JSON кодируется на лету.
+func (m *Memory) GetJSON(_ context.Context, uid string) ([]byte, bool, bool, error) {
+	e, ok := m.get(uid)
+	if !ok {
+		return nil, false, false, nil
+	}
+	if e.body != nil {
+		return bytes.Clone(e.body), e.gzipped, true, nil
+	}
+	body, err := encodeOrder(e.order, false)
+	return body, false, err == nil, err
+}
+
+// Set сохраняет копию заказа.
+func (m *Memory) Set(_ context.Context, order *model.Order) error {
+	e := m.newEntry(order.Clone())
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if old, ok := m.orders[order.OrderUID]; ok {
+		m.bytes -= old.size
+	}
+	m.orders[order.OrderUID] = e
+	m.bytes += e.size
+	return nil
+}
+
+func (m *Memory) Delete(_ context.Context, uid string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.orders[uid]
+	if !ok {
+		return false, nil
+	}
+	delete(m.orders, uid)
+	m.bytes -= e.size
+	return true, nil
+}
+
+// Replace готовит новые записи до захвата блокировки, читатели не простаивают.
+func (m *Memory) Replace(_ context.Context, orders []*model.Order) (int, error) {
+	fresh := make(map[string]*entry, len(orders))
+	var bytes int64
+	for _, order := range orders {
+		e := m.newEntry(order.Clone())
+		if old, ok := fresh[order.OrderUID]; ok {
+			bytes -= old.size
+		}
+		fresh[order.OrderUID] = e
+		bytes += e.size
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := len(m.orders)
+	m.orders, m.bytes = fresh, bytes
+	return n, nil
+}
+
+// All возвращает все заказы кэша (порядок не определен).
+func (m *Memory) All(_ context.Context) ([]*model.Order, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	orders := make([]*model.Order, 0, len(m.orders))
+	for _, e := range m.orders {
+		order, err := e.decode()
+		if err != nil {
+			log.Println("fail to decode cached order:", err)
+			continue
+		}
+		orders = append(orders, order)
+	}
+	return orders, nil
+}
+
+func (m *Memory) Size(_ context.Context) (int, int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.orders), m.bytes, nil
+}
+
+func (m *Memory) newEntry(order *model.Order) *entry {
+	e := &entry{order: order}
+	if m.encoding != EncodeNone {
+		body, err := encodeOrder(order, m.compress)
+		if err != nil {
+			log.Println("fail to encode order for cache, keep struct only:", err)
+		} else {
+			e.body, e.gzipped = body, m.compress
+			if m.encoding == EncodeOnly {
+				e.order = nil
+			}
+		}
+	}
+	e.size = e.approxSize()
+	return e
+}
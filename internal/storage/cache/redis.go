@@ -0,0 +1,289 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/dws33/WB_ZeroProj/internal/model"
+)
+
+// Redis — общий кэш на сервере с протоколом RESP (Redis, KeyDB, respserver).
+// Заказ хранится как канонический JSON (опционально gzip) под ключом
+// <prefix>order:<uid>, множество <prefix>orders содержит все uid,
+// а <prefix>cursor — позицию журнала изменений, см. Shared.
+// Сжатие определяется при чтении по сигнатуре gzip, поэтому процессы
+// с разной настройкой compress могут разделять один кэш.
+type Redis struct {
+	client   *respClient
+	prefix   string
+	compress bool
+}
+
+const (
+	mgetBatch      = 500  // ключей в одном MGET в All
+	pipelineBatch  = 1000 // команд в одной порции конвейера
+	replaceRetries = 10   // попыток Replace, если индекс менялся параллельно
+)
+
+// errWatchFailed — транзакция не выполнена: ключ под WATCH изменился.
+var errWatchFailed = errors.New("resp: watched key changed, transaction aborted")
+
+// NewRedis создает backend поверх сервера addr (host:port).
+func NewRedis(addr, prefix string, compress bool) *Redis {
+	return &Redis{
+		client:   newRespClient(addr, 16),
+		prefix:   prefix,
+		compress: compress,
+	}
+}
+
+// Ping проверяет доступность сервера.
+func (r *Redis) Ping(ctx context.Context) error {
+	_, err := r.client.do(ctx, "PING")
+	return err
+}
+
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
+
+func (r *Redis) key(uid string) string { return r.prefix + "order:" + uid }
+func (r *Redis) index() string         { return r.prefix + "orders" }
+func (r *Redis) cursorKey() string     { return r.prefix + "cursor" }
+
+// ChangeCursor возвращает позицию журнала изменений, до которой общий кэш
+// согласован с БД; "" — позиция не записана.
+func (r *Redis) ChangeCursor(ctx context.Context) (string, error) {
+	reply, err := r.client.do(ctx, "GET", r.cursorKey())
+	if err != nil {
+		return "", err
+	}
+	b, _ := reply.([]byte)
+	return string(b), nil
+}
+
+func (r *Redis) SetChangeCursor(ctx context.Context, cursor string) error {
+	_, err := r.client.do(ctx, "SET", r.cursorKey(), cursor)
+	return err
+}
+
+func (r *Redis) GetJSON(ctx context.Context, uid string) ([]byte, bool, bool, error) {
+	reply, err := r.client.do(ctx, "GET", r.key(uid))
+	if err != nil {
+		return nil, false, false, err
+	}
+	body, _ := reply.([]byte)
+	if body == nil {
+		return nil, false, false, nil
+	}
+	return body, isGzip(body), true, nil
+}
+
+func (r *Redis) Get(ctx context.Context, uid string) (*model.Order, bool, error) {
+	body, _, ok, err := r.GetJSON(ctx, uid)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	order, err := r.decode(body)
+	return order, err == nil, err
+}
+
+// isGzip проверяет сигнатуру gzip; JSON не может начинаться с 0x1f.
+func isGzip(body []byte) bool {
+	return len(body) >= 2 && body[0] == 0x1f && body[1] == 0x8b
+}
+
+func (r *Redis) decode(body []byte) (*model.Order, error) {
+	if isGzip(body) {
+		var err error
+		if body, err = Gunzip(body); err != nil {
+			return nil, err
+		}
+	}
+	order := new(model.Order)
+	if err := json.Unmarshal(body, order); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+func (r *Redis) Set(ctx context.Context, order *model.Order) error {
+	body, err := encodeOrder(order, r.compress)
+	if err != nil {
+		return err
+	}
+	return r.exec(ctx, [][]any{
+		{"SET", r.key(order.OrderUID), body},
+		{"SADD", r.index(), order.OrderUID},
+	})
+}
+
+func (r *Redis) Delete(ctx context.Context, uid string) (bool, error) {
+	replies, err := r.client.pipeline(ctx, [][]any{
+		{"DEL", r.key(uid)},
+		{"SREM", r.index(), uid},
+	})
+	if err != nil {
+		return false, err
+	}
+	if err := firstError(replies); err != nil {
+		return false, err
+	}
+	n, _ := replies[0].(int64)
+	return n > 0, nil
+}
+
+// Replace атомарна: старые записи удаляются и новые пишутся одной
+// транзакцией MULTI/EXEC, и читатели других процессов видят либо прежнее
+// содержимое, либо новое. Индекс берется под WATCH; если другой процесс
+// изменил его до EXEC, замена повторяется. Пока транзакция выполняется,
+// сервер не отвечает другим клиентам.
+func (r *Redis) Replace(ctx context.Context, orders []*model.Order) (int, error) {
+	cmds := make([][]any, 0, 2*len(orders))
+	for _, order := range orders {
+		body, err := encodeOrder(order, r.compress)
+		if err != nil {
+			return 0, err
+		}
+		cmds = append(cmds,
+			[]any{"SET", r.key(order.OrderUID), body},
+			[]any{"SADD", r.index(), order.OrderUID})
+	}
+	for range replaceRetries {
+		n, err := r.replace(ctx, cmds)
+		if !errors.Is(err, errWatchFailed) {
+			return n, err
+		}
+	}
+	return 0, errWatchFailed
+}
+
+func (r *Redis) replace(ctx context.Context, cmds [][]any) (int, error) {
+	var n int
+	err := r.client.withConn(ctx, func(cn *respConn) error {
+		replies, err := cn.pipeline([][]any{{"WATCH", r.index()}, {"SMEMBERS", r.index()}})
+		if err != nil {
+			return err
+		}
+		if err := firstError(replies); err != nil {
+			return err
+		}
+		old, err := members(replies[1])
+		if err != nil {
+			return err
+		}
+
+		tx := make([][]any, 0, len(old)+len(cmds)+3)
+		tx = append(tx, []any{"MULTI"})
+		for _, uid := range old {
+			tx = append(tx, []any{"DEL", r.key(uid)})
+		}
+		tx = append(tx, []any{"DEL", r.index()})
+		tx = append(tx, cmds...)
+		tx = append(tx, []any{"EXEC"})
+		if replies, err = cn.pipeline(tx); err != nil {
+			return err
+		}
+		if err := firstError(replies); err != nil {
+			return err
+		}
+		results, _ := replies[len(replies)-1].([]any)
+		if results == nil {
+			return errWatchFailed
+		}
+		if err := firstError(results); err != nil {
+			return err
+		}
+		n = len(old)
+		return nil
+	})
+	return n, err
+}
+
+func (r *Redis) All(ctx context.Context) ([]*model.Order, error) {
+	uids, err := r.members(ctx)
+	if err != nil {
+		return nil, err
+	}
+	orders := make([]*model.Order, 0, len(uids))
+	for start := 0; start < len(uids); start += mgetBatch {
+		end := min(start+mgetBatch, len(uids))
+		args := []any{"MGET"}
+		for _, uid := range uids[start:end] {
+			args = append(args, r.key(uid))
+		}
+		reply, err := r.client.do(ctx, args...)
+		if err != nil {
+			return nil, err
+		}
+		values, _ := reply.([]any)
+		for _, v := range values {
+			body, _ := v.([]byte)
+			if body == nil {
+				continue // удален между SMEMBERS и MGET
+			}
+			order, err := r.decode(body)
+			if err != nil {
+				return nil, err
+			}
+			orders = append(orders, order)
+		}
+	}
+	return orders, nil
+}
+
+// Size возвращает число записей; объем в байтах неизвестен (-1).
+func (r *Redis) Size(ctx context.Context) (int, int64, error) {
+	reply, err := r.client.do(ctx, "SCARD", r.index())
+	if err != nil {
+		return 0, -1, err
+	}
+	n, _ := reply.(int64)
+	return int(n), -1, nil
+}
+
+func (r *Redis) members(ctx context.Context) ([]string, error) {
+	reply, err := r.client.do(ctx, "SMEMBERS", r.index())
+	if err != nil {
+		return nil, err
+	}
+	return members(reply)
+}
+
+func members(reply any) ([]string, error) {
+	arr, _ := reply.([]any)
+	uids := make([]string, 0, len(arr))
+	for _, v := range arr {
+		b, ok := v.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("resp: unexpected SMEMBERS element %T", v)
+		}
+		uids = append(uids, string(b))
+	}
+	return uids, nil
+}
+
+// exec выполняет команды конвейером порциями по pipelineBatch.
+func (r *Redis) exec(ctx context.Context, cmds [][]any) error {
+	for start := 0; start < len(cmds); start += pipelineBatch {
+		replies, err := r.client.pipeline(ctx, cmds[start:min(start+pipelineBatch, len(cmds))])
+		if err != nil {
+			return err
+		}
+		if err := firstError(replies); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func firstError(replies []any) error {
+	for _, reply := range replies {
+		if err, ok := reply.(RespError); ok {
+			return err
+		}
+	}
+	return nil
+}
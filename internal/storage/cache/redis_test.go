@@ -0,0 +1,233 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dws33/WB_ZeroProj/internal/model"
+	"github.com/dws33/WB_ZeroProj/internal/storage"
+	"github.com/dws33/WB_ZeroProj/internal/storage/cache"
+	"github.com/dws33/WB_ZeroProj/internal/storage/cache/respserver"
+	"github.com/dws33/WB_ZeroProj/internal/storage/storagetest"
+)
+
+// newRedis запускает respserver и возвращает адрес.
+func newRedis(t *testing.T) string {
+	t.Helper()
+	srv := respserver.New()
+	addr, err := srv.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return addr
+}
+
+func redisBackend(t *testing.T, addr string, compress bool) *cache.Redis {
+	t.Helper()
+	r := cache.NewRedis(addr, "test:", compress)
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+func TestRedis(t *testing.T) {
+	ctx := context.Background()
+	addr := newRedis(t)
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprint("compress=", compress), func(t *testing.T) {
+			r := redisBackend(t, addr, compress)
+			if _, err := r.Replace(ctx, nil); err != nil {
+				t.Fatal(err)
+			}
+			order := storagetest.NewOrder("a", 0)
+			if err := r.Set(ctx, order); err != nil {
+				t.Fatal(err)
+			}
+			got, ok, err := r.Get(ctx, "a")
+			if err != nil || !ok || got.Delivery.Name != order.Delivery.Name {
+				t.Fatalf("Get: got %+v, %t, %v", got, ok, err)
+			}
+			body, gzipped, ok, err := r.GetJSON(ctx, "a")
+			if err != nil || !ok || gzipped != compress || len(body) == 0 {
+				t.Fatalf("GetJSON: got %d bytes, gzipped %t, %t, %v", len(body), gzipped, ok, err)
+			}
+			// другой процесс без сжатия читает то же тело
+			if got, ok, err := redisBackend(t, addr, !compress).Get(ctx, "a"); err != nil || !ok || got.OrderUID != "a" {
+				t.Errorf("Get with other compress: got %+v, %t, %v", got, ok, err)
+			}
+
+			n, err := r.Replace(ctx, []*model.Order{storagetest.NewOrder("b", 0), storagetest.NewOrder("c", 0)})
+			if err != nil || n != 1 {
+				t.Fatalf("Replace: got %d, %v; want 1 replaced", n, err)
+			}
+			if _, ok, _ := r.Get(ctx, "a"); ok {
+				t.Error("order a survived Replace")
+			}
+			all, err := r.All(ctx)
+			if err != nil || len(all) != 2 {
+				t.Fatalf("All: got %d orders, %v; want 2", len(all), err)
+			}
+			if ok, err := r.Delete(ctx, "b"); err != nil || !ok {
+				t.Errorf("Delete: got %t, %v", ok, err)
+			}
+			if ok, _ := r.Delete(ctx, "b"); ok {
+				t.Error("second Delete reported an entry")
+			}
+			if entries, _, err := r.Size(ctx); err != nil || entries != 1 {
+				t.Errorf("Size: got %d, %v; want 1", entries, err)
+			}
+		})
+	}
+}
+
+// TestRedisReplaceAtomic проверяет, что читатели не видят частично
+// замененного содержимого, а параллельная запись не теряется и не
+// оставляет заказов вне индекса.
+func TestRedisReplaceAtomic(t *testing.T) {
+	ctx := context.Background()
+	r := redisBackend(t, newRedis(t), false)
+	batch := func(prefix string, n int) []*model.Order {
+		orders := make([]*model.Order, n)
+		for i := range orders {
+			orders[i] = storagetest.NewOrder(fmt.Sprintf("%s%d", prefix, i), 0)
+		}
+		return orders
+	}
+	if _, err := r.Replace(ctx, batch("old", 300)); err != nil {
+		t.Fatal(err)
+	}
+
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for !stop.Load() {
+			entries, _, err := r.Size(ctx)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if entries != 300 && entries != 301 && entries != 200 && entries != 201 {
+				t.Errorf("reader saw %d entries: Replace is not atomic", entries)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		// промах другой реплики кладет заказ во время замены
+		if err := r.Set(ctx, storagetest.NewOrder("fill", 0)); err != nil {
+			t.Error(err)
+		}
+	}()
+	for range 5 {
+		if _, err := r.Replace(ctx, batch("new", 200)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stop.Store(true)
+	wg.Wait()
+
+	all, err := r.All(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _, _ := r.Size(ctx)
+	if len(all) != entries {
+		t.Errorf("All returned %d orders, index has %d", len(all), entries)
+	}
+	if _, ok, _ := r.Get(ctx, "old0"); ok {
+		t.Error("old order survived Replace")
+	}
+}
+
+// countingStore считает полные загрузки кэша.
+type countingStore struct {
+	*storage.MemoryStore
+	loads atomic.Int32
+}
+
+func (s *countingStore) GetAllOrders(ctx context.Context) ([]*model.Order, error) {
+	s.loads.Add(1)
+	return s.MemoryStore.GetAllOrders(ctx)
+}
+
+// TestSharedJoin проверяет, что новая реплика не перезаписывает общий
+// кэш, а досинхронизирует его по журналу с сохраненной позиции, и что
+// L1 каждой реплики узнает об изменениях, сделанных другой.
+func TestSharedJoin(t *testing.T) {
+	ctx := context.Background()
+	addr := newRedis(t)
+	store := &countingStore{MemoryStore: storage.NewMemoryStore()}
+	for _, uid := range []string{"a", "b", "c"} {
+		if err := store.CreateOrder(ctx, storagetest.NewOrder(uid, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tiered := func() cache.Option {
+		return cache.WithBackend(cache.NewTiered(
+			cache.NewMemory(cache.EncodeAlongside, false), redisBackend(t, addr, true)))
+	}
+
+	first := newCache(t, store, tiered(), cache.WithSync(0))
+	defer first.Close()
+	if store.loads.Load() != 1 {
+		t.Fatalf("first replica: got %d full loads, want 1", store.loads.Load())
+	}
+	if _, err := first.GetOrder(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	// пока второй реплики нет, заказ удаляют мимо кэшей
+	if err := store.DeleteOrder(ctx, "c", "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	second := newCache(t, store, tiered(), cache.WithSync(0))
+	defer second.Close()
+	if store.loads.Load() != 1 {
+		t.Errorf("second replica reloaded the shared cache: %d full loads", store.loads.Load())
+	}
+	if _, ok, _ := redisBackend(t, addr, false).Get(ctx, "c"); ok {
+		t.Error("deleted order is still in the shared cache after join")
+	}
+	if _, ok, _ := redisBackend(t, addr, false).Get(ctx, "b"); !ok {
+		t.Error("shared cache lost order b on join")
+	}
+
+	order := storagetest.NewOrder("a", 0)
+	order.TrackNumber = "CHANGED"
+	if _, err := second.UpdateOrder(ctx, order, "test", "join"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := first.GetOrder(ctx, "a"); err != nil || got.TrackNumber != "CHANGED" {
+		t.Errorf("first replica L1: got %+v, %v; want updated order", got, err)
+	}
+	if _, err := first.GetOrder(ctx, "c"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("deleted order: got %v, want ErrNotFound", err)
+	}
+
+	// журнал очищен дальше позиции общего кэша — новая реплика загружает его целиком
+	if _, err := store.PruneChanges(ctx, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateOrder(ctx, storagetest.NewOrder("d", 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := redisBackend(t, addr, false).SetChangeCursor(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+	third := newCache(t, store, tiered(), cache.WithSync(0))
+	defer third.Close()
+	if store.loads.Load() != 2 {
+		t.Errorf("expired cursor: got %d full loads, want 2", store.loads.Load())
+	}
+}
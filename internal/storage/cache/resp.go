@@ -0,0 +1,216 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Минимальный клиент протокола RESP2 (Redis и совместимые серверы):
+// пул соединений, одиночные команды и конвейер (pipeline).
+
+// RespError — ошибка, которую вернул сервер ("-ERR ...").
+type RespError string
+
+func (e RespError) Error() string { return string(e) }
+
+type respConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+type respClient struct {
+	addr string
+	idle chan *respConn
+}
+
+func newRespClient(addr string, poolSize int) *respClient {
+	return &respClient{addr: addr, idle: make(chan *respConn, poolSize)}
+}
+
+func (c *respClient) conn(ctx context.Context) (*respConn, error) {
+	select {
+	case cn := <-c.idle:
+		return cn, nil
+	default:
+	}
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	return &respConn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}, nil
+}
+
+func (c *respClient) put(cn *respConn) {
+	select {
+	case c.idle <- cn:
+	default:
+		cn.Close()
+	}
+}
+
+// do выполняет одну команду. Аргументы — string, []byte или int.
+func (c *respClient) do(ctx context.Context, args ...any) (any, error) {
+	replies, err := c.pipeline(ctx, [][]any{args})
+	if err != nil {
+		return nil, err
+	}
+	if err, ok := replies[0].(RespError); ok {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// pipeline отправляет команды одним пакетом и читает все ответы.
+// Ошибки сервера возвращаются как элементы типа RespError.
+func (c *respClient) pipeline(ctx context.Context, cmds [][]any) ([]any, error) {
+	var replies []any
+	err := c.withConn(ctx, func(cn *respConn) error {
+		var err error
+		replies, err = cn.pipeline(cmds)
+		return err
+	})
+	return replies, err
+}
+
+// withConn выполняет fn на одном соединении пула — так выполняются
+// WATCH и MULTI/EXEC. После ошибки fn соединение закрывается: на нем
+// могли остаться WATCH или незавершенный MULTI.
+func (c *respClient) withConn(ctx context.Context, fn func(cn *respConn) error) error {
+	cn, err := c.conn(ctx)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		cn.SetDeadline(deadline)
+	} else {
+		cn.SetDeadline(time.Time{})
+	}
+	if err := fn(cn); err != nil {
+		cn.Close()
+		return err
+	}
+	c.put(cn)
+	return nil
+}
+
+func (cn *respConn) pipeline(cmds [][]any) ([]any, error) {
+	for _, args := range cmds {
+		if err := writeCommand(cn.w, args); err != nil {
+			return nil, err
+		}
+	}
+	if err := cn.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]any, len(cmds))
+	for i := range cmds {
+		var err error
+		if replies[i], err = readReply(cn.r); err != nil {
+			return nil, err
+		}
+	}
+	return replies, nil
+}
+
+func (c *respClient) Close() error {
+	for {
+		select {
+		case cn := <-c.idle:
+			cn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func writeCommand(w *bufio.Writer, args []any) error {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		var b []byte
+		switch v := arg.(type) {
+		case string:
+			b = []byte(v)
+		case []byte:
+			b = v
+		case int:
+			b = strconv.AppendInt(nil, int64(v), 10)
+		default:
+			return fmt.Errorf("resp: unsupported argument type %T", arg)
+		}
+		fmt.Fprintf(w, "$%d\r\n", len(b))
+		w.Write(b)
+		if _, err := w.WriteString("\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readReply читает один ответ: string (+), RespError (-), int64 (:),
+// []byte (пустой bulk — nil), []any (массив).
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("resp: empty reply line")
+	}
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return RespError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(string(line[1:]), 10, 64)
+	case '$':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return []byte(nil), nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return []any(nil), nil
+		}
+		arr := make([]any, n)
+		for i := range arr {
+			if arr[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	}
+	return nil, fmt.Errorf("resp: unexpected reply type %q", line[0])
+}
+
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errors.New("resp: malformed line")
+	}
+	return line[:len(line)-2], nil
+}
@@ -0,0 +1,439 @@
+// Package respserver — in-process сервер с подмножеством протокола Redis (RESP2).
+// Заменяет Redis при локальной разработке и проверке cache.Redis без Docker.
+//
+// Поддерживаются команды: PING, QUIT, GET, SET, DEL, EXISTS, MGET,
+// SADD, SREM, SMEMBERS, SCARD, DBSIZE, FLUSHDB, FLUSHALL и транзакции
+// MULTI, EXEC, DISCARD, WATCH, UNWATCH.
+package respserver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type Server struct {
+	mu      sync.Mutex
+	strings map[string][]byte
+	sets    map[string]map[string]struct{}
+	// versions — номер последней записи ключа, пока его наблюдает
+	// хотя бы одна сессия (watchers — их число); для WATCH.
+	versions map[string]uint64
+	watchers map[string]int
+	seq      uint64
+
+	lnMu  sync.Mutex
+	ln    net.Listener
+	conns map[net.Conn]struct{}
+}
+
+func New() *Server {
+	return &Server{
+		strings:  make(map[string][]byte),
+		sets:     make(map[string]map[string]struct{}),
+		versions: make(map[string]uint64),
+		watchers: make(map[string]int),
+		conns:    make(map[net.Conn]struct{}),
+	}
+}
+
+// Start слушает addr (например "127.0.0.1:0") в фоне и возвращает фактический адрес.
+func (s *Server) Start(addr string) (string, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	go s.Serve(ln)
+	return ln.Addr().String(), nil
+}
+
+// Serve принимает соединения до закрытия ln или Close.
+func (s *Server) Serve(ln net.Listener) error {
+	s.lnMu.Lock()
+	s.ln = ln
+	s.lnMu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		s.lnMu.Lock()
+		s.conns[conn] = struct{}{}
+		s.lnMu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+// Close останавливает listener и закрывает все соединения.
+func (s *Server) Close() error {
+	s.lnMu.Lock()
+	defer s.lnMu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Close()
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer func() {
+		s.lnMu.Lock()
+		delete(s.conns, conn)
+		s.lnMu.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	var sess session
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.unwatch(&sess)
+	}()
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Println("respserver: read command:", err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := strings.EqualFold(string(args[0]), "QUIT")
+		s.exec(w, &sess, args)
+		// отвечаем пачкой, когда клиент закончил конвейер
+		if r.Buffered() == 0 || quit {
+			if err := w.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// session — транзакция соединения: команды после MULTI и ключи под WATCH.
+type session struct {
+	multi   bool
+	queued  [][][]byte
+	failed  bool // ошибка в команде после MULTI: EXEC ее отменит
+	watched map[string]uint64
+}
+
+func (sess *session) reset() {
+	*sess = session{}
+}
+
+// commands — команды, которые можно поставить в очередь после MULTI.
+var commands = map[string]bool{
+	"PING": true, "GET": true, "SET": true, "MGET": true, "DEL": true, "EXISTS": true,
+	"SADD": true, "SREM": true, "SMEMBERS": true, "SCARD": true,
+	"DBSIZE": true, "FLUSHDB": true, "FLUSHALL": true,
+}
+
+func (s *Server) exec(w *bufio.Writer, sess *session, args [][]byte) {
+	cmd := strings.ToUpper(string(args[0]))
+	switch cmd {
+	case "MULTI":
+		if sess.multi {
+			writeError(w, "ERR MULTI calls can not be nested")
+			return
+		}
+		sess.multi = true
+		writeSimple(w, "OK")
+		return
+	case "EXEC":
+		if !sess.multi {
+			writeError(w, "ERR EXEC without MULTI")
+			return
+		}
+		s.execMulti(w, sess)
+		return
+	case "DISCARD":
+		if !sess.multi {
+			writeError(w, "ERR DISCARD without MULTI")
+			return
+		}
+		s.mu.Lock()
+		s.unwatch(sess)
+		s.mu.Unlock()
+		sess.reset()
+		writeSimple(w, "OK")
+		return
+	case "WATCH":
+		if sess.multi {
+			writeError(w, "ERR WATCH inside MULTI is not allowed")
+			return
+		}
+		if len(args) < 2 {
+			writeError(w, "ERR wrong number of arguments for 'watch' command")
+			return
+		}
+		if sess.watched == nil {
+			sess.watched = make(map[string]uint64)
+		}
+		s.mu.Lock()
+		for _, key := range args[1:] {
+			k := string(key)
+			if _, ok := sess.watched[k]; !ok {
+				s.watchers[k]++
+				sess.watched[k] = s.versions[k]
+			}
+		}
+		s.mu.Unlock()
+		writeSimple(w, "OK")
+		return
+	case "UNWATCH":
+		s.mu.Lock()
+		s.unwatch(sess)
+		s.mu.Unlock()
+		writeSimple(w, "OK")
+		return
+	}
+	if sess.multi && cmd != "QUIT" {
+		if !commands[cmd] {
+			sess.failed = true
+			writeError(w, "ERR unknown command '"+strings.ToLower(cmd)+"'")
+			return
+		}
+		sess.queued = append(sess.queued, args)
+		writeSimple(w, "QUEUED")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.run(w, cmd, args[1:])
+}
+
+// execMulti выполняет команды транзакции под одной блокировкой. Если ключ
+// под WATCH с тех пор записан, транзакция не выполняется (пустой массив).
+func (s *Server) execMulti(w *bufio.Writer, sess *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer sess.reset()
+	defer s.unwatch(sess)
+	if sess.failed {
+		writeError(w, "EXECABORT Transaction discarded because of previous errors.")
+		return
+	}
+
+	for key, version := range sess.watched {
+		if s.versions[key] != version {
+			w.WriteString("*-1\r\n")
+			return
+		}
+	}
+	fmt.Fprintf(w, "*%d\r\n", len(sess.queued))
+	for _, args := range sess.queued {
+		s.run(w, strings.ToUpper(string(args[0])), args[1:])
+	}
+}
+
+// touch отмечает запись ключа для WATCH; вызывается под s.mu. Версии
+// ненаблюдаемых ключей не хранятся: WATCH начинает с нулевой версии.
+func (s *Server) touch(key string) {
+	s.seq++
+	if s.watchers[key] > 0 {
+		s.versions[key] = s.seq
+	}
+}
+
+// unwatch снимает WATCH сессии и забывает версии ключей, которые больше
+// никто не наблюдает; вызывается под s.mu.
+func (s *Server) unwatch(sess *session) {
+	for key := range sess.watched {
+		if s.watchers[key]--; s.watchers[key] <= 0 {
+			delete(s.watchers, key)
+			delete(s.versions, key)
+		}
+	}
+	sess.watched = nil
+}
+
+// run выполняет одну команду; вызывается под s.mu.
+func (s *Server) run(w *bufio.Writer, cmd string, args [][]byte) {
+	switch cmd {
+	case "PING":
+		writeSimple(w, "PONG")
+	case "QUIT":
+		writeSimple(w, "OK")
+	case "GET":
+		if !arity(w, args, 1) {
+			return
+		}
+		writeBulk(w, s.strings[string(args[0])])
+	case "SET":
+		if !arity(w, args, 2) {
+			return
+		}
+		// копия не nil и для пустого значения: GET вернет "", а не nil
+		value := make([]byte, len(args[1]))
+		copy(value, args[1])
+		s.strings[string(args[0])] = value
+		s.touch(string(args[0]))
+		writeSimple(w, "OK")
+	case "MGET":
+		fmt.Fprintf(w, "*%d\r\n", len(args))
+		for _, key := range args {
+			writeBulk(w, s.strings[string(key)])
+		}
+	case "DEL", "EXISTS":
+		var n int
+		for _, key := range args {
+			k := string(key)
+			_, isString := s.strings[k]
+			_, isSet := s.sets[k]
+			if isString || isSet {
+				n++
+				if cmd == "DEL" {
+					delete(s.strings, k)
+					delete(s.sets, k)
+					s.touch(k)
+				}
+			}
+		}
+		writeInt(w, n)
+	case "SADD", "SREM":
+		if len(args) < 2 {
+			writeError(w, "ERR wrong number of arguments for '"+strings.ToLower(cmd)+"' command")
+			return
+		}
+		key := string(args[0])
+		set := s.sets[key]
+		if set == nil {
+			set = make(map[string]struct{})
+		}
+		var n int
+		for _, m := range args[1:] {
+			_, ok := set[string(m)]
+			if cmd == "SADD" && !ok {
+				set[string(m)] = struct{}{}
+				n++
+			} else if cmd == "SREM" && ok {
+				delete(set, string(m))
+				n++
+			}
+		}
+		if len(set) == 0 {
+			delete(s.sets, key)
+		} else {
+			s.sets[key] = set
+		}
+		if n > 0 {
+			s.touch(key)
+		}
+		writeInt(w, n)
+	case "SMEMBERS":
+		if !arity(w, args, 1) {
+			return
+		}
+		set := s.sets[string(args[0])]
+		fmt.Fprintf(w, "*%d\r\n", len(set))
+		for m := range set {
+			writeBulk(w, []byte(m))
+		}
+	case "SCARD":
+		if !arity(w, args, 1) {
+			return
+		}
+		writeInt(w, len(s.sets[string(args[0])]))
+	case "DBSIZE":
+		writeInt(w, len(s.strings)+len(s.sets))
+	case "FLUSHDB", "FLUSHALL":
+		for k := range s.strings {
+			s.touch(k)
+		}
+		for k := range s.sets {
+			s.touch(k)
+		}
+		s.strings = make(map[string][]byte)
+		s.sets = make(map[string]map[string]struct{})
+		writeSimple(w, "OK")
+	default:
+		writeError(w, "ERR unknown command '"+strings.ToLower(cmd)+"'")
+	}
+}
+
+func arity(w *bufio.Writer, args [][]byte, n int) bool {
+	if len(args) != n {
+		writeError(w, "ERR wrong number of arguments")
+		return false
+	}
+	return true
+}
+
+// readCommand читает команду в виде массива bulk-строк
+// (inline-команды вида "PING\r\n" тоже принимаются).
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		fields := strings.Fields(string(line))
+		args := make([][]byte, len(fields))
+		for i, f := range fields {
+			args[i] = []byte(f)
+		}
+		return args, nil
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil {
+		return nil, fmt.Errorf("bad array length: %w", err)
+	}
+	args := make([][]byte, n)
+	for i := range args {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("expected bulk string, got %q", line)
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("bad bulk length %q", line)
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = b[:size]
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strings.TrimRight(string(line), "\r\n")), nil
+}
+
+func writeSimple(w *bufio.Writer, s string) { fmt.Fprintf(w, "+%s\r\n", s) }
+func writeError(w *bufio.Writer, s string)  { fmt.Fprintf(w, "-%s\r\n", s) }
+func writeInt(w *bufio.Writer, n int)       { fmt.Fprintf(w, ":%d\r\n", n) }
+
+func writeBulk(w *bufio.Writer, b []byte) {
+	if b == nil {
+		w.WriteString("$-1\r\n")
+		return
+	}
+	fmt.Fprintf(w, "$%d\r\n", len(b))
+	w.Write(b)
+	w.WriteString("\r\n")
+}
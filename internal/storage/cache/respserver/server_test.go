@@ -0,0 +1,120 @@
+package respserver
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// client — соединение с сервером, отправляющее команды по одной.
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *client {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// do отправляет команду и возвращает первую строку ответа и тело
+// bulk-строки, если ответ — bulk-строка.
+func (c *client) do(args ...string) (string, string) {
+	c.t.Helper()
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _, a := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := c.conn.Write([]byte(cmd)); err != nil {
+		c.t.Fatal(err)
+	}
+	line, err := readLine(c.r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	var n int
+	if _, err := fmt.Sscanf(string(line), "$%d", &n); err != nil || n < 0 {
+		return string(line), ""
+	}
+	body, err := readLine(c.r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return string(line), string(body)
+}
+
+func start(t *testing.T) (*Server, string) {
+	t.Helper()
+	s := New()
+	addr, err := s.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, addr
+}
+
+func TestSetEmptyValue(t *testing.T) {
+	_, addr := start(t)
+	c := dial(t, addr)
+	if got, _ := c.do("SET", "k", ""); got != "+OK" {
+		t.Fatalf("SET: got %q", got)
+	}
+	if got, _ := c.do("GET", "k"); got != "$0" {
+		t.Errorf("GET empty value: got %q, want $0", got)
+	}
+	if got, _ := c.do("EXISTS", "k"); got != ":1" {
+		t.Errorf("EXISTS: got %q, want :1", got)
+	}
+	if got, _ := c.do("GET", "missing"); got != "$-1" {
+		t.Errorf("GET missing key: got %q, want $-1", got)
+	}
+}
+
+// TestWatchVersions проверяет, что версии хранятся только для ключей под
+// WATCH, а изменение наблюдаемого ключа отменяет транзакцию.
+func TestWatchVersions(t *testing.T) {
+	s, addr := start(t)
+	a, b := dial(t, addr), dial(t, addr)
+	for i := range 100 {
+		a.do("SET", fmt.Sprint("k", i), "v")
+		a.do("DEL", fmt.Sprint("k", i))
+	}
+	if n := versions(s); n != 0 {
+		t.Errorf("versions of unwatched keys: got %d, want 0", n)
+	}
+
+	a.do("WATCH", "w")
+	b.do("SET", "w", "other")
+	a.do("MULTI")
+	a.do("SET", "w", "mine")
+	if got, _ := a.do("EXEC"); got != "*-1" {
+		t.Errorf("EXEC after concurrent write: got %q, want *-1", got)
+	}
+	if _, got := a.do("GET", "w"); got != "other" {
+		t.Errorf("GET: got %q, want other", got)
+	}
+	if n := versions(s); n != 0 {
+		t.Errorf("versions after EXEC: got %d, want 0", n)
+	}
+
+	a.do("WATCH", "w")
+	b.do("SET", "w", "again")
+	a.do("UNWATCH")
+	if n := versions(s); n != 0 {
+		t.Errorf("versions after UNWATCH: got %d, want 0", n)
+	}
+}
+
+func versions(s *Server) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.versions) + len(s.watchers)
+}
@@ -0,0 +1,168 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/dws33/WB_ZeroProj/internal/model"
+	"github.com/dws33/WB_ZeroProj/internal/pii"
+)
+
+// Формат файла снапшота:
+//
+//	magic   [4]byte  "WBOC"
+//	version uint8
+//	crc32   uint32   контрольная сумма (IEEE) тела
+//	length  uint64   длина тела в байтах
+//	body    gzip(gob(snapshot)); с WithSnapshotCipher — он же, зашифрованный
+//	        pii.Cipher.Seal (текст "pii:v1:...")
+const (
+	snapshotMagic   = "WBOC"
+	snapshotVersion = 2 // 1 — high-water mark по date_created
+	headerSize      = len(snapshotMagic) + 1 + 4 + 8
+)
+
+var ErrCorruptSnapshot = errors.New("cache snapshot is corrupt")
+
+// snapshot — содержимое кэша на момент записи. Cursor — позиция журнала
+// storage.ChangeFeed, до которой кэш согласован с БД: после загрузки
+// заказы, измененные позже (в том числе удаленные и стертые), перечитываются.
+type snapshot struct {
+	Cursor string
+	Orders []*model.Order
+
+	sealed bool // тело было зашифровано; при записи не используется
+}
+
+// writeSnapshot атомарно записывает снапшот: сначала во временный файл
+// в той же директории, затем rename поверх старого.
+// Если c не nil, тело шифруется.
+func writeSnapshot(path string, s *snapshot, c *pii.Cipher) error {
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	if err := gob.NewEncoder(zw).Encode(s); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if c != nil {
+		sealed, err := c.Seal(context.Background(), pii.FieldCacheSnapshot, body.String())
+		if err != nil {
+			return fmt.Errorf("encrypt cache snapshot: %w", err)
+		}
+		body.Reset()
+		body.WriteString(sealed)
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // после успешного rename файла уже нет
+
+	w := bufio.NewWriter(f)
+	header := make([]byte, 0, headerSize)
+	header = append(header, snapshotMagic...)
+	header = append(header, snapshotVersion)
+	header = binary.BigEndian.AppendUint32(header, crc32.ChecksumIEEE(body.Bytes()))
+	header = binary.BigEndian.AppendUint64(header, uint64(body.Len()))
+	if _, err := w.Write(header); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := body.WriteTo(w); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// readSnapshot читает и проверяет снапшот. Любое расхождение формата или
+// контрольной суммы возвращается как ErrCorruptSnapshot. Зашифрованное
+// тело расшифровывается c; без c такой снапшот не читается.
+func readSnapshot(path string, c *pii.Cipher) (*snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: read header: %v", ErrCorruptSnapshot, err)
+	}
+	if string(header[:4]) != snapshotMagic {
+		return nil, fmt.Errorf("%w: bad magic", ErrCorruptSnapshot)
+	}
+	if header[4] != snapshotVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrCorruptSnapshot, header[4])
+	}
+	sum := binary.BigEndian.Uint32(header[5:9])
+	length := binary.BigEndian.Uint64(header[9:17])
+
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if length != uint64(st.Size())-uint64(headerSize) {
+		return nil, fmt.Errorf("%w: length mismatch", ErrCorruptSnapshot)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("%w: read body: %v", ErrCorruptSnapshot, err)
+	}
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCorruptSnapshot)
+	}
+	sealed := pii.IsSealed(string(body[:min(len(body), 16)]))
+	if sealed {
+		if c == nil {
+			return nil, errors.New("cache snapshot is encrypted, but no PII cipher is configured")
+		}
+		opened, err := c.Open(context.Background(), pii.FieldCacheSnapshot, string(body))
+		if err != nil {
+			return nil, fmt.Errorf("decrypt cache snapshot: %w", err)
+		}
+		body = []byte(opened)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptSnapshot, err)
+	}
+	defer zr.Close()
+
+	s := &snapshot{sealed: sealed}
+	if err := gob.NewDecoder(zr).Decode(s); err != nil {
+		return nil, fmt.Errorf("%w: decode: %v", ErrCorruptSnapshot, err)
+	}
+	return s, nil
+}
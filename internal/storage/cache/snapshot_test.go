@@ -0,0 +1,164 @@
+package cache_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dws33/WB_ZeroProj/internal/pii"
+	"github.com/dws33/WB_ZeroProj/internal/storage"
+	"github.com/dws33/WB_ZeroProj/internal/storage/cache"
+	"github.com/dws33/WB_ZeroProj/internal/storage/storagetest"
+)
+
+// TestSnapshotReconcile проверяет досинхронизацию снапшота по журналу:
+// изменения, сделанные в БД после его записи (другим процессом), не
+// возвращаются из снапшота.
+func TestSnapshotReconcile(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	for _, uid := range []string{"updated", "deleted", "erased", "kept"} {
+		if err := store.CreateOrder(ctx, storagetest.NewOrder(uid, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "cache.snap")
+	c := newCache(t, store, cache.WithSnapshot(path, 0))
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// изменения мимо кэша, как из eventhandler или другой реплики
+	order := storagetest.NewOrder("updated", 0)
+	order.TrackNumber = "CHANGED"
+	if _, err := store.UpdateOrder(ctx, order, "test", "reconcile"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteOrder(ctx, "deleted", "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.EraseOrderPII(ctx, "erased", "test"); err != nil {
+		t.Fatal(err)
+	}
+	// получен позже, но создан раньше всех заказов снапшота
+	if err := store.CreateOrder(ctx, storagetest.NewOrder("late", -100000)); err != nil {
+		t.Fatal(err)
+	}
+
+	c = newCache(t, store, cache.WithSnapshot(path, 0))
+	defer c.Close()
+	got, err := c.GetOrder(ctx, "updated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.TrackNumber != "CHANGED" {
+		t.Errorf("updated order: got track %q, want CHANGED", got.TrackNumber)
+	}
+	if _, err := c.GetOrder(ctx, "deleted"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("deleted order: got %v, want ErrNotFound", err)
+	}
+	if got, err := c.GetOrder(ctx, "erased"); err != nil || got.Delivery.Name != "" || got.CustomerID != "" {
+		t.Errorf("erased order: got %+v, %v; want PII erased", got, err)
+	}
+	stats, err := c.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// kept, updated, erased и late — из прогрева, без обращений к БД
+	if stats.Entries != 4 || stats.Misses != 1 {
+		t.Errorf("stats: got %d entries, %d misses; want 4 entries, 1 miss (deleted)", stats.Entries, stats.Misses)
+	}
+}
+
+// TestSnapshotExpired проверяет, что снапшот, курсор которого журнал уже
+// не покрывает, не используется.
+func TestSnapshotExpired(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	if err := store.CreateOrder(ctx, storagetest.NewOrder("a", 0)); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "cache.snap")
+	c := newCache(t, store, cache.WithSnapshot(path, 0))
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.DeleteOrder(ctx, "a", "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.PruneChanges(ctx, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	c = newCache(t, store, cache.WithSnapshot(path, 0))
+	defer c.Close()
+	if stats, _ := c.Stats(ctx); stats.Entries != 0 {
+		t.Errorf("got %d entries, want 0: expired snapshot must not be loaded", stats.Entries)
+	}
+}
+
+// TestSnapshotCipher проверяет, что с WithSnapshotCipher в файле снапшота
+// нет открытых персональных данных, а открытый снапшот, записанный до
+// включения шифрования, сразу перезаписывается зашифрованным.
+func TestSnapshotCipher(t *testing.T) {
+	ctx := context.Background()
+	keys, err := pii.NewLocalKeys("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher := pii.New(keys, bytes.Repeat([]byte{2}, 32))
+
+	store := storage.NewMemoryStore()
+	order := storagetest.NewOrder("a", 0)
+	order.Delivery.Name = "Unique Secret Name"
+	if err := store.CreateOrder(ctx, order); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "cache.snap")
+	encrypted := func(t *testing.T) bool {
+		t.Helper()
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(b, []byte(order.Delivery.Name)) {
+			return false
+		}
+		return pii.IsSealed(string(b[17:]))
+	}
+
+	// открытый снапшот до включения шифрования
+	c := newCache(t, store, cache.WithSnapshot(path, 0), cache.WithSync(0))
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !snapshotContains(t, path, order.Delivery.Name) {
+		t.Fatal("plain snapshot does not contain the order")
+	}
+
+	c = newCache(t, store, cache.WithSnapshot(path, 0), cache.WithSnapshotCipher(cipher), cache.WithSync(0))
+	if !encrypted(t) {
+		t.Error("plain snapshot was not rewritten encrypted on load")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !encrypted(t) {
+		t.Error("snapshot written with cipher is not encrypted")
+	}
+
+	c = newCache(t, store, cache.WithSnapshot(path, 0), cache.WithSnapshotCipher(cipher), cache.WithSync(0))
+	defer c.Close()
+	got, err := c.GetOrder(ctx, "a")
+	if err != nil || got.Delivery.Name != order.Delivery.Name {
+		t.Fatalf("got %+v, %v", got, err)
+	}
+	if stats, _ := c.Stats(ctx); stats.Misses != 0 {
+		t.Errorf("got %d misses, want the order from the encrypted snapshot", stats.Misses)
+	}
+}
@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/dws33/WB_ZeroProj/internal/model"
+	"github.com/dws33/WB_ZeroProj/internal/storage"
+)
+
+// Stats — состояние кэша для мониторинга.
+type Stats struct {
+	Entries        int           `json:"entries"`
+	ApproxBytes    int64         `json:"approx_bytes"`
+	Hits           int64         `json:"hits"`
+	Misses         int64         `json:"misses"`
+	Evictions      int64         `json:"evictions"`
+	WarmUpDuration time.Duration `json:"warm_up_duration_ns"`
+	WarmedUpAt     time.Time     `json:"warmed_up_at"`
+	// SyncLag — сколько ждет самое старое изменение журнала, еще не
+	// прочитанное кэшем (storage.ChangeFeed.ChangeLag). В PostgreSQL растет,
+	// пока долгая транзакция держит курсор журнала; 0 без журнала.
+	SyncLag time.Duration `json:"sync_lag_ns"`
+}
+
+type counters struct {
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+// Stats возвращает текущие счетчики и размер кэша.
+func (c *CachedStorage) Stats(ctx context.Context) (Stats, error) {
+	entries, bytes, err := c.backend.Size(ctx)
+	if err != nil {
+		return Stats{}, err
+	}
+	var lag time.Duration
+	if cursor := c.changeCursor(); c.feed != nil && cursor != "" {
+		if lag, err = c.feed.ChangeLag(ctx, cursor); err != nil {
+			return Stats{}, err
+		}
+	}
+
+	c.warmUpMu.Lock()
+	defer c.warmUpMu.Unlock()
+	return Stats{
+		Entries:        entries,
+		ApproxBytes:    bytes,
+		Hits:           c.counters.hits.Load(),
+		Misses:         c.counters.misses.Load(),
+		Evictions:      c.counters.evictions.Load(),
+		WarmUpDuration: c.warmUpDuration,
+		WarmedUpAt:     c.warmedUpAt,
+		SyncLag:        lag,
+	}, nil
+}
+
+// Evict удаляет заказ из кэша; false — заказа в кэше не было. Копия,
+// которую параллельный промах прочитал из БД до вытеснения, в кэш не попадет.
+func (c *CachedStorage) Evict(ctx context.Context, uid string) (bool, error) {
+	c.nextGeneration()
+	ok, err := c.backend.Delete(ctx, uid)
+	if err != nil || !ok {
+		return false, err
+	}
+	c.counters.evictions.Add(1)
+	return true, nil
+}
+
+// Flush очищает кэш целиком и возвращает число удаленных записей.
+func (c *CachedStorage) Flush(ctx context.Context) (int, error) {
+	c.nextGeneration()
+	n, err := c.backend.Replace(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	c.counters.evictions.Add(int64(n))
+	return n, nil
+}
+
+// Reload перечитывает все заказы из БД и атомарно подменяет содержимое кэша.
+// Снапшот при этом не используется.
+func (c *CachedStorage) Reload(ctx context.Context) error {
+	start := time.Now()
+	if err := c.load(storage.ReadPrimary(ctx)); err != nil {
+		return err
+	}
+	c.setWarmUp(start)
+	return nil
+}
+
+func (c *CachedStorage) setWarmUp(start time.Time) {
+	c.warmUpMu.Lock()
+	defer c.warmUpMu.Unlock()
+	c.warmedUpAt = time.Now()
+	c.warmUpDuration = c.warmedUpAt.Sub(start)
+}
+
+// approxSize — грубая оценка памяти, занимаемой записью кэша.
+func (e *entry) approxSize() int64 {
+	size := int64(unsafe.Sizeof(*e)) + int64(cap(e.body))
+	if o := e.order; o != nil {
+		size += int64(unsafe.Sizeof(*o)) +
+			int64(len(o.OrderUID)+len(o.TrackNumber)+len(o.Entry)+len(o.Locale)+
+				len(o.InternalSignature)+len(o.CustomerID)+len(o.DeliveryService)+
+				len(o.ShardKey)+len(o.OofShard))
+		if d := o.Delivery; d != nil {
+			size += int64(unsafe.Sizeof(*d)) +
+				int64(len(d.Name)+len(d.Phone)+len(d.Zip)+len(d.City)+len(d.Address)+len(d.Region)+len(d.Email))
+		}
+		if p := o.Payment; p != nil {
+			size += int64(unsafe.Sizeof(*p)) +
+				int64(len(p.Transaction)+len(p.RequestID)+len(p.Currency)+len(p.Provider)+len(p.Bank))
+		}
+		size += int64(cap(o.Items)) * int64(unsafe.Sizeof((*model.Item)(nil)))
+		for _, it := range o.Items {
+			if it != nil {
+				size += int64(unsafe.Sizeof(*it)) +
+					int64(len(it.TrackNumber)+len(it.RID)+len(it.Name)+len(it.Size)+len(it.Brand))
+			}
+		}
+	}
+	return size
+}
@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/dws33/WB_ZeroProj/internal/model"
+	"github.com/dws33/WB_ZeroProj/internal/storage"
+)
+
+// defaultSyncInterval — как часто кэш читает журнал изменений, если
+// WithSync не задан.
+const defaultSyncInterval = time.Second
+
+// WithSync задает, как часто кэш читает журнал storage.ChangeFeed и
+// вытесняет заказы, измененные в БД, в том числе другими процессами
+// (eventhandler, website, другие реплики). interval <= 0 отключает чтение:
+// кэш видит только изменения, сделанные через него самого.
+func WithSync(interval time.Duration) Option {
+	return func(c *CachedStorage) {
+		c.syncInterval = interval
+	}
+}
+
+// Sync вытесняет заказы, измененные в БД после прошлой синхронизации,
+// и возвращает число прочитанных изменений. Если журнал очищен дальше
+// позиции кэша, кэш перечитывается целиком. После удаления, стирания
+// персональных данных, очистки, перешифрования или retention снапшот
+// перезаписывается сразу, чтобы в файле не оставалось прежних данных.
+func (c *CachedStorage) Sync(ctx context.Context) (int, error) {
+	if c.feed == nil {
+		return 0, nil
+	}
+	c.syncMu.Lock()
+	defer c.syncMu.Unlock()
+
+	cursor := c.changeCursor()
+	var read int
+	rewrite := false
+	for {
+		changes, next, err := c.feed.ChangesSince(ctx, cursor, 0)
+		if errors.Is(err, storage.ErrCursorExpired) {
+			log.Println("cache is behind the change feed, reloading:", err)
+			if err := c.loadLocked(storage.ReadPrimary(ctx)); err != nil {
+				return read, err
+			}
+			return read, c.rewriteSnapshot(true)
+		}
+		if err != nil {
+			return read, err
+		}
+		for _, ch := range changes {
+			if _, err := c.Evict(ctx, ch.OrderUID); err != nil {
+				// позиция не сдвигается: изменение прочитается еще раз
+				return read, err
+			}
+			if ch.Kind != storage.ChangeCreate && ch.Kind != storage.ChangeUpdate {
+				rewrite = true
+			}
+		}
+		read += len(changes)
+		if len(changes) > 0 || next != cursor {
+			c.advance(ctx, next)
+		}
+		cursor = next
+		if len(changes) == 0 {
+			return read, c.rewriteSnapshot(rewrite)
+		}
+	}
+}
+
+func (c *CachedStorage) syncLoop() {
+	defer close(c.syncDone)
+	ticker := time.NewTicker(c.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := c.Sync(context.Background()); err != nil {
+				log.Println("fail to sync cache with change feed:", err)
+			}
+		case <-c.syncStop:
+			return
+		}
+	}
+}
+
+// rewriteSnapshot перезаписывает снапшот, если он включен и need == true.
+func (c *CachedStorage) rewriteSnapshot(need bool) error {
+	if !need || c.snapshotPath == "" {
+		return nil
+	}
+	return c.SaveSnapshot()
+}
+
+// Поколение кэша растет при каждом вытеснении. Чтение из БД запоминает
+// поколение до запроса и кладет заказ в кэш, только если оно не
+// изменилось: иначе копия, прочитанная до изменения, пережила бы его
+// вытеснение.
+
+func (c *CachedStorage) generation() uint64 {
+	c.fillMu.RLock()
+	defer c.fillMu.RUnlock()
+	return c.gen
+}
+
+func (c *CachedStorage) nextGeneration() {
+	c.fillMu.Lock()
+	defer c.fillMu.Unlock()
+	c.gen++
+}
+
+// fill кладет в кэш заказ, прочитанный из БД в поколении gen.
+func (c *CachedStorage) fill(ctx context.Context, order *model.Order, gen uint64) {
+	c.fillMu.RLock()
+	defer c.fillMu.RUnlock()
+	if c.gen == gen {
+		c.set(ctx, order)
+	}
+}
@@ -0,0 +1,208 @@
+package cache_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dws33/WB_ZeroProj/internal/storage"
+	"github.com/dws33/WB_ZeroProj/internal/storage/cache"
+	"github.com/dws33/WB_ZeroProj/internal/storage/storagetest"
+)
+
+// TestSync проверяет, что кэш одного процесса узнает об изменениях,
+// сделанных через другой кэш и мимо кэшей (eventhandler), в том числе
+// при общем L2: у каждого процесса свой L1.
+func TestSync(t *testing.T) {
+	ctx := context.Background()
+	shared := cache.NewMemory(cache.EncodeOnly, false)
+	for _, tc := range []struct {
+		name    string
+		backend func() cache.Backend
+	}{
+		{"memory", func() cache.Backend { return cache.NewMemory(cache.EncodeNone, false) }},
+		{"tiered", func() cache.Backend {
+			return cache.NewTiered(cache.NewMemory(cache.EncodeAlongside, false), shared)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store := storage.NewMemoryStore()
+			for _, uid := range []string{"updated", "deleted", "erased"} {
+				if err := store.CreateOrder(ctx, storagetest.NewOrder(uid, 0)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			httpserver := newCache(t, store, cache.WithBackend(tc.backend()), cache.WithSync(0))
+			website := newCache(t, store, cache.WithBackend(tc.backend()), cache.WithSync(0))
+
+			order := storagetest.NewOrder("updated", 0)
+			order.TrackNumber = "CHANGED"
+			if _, err := httpserver.UpdateOrder(ctx, order, "test", "sync"); err != nil {
+				t.Fatal(err)
+			}
+			if err := httpserver.DeleteOrder(ctx, "deleted", "test"); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.EraseOrderPII(ctx, "erased", "test"); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.CreateOrder(ctx, storagetest.NewOrder("created", 0)); err != nil {
+				t.Fatal(err)
+			}
+
+			if stats, err := website.Stats(ctx); err != nil || stats.SyncLag <= 0 {
+				t.Errorf("lag before Sync: got %+v, %v; want > 0", stats, err)
+			}
+			if n, err := website.Sync(ctx); err != nil || n != 4 {
+				t.Fatalf("Sync: got %d, %v; want 4 changes", n, err)
+			}
+			got, err := website.GetOrder(ctx, "updated")
+			if err != nil || got.TrackNumber != "CHANGED" {
+				t.Errorf("updated order: got %+v, %v", got, err)
+			}
+			if _, err := website.GetOrder(ctx, "deleted"); !errors.Is(err, storage.ErrNotFound) {
+				t.Errorf("deleted order: got %v, want ErrNotFound", err)
+			}
+			if got, err := website.GetOrder(ctx, "erased"); err != nil || got.Delivery.Name != "" {
+				t.Errorf("erased order: got %+v, %v; want PII erased", got, err)
+			}
+			if _, err := website.GetOrder(ctx, "created"); err != nil {
+				t.Error(err)
+			}
+			if n, err := website.Sync(ctx); err != nil || n != 0 {
+				t.Errorf("second Sync: got %d, %v; want 0 changes", n, err)
+			}
+			if stats, err := website.Stats(ctx); err != nil || stats.SyncLag != 0 {
+				t.Errorf("lag after Sync: got %+v, %v; want 0", stats, err)
+			}
+		})
+	}
+}
+
+// TestSyncExpired проверяет полную перезагрузку кэша, отставшего от
+// очищенного журнала.
+func TestSyncExpired(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	if err := store.CreateOrder(ctx, storagetest.NewOrder("a", 0)); err != nil {
+		t.Fatal(err)
+	}
+	c := newCache(t, store, cache.WithSync(0))
+	if err := store.DeleteOrder(ctx, "a", "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateOrder(ctx, storagetest.NewOrder("b", 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.PruneChanges(ctx, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := c.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Entries != 1 {
+		t.Errorf("got %d entries, want 1 (only b) after reload", stats.Entries)
+	}
+}
+
+// TestEraseScrubsSnapshot проверяет, что после стирания персональных
+// данных их нет в файле снапшота — и при стирании через этот кэш,
+// и при стирании другим процессом.
+func TestEraseScrubsSnapshot(t *testing.T) {
+	ctx := context.Background()
+	for _, viaCache := range []bool{true, false} {
+		store := storage.NewMemoryStore()
+		order := storagetest.NewOrder("a", 0)
+		order.Delivery.Name = "Unique Secret Name"
+		if err := store.CreateOrder(ctx, order); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(t.TempDir(), "cache.snap")
+		c := newCache(t, store, cache.WithSnapshot(path, 0), cache.WithSync(0))
+		if err := c.SaveSnapshot(); err != nil {
+			t.Fatal(err)
+		}
+		if !snapshotContains(t, path, order.Delivery.Name) {
+			t.Fatal("snapshot does not contain the order")
+		}
+
+		if viaCache {
+			if err := c.EraseOrderPII(ctx, "a", "test"); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			if err := store.EraseOrderPII(ctx, "a", "test"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := c.Sync(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if snapshotContains(t, path, order.Delivery.Name) {
+			t.Errorf("via cache %t: erased PII is still in the snapshot", viaCache)
+		}
+		if err := c.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// snapshotContains ищет s в распакованном теле снапшота (после заголовка
+// из 17 байт, см. snapshot.go).
+func snapshotContains(t *testing.T, path, s string) bool {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := cache.Gunzip(b[17:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Contains(body, []byte(s))
+}
+
+// TestSyncItemStatuses проверяет, что статусы товаров, исправленные
+// eventhandler (событие item_status.updated) прямо в БД, видны через кэш
+// httpserver после чтения журнала.
+func TestSyncItemStatuses(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	if err := store.CreateOrder(ctx, storagetest.NewOrder("a", 0)); err != nil {
+		t.Fatal(err)
+	}
+	c := newCache(t, store, cache.WithSync(0))
+	defer c.Close()
+	if _, err := c.GetOrder(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.UpdateItemStatuses(ctx, &storage.ItemStatusEvent{
+		OrderUID: "a", Items: []storage.ItemStatusUpdate{{RID: "rid-a", Status: 302}},
+		Actor: "eventhandler", Reason: "item_status.updated",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.GetOrder(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Items[0].Status != 302 {
+		t.Errorf("got item status %d, want 302", got.Items[0].Status)
+	}
+	body := orderJSON(t, c, "a")
+	if !bytes.Contains(body, []byte(`"status":302`)) {
+		t.Errorf("cached JSON is stale: %s", body)
+	}
+}
@@ -0,0 +1,452 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Виды изменений журнала ChangeFeed. Delete, erase и purge совпадают
+// с действиями AuditRecord.
+const (
+	ChangeCreate = "create"
+	ChangeUpdate = "update"
+	ChangeDelete = AuditDelete
+	ChangeErase  = AuditErase
+	ChangePurge  = AuditPurge
+	ChangeRotate = "rotate"
+	ChangeRetire = "retire"
+)
+
+// changeBatch — сколько изменений ChangesSince возвращает при limit <= 0.
+const changeBatch = 1000
+
+// ErrCursorExpired — журнал уже очищен дальше курсора: изменения после
+// него потеряны, и читатель должен перечитать заказы целиком.
+var ErrCursorExpired = errors.New("change cursor expired")
+
+// OrderChange — запись журнала: заказ OrderUID изменен (Kind) в момент At.
+type OrderChange struct {
+	OrderUID string    `json:"order_uid"`
+	Kind     string    `json:"kind"`
+	At       time.Time `json:"at"`
+}
+
+// ChangeFeed — журнал изменений заказов (миграция 0016): создание,
+// исправление, удаление, стирание персональных данных, очистка,
+// перешифрование и retention. По нему кэши всех процессов узнают, какие
+// заказы изменены в БД, в том числе другими процессами.
+//
+// Курсор — непрозрачная строка. Изменение, зафиксированное после
+// получения курсора, вернет ChangesSince с этим курсором.
+type ChangeFeed interface {
+	// ChangeCursor возвращает курсор текущего конца журнала.
+	ChangeCursor(ctx context.Context) (string, error)
+	// ChangesSince возвращает не больше limit изменений после cursor
+	// и курсор для следующего вызова. ErrCursorExpired — журнал очищен
+	// дальше cursor; ErrInvalidArgument — курсор не разобрать.
+	ChangesSince(ctx context.Context, cursor string, limit int) ([]*OrderChange, string, error)
+	// PruneChanges удаляет изменения старше before и возвращает их число.
+	PruneChanges(ctx context.Context, before time.Time) (int, error)
+	// ChangeLag возвращает, сколько ждет самое старое зафиксированное
+	// изменение после cursor; 0 — ChangesSince с cursor уже отдал все.
+	// Для курсора после ChangesSince это отставание читателя, в том числе
+	// из-за долгих транзакций в PostgreSQL (см. pgChangesSince).
+	ChangeLag(ctx context.Context, cursor string) (time.Duration, error)
+}
+
+// RunChangePruning каждые interval удаляет из журнала изменения старше
+// retain, пока не отменен ctx. Кэш, остановленный дольше retain, при
+// старте перечитывает заказы целиком. Ошибки пишутся в лог.
+func RunChangePruning(ctx context.Context, feed ChangeFeed, retain, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := feed.PruneChanges(ctx, time.Now().Add(-retain))
+		if err != nil {
+			log.Println("fail to prune order changes:", err)
+		}
+		if n > 0 {
+			log.Printf("%d order changes pruned", n)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// pgCursor — позиция в order_changes PostgreSQL: прочитаны все строки
+// с (xid, seq) не больше курсора.
+type pgCursor struct {
+	xid uint64
+	seq int64
+}
+
+func (c pgCursor) String() string {
+	return fmt.Sprintf("%d:%d", c.xid, c.seq)
+}
+
+func parsePGCursor(s string) (pgCursor, error) {
+	x, q, ok := strings.Cut(s, ":")
+	xid, err1 := strconv.ParseUint(x, 10, 64)
+	seq, err2 := strconv.ParseInt(q, 10, 64)
+	if !ok || err1 != nil || err2 != nil {
+		return pgCursor{}, fmt.Errorf("%w: malformed change cursor %q", ErrInvalidArgument, s)
+	}
+	return pgCursor{xid: xid, seq: seq}, nil
+}
+
+// execer — транзакция или пул, в которых пишется журнал.
+type execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+// recordChanges добавляет в журнал изменения заказов uids; вызывается
+// в транзакции самого изменения.
+func recordChanges(ctx context.Context, db execer, kind string, uids ...string) error {
+	_, err := db.Exec(ctx, `
+		INSERT INTO order_changes (order_uid, kind)
+		SELECT uid, $2 FROM unnest($1::text[]) AS uid
+	`, uids, kind)
+	return err
+}
+
+// pgChangeCursor возвращает курсор конца журнала: все транзакции
+// с xid меньше xmin текущего снапшота завершены.
+func pgChangeCursor(ctx context.Context, pool *pgxpool.Pool) (string, error) {
+	var xmin string
+	if err := pool.QueryRow(ctx, `SELECT pg_snapshot_xmin(pg_current_snapshot())::text`).Scan(&xmin); err != nil {
+		return "", wrapErr(err)
+	}
+	xid, err := strconv.ParseUint(xmin, 10, 64)
+	if err != nil {
+		return "", err
+	}
+	return pgCursor{xid: xid}.String(), nil
+}
+
+// pgChangesSince читает журнал в одном снапшоте. Строки еще не завершенных
+// транзакций (xid не меньше xmin) не читаются, пока те не завершатся:
+// иначе курсор ушел бы дальше строки транзакции, которая зафиксируется позже.
+//
+// Поэтому курсор стоит, пока открыта самая старая транзакция базы — любая,
+// а не только пишущая журнал: долгий отчет, забытая сессия "idle in
+// transaction" или pg_dump. Изменения, зафиксированные за это время,
+// кэши не видят, пока она не завершится; отставание показывает ChangeLag
+// (cache.Stats.SyncLag). Долгие транзакции ограничивает
+// idle_in_transaction_session_timeout и мониторинг pg_stat_activity.
+func pgChangesSince(ctx context.Context, pool *pgxpool.Pool, cursor string, limit int) ([]*OrderChange, string, error) {
+	after, err := parsePGCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	if limit <= 0 {
+		limit = changeBatch
+	}
+
+	tx, err := pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, "", wrapErr(err)
+	}
+	defer tx.Rollback(ctx)
+
+	var expired bool
+	var xmin string
+	if err := tx.QueryRow(ctx, `
+		SELECT (xid, seq) > ($1::text::xid8, $2), pg_snapshot_xmin(pg_current_snapshot())::text
+		FROM order_change_horizon
+	`, strconv.FormatUint(after.xid, 10), after.seq).Scan(&expired, &xmin); err != nil {
+		return nil, "", wrapErr(err)
+	}
+	if expired {
+		return nil, "", fmt.Errorf("%w: %s", ErrCursorExpired, cursor)
+	}
+
+	rows, err := tx.Query(ctx, `
+		SELECT xid::text, seq, order_uid, kind, at FROM order_changes
+		WHERE (xid, seq) > ($1::text::xid8, $2) AND xid < $3::text::xid8
+		ORDER BY xid, seq
+		LIMIT $4
+	`, strconv.FormatUint(after.xid, 10), after.seq, xmin, limit)
+	if err != nil {
+		return nil, "", wrapErr(err)
+	}
+	next := after
+	changes, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*OrderChange, error) {
+		var xid string
+		c := new(OrderChange)
+		if err := row.Scan(&xid, &next.seq, &c.OrderUID, &c.Kind, &c.At); err != nil {
+			return nil, err
+		}
+		next.xid, err = strconv.ParseUint(xid, 10, 64)
+		return c, err
+	})
+	if err != nil {
+		return nil, "", wrapErr(err)
+	}
+	if len(changes) < limit {
+		// прочитано все, что завершилось до снапшота
+		xid, err := strconv.ParseUint(xmin, 10, 64)
+		if err != nil {
+			return nil, "", err
+		}
+		if xid > next.xid {
+			next = pgCursor{xid: xid}
+		}
+	}
+	return changes, next.String(), nil
+}
+
+// pgChangeLag — возраст самого старого видимого (зафиксированного)
+// изменения после cursor по часам БД.
+func pgChangeLag(ctx context.Context, pool *pgxpool.Pool, cursor string) (time.Duration, error) {
+	after, err := parsePGCursor(cursor)
+	if err != nil {
+		return 0, err
+	}
+	var seconds float64
+	if err := pool.QueryRow(ctx, `
+		SELECT COALESCE(extract(epoch FROM now() - min(at)), 0)::float8 FROM order_changes
+		WHERE (xid, seq) > ($1::text::xid8, $2)
+	`, strconv.FormatUint(after.xid, 10), after.seq).Scan(&seconds); err != nil {
+		return 0, wrapErr(err)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// pgPruneChanges удаляет старые изменения и сдвигает границу очистки
+// на самую позднюю удаленную позицию.
+func pgPruneChanges(ctx context.Context, pool *pgxpool.Pool, before time.Time) (int, error) {
+	var n int
+	err := pool.QueryRow(ctx, `
+		WITH d AS (
+			DELETE FROM order_changes WHERE at < $1 RETURNING xid, seq
+		), last AS (
+			SELECT xid, seq FROM d ORDER BY xid DESC, seq DESC LIMIT 1
+		), h AS (
+			UPDATE order_change_horizon h SET xid = last.xid, seq = last.seq
+			FROM last WHERE (last.xid, last.seq) > (h.xid, h.seq)
+		)
+		SELECT count(*) FROM d
+	`, before).Scan(&n)
+	return n, wrapErr(err)
+}
+
+func (s *Storage) ChangeCursor(ctx context.Context) (string, error) {
+	return pgChangeCursor(ctx, s.pool)
+}
+
+func (s *Storage) ChangesSince(ctx context.Context, cursor string, limit int) ([]*OrderChange, string, error) {
+	return pgChangesSince(ctx, s.pool, cursor, limit)
+}
+
+func (s *Storage) PruneChanges(ctx context.Context, before time.Time) (int, error) {
+	return pgPruneChanges(ctx, s.pool, before)
+}
+
+func (s *Storage) ChangeLag(ctx context.Context, cursor string) (time.Duration, error) {
+	return pgChangeLag(ctx, s.pool, cursor)
+}
+
+func (s *DocumentStorage) ChangeCursor(ctx context.Context) (string, error) {
+	return pgChangeCursor(ctx, s.pool)
+}
+
+func (s *DocumentStorage) ChangesSince(ctx context.Context, cursor string, limit int) ([]*OrderChange, string, error) {
+	return pgChangesSince(ctx, s.pool, cursor, limit)
+}
+
+func (s *DocumentStorage) PruneChanges(ctx context.Context, before time.Time) (int, error) {
+	return pgPruneChanges(ctx, s.pool, before)
+}
+
+func (s *DocumentStorage) ChangeLag(ctx context.Context, cursor string) (time.Duration, error) {
+	return pgChangeLag(ctx, s.pool, cursor)
+}
+
+// Журнал шардов: у каждого шарда свой журнал, курсор — JSON-объект
+// с курсорами шардов по именам. Курсор без какого-то шарда (шард добавлен
+// в карту) считается устаревшим.
+
+func (s *ShardedStorage) ChangeCursor(ctx context.Context) (string, error) {
+	cursors, err := scatter(ctx, s, func(ctx context.Context, shard *Storage) (string, error) {
+		return shard.ChangeCursor(ctx)
+	})
+	if err != nil {
+		return "", err
+	}
+	return s.encodeCursor(cursors)
+}
+
+func (s *ShardedStorage) ChangesSince(ctx context.Context, cursor string, limit int) ([]*OrderChange, string, error) {
+	var byShard map[string]string
+	if err := json.Unmarshal([]byte(cursor), &byShard); err != nil {
+		return nil, "", fmt.Errorf("%w: malformed change cursor %q", ErrInvalidArgument, cursor)
+	}
+	for _, name := range s.names {
+		if _, ok := byShard[name]; !ok {
+			return nil, "", fmt.Errorf("%w: no position for shard %s", ErrCursorExpired, name)
+		}
+	}
+	type part struct {
+		changes []*OrderChange
+		cursor  string
+	}
+	parts, err := scatter(ctx, s, func(ctx context.Context, shard *Storage) (part, error) {
+		name := s.nameOf(shard)
+		changes, next, err := shard.ChangesSince(ctx, byShard[name], limit)
+		return part{changes, next}, err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	var changes []*OrderChange
+	cursors := make([]string, len(parts))
+	for i, p := range parts {
+		changes = append(changes, p.changes...)
+		cursors[i] = p.cursor
+	}
+	next, err := s.encodeCursor(cursors)
+	return changes, next, err
+}
+
+func (s *ShardedStorage) PruneChanges(ctx context.Context, before time.Time) (int, error) {
+	counts, err := scatter(ctx, s, func(ctx context.Context, shard *Storage) (int, error) {
+		return shard.PruneChanges(ctx, before)
+	})
+	var n int
+	for _, c := range counts {
+		n += c
+	}
+	return n, err
+}
+
+// ChangeLag — наибольшее отставание по шардам.
+func (s *ShardedStorage) ChangeLag(ctx context.Context, cursor string) (time.Duration, error) {
+	var byShard map[string]string
+	if err := json.Unmarshal([]byte(cursor), &byShard); err != nil {
+		return 0, fmt.Errorf("%w: malformed change cursor %q", ErrInvalidArgument, cursor)
+	}
+	lags, err := scatter(ctx, s, func(ctx context.Context, shard *Storage) (time.Duration, error) {
+		c, ok := byShard[s.nameOf(shard)]
+		if !ok {
+			return 0, nil
+		}
+		return shard.ChangeLag(ctx, c)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return slices.Max(append(lags, 0)), nil
+}
+
+// encodeCursor собирает курсор из курсоров шардов в порядке s.names.
+func (s *ShardedStorage) encodeCursor(cursors []string) (string, error) {
+	byShard := make(map[string]string, len(cursors))
+	for i, c := range cursors {
+		byShard[s.names[i]] = c
+	}
+	b, err := json.Marshal(byShard)
+	return string(b), err
+}
+
+func (s *ShardedStorage) nameOf(shard *Storage) string {
+	for _, name := range s.names {
+		if s.shards[name] == shard {
+			return name
+		}
+	}
+	return ""
+}
+
+// Журнал MemoryStore: изменения записываются под общей блокировкой,
+// поэтому порядок seq совпадает с порядком изменений.
+
+// memoryChange — запись журнала MemoryStore.
+type memoryChange struct {
+	seq int64
+	OrderChange
+}
+
+// recordChange добавляет изменение в журнал; вызывается под m.mu.
+func (m *MemoryStore) recordChange(kind string, uids ...string) {
+	for _, uid := range uids {
+		m.changeSeq++
+		m.changes = append(m.changes, &memoryChange{
+			seq:         m.changeSeq,
+			OrderChange: OrderChange{OrderUID: uid, Kind: kind, At: time.Now()},
+		})
+	}
+}
+
+func (m *MemoryStore) ChangeCursor(_ context.Context) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return strconv.FormatInt(m.changeSeq, 10), nil
+}
+
+func (m *MemoryStore) ChangesSince(_ context.Context, cursor string, limit int) ([]*OrderChange, string, error) {
+	after, err := strconv.ParseInt(cursor, 10, 64)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: malformed change cursor %q", ErrInvalidArgument, cursor)
+	}
+	if limit <= 0 {
+		limit = changeBatch
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if after < m.changesPruned {
+		return nil, "", fmt.Errorf("%w: %s", ErrCursorExpired, cursor)
+	}
+	i, _ := slices.BinarySearchFunc(m.changes, after+1, func(c *memoryChange, seq int64) int {
+		return int(c.seq - seq)
+	})
+	var changes []*OrderChange
+	next := after
+	for _, c := range m.changes[i:min(i+limit, len(m.changes))] {
+		oc := c.OrderChange
+		changes = append(changes, &oc)
+		next = c.seq
+	}
+	return changes, strconv.FormatInt(next, 10), nil
+}
+
+func (m *MemoryStore) PruneChanges(_ context.Context, before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for n < len(m.changes) && m.changes[n].At.Before(before) {
+		m.changesPruned = m.changes[n].seq
+		n++
+	}
+	m.changes = slices.Delete(m.changes, 0, n)
+	return n, nil
+}
+
+func (m *MemoryStore) ChangeLag(_ context.Context, cursor string) (time.Duration, error) {
+	after, err := strconv.ParseInt(cursor, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: malformed change cursor %q", ErrInvalidArgument, cursor)
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	i, _ := slices.BinarySearchFunc(m.changes, after+1, func(c *memoryChange, seq int64) int {
+		return int(c.seq - seq)
+	})
+	if i == len(m.changes) {
+		return 0, nil
+	}
+	return time.Since(m.changes[i].At), nil
+}
@@ -2,27 +2,109 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"iter"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 
 	"github.com/dws33/WB_ZeroProj/internal/model"
+	"github.com/dws33/WB_ZeroProj/internal/pii"
 )
 
+// Storage пишет в primary (pool), а GetOrder, ListOrders, FindOrders
+// и загрузку всех заказов по возможности читает из реплик (WithReplicas).
 type Storage struct {
-	pool *pgxpool.Pool
+	pool     *pgxpool.Pool
+	replicas *replicaSet
+	pii      *pii.Cipher
 }
 
-func New(ctx context.Context, pool *pgxpool.Pool) (*Storage, error) {
+func New(ctx context.Context, pool *pgxpool.Pool, opts ...Option) (*Storage, error) {
 	err := pool.Ping(ctx)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	replicas, err := newReplicaSet(ctx, &o)
 	if err != nil {
 		return nil, err
 	}
-	return &Storage{pool: pool}, nil
+	return &Storage{pool: pool, replicas: replicas, pii: o.pii}, nil
 }
 
+// Close останавливает проверку реплик и закрывает пулы, созданные по
+// WithReplicaDSNs. Пул primary закрывает его владелец.
+func (s *Storage) Close() {
+	s.replicas.close()
+}
+
+// CreateOrder сохраняет заказ целиком в одной транзакции.
+// Повторный order_uid или transaction возвращает ErrConflict.
+// С WithPII поля доставки order заменяются зашифрованными значениями.
 func (s *Storage) CreateOrder(ctx context.Context, order *model.Order) error {
+	if err := s.createOrder(ctx, order); err != nil {
+		return wrapErr(err)
+	}
+	s.replicas.wrote(ctx, s.pool)
+	return nil
+}
+
+// deleteOrder удаляет заказ вместе с оплатой; доставка и товары удаляются
+// каскадно через order_keys.
+func (s *Storage) deleteOrder(ctx context.Context, uid string) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return wrapErr(err)
+	}
+	defer tx.Rollback(ctx)
+
+	var paymentID string
+	err = tx.QueryRow(ctx, `SELECT payment_id FROM orders WHERE order_uid = $1`, uid).Scan(&paymentID)
+	if err != nil {
+		return wrapErr(err)
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM order_keys WHERE order_uid = $1`, uid); err != nil {
+		return wrapErr(err)
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM transactions WHERE transactions_uid = $1`, paymentID); err != nil {
+		return wrapErr(err)
+	}
+	if err := recordChanges(ctx, tx, ChangeDelete, uid); err != nil {
+		return wrapErr(err)
+	}
+	return wrapErr(tx.Commit(ctx))
+}
+
+// read выполняет чтение query на реплике, а если подходящей нет или она
+// недоступна — на primary. Заказ, не найденный на реплике, ищется и в primary:
+// его мог только что записать другой экземпляр сервиса.
+func (s *Storage) read(ctx context.Context, query func(*pgxpool.Pool) error) error {
+	if r := s.replicas.pick(ctx); r != nil {
+		err := query(r.pool)
+		switch {
+		case err == nil || ctx.Err() != nil:
+			return err
+		case errors.Is(err, pgx.ErrNoRows):
+		case errors.Is(wrapErr(err), ErrUnavailable):
+			s.replicas.markDown(r, err)
+		default:
+			return err
+		}
+	}
+	return query(s.pool)
+}
+
+func (s *Storage) createOrder(ctx context.Context, order *model.Order) error {
+	sealed, err := s.sealDelivery(ctx, order.Delivery)
+	if err != nil {
+		return err
+	}
+
 	tx, err := s.pool.Begin(ctx)
 	if err != nil {
 		return err
@@ -45,6 +127,13 @@ func (s *Storage) CreateOrder(ctx context.Context, order *model.Order) error {
 		return err
 	}
 
+	// order_keys обеспечивает уникальность order_uid во всех секциях orders
+	_, err = tx.Exec(ctx, `INSERT INTO order_keys (order_uid, date_created) VALUES ($1, $2)`,
+		order.OrderUID, order.DateCreated)
+	if err != nil {
+		return err
+	}
+
 	// Вставка в orders
 	_, err = tx.Exec(ctx, `
 		INSERT INTO orders (
@@ -62,28 +151,44 @@ func (s *Storage) CreateOrder(ctx context.Context, order *model.Order) error {
 
 	_, err = tx.Exec(ctx, `
 		INSERT INTO deliveries (
-			order_uid, name, phone, zip, city, address, region, email
-		) VALUES ($1,$2,$3,$4,$5,$6,$7,$8)
+			order_uid, date_created, name, phone, zip, city, address, region, email,
+			pii_key_id, phone_bidx, email_bidx
+		) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12)
 	`,
-		order.OrderUID,
+		order.OrderUID, order.DateCreated,
 		order.Delivery.Name, order.Delivery.Phone, order.Delivery.Zip,
 		order.Delivery.City, order.Delivery.Address, order.Delivery.Region,
 		order.Delivery.Email,
+		sealed.keyID, sealed.phoneIndex, sealed.emailIndex,
 	)
 	if err != nil {
 		return err
 	}
 
+	if err := insertItems(ctx, tx, order); err != nil {
+		return err
+	}
+
+	if err := recordChanges(ctx, tx, ChangeCreate, order.OrderUID); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// insertItems вставляет товары заказа через COPY.
+func insertItems(ctx context.Context, tx pgx.Tx, order *model.Order) error {
 	copyCount, err := tx.CopyFrom(ctx,
 		pgx.Identifier{"items"},
 		[]string{
-			"order_uid", "chrt_id", "track_number", "price", "rid", "name",
+			"order_uid", "date_created", "chrt_id", "track_number", "price", "rid", "name",
 			"sale", "size", "total_price", "nm_id", "brand", "status",
 		},
 		pgx.CopyFromSlice(len(order.Items), func(i int) ([]any, error) {
 			item := order.Items[i]
 			return []any{
 				order.OrderUID,
+				order.DateCreated,
 				item.ChrtID,
 				item.TrackNumber,
 				item.Price,
@@ -104,94 +209,84 @@ func (s *Storage) CreateOrder(ctx context.Context, order *model.Order) error {
 	if copyCount != int64(len(order.Items)) {
 		return fmt.Errorf("expected to insert %d items, but inserted %d", len(order.Items), copyCount)
 	}
-
-	return tx.Commit(ctx)
+	return nil
 }
 
-func (s *Storage) GetAllOrders(ctx context.Context) ([]*model.Order, error) {
-	const ordersQuery = `
+// selectOrdersQuery читает заказ вместе с доставкой, оплатой и товарами
+// за один запрос: товары собираются в JSON-массив коррелированным подзапросом.
+// Удаленные заказы (order_keys.deleted_at) не читаются.
+const selectOrdersQuery = `
        SELECT
            o.order_uid, o.track_number, o.entry, o.locale, o.internal_signature, o.customer_id,
            o.delivery_service, o.shardkey, o.sm_id, o.date_created, o.oof_shard,
            d.name, d.phone, d.zip, d.city, d.address, d.region, d.email,
-           t.transactions_uid, t.request_id, t.currency, t.provider, t.amount, t.payment_dt, t.bank, t.delivery_cost, t.goods_total, t.custom_fee
+           t.transactions_uid, t.request_id, t.currency, t.provider, t.amount, t.payment_dt, t.bank, t.delivery_cost, t.goods_total, t.custom_fee,
+           COALESCE((
+               SELECT json_agg(json_build_object(
+                   'chrt_id', i.chrt_id, 'track_number', i.track_number, 'price', i.price,
+                   'rid', i.rid, 'name', i.name, 'sale', i.sale, 'size', i.size,
+                   'total_price', i.total_price, 'nm_id', i.nm_id, 'brand', i.brand,
+                   'status', i.status
+               ) ORDER BY i.id)
+               FROM items i
+               WHERE i.order_uid = o.order_uid AND i.date_created = o.date_created
+           ), '[]'::json)
        FROM orders o
-       LEFT JOIN deliveries d ON o.order_uid = d.order_uid
+       JOIN order_keys k ON k.order_uid = o.order_uid AND k.deleted_at IS NULL
+       LEFT JOIN deliveries d ON o.order_uid = d.order_uid AND o.date_created = d.date_created
        LEFT JOIN transactions t ON o.payment_id = t.transactions_uid
     `
 
-	rows, err := s.pool.Query(ctx, ordersQuery)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var orders []*model.Order
-
-	for rows.Next() {
-		order := new(model.Order)
+func (s *Storage) GetAllOrders(ctx context.Context) ([]*model.Order, error) {
+	orders, err := s.queryOrders(ctx, selectOrdersQuery)
+	return orders, wrapErr(err)
+}
 
-		err := rows.Scan(orderToPtrs(order)...)
-		if err != nil {
-			return nil, err
-		}
+// AllOrders — потоковый вариант GetAllOrders: заказы читаются по мере
+// итерации, без накопления всего результата в памяти. Итерация
+// прекращается после первой ошибки.
+func (s *Storage) AllOrders(ctx context.Context) iter.Seq2[*model.Order, error] {
+	return s.iterOrders(ctx, selectOrdersQuery)
+}
 
-		order.Items, err = getAllItems(ctx, s.pool, order.OrderUID)
+func (s *Storage) queryOrders(ctx context.Context, query string, args ...any) ([]*model.Order, error) {
+	var orders []*model.Order
+	for order, err := range s.iterOrders(ctx, query, args...) {
 		if err != nil {
 			return nil, err
 		}
 		orders = append(orders, order)
 	}
-
-	if err = rows.Err(); err != nil {
-		return nil, err
-	}
-
 	return orders, nil
 }
 
-type rowQueryer interface {
-	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
-}
-
-func getAllItems(ctx context.Context, q rowQueryer, orderId string) ([]*model.Item, error) {
-	const itemsQuery = `
-            SELECT chrt_id, track_number, price, rid, name, sale, size, total_price, nm_id, brand, status
-            FROM items
-            WHERE order_uid = $1
-        `
-	rows, err := q.Query(ctx, itemsQuery, orderId)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var items []*model.Item
-
-	for rows.Next() {
-		item := new(model.Item)
-		err := rows.Scan(
-			&item.ChrtID,
-			&item.TrackNumber,
-			&item.Price,
-			&item.RID,
-			&item.Name,
-			&item.Sale,
-			&item.Size,
-			&item.TotalPrice,
-			&item.NmID,
-			&item.Brand,
-			&item.Status,
-		)
+func (s *Storage) iterOrders(ctx context.Context, query string, args ...any) iter.Seq2[*model.Order, error] {
+	return func(yield func(*model.Order, error) bool) {
+		var rows pgx.Rows
+		err := s.read(ctx, func(pool *pgxpool.Pool) (err error) {
+			rows, err = pool.Query(ctx, query, args...)
+			return err
+		})
 		if err != nil {
-			return nil, err
+			yield(nil, wrapErr(err))
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			order := new(model.Order)
+			if err := rows.Scan(orderToPtrs(order)...); err != nil {
+				yield(nil, wrapErr(err))
+				return
+			}
+			if !yield(order, nil) {
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			yield(nil, wrapErr(err))
 		}
-		items = append(items, item)
-	}
-	if err = rows.Err(); err != nil {
-		return nil, err
 	}
-	return items, nil
 }
 
 func orderToPtrs(order *model.Order) []any {
@@ -229,30 +324,25 @@ func orderToPtrs(order *model.Order) []any {
 		&order.Payment.DeliveryCost,
 		&order.Payment.GoodsTotal,
 		&order.Payment.CustomFee,
+
+		&order.Items,
 	}
 }
 
+// GetOrder возвращает заказ по order_uid; ErrNotFound — такого заказа нет.
 func (s *Storage) GetOrder(ctx context.Context, uid string) (*model.Order, error) {
-	const orderQuery = `
-       SELECT
-           o.order_uid, o.track_number, o.entry, o.locale, o.internal_signature, o.customer_id,
-           o.delivery_service, o.shardkey, o.sm_id, o.date_created, o.oof_shard,
-           d.name, d.phone, d.zip, d.city, d.address, d.region, d.email,
-           t.transactions_uid, t.request_id, t.currency, t.provider, t.amount, t.payment_dt, t.bank, t.delivery_cost, t.goods_total, t.custom_fee
-       FROM orders o
-       LEFT JOIN deliveries d ON o.order_uid = d.order_uid
-       LEFT JOIN transactions t ON o.payment_id = t.transactions_uid
-       WHERE o.order_uid = $1
-   `
+	order, err := s.getOrder(ctx, uid)
+	return order, wrapErr(err)
+}
 
-	order := new(model.Order)
+func (s *Storage) getOrder(ctx context.Context, uid string) (*model.Order, error) {
+	const orderQuery = selectOrdersQuery + ` WHERE o.order_uid = $1`
 
-	err := s.pool.QueryRow(ctx, orderQuery, uid).Scan(orderToPtrs(order)...)
-	if err != nil {
-		return nil, err
-	}
+	order := new(model.Order)
 
-	order.Items, err = getAllItems(ctx, s.pool, order.OrderUID)
+	err := s.read(ctx, func(pool *pgxpool.Pool) error {
+		return pool.QueryRow(ctx, orderQuery, uid).Scan(orderToPtrs(order)...)
+	})
 	if err != nil {
 		return nil, err
 	}
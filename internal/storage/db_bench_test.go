@@ -0,0 +1,176 @@
+package storage_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/dws33/WB_ZeroProj/internal/model"
+	"github.com/dws33/WB_ZeroProj/internal/storage"
+	"github.com/dws33/WB_ZeroProj/internal/storage/storagetest"
+)
+
+// Бенчмарки сравнивают чтение заказа одним запросом с json_agg товаров
+// (Storage) и прежнее чтение: заказ с доставкой и оплатой, затем товары
+// отдельным запросом на каждый заказ. Запускаются только с TEST_POSTGRES_DSN:
+//
+//	TEST_POSTGRES_DSN=... go test ./internal/storage -run x -bench 'Order'
+
+const (
+	benchOrders = 200
+	benchItems  = 5
+)
+
+// multiOrderQuery — заказ без товаров, как до чтения одним запросом.
+const multiOrderQuery = `
+	SELECT
+		o.order_uid, o.track_number, o.entry, o.locale, o.internal_signature, o.customer_id,
+		o.delivery_service, o.shardkey, o.sm_id, o.date_created, o.oof_shard,
+		d.name, d.phone, d.zip, d.city, d.address, d.region, d.email,
+		t.transactions_uid, t.request_id, t.currency, t.provider, t.amount, t.payment_dt, t.bank,
+		t.delivery_cost, t.goods_total, t.custom_fee
+	FROM orders o
+	JOIN order_keys k ON k.order_uid = o.order_uid AND k.deleted_at IS NULL
+	LEFT JOIN deliveries d ON o.order_uid = d.order_uid AND o.date_created = d.date_created
+	LEFT JOIN transactions t ON o.payment_id = t.transactions_uid
+`
+
+func newBenchStorage(b *testing.B) (*storage.Storage, *pgxpool.Pool) {
+	b.Helper()
+	ctx := context.Background()
+	pool := storagetest.PostgresPool(b)
+	s, err := storage.New(ctx, pool)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(s.Close)
+	for i := range benchOrders {
+		order := storagetest.NewOrder(fmt.Sprint("bench-", i), i)
+		item := order.Items[0]
+		order.Items = nil
+		for j := range benchItems {
+			it := *item
+			it.RID = fmt.Sprintf("rid-bench-%d-%d", i, j)
+			order.Items = append(order.Items, &it)
+		}
+		if err := s.CreateOrder(ctx, order); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return s, pool
+}
+
+func scanMultiOrder(row pgx.Row) (*model.Order, error) {
+	o := &model.Order{Delivery: new(model.Delivery), Payment: new(model.Payment)}
+	d, p := o.Delivery, o.Payment
+	err := row.Scan(
+		&o.OrderUID, &o.TrackNumber, &o.Entry, &o.Locale, &o.InternalSignature, &o.CustomerID,
+		&o.DeliveryService, &o.ShardKey, &o.SmID, &o.DateCreated, &o.OofShard,
+		&d.Name, &d.Phone, &d.Zip, &d.City, &d.Address, &d.Region, &d.Email,
+		&p.Transaction, &p.RequestID, &p.Currency, &p.Provider, &p.Amount, &p.PaymentDT, &p.Bank,
+		&p.DeliveryCost, &p.GoodsTotal, &p.CustomFee,
+	)
+	return o, err
+}
+
+func multiItems(ctx context.Context, pool *pgxpool.Pool, order *model.Order) error {
+	rows, err := pool.Query(ctx, `
+		SELECT chrt_id, track_number, price, rid, name, sale, size, total_price, nm_id, brand, status
+		FROM items
+		WHERE order_uid = $1 AND date_created = $2
+		ORDER BY id
+	`, order.OrderUID, order.DateCreated)
+	if err != nil {
+		return err
+	}
+	order.Items, err = pgx.CollectRows(rows, pgx.RowToAddrOfStructByPos[model.Item])
+	return err
+}
+
+func multiGetOrder(ctx context.Context, pool *pgxpool.Pool, uid string) (*model.Order, error) {
+	order, err := scanMultiOrder(pool.QueryRow(ctx, multiOrderQuery+` WHERE o.order_uid = $1`, uid))
+	if err != nil {
+		return nil, err
+	}
+	return order, multiItems(ctx, pool, order)
+}
+
+func multiGetAllOrders(ctx context.Context, pool *pgxpool.Pool) ([]*model.Order, error) {
+	rows, err := pool.Query(ctx, multiOrderQuery)
+	if err != nil {
+		return nil, err
+	}
+	orders, err := pgx.CollectRows(rows, func(r pgx.CollectableRow) (*model.Order, error) {
+		return scanMultiOrder(r)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, order := range orders {
+		if err := multiItems(ctx, pool, order); err != nil {
+			return nil, err
+		}
+	}
+	return orders, nil
+}
+
+func BenchmarkGetOrder(b *testing.B) {
+	storagetest.RequirePostgres(b)
+	ctx := context.Background()
+	s, pool := newBenchStorage(b)
+
+	check := func(b *testing.B, order *model.Order, err error) {
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(order.Items) != benchItems {
+			b.Fatalf("order %s: %d items, want %d", order.OrderUID, len(order.Items), benchItems)
+		}
+	}
+	b.Run("json_agg", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := range b.N {
+			order, err := s.GetOrder(ctx, fmt.Sprint("bench-", i%benchOrders))
+			check(b, order, err)
+		}
+	})
+	b.Run("multi-query", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := range b.N {
+			order, err := multiGetOrder(ctx, pool, fmt.Sprint("bench-", i%benchOrders))
+			check(b, order, err)
+		}
+	})
+}
+
+func BenchmarkGetAllOrders(b *testing.B) {
+	storagetest.RequirePostgres(b)
+	ctx := context.Background()
+	s, pool := newBenchStorage(b)
+
+	check := func(b *testing.B, orders []*model.Order, err error) {
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(orders) != benchOrders {
+			b.Fatalf("%d orders, want %d", len(orders), benchOrders)
+		}
+	}
+	b.Run("json_agg", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			orders, err := s.GetAllOrders(ctx)
+			check(b, orders, err)
+		}
+	})
+	b.Run("multi-query", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			orders, err := multiGetAllOrders(ctx, pool)
+			check(b, orders, err)
+		}
+	})
+}
@@ -0,0 +1,37 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dws33/WB_ZeroProj/internal/storage"
+	"github.com/dws33/WB_ZeroProj/internal/storage/storagetest"
+)
+
+// Тесты на PostgreSQL запускаются только с TEST_POSTGRES_DSN, например:
+//
+//	TEST_POSTGRES_DSN="host=localhost user=postgres password=postgres dbname=orders sslmode=disable" \
+//		go test ./internal/storage
+
+func TestStorage(t *testing.T) {
+	storagetest.RequirePostgres(t)
+	storagetest.Run(t, func(t *testing.T) storage.OrderStore {
+		s, err := storage.New(context.Background(), storagetest.PostgresPool(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(s.Close)
+		return s
+	})
+}
+
+func TestDocumentStorage(t *testing.T) {
+	storagetest.RequirePostgres(t)
+	storagetest.Run(t, func(t *testing.T) storage.OrderStore {
+		s, err := storage.NewDocument(context.Background(), storagetest.PostgresPool(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
@@ -0,0 +1,405 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/dws33/WB_ZeroProj/internal/model"
+)
+
+// Действия журнала AuditRecord.
+const (
+	AuditDelete = "delete"
+	AuditErase  = "erase"
+	AuditPurge  = "purge"
+)
+
+// PurgeActor — исполнитель окончательного удаления в журнале.
+const PurgeActor = "system:purge"
+
+// purgeBatch — сколько заказов PurgeDeleted удаляет в одной транзакции.
+const purgeBatch = 500
+
+// AuditRecord — запись журнала: кто и когда удалил заказ, стер его
+// персональные данные или окончательно удалил.
+type AuditRecord struct {
+	OrderUID string    `json:"order_uid"`
+	Action   string    `json:"action"`
+	Actor    string    `json:"actor"`
+	At       time.Time `json:"at"`
+}
+
+// DeleteStore — удаление заказов и персональных данных.
+type DeleteStore interface {
+	// DeleteOrder помечает заказ удаленным: он пропадает из чтения, но его
+	// order_uid остается занятым — повторная доставка вернет ErrConflict.
+	// ErrNotFound — заказа нет или он уже удален.
+	DeleteOrder(ctx context.Context, uid, actor string) error
+	// EraseOrderPII стирает имя, телефон, адрес и email доставки, customer_id
+	// (в том числе в копии order_documents) и исходные сообщения заказа;
+	// оплата остается для бухгалтерии.
+	// Работает и для удаленного, но еще не очищенного заказа.
+	EraseOrderPII(ctx context.Context, uid, actor string) error
+	// PurgeDeleted окончательно удаляет заказы, удаленные раньше before,
+	// вместе с оплатой, исходными сообщениями, метаданными получения,
+	// историей исправлений, статусов заказа и товаров, возвратами и копией
+	// в order_documents.
+	PurgeDeleted(ctx context.Context, before time.Time) (int, error)
+	// AuditLog возвращает журнал заказа от старых записей к новым.
+	AuditLog(ctx context.Context, uid string) ([]*AuditRecord, error)
+}
+
+// erasePII стирает персональные данные заказа order.
+func erasePII(order *model.Order) {
+	order.CustomerID = ""
+	if d := order.Delivery; d != nil {
+		d.Name, d.Phone, d.Address, d.Email = "", "", "", ""
+	}
+}
+
+func (s *Storage) DeleteOrder(ctx context.Context, uid, actor string) error {
+	err := s.audited(ctx, uid, AuditDelete, actor, func(tx pgx.Tx) (bool, error) {
+		tag, err := tx.Exec(ctx, `
+			UPDATE order_keys SET deleted_at = now(), deleted_by = $2
+			WHERE order_uid = $1 AND deleted_at IS NULL
+		`, uid, actor)
+		return tag.RowsAffected() > 0, err
+	})
+	if err == nil {
+		s.replicas.wrote(ctx, s.pool)
+	}
+	return err
+}
+
+func (s *Storage) EraseOrderPII(ctx context.Context, uid, actor string) error {
+	err := s.audited(ctx, uid, AuditErase, actor, func(tx pgx.Tx) (bool, error) {
+		tag, err := tx.Exec(ctx, `UPDATE orders SET customer_id = '' WHERE order_uid = $1`, uid)
+		if err != nil || tag.RowsAffected() == 0 {
+			return false, err
+		}
+		if _, err := tx.Exec(ctx, `
+			UPDATE deliveries SET name = '', phone = '', address = '', email = '',
+				pii_key_id = NULL, phone_bidx = NULL, email_bidx = NULL
+			WHERE order_uid = $1
+		`, uid); err != nil {
+			return false, err
+		}
+		// копия заказа для документного режима (миграция 0004, sync-documents)
+		if _, err := tx.Exec(ctx, `
+			UPDATE order_documents
+			SET doc = doc || jsonb_build_object('customer_id', '', 'delivery',
+				COALESCE(doc->'delivery', '{}') || '{"name": "", "phone": "", "address": "", "email": ""}')
+			WHERE order_uid = $1
+		`, uid); err != nil {
+			return false, err
+		}
+		// исходные сообщения содержат те же данные; заказ в них не отредактировать
+		_, err = tx.Exec(ctx, `DELETE FROM raw_messages WHERE order_uid = $1`, uid)
+		return true, err
+	})
+	if err == nil {
+		s.replicas.wrote(ctx, s.pool)
+	}
+	return err
+}
+
+// audited выполняет change и запись в журнал в одной транзакции;
+// change возвращает false, если заказа нет.
+func (s *Storage) audited(ctx context.Context, uid, action, actor string, change func(pgx.Tx) (bool, error)) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return wrapErr(err)
+	}
+	defer tx.Rollback(ctx)
+
+	ok, err := change(tx)
+	if err != nil {
+		return wrapErr(err)
+	}
+	if !ok {
+		return fmt.Errorf("%w: order %q", ErrNotFound, uid)
+	}
+	if _, err := tx.Exec(ctx, `INSERT INTO order_audit (order_uid, action, actor) VALUES ($1, $2, $3)`,
+		uid, action, actor); err != nil {
+		return wrapErr(err)
+	}
+	// виды изменений журнала совпадают с действиями аудита
+	if err := recordChanges(ctx, tx, action, uid); err != nil {
+		return wrapErr(err)
+	}
+	return wrapErr(tx.Commit(ctx))
+}
+
+func (s *Storage) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	uids, err := s.purgeDeleted(ctx, before)
+	return len(uids), err
+}
+
+// purgeDeleted очищает заказы пачками по purgeBatch и возвращает их order_uid.
+func (s *Storage) purgeDeleted(ctx context.Context, before time.Time) ([]string, error) {
+	var purged []string
+	for {
+		uids, err := s.purgeBatch(ctx, before)
+		purged = append(purged, uids...)
+		if err != nil || len(uids) < purgeBatch {
+			return purged, wrapErr(err)
+		}
+	}
+}
+
+func (s *Storage) purgeBatch(ctx context.Context, before time.Time) ([]string, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `
+		SELECT order_uid FROM order_keys
+		WHERE deleted_at < $1 AND purged_at IS NULL
+		ORDER BY deleted_at
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED
+	`, before, purgeBatch)
+	if err != nil {
+		return nil, err
+	}
+	uids, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil || len(uids) == 0 {
+		return nil, err
+	}
+
+	// доставка и товары удаляются каскадно вместе с orders
+	rows, err = tx.Query(ctx, `DELETE FROM orders WHERE order_uid = ANY($1) RETURNING payment_id`, uids)
+	if err != nil {
+		return nil, err
+	}
+	payments, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+	for _, q := range []struct {
+		sql string
+		arg []string
+	}{
+		{`DELETE FROM transactions WHERE transactions_uid = ANY($1)`, payments},
+		{`DELETE FROM raw_messages WHERE order_uid = ANY($1)`, uids},
+		{`DELETE FROM ingest_meta WHERE order_uid = ANY($1)`, uids},
+		{`DELETE FROM order_history WHERE order_uid = ANY($1)`, uids},
+		{`DELETE FROM order_status_history WHERE order_uid = ANY($1)`, uids},
+		{`DELETE FROM item_status_history WHERE order_uid = ANY($1)`, uids},
+		{`DELETE FROM item_status_events WHERE order_uid = ANY($1)`, uids},
+		{`DELETE FROM refunds WHERE order_uid = ANY($1)`, uids},
+		{`DELETE FROM order_documents WHERE order_uid = ANY($1)`, uids},
+		{`UPDATE order_keys SET purged_at = now() WHERE order_uid = ANY($1)`, uids},
+	} {
+		if _, err := tx.Exec(ctx, q.sql, q.arg); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO order_audit (order_uid, action, actor)
+		SELECT uid, $2, $3 FROM unnest($1::text[]) AS uid
+	`, uids, AuditPurge, PurgeActor); err != nil {
+		return nil, err
+	}
+	if err := recordChanges(ctx, tx, ChangePurge, uids...); err != nil {
+		return nil, err
+	}
+	return uids, tx.Commit(ctx)
+}
+
+// RunPurge каждые interval окончательно удаляет заказы, удаленные больше
+// grace назад, пока не отменен ctx. Ошибки пишутся в лог.
+func RunPurge(ctx context.Context, store DeleteStore, grace, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := store.PurgeDeleted(ctx, time.Now().Add(-grace))
+		if err != nil {
+			log.Println("fail to purge deleted orders:", err)
+		}
+		if n > 0 {
+			log.Printf("%d deleted orders purged", n)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Storage) AuditLog(ctx context.Context, uid string) ([]*AuditRecord, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT order_uid, action, actor, at FROM order_audit
+		WHERE order_uid = $1
+		ORDER BY id
+	`, uid)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	records, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByPos[AuditRecord])
+	return records, wrapErr(err)
+}
+
+// Удаление в шардах: заказ ищется так же, как в GetOrder, журнал пишется
+// в шард заказа, очистка идет во всех шардах.
+
+func (s *ShardedStorage) DeleteOrder(ctx context.Context, uid, actor string) error {
+	shard, err := s.shardOfOrder(ctx, uid)
+	if err != nil {
+		return err
+	}
+	return shard.DeleteOrder(ctx, uid, actor)
+}
+
+func (s *ShardedStorage) EraseOrderPII(ctx context.Context, uid, actor string) error {
+	// удаленный заказ не находится через GetOrder, поэтому стирание
+	// пробуется во всех шардах
+	results, err := scatter(ctx, s, func(ctx context.Context, shard *Storage) (bool, error) {
+		err := shard.EraseOrderPII(ctx, uid, actor)
+		if errors.Is(err, ErrNotFound) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(results, true) {
+		return fmt.Errorf("%w: order %q", ErrNotFound, uid)
+	}
+	_, err = s.home().pool.Exec(ctx, `DELETE FROM raw_messages WHERE order_uid = $1`, uid)
+	return wrapErr(err)
+}
+
+// PurgeDeleted очищает шарды по очереди; архив сообщений и метаданные
+// очищенных заказов удаляются на шарде Home.
+func (s *ShardedStorage) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	var purged int
+	for _, shard := range s.Shards() {
+		uids, err := shard.purgeDeleted(ctx, before)
+		purged += len(uids)
+		if len(uids) > 0 {
+			if _, herr := s.home().pool.Exec(ctx, `DELETE FROM raw_messages WHERE order_uid = ANY($1)`, uids); herr != nil {
+				return purged, wrapErr(herr)
+			}
+			if _, herr := s.home().pool.Exec(ctx, `DELETE FROM ingest_meta WHERE order_uid = ANY($1)`, uids); herr != nil {
+				return purged, wrapErr(herr)
+			}
+		}
+		if err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+func (s *ShardedStorage) AuditLog(ctx context.Context, uid string) ([]*AuditRecord, error) {
+	results, err := scatter(ctx, s, func(ctx context.Context, shard *Storage) ([]*AuditRecord, error) {
+		return shard.AuditLog(ctx, uid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	records := slices.Concat(results...)
+	slices.SortStableFunc(records, func(a, b *AuditRecord) int { return a.At.Compare(b.At) })
+	return records, nil
+}
+
+// shardOfOrder возвращает шард, в котором лежит заказ uid.
+func (s *ShardedStorage) shardOfOrder(ctx context.Context, uid string) (*Storage, error) {
+	if _, err := s.GetOrder(ctx, uid); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shards[s.located[uid]], nil
+}
+
+func (m *MemoryStore) DeleteOrder(_ context.Context, uid, actor string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	order, ok := m.orders[uid]
+	if !ok {
+		return fmt.Errorf("%w: order %q", ErrNotFound, uid)
+	}
+	delete(m.orders, uid)
+	m.deleted[uid] = &deletedOrder{order: order, at: time.Now()}
+	m.audit(uid, AuditDelete, actor)
+	m.recordChange(ChangeDelete, uid)
+	return nil
+}
+
+func (m *MemoryStore) EraseOrderPII(_ context.Context, uid, actor string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	order, ok := m.orders[uid]
+	if d := m.deleted[uid]; !ok && d != nil {
+		order, ok = d.order, d.order != nil
+	}
+	if !ok {
+		return fmt.Errorf("%w: order %q", ErrNotFound, uid)
+	}
+	erasePII(order)
+	m.dropRaw(uid)
+	m.audit(uid, AuditErase, actor)
+	m.recordChange(ChangeErase, uid)
+	return nil
+}
+
+func (m *MemoryStore) PurgeDeleted(_ context.Context, before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var purged int
+	for uid, d := range m.deleted {
+		if d.order == nil || !d.at.Before(before) {
+			continue
+		}
+		if d.order.Payment != nil {
+			delete(m.transactions, d.order.Payment.Transaction)
+		}
+		// запись остается: order_uid по-прежнему занят
+		d.order = nil
+		m.dropRaw(uid)
+		delete(m.meta, uid)
+		delete(m.history, uid)
+		delete(m.statuses, uid)
+		delete(m.itemStatuses, uid)
+		delete(m.refunds, uid)
+		m.audit(uid, AuditPurge, PurgeActor)
+		m.recordChange(ChangePurge, uid)
+		purged++
+	}
+	return purged, nil
+}
+
+func (m *MemoryStore) AuditLog(_ context.Context, uid string) ([]*AuditRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var records []*AuditRecord
+	for _, r := range m.audits {
+		if r.OrderUID == uid {
+			c := *r
+			records = append(records, &c)
+		}
+	}
+	return records, nil
+}
+
+func (m *MemoryStore) audit(uid, action, actor string) {
+	m.audits = append(m.audits, &AuditRecord{OrderUID: uid, Action: action, Actor: actor, At: time.Now()})
+}
+
+// dropRaw удаляет исходные сообщения заказа. Их позиции остаются
+// в rawOffsets: повторно доставленное сообщение не архивируется заново.
+func (m *MemoryStore) dropRaw(uid string) {
+	m.raw = slices.DeleteFunc(m.raw, func(msg *RawMessage) bool { return msg.OrderUID == uid })
+}
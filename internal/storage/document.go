@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/dws33/WB_ZeroProj/internal/model"
+)
+
+// DocumentStorage — OrderStore в документном режиме: заказ хранится целиком
+// в JSONB-колонке order_documents.doc (миграция 0004). Новое поле model.Order
+// не требует изменения схемы; колонки order_uid, transaction, customer_id
+// и track_number вычисляются из документа, date_created записывается вместе
+// с ним; все они индексированы.
+type DocumentStorage struct {
+	pool *pgxpool.Pool
+}
+
+func NewDocument(ctx context.Context, pool *pgxpool.Pool) (*DocumentStorage, error) {
+	if err := pool.Ping(ctx); err != nil {
+		return nil, wrapErr(err)
+	}
+	return &DocumentStorage{pool: pool}, nil
+}
+
+// Pool возвращает пул соединений PostgreSQL (например, для миграций).
+func (s *DocumentStorage) Pool() *pgxpool.Pool {
+	return s.pool
+}
+
+// documentOf возвращает документ заказа и его date_created. Время приводится
+// к UTC с точностью TIMESTAMP, чтобы документ совпадал с тем, что вернули бы
+// другие хранилища.
+func documentOf(order *model.Order) ([]byte, time.Time, error) {
+	o := order.Clone()
+	o.DateCreated = o.DateCreated.UTC().Truncate(time.Microsecond)
+	doc, err := json.Marshal(o)
+	return doc, o.DateCreated, err
+}
+
+// CreateOrder сохраняет документ заказа.
+// Повторный order_uid или transaction возвращает ErrConflict.
+func (s *DocumentStorage) CreateOrder(ctx context.Context, order *model.Order) error {
+	doc, created, err := documentOf(order)
+	if err != nil {
+		return err
+	}
+	_, err = s.pool.Exec(ctx, `
+		WITH d AS (INSERT INTO order_documents (doc, date_created) VALUES ($1, $2) RETURNING order_uid)
+		INSERT INTO order_changes (order_uid, kind) SELECT order_uid, $3 FROM d
+	`, doc, created, ChangeCreate)
+	return wrapErr(err)
+}
+
+// selectDocumentsQuery выдает документы под алиасами selectOrdersQuery
+// (o, t, d, payment_id), чтобы использовать те же listClause и lookupConditions.
+// Поля без отдельной колонки извлекаются из документа.
+const selectDocumentsQuery = `
+       SELECT o.doc
+       FROM (
+           SELECT doc, order_uid, customer_id, track_number, date_created,
+                  transaction AS payment_id,
+                  doc->>'entry' AS entry,
+                  doc->>'locale' AS locale,
+                  doc->>'delivery_service' AS delivery_service
+           FROM order_documents
+       ) o
+       CROSS JOIN LATERAL (
+           SELECT o.doc->'payment'->>'provider' AS provider,
+                  o.doc->'payment'->>'bank' AS bank,
+                  o.doc->'payment'->>'currency' AS currency
+       ) t
+       CROSS JOIN LATERAL (
+           SELECT o.doc->'delivery'->>'phone' AS phone,
+                  o.doc->'delivery'->>'email' AS email
+       ) d
+    `
+
+// documentItems заменяет itemsOfOrder: товары берутся из массива в документе.
+const documentItems = "jsonb_to_recordset(o.doc->'items') AS i(rid TEXT, chrt_id INT, nm_id INT, brand TEXT) WHERE TRUE"
+
+func documentCondition(cond string) string {
+	return strings.ReplaceAll(cond, itemsOfOrder, documentItems)
+}
+
+func (s *DocumentStorage) GetOrder(ctx context.Context, uid string) (*model.Order, error) {
+	var doc []byte
+	err := s.pool.QueryRow(ctx, `SELECT doc FROM order_documents WHERE order_uid = $1`, uid).Scan(&doc)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	order := new(model.Order)
+	if err := json.Unmarshal(doc, order); err != nil {
+		return nil, fmt.Errorf("order %s: %w", uid, err)
+	}
+	return order, nil
+}
+
+func (s *DocumentStorage) GetAllOrders(ctx context.Context) ([]*model.Order, error) {
+	return s.queryDocuments(ctx, selectDocumentsQuery)
+}
+
+func (s *DocumentStorage) ListOrders(ctx context.Context, f OrderFilter) (*OrderPage, error) {
+	clause, args, limit, err := listClause(f,
+		func(n int) string { return fmt.Sprintf("$%d", n) },
+		func(t time.Time) any { return t.UTC() })
+	if err != nil {
+		return nil, err
+	}
+	orders, err := s.queryDocuments(ctx, selectDocumentsQuery+documentCondition(clause), args...)
+	if err != nil {
+		return nil, err
+	}
+	return newPage(orders, limit), nil
+}
+
+func (s *DocumentStorage) FindOrders(ctx context.Context, field LookupField, value string) ([]*model.Order, error) {
+	cond, arg, err := lookupCondition(field, value)
+	if err != nil {
+		return nil, err
+	}
+	query := selectDocumentsQuery + " WHERE " + documentCondition(cond) +
+		fmt.Sprintf(" ORDER BY o.date_created DESC, o.order_uid DESC LIMIT %d", MaxListLimit)
+	return s.queryDocuments(ctx, query, arg)
+}
+
+func (s *DocumentStorage) queryDocuments(ctx context.Context, query string, args ...any) ([]*model.Order, error) {
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	defer rows.Close()
+
+	var orders []*model.Order
+	for rows.Next() {
+		var doc []byte
+		if err := rows.Scan(&doc); err != nil {
+			return nil, wrapErr(err)
+		}
+		order := new(model.Order)
+		if err := json.Unmarshal(doc, order); err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	return orders, wrapErr(rows.Err())
+}
+
+// SyncDocuments копирует в order_documents заказы из нормализованных таблиц,
+// которых там еще нет, и возвращает их число. Нужна при переходе в документный
+// режим, если после миграции 0004 сервисы еще писали в нормализованные таблицы.
+func SyncDocuments(ctx context.Context, pool *pgxpool.Pool) (int, error) {
+	src := &Storage{pool: pool}
+	var copied int
+	for order, err := range src.AllOrders(ctx) {
+		if err != nil {
+			return copied, err
+		}
+		doc, created, err := documentOf(order)
+		if err != nil {
+			return copied, err
+		}
+		tag, err := pool.Exec(ctx, `
+			WITH d AS (INSERT INTO order_documents (doc, date_created) VALUES ($1, $2) ON CONFLICT DO NOTHING RETURNING order_uid)
+			INSERT INTO order_changes (order_uid, kind) SELECT order_uid, $3 FROM d
+		`, doc, created, ChangeCreate)
+		if err != nil {
+			return copied, wrapErr(err)
+		}
+		copied += int(tag.RowsAffected())
+	}
+	return copied, nil
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/puddle/v2"
+)
+
+// Ошибки хранилища. Методы Storage оборачивают ими ошибки драйвера,
+// исходная ошибка доступна через errors.Is / errors.As.
+var (
+	// ErrNotFound — заказ не найден (оборачивает pgx.ErrNoRows).
+	ErrNotFound = errors.New("not found")
+	// ErrConflict — заказ (или его оплата, возврат) с таким идентификатором уже существует.
+	ErrConflict = errors.New("already exists")
+	// ErrUnavailable — БД недоступна: нет соединения, таймаут, пул исчерпан или закрыт.
+	ErrUnavailable = errors.New("storage unavailable")
+	// ErrInvalidArgument — некорректные параметры запроса (курсор, поле поиска и т.п.)
+	// или данные, нарушающие ограничения схемы (NOT NULL, CHECK, внешние ключи).
+	ErrInvalidArgument = errors.New("invalid argument")
+)
+
+// wrapErr классифицирует ошибку драйвера; неизвестные ошибки возвращаются как есть.
+func wrapErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, known := range []error{ErrNotFound, ErrConflict, ErrUnavailable, ErrInvalidArgument} {
+		if errors.Is(err, known) {
+			return err // уже классифицирована
+		}
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch {
+		case pgErr.Code == "23505": // unique_violation
+			return fmt.Errorf("%w: %w", ErrConflict, err)
+		case pgErr.Code == "23502", // not_null_violation
+			pgErr.Code == "23503", // foreign_key_violation
+			pgErr.Code == "23514": // check_violation
+			return fmt.Errorf("%w: %w", ErrInvalidArgument, err)
+		case strings.HasPrefix(pgErr.Code, "08"), // connection_exception
+			strings.HasPrefix(pgErr.Code, "53"), // insufficient_resources
+			pgErr.Code == "57P01",               // admin_shutdown
+			pgErr.Code == "57P03",               // cannot_connect_now
+			pgErr.Code == "57014":               // query_canceled (statement_timeout)
+			return fmt.Errorf("%w: %w", ErrUnavailable, err)
+		}
+		return err
+	}
+
+	var netErr net.Error
+	var connectErr *pgconn.ConnectError
+	if errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, puddle.ErrClosedPool) ||
+		pgconn.Timeout(err) ||
+		errors.As(err, &connectErr) ||
+		errors.As(err, &netErr) {
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	return err
+}
@@ -0,0 +1,418 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/dws33/WB_ZeroProj/internal/model"
+)
+
+// RedactedValue заменяет в истории значения персональных данных: история
+// хранит факт изменения, но не сами данные, поэтому EraseOrderPII ее не трогает.
+const RedactedValue = "[redacted]"
+
+// isPII сообщает, содержит ли путь model.Change персональные данные:
+// customer_id и любое поле доставки — индекс, город и регион вместе
+// с остальными полями указывают на покупателя.
+func isPII(path string) bool {
+	return path == "customer_id" || path == "delivery" || strings.HasPrefix(path, "delivery.")
+}
+
+// OrderRevision — исправление заказа: номер версии после него (исходный
+// заказ — версия 1), кто, когда и почему его внес и какие поля изменились.
+type OrderRevision struct {
+	OrderUID string         `json:"order_uid"`
+	Version  int            `json:"version"`
+	Actor    string         `json:"actor"`
+	Reason   string         `json:"reason"`
+	At       time.Time      `json:"at"`
+	Changes  []model.Change `json:"changes"`
+}
+
+// HistoryStore — исправление заказов с историей изменений.
+type HistoryStore interface {
+	// UpdateOrder заменяет заказ order.OrderUID на order и записывает
+	// изменения в историю. nil без ошибки — заказ не изменился.
+	// order_uid, date_created и транзакция оплаты не меняются, а сумма
+	// оплаты не опускается ниже возвратов (ErrInvalidArgument).
+	// ErrNotFound — заказа нет или он удален.
+	UpdateOrder(ctx context.Context, order *model.Order, actor, reason string) (*OrderRevision, error)
+	// OrderHistory возвращает исправления заказа от старых к новым; пустая
+	// история — заказ не исправлялся. ErrNotFound — заказа нет.
+	OrderHistory(ctx context.Context, uid string) ([]*OrderRevision, error)
+}
+
+// revisionChanges возвращает изменения от prev к next со скрытыми
+// персональными данными или ErrInvalidArgument, если next меняет
+// идентификаторы заказа.
+func revisionChanges(prev, next *model.Order) ([]model.Change, error) {
+	if !next.DateCreated.Equal(prev.DateCreated) {
+		return nil, fmt.Errorf("%w: date_created of order %q cannot be changed", ErrInvalidArgument, prev.OrderUID)
+	}
+	if next.Payment == nil || prev.Payment == nil || next.Payment.Transaction != prev.Payment.Transaction {
+		return nil, fmt.Errorf("%w: payment transaction of order %q cannot be changed", ErrInvalidArgument, prev.OrderUID)
+	}
+	changes := model.Diff(prev, next)
+	for i, c := range changes {
+		if isPII(c.Path) {
+			changes[i].Old, changes[i].New = redact(c.Old), redact(c.New)
+		}
+	}
+	return changes, nil
+}
+
+func redact(v any) any {
+	if v == nil || v == "" {
+		return v
+	}
+	return RedactedValue
+}
+
+// UpdateOrder заменяет заказ в одной транзакции с записью в order_history.
+// С WithPII поля доставки order заменяются зашифрованными значениями.
+func (s *Storage) UpdateOrder(ctx context.Context, order *model.Order, actor, reason string) (*OrderRevision, error) {
+	return s.update(ctx, order.OrderUID, func(*model.Order) (*model.Order, error) { return order, nil }, actor, reason, nil)
+}
+
+// UpdateItemStatuses меняет статусы в заказе, прочитанном в транзакции
+// исправления под блокировкой order_keys; в той же транзакции
+// записывается позиция события (item_status_events, миграция 0018).
+func (s *Storage) UpdateItemStatuses(ctx context.Context, e *ItemStatusEvent) (*OrderRevision, error) {
+	return s.update(ctx, e.OrderUID, func(prev *model.Order) (*model.Order, error) {
+		return withItemStatuses(prev, e.Items)
+	}, e.Actor, e.Reason, e)
+}
+
+func (s *Storage) update(ctx context.Context, uid string, build func(prev *model.Order) (*model.Order, error), actor, reason string, event *ItemStatusEvent) (*OrderRevision, error) {
+	rev, err := s.updateOrder(ctx, uid, build, actor, reason, event)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	if rev != nil {
+		s.replicas.wrote(ctx, s.pool)
+	}
+	return rev, nil
+}
+
+// updateOrder заменяет заказ uid на build(prev), где prev — заказ,
+// прочитанный из primary под блокировкой исправлений. Если задано event
+// с позицией в Kafka, уже примененное событие пропускается.
+func (s *Storage) updateOrder(ctx context.Context, uid string, build func(prev *model.Order) (*model.Order, error), actor, reason string, event *ItemStatusEvent) (*OrderRevision, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// исправления одного заказа выполняются по очереди
+	var locked string
+	if err := tx.QueryRow(ctx, `
+		SELECT order_uid FROM order_keys
+		WHERE order_uid = $1 AND deleted_at IS NULL
+		FOR UPDATE
+	`, uid).Scan(&locked); err != nil {
+		return nil, err
+	}
+	claimed := false
+	if event != nil && event.Topic != "" {
+		if claimed, err = claimEvent(ctx, tx, event); err != nil || !claimed {
+			return nil, err
+		}
+	}
+	prev := new(model.Order)
+	if err := tx.QueryRow(ctx, selectOrdersQuery+` WHERE o.order_uid = $1`, uid).
+		Scan(orderToPtrs(prev)...); err != nil {
+		return nil, err
+	}
+	order, err := build(prev)
+	if err != nil {
+		return nil, err
+	}
+
+	opened, openedPrev := order, prev
+	if s.pii != nil {
+		if opened, err = s.pii.OpenOrder(ctx, order); err != nil {
+			return nil, err
+		}
+		if openedPrev, err = s.pii.OpenOrder(ctx, prev); err != nil {
+			return nil, err
+		}
+	}
+	changes, err := revisionChanges(openedPrev, opened)
+	if err != nil {
+		return nil, err
+	}
+	if len(changes) == 0 {
+		// позиция события сохраняется и без изменений
+		return nil, tx.Commit(ctx)
+	}
+	refunds, err := queryRefunds(ctx, tx, order.OrderUID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRefunded(order, refunds); err != nil {
+		return nil, err
+	}
+	// то же время, что в ключе секции, в том же представлении
+	order.DateCreated = prev.DateCreated
+
+	sealed, err := s.sealDelivery(ctx, order.Delivery)
+	if err != nil {
+		return nil, err
+	}
+	p := order.Payment
+	if _, err := tx.Exec(ctx, `
+		UPDATE transactions SET
+			request_id = $2, currency = $3, provider = $4, amount = $5, payment_dt = $6,
+			bank = $7, delivery_cost = $8, goods_total = $9, custom_fee = $10
+		WHERE transactions_uid = $1
+	`, p.Transaction, p.RequestID, p.Currency, p.Provider, p.Amount, p.PaymentDT,
+		p.Bank, p.DeliveryCost, p.GoodsTotal, p.CustomFee); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(ctx, `
+		UPDATE orders SET
+			track_number = $3, entry = $4, locale = $5, internal_signature = $6, customer_id = $7,
+			delivery_service = $8, shardkey = $9, sm_id = $10, oof_shard = $11
+		WHERE order_uid = $1 AND date_created = $2
+	`, order.OrderUID, order.DateCreated, order.TrackNumber, order.Entry, order.Locale,
+		order.InternalSignature, order.CustomerID, order.DeliveryService, order.ShardKey,
+		order.SmID, order.OofShard); err != nil {
+		return nil, err
+	}
+	d := order.Delivery
+	if _, err := tx.Exec(ctx, `
+		UPDATE deliveries SET
+			name = $3, phone = $4, zip = $5, city = $6, address = $7, region = $8, email = $9,
+			pii_key_id = $10, phone_bidx = $11, email_bidx = $12
+		WHERE order_uid = $1 AND date_created = $2
+	`, order.OrderUID, order.DateCreated, d.Name, d.Phone, d.Zip, d.City, d.Address, d.Region, d.Email,
+		sealed.keyID, sealed.phoneIndex, sealed.emailIndex); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM items WHERE order_uid = $1 AND date_created = $2`,
+		order.OrderUID, order.DateCreated); err != nil {
+		return nil, err
+	}
+	if err := insertItems(ctx, tx, order); err != nil {
+		return nil, err
+	}
+
+	rev := &OrderRevision{OrderUID: order.OrderUID, Actor: actor, Reason: reason, Changes: changes}
+	body, err := json.Marshal(changes)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.QueryRow(ctx, `
+		INSERT INTO order_history (order_uid, version, actor, reason, changes)
+		SELECT $1, COALESCE(max(version), 1) + 1, $2, $3, $4
+		FROM order_history WHERE order_uid = $1
+		RETURNING version, at
+	`, order.OrderUID, actor, reason, body).Scan(&rev.Version, &rev.At); err != nil {
+		return nil, err
+	}
+	itemChanges := itemStatusChanges(prev, order, actor, reason)
+	for _, c := range itemChanges {
+		c.At = rev.At
+	}
+	if err := insertItemStatusChanges(ctx, tx, itemChanges); err != nil {
+		return nil, err
+	}
+	if claimed {
+		if _, err := tx.Exec(ctx, `
+			UPDATE item_status_events SET version = $4
+			WHERE topic = $1 AND kafka_partition = $2 AND kafka_offset = $3
+		`, event.Topic, event.Partition, event.Offset, rev.Version); err != nil {
+			return nil, err
+		}
+	}
+	if err := recordChanges(ctx, tx, ChangeUpdate, order.OrderUID); err != nil {
+		return nil, err
+	}
+	return rev, tx.Commit(ctx)
+}
+
+func (s *Storage) OrderHistory(ctx context.Context, uid string) ([]*OrderRevision, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT order_uid, version, actor, reason, at, changes FROM order_history
+		WHERE order_uid = $1
+		ORDER BY version
+	`, uid)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	revs, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByPos[OrderRevision])
+	if err != nil || len(revs) > 0 {
+		return revs, wrapErr(err)
+	}
+	var exists bool
+	if err := s.pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM order_keys WHERE order_uid = $1)`, uid).
+		Scan(&exists); err != nil {
+		return nil, wrapErr(err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("%w: order %q", ErrNotFound, uid)
+	}
+	return []*OrderRevision{}, nil
+}
+
+// importHistory копирует историю заказа, перенесенного Rebalance.
+func (s *Storage) importHistory(ctx context.Context, revs []*OrderRevision) error {
+	for _, rev := range revs {
+		body, err := json.Marshal(rev.Changes)
+		if err != nil {
+			return err
+		}
+		if _, err := s.pool.Exec(ctx, `
+			INSERT INTO order_history (order_uid, version, actor, reason, at, changes)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT DO NOTHING
+		`, rev.OrderUID, rev.Version, rev.Actor, rev.Reason, rev.At, body); err != nil {
+			return wrapErr(err)
+		}
+	}
+	return nil
+}
+
+// История в шардах хранится в шарде заказа.
+
+// UpdateOrder исправляет заказ в его шарде, а если исправлен shardkey и
+// заказ теперь относится к другому шарду, переносит его туда вместе
+// с историей, статусами и возвратами (как Rebalance). Если перенос
+// не удался, исправление уже сохранено, а заказ перенесет Rebalance.
+func (s *ShardedStorage) UpdateOrder(ctx context.Context, order *model.Order, actor, reason string) (*OrderRevision, error) {
+	target, err := s.m.shardOf(order.ShardKey)
+	if err != nil {
+		return nil, err
+	}
+	var rev *OrderRevision
+	err = s.lockOrder(ctx, order.OrderUID, func() error {
+		shard, err := s.shardOfOrder(ctx, order.OrderUID)
+		if err != nil {
+			return err
+		}
+		if rev, err = shard.UpdateOrder(ctx, order, actor, reason); err != nil {
+			return err
+		}
+		if shard == s.shards[target] {
+			return nil
+		}
+		if err := moveOrder(ctx, shard, s.shards[target], order.OrderUID); err != nil {
+			return fmt.Errorf("move order %s from shard %s to %s: %w",
+				order.OrderUID, s.nameOf(shard), target, err)
+		}
+		s.remember(order.OrderUID, target)
+		return nil
+	})
+	return rev, err
+}
+
+func (s *ShardedStorage) OrderHistory(ctx context.Context, uid string) ([]*OrderRevision, error) {
+	// удаленный заказ не находится через GetOrder, поэтому история
+	// ищется во всех шардах
+	results, err := scatter(ctx, s, func(ctx context.Context, shard *Storage) ([]*OrderRevision, error) {
+		revs, err := shard.OrderHistory(ctx, uid)
+		if errors.Is(err, ErrNotFound) {
+			return nil, nil
+		}
+		return revs, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !slices.ContainsFunc(results, func(revs []*OrderRevision) bool { return revs != nil }) {
+		return nil, fmt.Errorf("%w: order %q", ErrNotFound, uid)
+	}
+	revs := slices.Concat(results...)
+	slices.SortStableFunc(revs, func(a, b *OrderRevision) int { return a.Version - b.Version })
+	return revs, nil
+}
+
+func (m *MemoryStore) UpdateOrder(_ context.Context, order *model.Order, actor, reason string) (*OrderRevision, error) {
+	order = order.Clone()
+	order.DateCreated = order.DateCreated.UTC().Truncate(time.Microsecond)
+	return m.update(order.OrderUID, func(*model.Order) (*model.Order, error) { return order, nil }, actor, reason, nil)
+}
+
+func (m *MemoryStore) UpdateItemStatuses(_ context.Context, e *ItemStatusEvent) (*OrderRevision, error) {
+	return m.update(e.OrderUID, func(prev *model.Order) (*model.Order, error) {
+		return withItemStatuses(prev, e.Items)
+	}, e.Actor, e.Reason, e)
+}
+
+// update заменяет заказ uid на build(prev) под блокировкой хранилища.
+// Позиция события event запоминается, если оно применено без ошибки.
+func (m *MemoryStore) update(uid string, build func(prev *model.Order) (*model.Order, error), actor, reason string, event *ItemStatusEvent) (*OrderRevision, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var pos rawPosition
+	if event != nil && event.Topic != "" {
+		pos = rawPosition{topic: event.Topic, partition: event.Partition, offset: event.Offset}
+		if _, ok := m.itemEvents[pos]; ok {
+			return nil, nil
+		}
+	}
+	prev, ok := m.orders[uid]
+	if !ok {
+		return nil, fmt.Errorf("%w: order %q", ErrNotFound, uid)
+	}
+	order, err := build(prev)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := revisionChanges(prev, order)
+	if err != nil {
+		return nil, err
+	}
+	if len(changes) > 0 {
+		if err := checkRefunded(order, m.refunds[order.OrderUID]); err != nil {
+			return nil, err
+		}
+	}
+	if pos.topic != "" {
+		m.itemEvents[pos] = struct{}{}
+	}
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	m.orders[order.OrderUID] = order
+	m.recordChange(ChangeUpdate, order.OrderUID)
+
+	rev := &OrderRevision{
+		OrderUID: order.OrderUID,
+		Version:  len(m.history[order.OrderUID]) + 2,
+		Actor:    actor,
+		Reason:   reason,
+		At:       time.Now(),
+		Changes:  changes,
+	}
+	m.history[order.OrderUID] = append(m.history[order.OrderUID], rev)
+	for _, c := range itemStatusChanges(prev, order, actor, reason) {
+		c.At = rev.At
+		m.itemStatuses[order.OrderUID] = append(m.itemStatuses[order.OrderUID], c)
+	}
+	c := *rev
+	return &c, nil
+}
+
+func (m *MemoryStore) OrderHistory(_ context.Context, uid string) ([]*OrderRevision, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.orders[uid]
+	if _, deleted := m.deleted[uid]; !ok && !deleted {
+		return nil, fmt.Errorf("%w: order %q", ErrNotFound, uid)
+	}
+	revs := make([]*OrderRevision, 0, len(m.history[uid]))
+	for _, r := range m.history[uid] {
+		c := *r
+		revs = append(revs, &c)
+	}
+	return revs, nil
+}
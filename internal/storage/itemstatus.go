@@ -0,0 +1,309 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/dws33/WB_ZeroProj/internal/model"
+)
+
+// ItemStatusChange — смена статуса товара заказа при исправлении.
+// Товар определяется по rid; From nil — товар добавлен, To nil — удален.
+type ItemStatusChange struct {
+	OrderUID string    `json:"order_uid"`
+	RID      string    `json:"rid"`
+	ChrtID   int       `json:"chrt_id"`
+	From     *int      `json:"from"`
+	To       *int      `json:"to"`
+	Actor    string    `json:"actor"`
+	Reason   string    `json:"reason"`
+	At       time.Time `json:"at"`
+}
+
+// ItemStatusStore — история статусов товаров. Смены записывает
+// HistoryStore.UpdateOrder вместе с исправлением заказа, в том числе
+// исправлением из ItemStatusUpdater.UpdateItemStatuses.
+type ItemStatusStore interface {
+	// ItemStatusHistory возвращает смены статусов товаров заказа от
+	// старых к новым. ErrNotFound — заказа нет.
+	ItemStatusHistory(ctx context.Context, uid string) ([]*ItemStatusChange, error)
+}
+
+// ItemStatusUpdate — новый статус товара rid заказа.
+type ItemStatusUpdate struct {
+	RID    string `json:"rid"`
+	Status int    `json:"status"`
+}
+
+// ItemStatusEvent — событие item_status.updated: новые статусы товаров
+// заказа. Topic, Partition и Offset — позиция события в Kafka, ключ
+// идемпотентности (пустой Topic — без ключа).
+type ItemStatusEvent struct {
+	OrderUID string             `json:"order_uid"`
+	Items    []ItemStatusUpdate `json:"items"`
+	Actor    string             `json:"actor"`
+	Reason   string             `json:"reason"`
+
+	Topic     string `json:"-"`
+	Partition int    `json:"-"`
+	Offset    int64  `json:"-"`
+}
+
+// ItemStatusUpdater — хранилище, меняющее статусы товаров исправлением заказа.
+type ItemStatusUpdater interface {
+	// UpdateItemStatuses меняет статусы товаров заказа e.OrderUID
+	// исправлением: смены попадают в историю заказа и в историю статусов
+	// товаров так же, как при HistoryStore.UpdateOrder. Статусы меняются
+	// в заказе, прочитанном под той же блокировкой, что у UpdateOrder,
+	// поэтому параллельное исправление не откатывается. Товар ищется по rid;
+	// ErrInvalidArgument — такого товара в заказе нет. nil без ошибки —
+	// статусы уже такие или событие с той же позицией в Kafka уже применено.
+	UpdateItemStatuses(ctx context.Context, e *ItemStatusEvent) (*OrderRevision, error)
+}
+
+// withItemStatuses возвращает копию order с новыми статусами товаров.
+func withItemStatuses(order *model.Order, updates []ItemStatusUpdate) (*model.Order, error) {
+	order = order.Clone()
+	for _, u := range updates {
+		i := slices.IndexFunc(order.Items, func(item *model.Item) bool { return item.RID == u.RID })
+		if i < 0 {
+			return nil, fmt.Errorf("%w: order %q has no item with rid %q", ErrInvalidArgument, order.OrderUID, u.RID)
+		}
+		order.Items[i].Status = u.Status
+	}
+	return order, nil
+}
+
+// ItemStatusPoint — статус товара с момента At. StatusInfo заполняет
+// тот, кто показывает ленту (справочник model.ItemStatusCatalog).
+type ItemStatusPoint struct {
+	Status     int                   `json:"status"`
+	StatusInfo *model.ItemStatusInfo `json:"status_info,omitempty"`
+	At         time.Time             `json:"at"`
+	Actor      string                `json:"actor,omitempty"`
+	Reason     string                `json:"reason,omitempty"`
+}
+
+// ItemTimeline — статусы одного товара по времени. Removed — товар
+// удален из заказа исправлением.
+type ItemTimeline struct {
+	RID     string            `json:"rid"`
+	ChrtID  int               `json:"chrt_id"`
+	Name    string            `json:"name,omitempty"`
+	Removed bool              `json:"removed"`
+	Points  []ItemStatusPoint `json:"points"`
+}
+
+// ItemTimelines строит ленты статусов товаров заказа по истории changes:
+// сначала товары заказа в его порядке, затем удаленные. Товар исходного
+// заказа начинается с date_created в статусе до первой смены.
+func ItemTimelines(order *model.Order, changes []*ItemStatusChange) []*ItemTimeline {
+	var timelines []*ItemTimeline
+	byRID := make(map[string]*ItemTimeline)
+	timeline := func(rid string, chrtID int) *ItemTimeline {
+		t, ok := byRID[rid]
+		if !ok {
+			t = &ItemTimeline{RID: rid, ChrtID: chrtID, Points: []ItemStatusPoint{}}
+			byRID[rid] = t
+			timelines = append(timelines, t)
+		}
+		return t
+	}
+	for _, item := range order.Items {
+		timeline(item.RID, item.ChrtID).Name = item.Name
+	}
+	for _, c := range changes {
+		t := timeline(c.RID, c.ChrtID)
+		if len(t.Points) == 0 && c.From != nil {
+			t.Points = append(t.Points, ItemStatusPoint{Status: *c.From, At: order.DateCreated})
+		}
+		if c.To == nil {
+			t.Removed = true
+			continue
+		}
+		t.Removed = false
+		t.Points = append(t.Points, ItemStatusPoint{Status: *c.To, At: c.At, Actor: c.Actor, Reason: c.Reason})
+	}
+	for _, item := range order.Items {
+		if t := byRID[item.RID]; len(t.Points) == 0 {
+			t.Points = append(t.Points, ItemStatusPoint{Status: item.Status, At: order.DateCreated})
+		}
+	}
+	return timelines
+}
+
+// itemStatusChanges возвращает смены статусов товаров от prev к next,
+// сопоставляя товары по rid.
+func itemStatusChanges(prev, next *model.Order, actor, reason string) []*ItemStatusChange {
+	var changes []*ItemStatusChange
+	status := func(item *model.Item) *int {
+		v := item.Status
+		return &v
+	}
+	add := func(item *model.Item, from, to *int) {
+		changes = append(changes, &ItemStatusChange{
+			OrderUID: next.OrderUID, RID: item.RID, ChrtID: item.ChrtID,
+			From: from, To: to, Actor: actor, Reason: reason,
+		})
+	}
+	before := make(map[string]*model.Item, len(prev.Items))
+	for _, item := range prev.Items {
+		before[item.RID] = item
+	}
+	after := make(map[string]bool, len(next.Items))
+	for _, item := range next.Items {
+		after[item.RID] = true
+		was, ok := before[item.RID]
+		switch {
+		case !ok:
+			add(item, nil, status(item))
+		case was.Status != item.Status:
+			add(item, status(was), status(item))
+		}
+	}
+	for _, item := range prev.Items {
+		if !after[item.RID] {
+			add(item, status(item), nil)
+		}
+	}
+	return changes
+}
+
+// insertItemStatusChanges записывает смены в транзакции исправления.
+func insertItemStatusChanges(ctx context.Context, tx pgx.Tx, changes []*ItemStatusChange) error {
+	for _, c := range changes {
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO item_status_history (order_uid, rid, chrt_id, from_status, to_status, actor, reason, at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		`, c.OrderUID, c.RID, c.ChrtID, c.From, c.To, c.Actor, c.Reason, c.At); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Storage) ItemStatusHistory(ctx context.Context, uid string) ([]*ItemStatusChange, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT order_uid, rid, chrt_id, from_status, to_status, actor, reason, at FROM item_status_history
+		WHERE order_uid = $1
+		ORDER BY id
+	`, uid)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	changes, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByPos[ItemStatusChange])
+	if err != nil || len(changes) > 0 {
+		return changes, wrapErr(err)
+	}
+	var exists bool
+	if err := s.pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM order_keys WHERE order_uid = $1)`, uid).
+		Scan(&exists); err != nil {
+		return nil, wrapErr(err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("%w: order %q", ErrNotFound, uid)
+	}
+	return []*ItemStatusChange{}, nil
+}
+
+// importItemStatusHistory копирует смены статусов товаров заказа,
+// перенесенного Rebalance.
+func (s *Storage) importItemStatusHistory(ctx context.Context, uid string, changes []*ItemStatusChange) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return wrapErr(err)
+	}
+	defer tx.Rollback(ctx)
+	// история копируется целиком: копия от прерванного переноса заменяется
+	if _, err := tx.Exec(ctx, `DELETE FROM item_status_history WHERE order_uid = $1`, uid); err != nil {
+		return wrapErr(err)
+	}
+	if err := insertItemStatusChanges(ctx, tx, changes); err != nil {
+		return wrapErr(err)
+	}
+	return wrapErr(tx.Commit(ctx))
+}
+
+func (s *ShardedStorage) ItemStatusHistory(ctx context.Context, uid string) ([]*ItemStatusChange, error) {
+	shard, err := s.shardOfOrder(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	return shard.ItemStatusHistory(ctx, uid)
+}
+
+// UpdateItemStatuses выполняется в шарде заказа: shardkey статусы не меняют.
+// Позиции примененных событий переносятся вместе с заказом (moveOrder).
+func (s *ShardedStorage) UpdateItemStatuses(ctx context.Context, e *ItemStatusEvent) (*OrderRevision, error) {
+	shard, err := s.shardOfOrder(ctx, e.OrderUID)
+	if err != nil {
+		return nil, err
+	}
+	return shard.UpdateItemStatuses(ctx, e)
+}
+
+// appliedEvent — позиция события item_status.updated, примененного к заказу.
+type appliedEvent struct {
+	Topic     string
+	Partition int
+	Offset    int64
+	Version   *int
+	At        time.Time
+}
+
+// claimEvent записывает позицию события e в транзакции исправления;
+// false — событие уже применено.
+func claimEvent(ctx context.Context, tx pgx.Tx, e *ItemStatusEvent) (bool, error) {
+	tag, err := tx.Exec(ctx, `
+		INSERT INTO item_status_events (topic, kafka_partition, kafka_offset, order_uid)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT DO NOTHING
+	`, e.Topic, e.Partition, e.Offset, e.OrderUID)
+	return tag.RowsAffected() > 0, err
+}
+
+func (s *Storage) itemStatusEvents(ctx context.Context, uid string) ([]appliedEvent, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT topic, kafka_partition, kafka_offset, version, at FROM item_status_events
+		WHERE order_uid = $1
+	`, uid)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	events, err := pgx.CollectRows(rows, pgx.RowToStructByPos[appliedEvent])
+	return events, wrapErr(err)
+}
+
+// importItemStatusEvents копирует позиции событий заказа, перенесенного
+// Rebalance: повтор события в новом шарде тоже пропускается.
+func (s *Storage) importItemStatusEvents(ctx context.Context, uid string, events []appliedEvent) error {
+	for _, e := range events {
+		if _, err := s.pool.Exec(ctx, `
+			INSERT INTO item_status_events (topic, kafka_partition, kafka_offset, order_uid, version, at)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT DO NOTHING
+		`, e.Topic, e.Partition, e.Offset, uid, e.Version, e.At); err != nil {
+			return wrapErr(err)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) ItemStatusHistory(_ context.Context, uid string) ([]*ItemStatusChange, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.orders[uid]
+	if _, deleted := m.deleted[uid]; !ok && !deleted {
+		return nil, fmt.Errorf("%w: order %q", ErrNotFound, uid)
+	}
+	changes := make([]*ItemStatusChange, 0, len(m.itemStatuses[uid]))
+	for _, c := range m.itemStatuses[uid] {
+		c := *c
+		changes = append(changes, &c)
+	}
+	return changes, nil
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dws33/WB_ZeroProj/internal/model"
+)
+
+const (
+	DefaultListLimit = 50
+	MaxListLimit     = 500
+)
+
+// ErrInvalidCursor — курсор пагинации поврежден или выдан не этим сервисом.
+var ErrInvalidCursor = fmt.Errorf("%w: cursor", ErrInvalidArgument)
+
+// OrderFilter — условия выборки ListOrders. Пустые поля не фильтруют.
+// CreatedFrom включительно, CreatedTo не включительно.
+type OrderFilter struct {
+	CustomerID      string
+	DeliveryService string
+	Entry           string
+	Locale          string
+	CreatedFrom     time.Time
+	CreatedTo       time.Time
+	PaymentProvider string
+	PaymentBank     string
+	PaymentCurrency string
+	ItemBrand       string
+
+	// Limit — размер страницы, 0 — DefaultListLimit, не больше MaxListLimit.
+	Limit int
+	// Cursor — NextCursor предыдущей страницы, пустой — первая страница.
+	Cursor string
+}
+
+// OrderPage — страница ListOrders. NextCursor пуст на последней странице.
+type OrderPage struct {
+	Orders     []*model.Order `json:"orders"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// cursor — позиция keyset-пагинации: последний заказ предыдущей страницы.
+type cursor struct {
+	DateCreated time.Time `json:"t"`
+	OrderUID    string    `json:"u"`
+}
+
+func (c cursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(b, &c); err != nil || c.OrderUID == "" {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// ListOrders возвращает заказы, подходящие под фильтр, от новых к старым
+// (date_created DESC, order_uid DESC) с пагинацией по курсору.
+func (s *Storage) ListOrders(ctx context.Context, f OrderFilter) (*OrderPage, error) {
+	clause, args, limit, err := listClause(f,
+		func(n int) string { return fmt.Sprintf("$%d", n) },
+		func(t time.Time) any { return t })
+	if err != nil {
+		return nil, err
+	}
+	orders, err := s.queryOrders(ctx, selectOrdersQuery+clause, args...)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	return newPage(orders, limit), nil
+}
+
+// listClause строит WHERE ... ORDER BY ... LIMIT для ListOrders поверх
+// selectOrdersQuery (алиасы o, t, items i). placeholder(n) — n-й параметр
+// в синтаксисе драйвера, timeArg — представление времени для драйвера.
+// Выбирается limit+1 строк, чтобы узнать, есть ли следующая страница.
+func listClause(f OrderFilter, placeholder func(n int) string, timeArg func(time.Time) any) (clause string, args []any, limit int, err error) {
+	limit = listLimit(f.Limit)
+
+	var where []string
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, placeholder(len(args))))
+	}
+	if f.CustomerID != "" {
+		add("o.customer_id = %s", f.CustomerID)
+	}
+	if f.DeliveryService != "" {
+		add("o.delivery_service = %s", f.DeliveryService)
+	}
+	if f.Entry != "" {
+		add("o.entry = %s", f.Entry)
+	}
+	if f.Locale != "" {
+		add("o.locale = %s", f.Locale)
+	}
+	if !f.CreatedFrom.IsZero() {
+		add("o.date_created >= %s", timeArg(f.CreatedFrom))
+	}
+	if !f.CreatedTo.IsZero() {
+		add("o.date_created < %s", timeArg(f.CreatedTo))
+	}
+	if f.PaymentProvider != "" {
+		add("t.provider = %s", f.PaymentProvider)
+	}
+	if f.PaymentBank != "" {
+		add("t.bank = %s", f.PaymentBank)
+	}
+	if f.PaymentCurrency != "" {
+		add("t.currency = %s", f.PaymentCurrency)
+	}
+	if f.ItemBrand != "" {
+		add("EXISTS (SELECT 1 FROM "+itemsOfOrder+" AND i.brand = %s)", f.ItemBrand)
+	}
+	if f.Cursor != "" {
+		c, err := decodeCursor(f.Cursor)
+		if err != nil {
+			return "", nil, 0, err
+		}
+		args = append(args, timeArg(c.DateCreated), c.OrderUID)
+		where = append(where, fmt.Sprintf("(o.date_created, o.order_uid) < (%s, %s)",
+			placeholder(len(args)-1), placeholder(len(args))))
+	}
+
+	if len(where) > 0 {
+		clause = " WHERE " + strings.Join(where, " AND ")
+	}
+	args = append(args, limit+1)
+	clause += " ORDER BY o.date_created DESC, o.order_uid DESC LIMIT " + placeholder(len(args))
+	return clause, args, limit, nil
+}
+
+// listLimit — размер страницы для OrderFilter.Limit.
+func listLimit(limit int) int {
+	if limit <= 0 {
+		return DefaultListLimit
+	}
+	return min(limit, MaxListLimit)
+}
+
+// newPage обрезает выборку из limit+1 строк до страницы и выставляет курсор.
+func newPage(orders []*model.Order, limit int) *OrderPage {
+	page := &OrderPage{Orders: orders}
+	if len(orders) > limit {
+		page.Orders = orders[:limit]
+		last := page.Orders[limit-1]
+		page.NextCursor = cursor{DateCreated: last.DateCreated, OrderUID: last.OrderUID}.encode()
+	}
+	if page.Orders == nil {
+		page.Orders = []*model.Order{}
+	}
+	return page
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/dws33/WB_ZeroProj/internal/model"
+)
+
+// LookupField — идентификатор, по которому ищется заказ.
+type LookupField string
+
+const (
+	ByOrderUID    LookupField = "order_uid"
+	ByTrackNumber LookupField = "track_number"
+	ByTransaction LookupField = "transaction"
+	ByRID         LookupField = "rid"
+	ByChrtID      LookupField = "chrt_id"
+	ByNmID        LookupField = "nm_id"
+	ByPhone       LookupField = "phone"
+	ByEmail       LookupField = "email"
+)
+
+// itemsOfOrder — источник товаров заказа o в подзапросах условий (алиас i).
+// Хранилища с другой схемой подставляют вместо него свой источник.
+const itemsOfOrder = "items i WHERE i.order_uid = o.order_uid"
+
+// lookupConditions — условие WHERE для каждого поля; $1 — искомое значение.
+var lookupConditions = map[LookupField]string{
+	ByOrderUID:    "o.order_uid = $1",
+	ByTrackNumber: "o.track_number = $1",
+	ByTransaction: "o.payment_id = $1",
+	ByRID:         "EXISTS (SELECT 1 FROM " + itemsOfOrder + " AND i.rid = $1)",
+	ByChrtID:      "EXISTS (SELECT 1 FROM " + itemsOfOrder + " AND i.chrt_id = $1)",
+	ByNmID:        "EXISTS (SELECT 1 FROM " + itemsOfOrder + " AND i.nm_id = $1)",
+	ByPhone:       "d.phone = $1",
+	ByEmail:       "d.email = $1",
+}
+
+// blindIndexConditions заменяют lookupConditions, когда доставка
+// зашифрована (WithPII): поиск идет по слепому индексу.
+var blindIndexConditions = map[LookupField]string{
+	ByPhone: "d.phone_bidx = $1",
+	ByEmail: "d.email_bidx = $1",
+}
+
+// lookupCondition возвращает условие lookupConditions и значение параметра $1.
+func lookupCondition(field LookupField, value string) (cond string, arg any, err error) {
+	cond, ok := lookupConditions[field]
+	if !ok {
+		return "", nil, fmt.Errorf("%w: unknown lookup field %q", ErrInvalidArgument, field)
+	}
+	if field == ByChrtID || field == ByNmID {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return "", nil, fmt.Errorf("%w: %s must be a number", ErrInvalidArgument, field)
+		}
+		return cond, n, nil
+	}
+	return cond, value, nil
+}
+
+// FindOrders ищет заказы по значению идентификатора, от новых к старым,
+// не больше MaxListLimit. Одному chrt_id или nm_id может соответствовать много заказов.
+// С WithPII телефон и email ищутся по слепому индексу нормализованного значения.
+func (s *Storage) FindOrders(ctx context.Context, field LookupField, value string) ([]*model.Order, error) {
+	cond, arg, err := lookupCondition(field, value)
+	if err != nil {
+		return nil, err
+	}
+	if bidx, ok := blindIndexConditions[field]; ok && s.pii != nil {
+		cond, arg = bidx, s.pii.BlindIndex(string(field), value)
+	}
+
+	query := selectOrdersQuery + " WHERE " + cond +
+		fmt.Sprintf(" ORDER BY o.date_created DESC, o.order_uid DESC LIMIT %d", MaxListLimit)
+	orders, err := s.queryOrders(ctx, query, arg)
+	return orders, wrapErr(err)
+}
+
+var (
+	numericRe   = regexp.MustCompile(`^[0-9]+$`)
+	upperCaseRe = regexp.MustCompile(`^[A-Z0-9]*[A-Z][A-Z0-9]*$`)
+	phoneRe     = regexp.MustCompile(`^\+[0-9]{7,15}$`)
+)
+
+// DetectLookupFields возвращает поля, в которых стоит искать произвольный
+// идентификатор, в порядке вероятности: строки с "@" — email, "+" и цифры —
+// телефон, числа — chrt_id/nm_id, строки в верхнем регистре — трек-номер,
+// остальное — order_uid, транзакция, rid.
+func DetectLookupFields(id string) []LookupField {
+	switch {
+	case strings.Contains(id, "@"):
+		return []LookupField{ByEmail, ByOrderUID, ByTransaction, ByRID, ByTrackNumber}
+	case phoneRe.MatchString(id):
+		return []LookupField{ByPhone}
+	case numericRe.MatchString(id):
+		return []LookupField{ByChrtID, ByNmID, ByOrderUID, ByTransaction, ByTrackNumber, ByRID, ByPhone}
+	case upperCaseRe.MatchString(id):
+		return []LookupField{ByTrackNumber, ByOrderUID, ByTransaction, ByRID}
+	default:
+		return []LookupField{ByOrderUID, ByTransaction, ByRID, ByTrackNumber}
+	}
+}
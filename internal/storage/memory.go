@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/dws33/WB_ZeroProj/internal/model"
+)
+
+// MemoryStore — OrderStore в памяти процесса с той же семантикой, что у
+// Storage: копии заказов, ErrConflict на повтор order_uid или транзакции,
+// ErrNotFound (оборачивает pgx.ErrNoRows), сортировка и пагинация ListOrders.
+type MemoryStore struct {
+	mu           sync.RWMutex
+	orders       map[string]*model.Order
+	transactions map[string]struct{}
+	raw          []*RawMessage
+	rawOffsets   map[rawPosition]struct{}
+	meta         map[string]*IngestMeta
+	deleted      map[string]*deletedOrder
+	audits       []*AuditRecord
+	history      map[string][]*OrderRevision
+	statuses     map[string][]*StatusChange
+	itemStatuses map[string][]*ItemStatusChange
+	itemEvents   map[rawPosition]struct{} // примененные события item_status.updated
+	refunds      map[string][]*model.Refund
+
+	changes       []*memoryChange
+	changeSeq     int64
+	changesPruned int64 // последний seq, удаленный PruneChanges
+}
+
+// deletedOrder — удаленный заказ; order == nil после PurgeDeleted.
+type deletedOrder struct {
+	order *model.Order
+	at    time.Time
+}
+
+// rawPosition — позиция сообщения в Kafka, ключ идемпотентности ArchiveRaw
+// и UpdateItemStatuses.
+type rawPosition struct {
+	topic     string
+	partition int
+	offset    int64
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		orders:       make(map[string]*model.Order),
+		transactions: make(map[string]struct{}),
+		rawOffsets:   make(map[rawPosition]struct{}),
+		meta:         make(map[string]*IngestMeta),
+		deleted:      make(map[string]*deletedOrder),
+		history:      make(map[string][]*OrderRevision),
+		statuses:     make(map[string][]*StatusChange),
+		itemStatuses: make(map[string][]*ItemStatusChange),
+		itemEvents:   make(map[rawPosition]struct{}),
+		refunds:      make(map[string][]*model.Refund),
+	}
+}
+
+func (m *MemoryStore) CreateOrder(_ context.Context, order *model.Order) error {
+	order = order.Clone()
+	// как у колонки TIMESTAMP в Postgres: микросекунды, без часового пояса
+	order.DateCreated = order.DateCreated.UTC().Truncate(time.Microsecond)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.orders[order.OrderUID]; ok {
+		return fmt.Errorf("%w: order %q", ErrConflict, order.OrderUID)
+	}
+	if _, ok := m.deleted[order.OrderUID]; ok {
+		return fmt.Errorf("%w: order %q was deleted", ErrConflict, order.OrderUID)
+	}
+	if order.Payment != nil {
+		if _, ok := m.transactions[order.Payment.Transaction]; ok {
+			return fmt.Errorf("%w: transaction %q", ErrConflict, order.Payment.Transaction)
+		}
+		m.transactions[order.Payment.Transaction] = struct{}{}
+	}
+	m.orders[order.OrderUID] = order
+	m.recordChange(ChangeCreate, order.OrderUID)
+	return nil
+}
+
+func (m *MemoryStore) GetOrder(_ context.Context, uid string) (*model.Order, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	order, ok := m.orders[uid]
+	if !ok {
+		return nil, fmt.Errorf("%w: %w", ErrNotFound, pgx.ErrNoRows)
+	}
+	return order.Clone(), nil
+}
+
+func (m *MemoryStore) GetAllOrders(_ context.Context) ([]*model.Order, error) {
+	return m.filter(func(*model.Order) bool { return true }), nil
+}
+
+func (m *MemoryStore) ListOrders(_ context.Context, f OrderFilter) (*OrderPage, error) {
+	limit := listLimit(f.Limit)
+
+	var after *cursor
+	if f.Cursor != "" {
+		c, err := decodeCursor(f.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		after = &c
+	}
+
+	orders := m.filter(func(o *model.Order) bool {
+		p := o.Payment
+		if p == nil {
+			p = new(model.Payment)
+		}
+		return match(f.CustomerID, o.CustomerID) &&
+			match(f.DeliveryService, o.DeliveryService) &&
+			match(f.Entry, o.Entry) &&
+			match(f.Locale, o.Locale) &&
+			(f.CreatedFrom.IsZero() || !o.DateCreated.Before(f.CreatedFrom)) &&
+			(f.CreatedTo.IsZero() || o.DateCreated.Before(f.CreatedTo)) &&
+			match(f.PaymentProvider, p.Provider) &&
+			match(f.PaymentBank, p.Bank) &&
+			match(f.PaymentCurrency, p.Currency) &&
+			(f.ItemBrand == "" || slices.ContainsFunc(o.Items, func(i *model.Item) bool { return i.Brand == f.ItemBrand })) &&
+			(after == nil || compareNewestFirst(o, after.DateCreated, after.OrderUID) > 0)
+	})
+	sortNewestFirst(orders)
+	if len(orders) > limit+1 {
+		orders = orders[:limit+1]
+	}
+	return newPage(orders, limit), nil
+}
+
+func (m *MemoryStore) FindOrders(_ context.Context, field LookupField, value string) ([]*model.Order, error) {
+	if _, ok := lookupConditions[field]; !ok {
+		return nil, fmt.Errorf("%w: unknown lookup field %q", ErrInvalidArgument, field)
+	}
+	var num int
+	if field == ByChrtID || field == ByNmID {
+		var err error
+		if num, err = strconv.Atoi(value); err != nil {
+			return nil, fmt.Errorf("%w: %s must be a number", ErrInvalidArgument, field)
+		}
+	}
+	anyItem := func(o *model.Order, pred func(*model.Item) bool) bool {
+		return slices.ContainsFunc(o.Items, pred)
+	}
+
+	orders := m.filter(func(o *model.Order) bool {
+		switch field {
+		case ByOrderUID:
+			return o.OrderUID == value
+		case ByTrackNumber:
+			return o.TrackNumber == value
+		case ByTransaction:
+			return o.Payment != nil && o.Payment.Transaction == value
+		case ByRID:
+			return anyItem(o, func(i *model.Item) bool { return i.RID == value })
+		case ByChrtID:
+			return anyItem(o, func(i *model.Item) bool { return i.ChrtID == num })
+		case ByNmID:
+			return anyItem(o, func(i *model.Item) bool { return i.NmID == num })
+		case ByPhone:
+			return o.Delivery != nil && o.Delivery.Phone == value
+		case ByEmail:
+			return o.Delivery != nil && o.Delivery.Email == value
+		}
+		return false
+	})
+	sortNewestFirst(orders)
+	if len(orders) > MaxListLimit {
+		orders = orders[:MaxListLimit]
+	}
+	return orders, nil
+}
+
+// filter возвращает копии заказов, для которых keep == true.
+func (m *MemoryStore) filter(keep func(*model.Order) bool) []*model.Order {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var orders []*model.Order
+	for _, o := range m.orders {
+		if keep(o) {
+			orders = append(orders, o.Clone())
+		}
+	}
+	return orders
+}
+
+func match(want, got string) bool {
+	return want == "" || want == got
+}
+
+// compareNewestFirst сравнивает заказ с позицией (t, uid) в порядке
+// date_created DESC, order_uid DESC: > 0 — заказ идет после позиции.
+func compareNewestFirst(o *model.Order, t time.Time, uid string) int {
+	if c := t.Compare(o.DateCreated); c != 0 {
+		return c
+	}
+	return cmp.Compare(uid, o.OrderUID)
+}
+
+func sortNewestFirst(orders []*model.Order) {
+	slices.SortFunc(orders, func(a, b *model.Order) int {
+		return compareNewestFirst(a, b.DateCreated, b.OrderUID)
+	})
+}
+
+func (m *MemoryStore) ArchiveRaw(_ context.Context, msg *RawMessage) error {
+	msg = cloneRaw(msg)
+	msg.ReceivedAt = msg.ReceivedAt.Truncate(time.Microsecond)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pos := rawPosition{msg.Topic, msg.Partition, msg.Offset}
+	if _, ok := m.rawOffsets[pos]; ok {
+		return nil
+	}
+	m.rawOffsets[pos] = struct{}{}
+	m.raw = append(m.raw, msg)
+	return nil
+}
+
+func (m *MemoryStore) GetRawMessages(_ context.Context, uid string) ([]*RawMessage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var messages []*RawMessage
+	for _, msg := range m.raw {
+		if msg.OrderUID == uid {
+			messages = append(messages, cloneRaw(msg))
+		}
+	}
+	if len(messages) == 0 {
+		return nil, noRawMessages(uid)
+	}
+	// сообщения добавляются по мере получения, сортировка устойчива
+	slices.SortStableFunc(messages, func(a, b *RawMessage) int {
+		return a.ReceivedAt.Compare(b.ReceivedAt)
+	})
+	return messages, nil
+}
+
+func cloneRaw(msg *RawMessage) *RawMessage {
+	c := *msg
+	c.Payload = bytes.Clone(msg.Payload)
+	c.Headers = make([]RawHeader, len(msg.Headers))
+	for i, h := range msg.Headers {
+		c.Headers[i] = RawHeader{Key: h.Key, Value: bytes.Clone(h.Value)}
+	}
+	return &c
+}
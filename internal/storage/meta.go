@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// KafkaSource — сообщение Kafka, из которого получен заказ.
+// По нему находится исходное сообщение в архиве (RawStore).
+type KafkaSource struct {
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+	Offset    int64  `json:"offset"`
+}
+
+// IngestMeta — откуда и когда получен заказ. Заполнен ровно один источник:
+// Kafka или HTTPClient.
+type IngestMeta struct {
+	Kafka      *KafkaSource `json:"kafka,omitempty"`
+	HTTPClient string       `json:"http_client,omitempty"`
+	IngestedAt time.Time    `json:"ingested_at"`
+	// Instance — экземпляр сервиса, принявший заказ (хост и pid).
+	Instance string `json:"instance"`
+	// SchemaVersion — model.SchemaVersion, которой разобран заказ.
+	SchemaVersion int `json:"schema_version"`
+	// Warnings — замечания, не помешавшие принять заказ (например, неизвестные поля).
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// MetaStore — метаданные получения заказов. Сохраняется первая запись:
+// повторная доставка того же заказа метаданные не меняет.
+type MetaStore interface {
+	SaveIngestMeta(ctx context.Context, uid string, meta *IngestMeta) error
+	// GetIngestMeta возвращает ErrNotFound, если метаданных нет
+	// (например, заказ получен до их появления).
+	GetIngestMeta(ctx context.Context, uid string) (*IngestMeta, error)
+}
+
+func noIngestMeta(uid string) error {
+	return fmt.Errorf("%w: no ingest metadata for order %q", ErrNotFound, uid)
+}
+
+func (s *Storage) SaveIngestMeta(ctx context.Context, uid string, meta *IngestMeta) error {
+	return saveIngestMeta(ctx, s.pool, uid, meta)
+}
+
+func (s *Storage) GetIngestMeta(ctx context.Context, uid string) (*IngestMeta, error) {
+	return getIngestMeta(ctx, s.pool, uid)
+}
+
+func (s *DocumentStorage) SaveIngestMeta(ctx context.Context, uid string, meta *IngestMeta) error {
+	return saveIngestMeta(ctx, s.pool, uid, meta)
+}
+
+func (s *DocumentStorage) GetIngestMeta(ctx context.Context, uid string) (*IngestMeta, error) {
+	return getIngestMeta(ctx, s.pool, uid)
+}
+
+// saveIngestMeta и getIngestMeta работают с таблицей ingest_meta (миграция 0006).
+// Метаданные хранятся документом: новые поля не требуют миграций.
+func saveIngestMeta(ctx context.Context, pool *pgxpool.Pool, uid string, meta *IngestMeta) error {
+	doc, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	_, err = pool.Exec(ctx, `
+		INSERT INTO ingest_meta (order_uid, meta) VALUES ($1, $2)
+		ON CONFLICT (order_uid) DO NOTHING
+	`, uid, doc)
+	return wrapErr(err)
+}
+
+func getIngestMeta(ctx context.Context, pool *pgxpool.Pool, uid string) (*IngestMeta, error) {
+	var doc []byte
+	err := pool.QueryRow(ctx, `SELECT meta FROM ingest_meta WHERE order_uid = $1`, uid).Scan(&doc)
+	if err != nil {
+		err = wrapErr(err)
+		if errors.Is(err, ErrNotFound) {
+			return nil, noIngestMeta(uid)
+		}
+		return nil, err
+	}
+	meta := new(IngestMeta)
+	if err := json.Unmarshal(doc, meta); err != nil {
+		return nil, fmt.Errorf("ingest metadata of order %s: %w", uid, err)
+	}
+	return meta, nil
+}
+
+func (s *SQLiteStore) SaveIngestMeta(ctx context.Context, uid string, meta *IngestMeta) error {
+	doc, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO ingest_meta (order_uid, meta) VALUES (?, ?)
+		ON CONFLICT (order_uid) DO NOTHING
+	`, uid, string(doc))
+	return wrapSQLiteErr(err)
+}
+
+func (s *SQLiteStore) GetIngestMeta(ctx context.Context, uid string) (*IngestMeta, error) {
+	var doc string
+	err := s.db.QueryRowContext(ctx, `SELECT meta FROM ingest_meta WHERE order_uid = ?`, uid).Scan(&doc)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, noIngestMeta(uid)
+	}
+	if err != nil {
+		return nil, wrapSQLiteErr(err)
+	}
+	meta := new(IngestMeta)
+	if err := json.Unmarshal([]byte(doc), meta); err != nil {
+		return nil, fmt.Errorf("ingest metadata of order %s: %w", uid, err)
+	}
+	return meta, nil
+}
+
+func (m *MemoryStore) SaveIngestMeta(_ context.Context, uid string, meta *IngestMeta) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.meta[uid]; !ok {
+		m.meta[uid] = cloneMeta(meta)
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetIngestMeta(_ context.Context, uid string) (*IngestMeta, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	meta, ok := m.meta[uid]
+	if !ok {
+		return nil, noIngestMeta(uid)
+	}
+	return cloneMeta(meta), nil
+}
+
+func cloneMeta(meta *IngestMeta) *IngestMeta {
+	c := *meta
+	if meta.Kafka != nil {
+		k := *meta.Kafka
+		c.Kafka = &k
+	}
+	c.Warnings = slices.Clone(meta.Warnings)
+	return &c
+}
@@ -0,0 +1,401 @@
+// Package migrations применяет версионированные миграции схемы БД.
+//
+// Миграции встроены в бинарник из каталога sql/ и именуются
+// NNNN_name.up.sql / NNNN_name.down.sql. Примененные версии хранятся
+// в таблице schema_migrations. На время работы берется advisory lock,
+// поэтому несколько сервисов, стартующих одновременно, не мешают друг другу.
+//
+// К миграции может прилагаться NNNN_name.check.sql — запросы, возвращающие
+// ключи строк, которые миграция отвергнет (например, новые ограничения).
+// Up не применяет такую миграцию, пока есть нарушения, а Check показывает их
+// заранее. Каждый запрос начинается строкой "-- check: описание" и выбирает
+// одну колонку — ключ строки.
+//
+// Каждая миграция выполняется в транзакции. Если первая строка файла —
+// "-- migrate:no-transaction", файл выполняется без нее, по одной команде
+// (команды разделяются ";" в конце строки) — например, для CREATE INDEX CONCURRENTLY.
+package migrations
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+//go:embed sql/*.sql
+var files embed.FS
+
+// lockKey — ключ pg_advisory_lock, общий для всех сервисов.
+const lockKey = 0x57425f6d6967 // "WB_mig"
+
+const noTxMarker = "-- migrate:no-transaction"
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+	Check   string
+}
+
+// Violation — результат одной проверки перед миграцией.
+type Violation struct {
+	Version int
+	Name    string // имя миграции
+	Check   string // описание проверки
+	Count   int64
+	Sample  []string // первые ключи нарушающих строк
+}
+
+// ViolationError возвращается Up, если миграцию нельзя применить
+// к текущим данным.
+type ViolationError struct {
+	Violations []Violation
+}
+
+func (e *ViolationError) Error() string {
+	var b strings.Builder
+	b.WriteString("existing rows violate pending migration")
+	for _, v := range e.Violations {
+		fmt.Fprintf(&b, "\n  %04d_%s: %s: %d rows, e.g. %s",
+			v.Version, v.Name, v.Check, v.Count, strings.Join(v.Sample, ", "))
+	}
+	return b.String()
+}
+
+// sampleSize — сколько ключей нарушающих строк показывать в отчете.
+const sampleSize = 10
+
+const checkPrefix = "-- check:"
+
+// Status — миграция и время ее применения (нулевое, если не применена).
+type Status struct {
+	Migration
+	AppliedAt time.Time
+}
+
+// Load читает встроенные миграции, отсортированные по версии.
+func Load() ([]Migration, error) {
+	entries, err := fs.ReadDir(files, "sql")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, e := range entries {
+		name := e.Name()
+		base, direction, ok := cutDirection(name)
+		if !ok {
+			return nil, fmt.Errorf("migration %s: expected NNNN_name.{up,down,check}.sql", name)
+		}
+		num, title, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s: missing name", name)
+		}
+		version, err := strconv.Atoi(num)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: bad version: %w", name, err)
+		}
+		body, err := files.ReadFile(path.Join("sql", name))
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: title}
+			byVersion[version] = m
+		} else if m.Name != title {
+			return nil, fmt.Errorf("migration %d: conflicting names %q and %q", version, m.Name, title)
+		}
+		switch direction {
+		case "up":
+			m.Up = string(body)
+		case "down":
+			m.Down = string(body)
+		case "check":
+			m.Check = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s: missing up script", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+func cutDirection(name string) (base, direction string, ok bool) {
+	if base, ok = strings.CutSuffix(name, ".up.sql"); ok {
+		return base, "up", true
+	}
+	if base, ok = strings.CutSuffix(name, ".down.sql"); ok {
+		return base, "down", true
+	}
+	if base, ok = strings.CutSuffix(name, ".check.sql"); ok {
+		return base, "check", true
+	}
+	return "", "", false
+}
+
+// Up применяет все еще не примененные миграции по возрастанию версии.
+func Up(ctx context.Context, pool *pgxpool.Pool) error {
+	return withLock(ctx, pool, func(conn *pgx.Conn) error {
+		migrations, applied, err := state(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			violations, err := check(ctx, conn, m)
+			if err != nil {
+				return fmt.Errorf("migration %04d_%s check: %w", m.Version, m.Name, err)
+			}
+			if len(violations) > 0 {
+				return &ViolationError{Violations: violations}
+			}
+			if err := apply(ctx, conn, m.Up, func(tx execer) error {
+				_, err := tx.Exec(ctx,
+					`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, m.Version, m.Name)
+				return err
+			}); err != nil {
+				return fmt.Errorf("migration %04d_%s up: %w", m.Version, m.Name, err)
+			}
+			log.Printf("migration %04d_%s applied", m.Version, m.Name)
+		}
+		return nil
+	})
+}
+
+// Down откатывает steps последних примененных миграций.
+func Down(ctx context.Context, pool *pgxpool.Pool, steps int) error {
+	return withLock(ctx, pool, func(conn *pgx.Conn) error {
+		migrations, applied, err := state(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			if m.Down == "" {
+				return fmt.Errorf("migration %04d_%s: no down script", m.Version, m.Name)
+			}
+			if err := apply(ctx, conn, m.Down, func(tx execer) error {
+				_, err := tx.Exec(ctx, `DELETE FROM schema_migrations WHERE version = $1`, m.Version)
+				return err
+			}); err != nil {
+				return fmt.Errorf("migration %04d_%s down: %w", m.Version, m.Name, err)
+			}
+			log.Printf("migration %04d_%s rolled back", m.Version, m.Name)
+			steps--
+		}
+		return nil
+	})
+}
+
+// List возвращает все известные миграции с отметкой о применении.
+func List(ctx context.Context, pool *pgxpool.Pool) ([]Status, error) {
+	var statuses []Status
+	err := withLock(ctx, pool, func(conn *pgx.Conn) error {
+		migrations, applied, err := state(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			statuses = append(statuses, Status{Migration: m, AppliedAt: applied[m.Version]})
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// Check выполняет проверки еще не примененных миграций и возвращает
+// найденные нарушения, ничего не меняя в базе.
+func Check(ctx context.Context, pool *pgxpool.Pool) ([]Violation, error) {
+	var violations []Violation
+	err := withLock(ctx, pool, func(conn *pgx.Conn) error {
+		migrations, applied, err := state(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			v, err := check(ctx, conn, m)
+			if err != nil {
+				return fmt.Errorf("migration %04d_%s check: %w", m.Version, m.Name, err)
+			}
+			violations = append(violations, v...)
+		}
+		return nil
+	})
+	return violations, err
+}
+
+// check выполняет запросы из check-файла миграции m. Проверки ссылаются
+// на схему до миграции, поэтому их можно выполнять только для следующей
+// по порядку миграции или когда предыдущие не меняют проверяемые таблицы.
+func check(ctx context.Context, conn *pgx.Conn, m Migration) ([]Violation, error) {
+	var violations []Violation
+	for i, stmt := range splitStatements(m.Check) {
+		title, query := checkTitle(stmt)
+		if strings.TrimSpace(query) == "" {
+			continue
+		}
+		if title == "" {
+			title = fmt.Sprintf("check %d", i+1)
+		}
+		query = strings.TrimSuffix(strings.TrimSpace(query), ";")
+
+		v := Violation{Version: m.Version, Name: m.Name, Check: title}
+		err := conn.QueryRow(ctx, fmt.Sprintf(`
+			SELECT count(*), coalesce((array_agg(key::text ORDER BY key::text))[1:%d], '{}')
+			FROM (%s) AS v(key)`, sampleSize, query)).Scan(&v.Count, &v.Sample)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", title, err)
+		}
+		if v.Count > 0 {
+			violations = append(violations, v)
+		}
+	}
+	return violations, nil
+}
+
+// checkTitle отделяет описание "-- check: ..." и прочие комментарии от запроса.
+func checkTitle(stmt string) (title, query string) {
+	var b strings.Builder
+	for _, line := range strings.SplitAfter(stmt, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if t, ok := strings.CutPrefix(trimmed, checkPrefix); ok {
+			title = strings.TrimSpace(t)
+			continue
+		}
+		if strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		b.WriteString(line)
+	}
+	return title, b.String()
+}
+
+type execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+// withLock выполняет fn на выделенном соединении под session-level advisory lock.
+func withLock(ctx context.Context, pool *pgxpool.Pool, fn func(conn *pgx.Conn) error) error {
+	c, err := pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Release()
+	conn := c.Conn()
+
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, lockKey); err != nil {
+		return fmt.Errorf("acquire migration lock: %w", err)
+	}
+	defer func() {
+		// контекст мог быть отменен — снимаем блокировку в любом случае
+		if _, err := conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, lockKey); err != nil {
+			log.Println("fail to release migration lock:", err)
+		}
+	}()
+
+	if _, err := conn.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INT PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+func state(ctx context.Context, conn *pgx.Conn) ([]Migration, map[int]time.Time, error) {
+	migrations, err := Load()
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, err := conn.Query(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var (
+			version int
+			at      time.Time
+		)
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, nil, err
+		}
+		applied[version] = at
+	}
+	return migrations, applied, rows.Err()
+}
+
+// apply выполняет скрипт и record (запись в schema_migrations) атомарно,
+// либо, для no-transaction миграций, последовательно.
+func apply(ctx context.Context, conn *pgx.Conn, script string, record func(tx execer) error) error {
+	if strings.HasPrefix(strings.TrimSpace(script), noTxMarker) {
+		// несколько команд в одном Exec выполнились бы в неявной транзакции
+		for _, stmt := range splitStatements(script) {
+			if _, err := conn.Exec(ctx, stmt); err != nil {
+				return err
+			}
+		}
+		return record(conn)
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, script); err != nil {
+		return err
+	}
+	if err := record(tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func splitStatements(script string) []string {
+	var (
+		stmts []string
+		cur   strings.Builder
+	)
+	for _, line := range strings.SplitAfter(script, "\n") {
+		cur.WriteString(line)
+		if strings.HasSuffix(strings.TrimSpace(line), ";") {
+			stmts = append(stmts, cur.String())
+			cur.Reset()
+		}
+	}
+	if strings.TrimSpace(cur.String()) != "" {
+		stmts = append(stmts, cur.String())
+	}
+	return stmts
+}
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS items;
+DROP TABLE IF EXISTS deliveries;
+DROP TABLE IF EXISTS orders;
+DROP TABLE IF EXISTS transactions;
@@ -1,10 +1,7 @@
--- DROP TABLE IF EXISTS orders CASCADE;
--- DROP TABLE IF EXISTS deliveries CASCADE;
--- DROP TABLE IF EXISTS transactions CASCADE;
--- DROP TABLE IF EXISTS items CASCADE;
+-- Исходная схема. IF NOT EXISTS — чтобы базы, созданные старым
+-- initdb-скриптом, приняли миграцию без изменений.
 
-
-CREATE TABLE transactions (
+CREATE TABLE IF NOT EXISTS transactions (
     transactions_uid TEXT PRIMARY KEY,
     request_id TEXT,
     currency TEXT,
@@ -17,7 +14,7 @@ CREATE TABLE transactions (
     custom_fee INT
 );
 
-CREATE TABLE orders (
+CREATE TABLE IF NOT EXISTS orders (
     order_uid TEXT PRIMARY KEY,
     track_number TEXT,
     entry TEXT,
@@ -32,7 +29,7 @@ CREATE TABLE orders (
     payment_id TEXT REFERENCES transactions
 );
 
-CREATE TABLE deliveries (
+CREATE TABLE IF NOT EXISTS deliveries (
     order_uid TEXT PRIMARY KEY REFERENCES orders,
     name TEXT,
     phone TEXT,
@@ -43,7 +40,7 @@ CREATE TABLE deliveries (
     email TEXT
 );
 
-CREATE TABLE items (
+CREATE TABLE IF NOT EXISTS items (
     id SERIAL PRIMARY KEY,
     order_uid TEXT REFERENCES orders,
     chrt_id INT,
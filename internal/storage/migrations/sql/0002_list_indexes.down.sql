@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS items_brand_idx;
+DROP INDEX IF EXISTS items_order_uid_idx;
+DROP INDEX IF EXISTS transactions_bank_idx;
+DROP INDEX IF EXISTS transactions_provider_idx;
+DROP INDEX IF EXISTS orders_payment_id_idx;
+DROP INDEX IF EXISTS orders_delivery_service_idx;
+DROP INDEX IF EXISTS orders_customer_id_idx;
+DROP INDEX IF EXISTS orders_date_created_idx;
@@ -0,0 +1,11 @@
+-- migrate:no-transaction
+-- Индексы для GET /orders: сортировка по date_created и фильтры.
+
+CREATE INDEX CONCURRENTLY IF NOT EXISTS orders_date_created_idx ON orders (date_created DESC, order_uid DESC);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS orders_customer_id_idx ON orders (customer_id, date_created DESC);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS orders_delivery_service_idx ON orders (delivery_service, date_created DESC);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS orders_payment_id_idx ON orders (payment_id);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS transactions_provider_idx ON transactions (provider);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS transactions_bank_idx ON transactions (bank);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS items_order_uid_idx ON items (order_uid);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS items_brand_idx ON items (brand, order_uid);
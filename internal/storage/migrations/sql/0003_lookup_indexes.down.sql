@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS items_nm_id_idx;
+DROP INDEX IF EXISTS items_chrt_id_idx;
+DROP INDEX IF EXISTS items_rid_idx;
+DROP INDEX IF EXISTS orders_track_number_idx;
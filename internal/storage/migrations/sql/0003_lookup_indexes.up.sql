@@ -0,0 +1,8 @@
+-- migrate:no-transaction
+-- Индексы для поиска заказа по трек-номеру и идентификаторам товаров.
+-- Поиск по транзакции использует orders_payment_id_idx из 0002.
+
+CREATE INDEX CONCURRENTLY IF NOT EXISTS orders_track_number_idx ON orders (track_number);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS items_rid_idx ON items (rid);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS items_chrt_id_idx ON items (chrt_id);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS items_nm_id_idx ON items (nm_id);
@@ -0,0 +1,63 @@
+-- Документный режим хранения: заказ целиком в JSONB, в формате model.Order.
+-- Отдельными колонками вычисляются только поля, по которым ищем и сортируем.
+--
+-- date_created (в UTC) — обычная колонка: ее записывает DocumentStorage
+-- вместе с документом. Разбор текста в timestamptz зависит от настроек
+-- сессии (DateStyle, TimeZone) и не IMMUTABLE, поэтому в generated column
+-- или индексе по выражению его использовать нельзя.
+
+CREATE TABLE IF NOT EXISTS order_documents (
+    doc          JSONB NOT NULL,
+    order_uid    TEXT GENERATED ALWAYS AS (doc->>'order_uid') STORED PRIMARY KEY,
+    transaction  TEXT GENERATED ALWAYS AS (doc->'payment'->>'transaction') STORED UNIQUE,
+    customer_id  TEXT GENERATED ALWAYS AS (doc->>'customer_id') STORED,
+    track_number TEXT GENERATED ALWAYS AS (doc->>'track_number') STORED,
+    date_created TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS order_documents_date_created_idx ON order_documents (date_created, order_uid);
+CREATE INDEX IF NOT EXISTS order_documents_customer_id_idx ON order_documents (customer_id);
+CREATE INDEX IF NOT EXISTS order_documents_track_number_idx ON order_documents (track_number);
+
+-- Перенос заказов из нормализованных таблиц. Заказы, записанные в них
+-- после миграции, переносит `migrate sync-documents`. Доставка и оплата
+-- присоединяются LEFT JOIN: заказ без них (до ограничений 0007) переносится
+-- с пустыми полями, а не пропадает.
+INSERT INTO order_documents (doc, date_created)
+SELECT jsonb_build_object(
+    'order_uid', o.order_uid,
+    'track_number', o.track_number,
+    'entry', o.entry,
+    'delivery', jsonb_build_object(
+        'name', d.name, 'phone', d.phone, 'zip', d.zip, 'city', d.city,
+        'address', d.address, 'region', d.region, 'email', d.email
+    ),
+    'payment', jsonb_build_object(
+        'transaction', t.transactions_uid, 'request_id', t.request_id,
+        'currency', t.currency, 'provider', t.provider, 'amount', t.amount,
+        'payment_dt', t.payment_dt, 'bank', t.bank, 'delivery_cost', t.delivery_cost,
+        'goods_total', t.goods_total, 'custom_fee', t.custom_fee
+    ),
+    'items', COALESCE((
+        SELECT jsonb_agg(jsonb_build_object(
+            'chrt_id', i.chrt_id, 'track_number', i.track_number, 'price', i.price,
+            'rid', i.rid, 'name', i.name, 'sale', i.sale, 'size', i.size,
+            'total_price', i.total_price, 'nm_id', i.nm_id, 'brand', i.brand,
+            'status', i.status
+        ) ORDER BY i.id)
+        FROM items i
+        WHERE i.order_uid = o.order_uid
+    ), '[]'::jsonb),
+    'locale', o.locale,
+    'internal_signature', o.internal_signature,
+    'customer_id', o.customer_id,
+    'delivery_service', o.delivery_service,
+    'shardkey', o.shardkey,
+    'sm_id', o.sm_id,
+    'oof_shard', o.oof_shard,
+    'date_created', to_char(o.date_created, 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"')
+), o.date_created
+FROM orders o
+LEFT JOIN deliveries d ON o.order_uid = d.order_uid
+LEFT JOIN transactions t ON o.payment_id = t.transactions_uid
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,17 @@
+-- Архив исходных сообщений Kafka: payload сжат gzip на стороне сервиса.
+CREATE TABLE IF NOT EXISTS raw_messages (
+    id BIGSERIAL PRIMARY KEY,
+    order_uid TEXT NOT NULL,
+    topic TEXT NOT NULL,
+    kafka_partition INT NOT NULL,
+    kafka_offset BIGINT NOT NULL,
+    headers JSONB NOT NULL DEFAULT '[]',
+    payload BYTEA NOT NULL,
+    received_at TIMESTAMPTZ NOT NULL,
+    UNIQUE (topic, kafka_partition, kafka_offset)
+);
+
+-- уже сжатый payload не нужно повторно сжимать в TOAST
+ALTER TABLE raw_messages ALTER COLUMN payload SET STORAGE EXTERNAL;
+
+CREATE INDEX IF NOT EXISTS raw_messages_order_uid_idx ON raw_messages (order_uid);
@@ -0,0 +1,5 @@
+-- Метаданные получения заказа (storage.IngestMeta) документом JSONB.
+CREATE TABLE IF NOT EXISTS ingest_meta (
+    order_uid TEXT PRIMARY KEY,
+    meta JSONB NOT NULL
+);
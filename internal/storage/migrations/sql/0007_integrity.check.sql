@@ -0,0 +1,41 @@
+-- Проверки перед 0007_integrity: каждый запрос возвращает ключи строк,
+-- которые нарушат добавляемые ограничения. Пока они есть, миграция не применяется.
+
+-- check: orders with NULL in required columns
+SELECT order_uid FROM orders
+WHERE track_number IS NULL OR entry IS NULL OR locale IS NULL OR internal_signature IS NULL
+   OR customer_id IS NULL OR delivery_service IS NULL OR shardkey IS NULL OR sm_id IS NULL
+   OR date_created IS NULL OR oof_shard IS NULL OR payment_id IS NULL;
+
+-- check: orders without delivery
+SELECT o.order_uid FROM orders o
+WHERE NOT EXISTS (SELECT 1 FROM deliveries d WHERE d.order_uid = o.order_uid);
+
+-- check: deliveries with NULL in required columns
+SELECT order_uid FROM deliveries
+WHERE name IS NULL OR phone IS NULL OR zip IS NULL OR city IS NULL
+   OR address IS NULL OR region IS NULL OR email IS NULL;
+
+-- check: transactions with NULL in required columns
+SELECT transactions_uid FROM transactions
+WHERE request_id IS NULL OR currency IS NULL OR provider IS NULL OR amount IS NULL
+   OR payment_dt IS NULL OR bank IS NULL OR delivery_cost IS NULL OR goods_total IS NULL
+   OR custom_fee IS NULL;
+
+-- check: transactions where amount != delivery_cost + goods_total
+SELECT transactions_uid FROM transactions
+WHERE amount <> delivery_cost + goods_total;
+
+-- check: transactions with non-positive amount or negative costs
+SELECT transactions_uid FROM transactions
+WHERE amount < 1 OR delivery_cost < 0 OR goods_total < 0 OR custom_fee < 0;
+
+-- check: items with NULL in required columns
+SELECT coalesce(order_uid, '') || '/' || id FROM items
+WHERE order_uid IS NULL OR chrt_id IS NULL OR track_number IS NULL OR price IS NULL
+   OR rid IS NULL OR name IS NULL OR sale IS NULL OR size IS NULL OR total_price IS NULL
+   OR nm_id IS NULL OR brand IS NULL OR status IS NULL;
+
+-- check: items with negative price or sale outside 0..100
+SELECT coalesce(order_uid, '') || '/' || id FROM items
+WHERE price < 0 OR total_price < 0 OR sale NOT BETWEEN 0 AND 100;
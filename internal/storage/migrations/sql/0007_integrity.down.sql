@@ -0,0 +1,62 @@
+DROP TRIGGER IF EXISTS orders_require_delivery ON orders;
+DROP FUNCTION IF EXISTS orders_require_delivery();
+
+ALTER TABLE items
+    DROP CONSTRAINT IF EXISTS items_price_non_negative,
+    DROP CONSTRAINT IF EXISTS items_sale_range,
+    DROP CONSTRAINT IF EXISTS items_order_uid_fkey,
+    ADD CONSTRAINT items_order_uid_fkey FOREIGN KEY (order_uid) REFERENCES orders,
+    ALTER COLUMN order_uid DROP NOT NULL,
+    ALTER COLUMN chrt_id DROP NOT NULL,
+    ALTER COLUMN track_number DROP NOT NULL,
+    ALTER COLUMN price DROP NOT NULL,
+    ALTER COLUMN rid DROP NOT NULL,
+    ALTER COLUMN name DROP NOT NULL,
+    ALTER COLUMN sale DROP NOT NULL,
+    ALTER COLUMN size DROP NOT NULL,
+    ALTER COLUMN total_price DROP NOT NULL,
+    ALTER COLUMN nm_id DROP NOT NULL,
+    ALTER COLUMN brand DROP NOT NULL,
+    ALTER COLUMN status DROP NOT NULL;
+
+ALTER TABLE deliveries
+    DROP CONSTRAINT IF EXISTS deliveries_order_uid_fkey,
+    ADD CONSTRAINT deliveries_order_uid_fkey FOREIGN KEY (order_uid) REFERENCES orders,
+    ALTER COLUMN name DROP NOT NULL,
+    ALTER COLUMN phone DROP NOT NULL,
+    ALTER COLUMN zip DROP NOT NULL,
+    ALTER COLUMN city DROP NOT NULL,
+    ALTER COLUMN address DROP NOT NULL,
+    ALTER COLUMN region DROP NOT NULL,
+    ALTER COLUMN email DROP NOT NULL;
+
+ALTER TABLE orders
+    DROP CONSTRAINT IF EXISTS orders_payment_id_fkey,
+    ADD CONSTRAINT orders_payment_id_fkey FOREIGN KEY (payment_id) REFERENCES transactions,
+    ALTER COLUMN track_number DROP NOT NULL,
+    ALTER COLUMN entry DROP NOT NULL,
+    ALTER COLUMN locale DROP NOT NULL,
+    ALTER COLUMN internal_signature DROP NOT NULL,
+    ALTER COLUMN internal_signature DROP DEFAULT,
+    ALTER COLUMN customer_id DROP NOT NULL,
+    ALTER COLUMN delivery_service DROP NOT NULL,
+    ALTER COLUMN shardkey DROP NOT NULL,
+    ALTER COLUMN sm_id DROP NOT NULL,
+    ALTER COLUMN date_created DROP NOT NULL,
+    ALTER COLUMN oof_shard DROP NOT NULL,
+    ALTER COLUMN payment_id DROP NOT NULL;
+
+ALTER TABLE transactions
+    DROP CONSTRAINT IF EXISTS transactions_amount_check,
+    DROP CONSTRAINT IF EXISTS transactions_amount_positive,
+    DROP CONSTRAINT IF EXISTS transactions_costs_non_negative,
+    ALTER COLUMN request_id DROP NOT NULL,
+    ALTER COLUMN currency DROP NOT NULL,
+    ALTER COLUMN provider DROP NOT NULL,
+    ALTER COLUMN amount DROP NOT NULL,
+    ALTER COLUMN payment_dt DROP NOT NULL,
+    ALTER COLUMN bank DROP NOT NULL,
+    ALTER COLUMN delivery_cost DROP NOT NULL,
+    ALTER COLUMN goods_total DROP NOT NULL,
+    ALTER COLUMN custom_fee DROP NOT NULL,
+    ALTER COLUMN custom_fee DROP DEFAULT;
@@ -0,0 +1,85 @@
+-- Ограничения, повторяющие правила model.Order.Validate. Существующие
+-- нарушения перечисляет 0007_integrity.check.sql (`migrate check`).
+
+ALTER TABLE transactions
+    ALTER COLUMN request_id SET NOT NULL,
+    ALTER COLUMN currency SET NOT NULL,
+    ALTER COLUMN provider SET NOT NULL,
+    ALTER COLUMN amount SET NOT NULL,
+    ALTER COLUMN payment_dt SET NOT NULL,
+    ALTER COLUMN bank SET NOT NULL,
+    ALTER COLUMN delivery_cost SET NOT NULL,
+    ALTER COLUMN goods_total SET NOT NULL,
+    ALTER COLUMN custom_fee SET NOT NULL,
+    ALTER COLUMN custom_fee SET DEFAULT 0,
+    ADD CONSTRAINT transactions_amount_check CHECK (amount = delivery_cost + goods_total),
+    ADD CONSTRAINT transactions_amount_positive CHECK (amount >= 1),
+    ADD CONSTRAINT transactions_costs_non_negative CHECK (delivery_cost >= 0 AND goods_total >= 0 AND custom_fee >= 0);
+
+ALTER TABLE orders
+    ALTER COLUMN track_number SET NOT NULL,
+    ALTER COLUMN entry SET NOT NULL,
+    ALTER COLUMN locale SET NOT NULL,
+    ALTER COLUMN internal_signature SET NOT NULL,
+    ALTER COLUMN internal_signature SET DEFAULT '',
+    ALTER COLUMN customer_id SET NOT NULL,
+    ALTER COLUMN delivery_service SET NOT NULL,
+    ALTER COLUMN shardkey SET NOT NULL,
+    ALTER COLUMN sm_id SET NOT NULL,
+    ALTER COLUMN date_created SET NOT NULL,
+    ALTER COLUMN oof_shard SET NOT NULL,
+    ALTER COLUMN payment_id SET NOT NULL,
+    -- оплату нельзя удалить, пока на нее ссылается заказ
+    DROP CONSTRAINT IF EXISTS orders_payment_id_fkey,
+    ADD CONSTRAINT orders_payment_id_fkey FOREIGN KEY (payment_id)
+        REFERENCES transactions ON DELETE RESTRICT;
+
+ALTER TABLE deliveries
+    ALTER COLUMN name SET NOT NULL,
+    ALTER COLUMN phone SET NOT NULL,
+    ALTER COLUMN zip SET NOT NULL,
+    ALTER COLUMN city SET NOT NULL,
+    ALTER COLUMN address SET NOT NULL,
+    ALTER COLUMN region SET NOT NULL,
+    ALTER COLUMN email SET NOT NULL,
+    -- доставка и товары удаляются вместе с заказом
+    DROP CONSTRAINT IF EXISTS deliveries_order_uid_fkey,
+    ADD CONSTRAINT deliveries_order_uid_fkey FOREIGN KEY (order_uid)
+        REFERENCES orders ON DELETE CASCADE;
+
+ALTER TABLE items
+    ALTER COLUMN order_uid SET NOT NULL,
+    ALTER COLUMN chrt_id SET NOT NULL,
+    ALTER COLUMN track_number SET NOT NULL,
+    ALTER COLUMN price SET NOT NULL,
+    ALTER COLUMN rid SET NOT NULL,
+    ALTER COLUMN name SET NOT NULL,
+    ALTER COLUMN sale SET NOT NULL,
+    ALTER COLUMN size SET NOT NULL,
+    ALTER COLUMN total_price SET NOT NULL,
+    ALTER COLUMN nm_id SET NOT NULL,
+    ALTER COLUMN brand SET NOT NULL,
+    ALTER COLUMN status SET NOT NULL,
+    ADD CONSTRAINT items_price_non_negative CHECK (price >= 0 AND total_price >= 0),
+    ADD CONSTRAINT items_sale_range CHECK (sale BETWEEN 0 AND 100),
+    DROP CONSTRAINT IF EXISTS items_order_uid_fkey,
+    ADD CONSTRAINT items_order_uid_fkey FOREIGN KEY (order_uid)
+        REFERENCES orders ON DELETE CASCADE;
+
+-- Заказ без доставки: проверка в конце транзакции, так как CreateOrder
+-- вставляет заказ раньше доставки.
+CREATE OR REPLACE FUNCTION orders_require_delivery() RETURNS trigger
+    LANGUAGE plpgsql AS $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM orders WHERE order_uid = NEW.order_uid)
+       AND NOT EXISTS (SELECT 1 FROM deliveries WHERE order_uid = NEW.order_uid) THEN
+        RAISE EXCEPTION 'order % has no delivery', NEW.order_uid
+            USING ERRCODE = 'check_violation';
+    END IF;
+    RETURN NULL;
+END $$;
+
+CREATE CONSTRAINT TRIGGER orders_require_delivery
+    AFTER INSERT ON orders
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE FUNCTION orders_require_delivery();
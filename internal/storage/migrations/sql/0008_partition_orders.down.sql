@@ -0,0 +1,95 @@
+-- Обратно к несекционированным таблицам (0007). Отсоединенные retention-ом
+-- секции (схема order_archive) не возвращаются.
+
+CREATE TABLE orders_plain (
+    order_uid TEXT CONSTRAINT orders_pkey_new PRIMARY KEY,
+    track_number TEXT NOT NULL,
+    entry TEXT NOT NULL,
+    locale TEXT NOT NULL,
+    internal_signature TEXT NOT NULL DEFAULT '',
+    customer_id TEXT NOT NULL,
+    delivery_service TEXT NOT NULL,
+    shardkey TEXT NOT NULL,
+    sm_id INT NOT NULL,
+    date_created TIMESTAMP NOT NULL,
+    oof_shard TEXT NOT NULL,
+    payment_id TEXT NOT NULL
+        CONSTRAINT orders_payment_id_fkey REFERENCES transactions ON DELETE RESTRICT
+);
+
+CREATE TABLE deliveries_plain (
+    order_uid TEXT CONSTRAINT deliveries_pkey_new PRIMARY KEY
+        CONSTRAINT deliveries_order_uid_fkey REFERENCES orders_plain ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    phone TEXT NOT NULL,
+    zip TEXT NOT NULL,
+    city TEXT NOT NULL,
+    address TEXT NOT NULL,
+    region TEXT NOT NULL,
+    email TEXT NOT NULL
+);
+
+CREATE TABLE items_plain (
+    id INT CONSTRAINT items_pkey_new PRIMARY KEY DEFAULT nextval('items_id_seq'),
+    order_uid TEXT NOT NULL
+        CONSTRAINT items_order_uid_fkey REFERENCES orders_plain ON DELETE CASCADE,
+    chrt_id INT NOT NULL,
+    track_number TEXT NOT NULL,
+    price INT NOT NULL,
+    rid TEXT NOT NULL,
+    name TEXT NOT NULL,
+    sale INT NOT NULL,
+    size TEXT NOT NULL,
+    total_price INT NOT NULL,
+    nm_id INT NOT NULL,
+    brand TEXT NOT NULL,
+    status INT NOT NULL,
+    CONSTRAINT items_price_non_negative CHECK (price >= 0 AND total_price >= 0),
+    CONSTRAINT items_sale_range CHECK (sale BETWEEN 0 AND 100)
+);
+
+INSERT INTO orders_plain
+SELECT order_uid, track_number, entry, locale, internal_signature, customer_id,
+       delivery_service, shardkey, sm_id, date_created, oof_shard, payment_id
+FROM orders;
+
+INSERT INTO deliveries_plain
+SELECT order_uid, name, phone, zip, city, address, region, email
+FROM deliveries;
+
+INSERT INTO items_plain
+SELECT id, order_uid, chrt_id, track_number, price, rid, name,
+       sale, size, total_price, nm_id, brand, status
+FROM items;
+
+ALTER SEQUENCE items_id_seq OWNED BY items_plain.id;
+
+DROP TABLE items;
+DROP TABLE deliveries;
+DROP TABLE orders;
+DROP TRIGGER orders_require_delivery ON order_keys;
+DROP TABLE order_keys;
+DROP FUNCTION create_order_partitions(DATE);
+
+ALTER TABLE orders_plain RENAME TO orders;
+ALTER TABLE deliveries_plain RENAME TO deliveries;
+ALTER TABLE items_plain RENAME TO items;
+ALTER TABLE orders RENAME CONSTRAINT orders_pkey_new TO orders_pkey;
+ALTER TABLE deliveries RENAME CONSTRAINT deliveries_pkey_new TO deliveries_pkey;
+ALTER TABLE items RENAME CONSTRAINT items_pkey_new TO items_pkey;
+
+CREATE CONSTRAINT TRIGGER orders_require_delivery
+    AFTER INSERT ON orders
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE FUNCTION orders_require_delivery();
+
+CREATE INDEX orders_date_created_idx ON orders (date_created DESC, order_uid DESC);
+CREATE INDEX orders_customer_id_idx ON orders (customer_id, date_created DESC);
+CREATE INDEX orders_delivery_service_idx ON orders (delivery_service, date_created DESC);
+CREATE INDEX orders_payment_id_idx ON orders (payment_id);
+CREATE INDEX orders_track_number_idx ON orders (track_number);
+CREATE INDEX items_order_uid_idx ON items (order_uid);
+CREATE INDEX items_brand_idx ON items (brand, order_uid);
+CREATE INDEX items_rid_idx ON items (rid);
+CREATE INDEX items_chrt_id_idx ON items (chrt_id);
+CREATE INDEX items_nm_id_idx ON items (nm_id);
@@ -0,0 +1,154 @@
+-- Секционирование orders, deliveries и items по месяцам date_created.
+--
+-- Первичный и внешние ключи секционированной таблицы должны включать ключ
+-- секционирования, поэтому:
+--   * уникальность order_uid обеспечивает несекционированная order_keys
+--     (на ней же проверка "заказ без доставки" из 0007);
+--   * deliveries и items получают копию date_created заказа и попадают
+--     в секцию того же месяца, что и заказ.
+-- Секции называются <таблица>_pYYYYMM, их создает create_order_partitions
+-- (заранее — storage.MaintainPartitions); строки вне созданных секций
+-- попадают в <таблица>_default.
+
+CREATE TABLE order_keys (
+    order_uid TEXT PRIMARY KEY,
+    date_created TIMESTAMP NOT NULL
+);
+INSERT INTO order_keys (order_uid, date_created)
+SELECT order_uid, date_created FROM orders;
+
+DROP TRIGGER orders_require_delivery ON orders;
+CREATE CONSTRAINT TRIGGER orders_require_delivery
+    AFTER INSERT ON order_keys
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE FUNCTION orders_require_delivery();
+
+ALTER TABLE items RENAME TO items_unpartitioned;
+ALTER TABLE deliveries RENAME TO deliveries_unpartitioned;
+ALTER TABLE orders RENAME TO orders_unpartitioned;
+
+-- Имена первичных ключей временные: индексы *_pkey старых таблиц еще существуют.
+CREATE TABLE orders (
+    order_uid TEXT NOT NULL REFERENCES order_keys ON DELETE CASCADE,
+    track_number TEXT NOT NULL,
+    entry TEXT NOT NULL,
+    locale TEXT NOT NULL,
+    internal_signature TEXT NOT NULL DEFAULT '',
+    customer_id TEXT NOT NULL,
+    delivery_service TEXT NOT NULL,
+    shardkey TEXT NOT NULL,
+    sm_id INT NOT NULL,
+    date_created TIMESTAMP NOT NULL,
+    oof_shard TEXT NOT NULL,
+    payment_id TEXT NOT NULL REFERENCES transactions ON DELETE RESTRICT,
+    CONSTRAINT orders_pkey_new PRIMARY KEY (order_uid, date_created)
+) PARTITION BY RANGE (date_created);
+
+CREATE TABLE deliveries (
+    order_uid TEXT NOT NULL,
+    date_created TIMESTAMP NOT NULL,
+    name TEXT NOT NULL,
+    phone TEXT NOT NULL,
+    zip TEXT NOT NULL,
+    city TEXT NOT NULL,
+    address TEXT NOT NULL,
+    region TEXT NOT NULL,
+    email TEXT NOT NULL,
+    CONSTRAINT deliveries_pkey_new PRIMARY KEY (order_uid, date_created),
+    CONSTRAINT deliveries_order_uid_fkey FOREIGN KEY (order_uid, date_created)
+        REFERENCES orders ON DELETE CASCADE
+) PARTITION BY RANGE (date_created);
+
+ALTER SEQUENCE items_id_seq OWNED BY NONE;
+
+CREATE TABLE items (
+    id INT NOT NULL DEFAULT nextval('items_id_seq'),
+    order_uid TEXT NOT NULL,
+    date_created TIMESTAMP NOT NULL,
+    chrt_id INT NOT NULL,
+    track_number TEXT NOT NULL,
+    price INT NOT NULL,
+    rid TEXT NOT NULL,
+    name TEXT NOT NULL,
+    sale INT NOT NULL,
+    size TEXT NOT NULL,
+    total_price INT NOT NULL,
+    nm_id INT NOT NULL,
+    brand TEXT NOT NULL,
+    status INT NOT NULL,
+    CONSTRAINT items_pkey_new PRIMARY KEY (id, date_created),
+    CONSTRAINT items_order_uid_fkey FOREIGN KEY (order_uid, date_created)
+        REFERENCES orders ON DELETE CASCADE,
+    CONSTRAINT items_price_non_negative CHECK (price >= 0 AND total_price >= 0),
+    CONSTRAINT items_sale_range CHECK (sale BETWEEN 0 AND 100)
+) PARTITION BY RANGE (date_created);
+
+ALTER SEQUENCE items_id_seq OWNED BY items.id;
+
+-- create_order_partitions создает секции orders, deliveries и items
+-- для месяца, в который попадает month. Повторный вызов ничего не делает.
+CREATE OR REPLACE FUNCTION create_order_partitions(month DATE) RETURNS void
+    LANGUAGE plpgsql AS $$
+DECLARE
+    lo DATE := date_trunc('month', month)::date;
+    hi DATE := (date_trunc('month', month) + INTERVAL '1 month')::date;
+    t TEXT;
+BEGIN
+    FOREACH t IN ARRAY ARRAY['orders', 'deliveries', 'items'] LOOP
+        EXECUTE format('CREATE TABLE IF NOT EXISTS %I PARTITION OF %I FOR VALUES FROM (%L) TO (%L)',
+                       t || to_char(lo, '"_p"YYYYMM'), t, lo, hi);
+    END LOOP;
+END $$;
+
+SELECT create_order_partitions(m::date)
+FROM generate_series(
+    date_trunc('month', coalesce((SELECT min(date_created) FROM orders_unpartitioned), now())),
+    date_trunc('month', now()) + INTERVAL '3 months',
+    INTERVAL '1 month'
+) AS m;
+
+CREATE TABLE orders_default PARTITION OF orders DEFAULT;
+CREATE TABLE deliveries_default PARTITION OF deliveries DEFAULT;
+CREATE TABLE items_default PARTITION OF items DEFAULT;
+
+INSERT INTO orders (
+    order_uid, track_number, entry, locale, internal_signature, customer_id,
+    delivery_service, shardkey, sm_id, date_created, oof_shard, payment_id
+)
+SELECT order_uid, track_number, entry, locale, internal_signature, customer_id,
+       delivery_service, shardkey, sm_id, date_created, oof_shard, payment_id
+FROM orders_unpartitioned;
+
+INSERT INTO deliveries (order_uid, date_created, name, phone, zip, city, address, region, email)
+SELECT d.order_uid, o.date_created, d.name, d.phone, d.zip, d.city, d.address, d.region, d.email
+FROM deliveries_unpartitioned d
+JOIN orders_unpartitioned o ON o.order_uid = d.order_uid;
+
+INSERT INTO items (
+    id, order_uid, date_created, chrt_id, track_number, price, rid, name,
+    sale, size, total_price, nm_id, brand, status
+)
+SELECT i.id, i.order_uid, o.date_created, i.chrt_id, i.track_number, i.price, i.rid, i.name,
+       i.sale, i.size, i.total_price, i.nm_id, i.brand, i.status
+FROM items_unpartitioned i
+JOIN orders_unpartitioned o ON o.order_uid = i.order_uid;
+
+DROP TABLE items_unpartitioned;
+DROP TABLE deliveries_unpartitioned;
+DROP TABLE orders_unpartitioned;
+
+ALTER TABLE orders RENAME CONSTRAINT orders_pkey_new TO orders_pkey;
+ALTER TABLE deliveries RENAME CONSTRAINT deliveries_pkey_new TO deliveries_pkey;
+ALTER TABLE items RENAME CONSTRAINT items_pkey_new TO items_pkey;
+
+-- индексы 0002/0003; на секционированных таблицах создаются для всех секций
+CREATE INDEX orders_date_created_idx ON orders (date_created DESC, order_uid DESC);
+CREATE INDEX orders_customer_id_idx ON orders (customer_id, date_created DESC);
+CREATE INDEX orders_delivery_service_idx ON orders (delivery_service, date_created DESC);
+CREATE INDEX orders_payment_id_idx ON orders (payment_id);
+CREATE INDEX orders_track_number_idx ON orders (track_number);
+CREATE INDEX items_order_uid_idx ON items (order_uid);
+CREATE INDEX items_brand_idx ON items (brand, order_uid);
+CREATE INDEX items_rid_idx ON items (rid);
+CREATE INDEX items_chrt_id_idx ON items (chrt_id);
+CREATE INDEX items_nm_id_idx ON items (nm_id);
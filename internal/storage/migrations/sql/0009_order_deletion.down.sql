@@ -0,0 +1,10 @@
+-- Удаленные, но не очищенные заказы снова становятся видимыми;
+-- ключи очищенных заказов удаляются — самих заказов уже нет.
+DROP TABLE IF EXISTS order_audit;
+DELETE FROM order_keys WHERE purged_at IS NOT NULL;
+DROP INDEX IF EXISTS order_keys_pending_purge_idx;
+ALTER TABLE order_keys
+    DROP CONSTRAINT IF EXISTS order_keys_purged_after_delete,
+    DROP COLUMN IF EXISTS purged_at,
+    DROP COLUMN IF EXISTS deleted_by,
+    DROP COLUMN IF EXISTS deleted_at;
@@ -0,0 +1,24 @@
+-- Удаление заказов (storage.DeleteStore).
+--
+-- Удаленный заказ помечается в order_keys и пропадает из чтения; строка
+-- order_keys остается и после окончательного удаления (purged_at), чтобы
+-- повторная доставка того же заказа не создала его заново.
+ALTER TABLE order_keys
+    ADD COLUMN deleted_at TIMESTAMPTZ,
+    ADD COLUMN deleted_by TEXT,
+    ADD COLUMN purged_at TIMESTAMPTZ,
+    ADD CONSTRAINT order_keys_purged_after_delete CHECK (purged_at IS NULL OR deleted_at IS NOT NULL);
+
+-- удаленные, но еще не очищенные заказы — для PurgeDeleted
+CREATE INDEX order_keys_pending_purge_idx ON order_keys (deleted_at)
+    WHERE deleted_at IS NOT NULL AND purged_at IS NULL;
+
+-- Журнал удалений, стираний персональных данных и очисток.
+CREATE TABLE order_audit (
+    id BIGSERIAL PRIMARY KEY,
+    order_uid TEXT NOT NULL,
+    action TEXT NOT NULL CHECK (action IN ('delete', 'erase', 'purge')),
+    actor TEXT NOT NULL,
+    at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX order_audit_order_uid_idx ON order_audit (order_uid, id);
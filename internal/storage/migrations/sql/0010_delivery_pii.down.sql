@@ -0,0 +1,16 @@
+-- Откат невозможен, пока в базе есть зашифрованные доставки: без
+-- pii_key_id их уже не отличить от открытого текста при ротации.
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM deliveries WHERE pii_key_id IS NOT NULL) THEN
+        RAISE EXCEPTION 'deliveries contain encrypted PII; decrypt them before rolling back';
+    END IF;
+END $$;
+
+DROP INDEX IF EXISTS deliveries_pii_key_id_idx;
+DROP INDEX IF EXISTS deliveries_email_bidx_idx;
+DROP INDEX IF EXISTS deliveries_phone_bidx_idx;
+ALTER TABLE deliveries
+    DROP COLUMN IF EXISTS email_bidx,
+    DROP COLUMN IF EXISTS phone_bidx,
+    DROP COLUMN IF EXISTS pii_key_id;
@@ -0,0 +1,14 @@
+-- Шифрование персональных данных доставки (storage.WithPII).
+--
+-- name, phone, address и email хранят значения в формате pii:v1:...;
+-- pii_key_id — ключ, которым они зашифрованы (NULL — открытый текст,
+-- такие строки шифрует ротация), phone_bidx и email_bidx — слепые
+-- индексы для поиска на равенство.
+ALTER TABLE deliveries
+    ADD COLUMN pii_key_id TEXT,
+    ADD COLUMN phone_bidx BYTEA,
+    ADD COLUMN email_bidx BYTEA;
+
+CREATE INDEX deliveries_phone_bidx_idx ON deliveries (phone_bidx);
+CREATE INDEX deliveries_email_bidx_idx ON deliveries (email_bidx);
+CREATE INDEX deliveries_pii_key_id_idx ON deliveries (pii_key_id);
@@ -0,0 +1,15 @@
+-- История исправлений заказов (storage.HistoryStore).
+--
+-- Строка — одно исправление: version — номер версии заказа после него
+-- (исходный заказ — версия 1), changes — массив model.Change без значений
+-- персональных данных. История удаляется вместе с order_keys (перенос
+-- между шардами, retention) и при окончательном удалении заказа.
+CREATE TABLE order_history (
+    order_uid TEXT NOT NULL REFERENCES order_keys ON DELETE CASCADE,
+    version INT NOT NULL CHECK (version > 1),
+    actor TEXT NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    changes JSONB NOT NULL,
+    PRIMARY KEY (order_uid, version)
+);
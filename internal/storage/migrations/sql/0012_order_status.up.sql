@@ -0,0 +1,16 @@
+-- Жизненный цикл заказа (storage.StatusStore, model.OrderStatus).
+--
+-- Текущий статус — to_status последнего перехода; заказ без переходов
+-- имеет статус, выведенный из статусов товаров.
+CREATE TABLE order_status_history (
+    id BIGSERIAL PRIMARY KEY,
+    order_uid TEXT NOT NULL REFERENCES order_keys ON DELETE CASCADE,
+    from_status TEXT NOT NULL,
+    to_status TEXT NOT NULL CHECK (to_status IN
+        ('created', 'paid', 'assembling', 'shipped', 'delivered', 'cancelled', 'returned')),
+    actor TEXT NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX order_status_history_order_uid_idx ON order_status_history (order_uid, id);
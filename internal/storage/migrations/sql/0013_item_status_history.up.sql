@@ -0,0 +1,19 @@
+-- История статусов товаров (storage.ItemStatusStore).
+--
+-- Строка — смена Item.Status товара rid при исправлении заказа:
+-- from_status NULL — товар добавлен, to_status NULL — удален. Начальные
+-- статусы не записываются: это статусы товаров до первой смены.
+CREATE TABLE item_status_history (
+    id BIGSERIAL PRIMARY KEY,
+    order_uid TEXT NOT NULL REFERENCES order_keys ON DELETE CASCADE,
+    rid TEXT NOT NULL,
+    chrt_id INT NOT NULL,
+    from_status INT,
+    to_status INT,
+    actor TEXT NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CHECK (from_status IS NOT NULL OR to_status IS NOT NULL)
+);
+
+CREATE INDEX item_status_history_order_uid_idx ON item_status_history (order_uid, id);
@@ -0,0 +1,16 @@
+-- Возвраты денег по заказам (storage.RefundStore, model.Refund).
+--
+-- refund_id задает отправитель и уникален в пределах заказа. items —
+-- массив model.RefundItem у возврата товаров. Сумма возвратов не больше
+-- transactions.amount: это проверяет CreateRefund под блокировкой order_keys.
+CREATE TABLE refunds (
+    order_uid TEXT NOT NULL REFERENCES order_keys ON DELETE CASCADE,
+    refund_id TEXT NOT NULL,
+    kind TEXT NOT NULL CHECK (kind IN ('full', 'partial', 'items')),
+    amount INT NOT NULL CHECK (amount > 0),
+    items JSONB NOT NULL DEFAULT '[]',
+    reason TEXT NOT NULL,
+    actor TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (order_uid, refund_id)
+);
@@ -0,0 +1,11 @@
+-- Откат невозможен, пока в архиве есть зашифрованные сообщения: без
+-- pii_key_id их не найдет ротация.
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM raw_messages WHERE pii_key_id IS NOT NULL) THEN
+        RAISE EXCEPTION 'raw_messages contain encrypted payloads; decrypt them before rolling back';
+    END IF;
+END $$;
+
+DROP INDEX IF EXISTS raw_messages_pii_key_id_idx;
+ALTER TABLE raw_messages DROP COLUMN IF EXISTS pii_key_id;
@@ -0,0 +1,8 @@
+-- Шифрование архива исходных сообщений (storage.WithPII).
+--
+-- payload хранит сжатое gzip тело сообщения в формате pii:v1:...;
+-- pii_key_id — ключ, которым оно зашифровано (NULL — открытый payload,
+-- такие строки шифрует ротация вместе с доставками).
+ALTER TABLE raw_messages ADD COLUMN pii_key_id TEXT;
+
+CREATE INDEX raw_messages_pii_key_id_idx ON raw_messages (pii_key_id);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS order_change_horizon;
+DROP TABLE IF EXISTS order_changes;
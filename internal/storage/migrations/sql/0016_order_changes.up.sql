@@ -0,0 +1,28 @@
+-- Журнал изменений заказов (storage.ChangeFeed).
+--
+-- Каждая транзакция, меняющая то, что возвращает GetOrder (создание,
+-- исправление, удаление, стирание персональных данных, очистка,
+-- перешифрование, retention), добавляет сюда строку на заказ. По журналу
+-- кэши всех процессов вытесняют измененные заказы, а снапшот кэша
+-- досинхронизируется после перезапуска.
+--
+-- xid — транзакция записи. Читатель берет только строки транзакций старше
+-- pg_snapshot_xmin текущего снапшота: они уже завершены, поэтому строка
+-- транзакции, зафиксированной позже соседей с большим seq, не пропускается.
+CREATE TABLE order_changes (
+    seq BIGSERIAL,
+    xid xid8 NOT NULL DEFAULT pg_current_xact_id(),
+    order_uid TEXT NOT NULL,
+    kind TEXT NOT NULL CHECK (kind IN ('create', 'update', 'delete', 'erase', 'purge', 'rotate', 'retire')),
+    at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (xid, seq)
+);
+CREATE INDEX order_changes_at_idx ON order_changes (at);
+
+-- Граница очистки журнала: самая поздняя удаленная позиция. Курсор до нее
+-- устарел — кэш перечитывает заказы целиком.
+CREATE TABLE order_change_horizon (
+    xid xid8 NOT NULL,
+    seq BIGINT NOT NULL
+);
+INSERT INTO order_change_horizon VALUES ('0', 0);
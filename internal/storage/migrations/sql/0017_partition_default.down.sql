@@ -0,0 +1,12 @@
+CREATE OR REPLACE FUNCTION create_order_partitions(month DATE) RETURNS void
+    LANGUAGE plpgsql AS $$
+DECLARE
+    lo DATE := date_trunc('month', month)::date;
+    hi DATE := (date_trunc('month', month) + INTERVAL '1 month')::date;
+    t TEXT;
+BEGIN
+    FOREACH t IN ARRAY ARRAY['orders', 'deliveries', 'items'] LOOP
+        EXECUTE format('CREATE TABLE IF NOT EXISTS %I PARTITION OF %I FOR VALUES FROM (%L) TO (%L)',
+                       t || to_char(lo, '"_p"YYYYMM'), t, lo, hi);
+    END LOOP;
+END $$;
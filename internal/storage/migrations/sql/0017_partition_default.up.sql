@@ -0,0 +1,37 @@
+-- create_order_partitions переносит строки месяца из <таблица>_default.
+--
+-- Заказ с date_created вне созданных секций попадает в <таблица>_default,
+-- а PostgreSQL не создает секцию, пока в default есть строки ее диапазона:
+-- раньше один такой заказ останавливал storage.MaintainPartitions. Теперь
+-- строки месяца переносятся во временные таблицы, секции создаются, и
+-- строки возвращаются уже в них.
+CREATE OR REPLACE FUNCTION create_order_partitions(month DATE) RETURNS void
+    LANGUAGE plpgsql AS $$
+DECLARE
+    lo DATE := date_trunc('month', month)::date;
+    hi DATE := (date_trunc('month', month) + INTERVAL '1 month')::date;
+    moving BOOLEAN;
+    t TEXT;
+BEGIN
+    moving := EXISTS (SELECT 1 FROM orders_default WHERE date_created >= lo AND date_created < hi);
+    IF moving THEN
+        FOREACH t IN ARRAY ARRAY['orders', 'deliveries', 'items'] LOOP
+            EXECUTE format('CREATE TEMP TABLE %I AS SELECT * FROM %I WHERE date_created >= %L AND date_created < %L',
+                           'moving_' || t, t || '_default', lo, hi);
+        END LOOP;
+        -- доставки и товары удаляются каскадом
+        DELETE FROM orders_default WHERE date_created >= lo AND date_created < hi;
+    END IF;
+
+    FOREACH t IN ARRAY ARRAY['orders', 'deliveries', 'items'] LOOP
+        EXECUTE format('CREATE TABLE IF NOT EXISTS %I PARTITION OF %I FOR VALUES FROM (%L) TO (%L)',
+                       t || to_char(lo, '"_p"YYYYMM'), t, lo, hi);
+    END LOOP;
+
+    IF moving THEN
+        FOREACH t IN ARRAY ARRAY['orders', 'deliveries', 'items'] LOOP
+            EXECUTE format('INSERT INTO %I SELECT * FROM %I', t, 'moving_' || t);
+            EXECUTE format('DROP TABLE %I', 'moving_' || t);
+        END LOOP;
+    END IF;
+END $$;
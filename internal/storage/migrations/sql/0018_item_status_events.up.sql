@@ -0,0 +1,21 @@
+-- События item_status.updated, уже примененные к заказам
+-- (storage.ItemStatusUpdater).
+--
+-- eventhandler читает топик без группы потребителей и после перезапуска
+-- получает все события заново. Событие с уже записанной позицией в Kafka
+-- пропускается, поэтому повтор не откатывает статусы товаров и не пишет
+-- ложных исправлений. Позиция записывается и для события, которое ничего
+-- не изменило: иначе его повтор откатил бы более поздние события.
+-- version — исправление, которое внесло событие (NULL — статусы уже были
+-- такими).
+CREATE TABLE item_status_events (
+    topic TEXT NOT NULL,
+    kafka_partition INT NOT NULL,
+    kafka_offset BIGINT NOT NULL,
+    order_uid TEXT NOT NULL REFERENCES order_keys ON DELETE CASCADE,
+    version INT,
+    at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (topic, kafka_partition, kafka_offset)
+);
+
+CREATE INDEX item_status_events_order_uid_idx ON item_status_events (order_uid);
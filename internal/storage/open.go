@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Open создает хранилище по DSN:
+//
+//	sqlite:<путь к файлу>  — SQLiteStore (например, sqlite:orders.db)
+//	memory:                — MemoryStore, данные живут до остановки процесса
+//	document:<postgres>    — DocumentStorage, заказы в JSONB (миграция 0004)
+//	shards:<путь к карте>  — ShardedStorage по карте шардов в JSON (LoadShardMap)
+//	остальное              — строка подключения PostgreSQL (URL или key=value)
+//
+// Реплики для чтения поддерживает только нормализованный режим PostgreSQL,
+// шифрование персональных данных (WithPII) — он же и shards:.
+// closeFn освобождает ресурсы хранилища.
+func Open(ctx context.Context, dsn string, opts ...Option) (store OrderStore, closeFn func(), err error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if len(o.replicas)+len(o.replicaDSNs) > 0 &&
+		(strings.HasPrefix(dsn, "sqlite:") || strings.HasPrefix(dsn, "memory:") || strings.HasPrefix(dsn, "document:") || strings.HasPrefix(dsn, "shards:")) {
+		return nil, nil, fmt.Errorf("%w: read replicas require normalized PostgreSQL storage", ErrInvalidArgument)
+	}
+	if o.pii != nil &&
+		(strings.HasPrefix(dsn, "sqlite:") || strings.HasPrefix(dsn, "memory:") || strings.HasPrefix(dsn, "document:")) {
+		return nil, nil, fmt.Errorf("%w: PII encryption requires normalized PostgreSQL storage", ErrInvalidArgument)
+	}
+
+	switch {
+	case strings.HasPrefix(dsn, "sqlite:"):
+		path := strings.TrimPrefix(strings.TrimPrefix(dsn, "sqlite:"), "//")
+		s, err := NewSQLite(ctx, path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return s, func() { s.Close() }, nil
+	case strings.HasPrefix(dsn, "memory:"):
+		return NewMemoryStore(), func() {}, nil
+	case strings.HasPrefix(dsn, "shards:"):
+		m, err := LoadShardMap(strings.TrimPrefix(dsn, "shards:"))
+		if err != nil {
+			return nil, nil, err
+		}
+		s, err := NewSharded(ctx, m, opts...)
+		if err != nil {
+			return nil, nil, err
+		}
+		return s, s.Close, nil
+	}
+
+	connStr, document := strings.CutPrefix(dsn, "document:")
+	pool, err := pgxpool.New(ctx, connStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if document {
+		store, err = NewDocument(ctx, pool)
+		closeFn = pool.Close
+	} else {
+		var s *Storage
+		s, err = New(ctx, pool, opts...)
+		store = s
+		closeFn = func() {
+			s.Close()
+			pool.Close()
+		}
+	}
+	if err != nil {
+		pool.Close()
+		return nil, nil, err
+	}
+	return store, closeFn, nil
+}
+
+// Pool возвращает пул соединений PostgreSQL (например, для миграций).
+func (s *Storage) Pool() *pgxpool.Pool {
+	return s.pool
+}
+
+// Pools возвращает пулы PostgreSQL хранилища store (все шарды
+// ShardedStorage); для остальных хранилищ — nil.
+func Pools(store OrderStore) []*pgxpool.Pool {
+	switch s := store.(type) {
+	case *Storage:
+		return []*pgxpool.Pool{s.pool}
+	case *DocumentStorage:
+		return []*pgxpool.Pool{s.pool}
+	case *ShardedStorage:
+		pools := make([]*pgxpool.Pool, 0, len(s.names))
+		for _, shard := range s.Shards() {
+			pools = append(pools, shard.pool)
+		}
+		return pools
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/dws33/WB_ZeroProj/internal/pii"
+)
+
+// Option настраивает Storage.
+type Option func(*options)
+
+type options struct {
+	replicas    []*pgxpool.Pool
+	replicaDSNs []string
+	maxLag      time.Duration
+	pii         *pii.Cipher
+}
+
+// WithReplicas добавляет реплики для чтения. Пулы остаются во владении
+// вызывающего: Close их не закрывает.
+func WithReplicas(pools ...*pgxpool.Pool) Option {
+	return func(o *options) { o.replicas = append(o.replicas, pools...) }
+}
+
+// WithReplicaDSNs добавляет реплики по строкам подключения; их пулы
+// создает New и закрывает Close.
+func WithReplicaDSNs(dsns ...string) Option {
+	return func(o *options) { o.replicaDSNs = append(o.replicaDSNs, dsns...) }
+}
+
+// WithMaxReplicaLag задает допустимое отставание реплики (по умолчанию
+// DefaultMaxReplicaLag).
+func WithMaxReplicaLag(d time.Duration) Option {
+	return func(o *options) {
+		if d > 0 {
+			o.maxLag = d
+		}
+	}
+}
+
+// WithPII включает шифрование персональных данных доставки: CreateOrder
+// шифрует имя, телефон, адрес и email, поиск по телефону и email идет
+// по слепым индексам. Чтение возвращает значения зашифрованными —
+// их расшифровывает pii.Cipher.OpenOrder при ответе клиенту.
+func WithPII(c *pii.Cipher) Option {
+	return func(o *options) { o.pii = c }
+}
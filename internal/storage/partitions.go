@@ -0,0 +1,284 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// partitionLockKey — ключ pg_advisory_xact_lock обслуживания секций:
+// несколько экземпляров сервиса не выполняют его одновременно.
+const partitionLockKey = 0x57425f70617274 // "WB_part"
+
+// archiveSchema — схема, куда retention переносит отсоединенные секции.
+const archiveSchema = "order_archive"
+
+// partitionedTables — секционированные таблицы в порядке отсоединения:
+// сначала ссылающиеся на orders.
+var partitionedTables = []string{"items", "deliveries", "orders"}
+
+// orderTables — несекционированные таблицы со строками заказа, которые
+// retention архивирует вместе с его секциями. История и возвраты удаляются
+// каскадом от order_keys, исходные сообщения и метаданные — явно.
+var orderTables = []string{
+	"order_history", "order_status_history", "item_status_history", "refunds",
+	"raw_messages", "ingest_meta",
+}
+
+// PartitionPolicy — настройки обслуживания помесячных секций (миграция 0008).
+type PartitionPolicy struct {
+	// Ahead — на сколько месяцев вперед создавать секции.
+	Ahead int
+	// Retain — сколько месяцев хранить, включая текущий; 0 — хранить все.
+	Retain int
+	// Archive — переносить старые секции в схему order_archive, а не удалять.
+	Archive bool
+}
+
+// MaintainPartitions создает секции на p.Ahead месяцев вперед и убирает
+// заказы старше p.Retain месяцев: секции месяцев целиком, а из секций
+// <таблица>_default — строки. Вместе с заказом убираются его история,
+// возвраты, исходные сообщения и метаданные. Убранные заказы попадают в
+// журнал ChangeFeed, и кэши сервисов их вытесняют.
+func MaintainPartitions(ctx context.Context, pool *pgxpool.Pool, p PartitionPolicy) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return wrapErr(err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, partitionLockKey); err != nil {
+		return wrapErr(err)
+	}
+
+	month := startOfMonth(time.Now().UTC())
+	for i := 0; i <= p.Ahead; i++ {
+		if _, err := tx.Exec(ctx, `SELECT create_order_partitions($1)`, month.AddDate(0, i, 0)); err != nil {
+			return fmt.Errorf("create partitions for %s: %w", month.AddDate(0, i, 0).Format("2006-01"), err)
+		}
+	}
+
+	if p.Retain > 0 {
+		cutoff := month.AddDate(0, 1-p.Retain, 0)
+		months, err := partitionMonths(ctx, tx)
+		if err != nil {
+			return err
+		}
+		for _, m := range months {
+			if !m.Before(cutoff) {
+				continue
+			}
+			if err := retirePartition(ctx, tx, m, p.Archive); err != nil {
+				return fmt.Errorf("retire partitions for %s: %w", m.Format("2006-01"), err)
+			}
+			log.Printf("order partitions for %s retired (archive=%t)", m.Format("2006-01"), p.Archive)
+		}
+		n, err := retireDefault(ctx, tx, cutoff, p.Archive)
+		if err != nil {
+			return fmt.Errorf("retire default partition rows before %s: %w", cutoff.Format("2006-01"), err)
+		}
+		if n > 0 {
+			log.Printf("%d orders before %s retired from default partitions (archive=%t)", n, cutoff.Format("2006-01"), p.Archive)
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// RunPartitionMaintenance выполняет MaintainPartitions сразу и затем каждые
+// interval, пока не отменен ctx. Ошибки пишутся в лог.
+func RunPartitionMaintenance(ctx context.Context, pool *pgxpool.Pool, p PartitionPolicy, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := MaintainPartitions(ctx, pool, p); err != nil {
+			log.Println("fail to maintain order partitions:", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func startOfMonth(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func partitionName(table string, month time.Time) string {
+	return table + month.Format("_p200601")
+}
+
+// partitionMonths возвращает месяцы существующих секций orders.
+func partitionMonths(ctx context.Context, tx pgx.Tx) ([]time.Time, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT c.relname
+		FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = 'orders'::regclass AND c.relname ~ '^orders_p[0-9]{6}$'
+	`)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	months := make([]time.Time, 0, len(names))
+	for _, name := range names {
+		m, err := time.Parse("orders_p200601", name)
+		if err != nil {
+			return nil, fmt.Errorf("partition %s: %w", name, err)
+		}
+		months = append(months, m)
+	}
+	return months, nil
+}
+
+// retirePartition отсоединяет секции месяца month и архивирует или удаляет их.
+// Внешние ключи отсоединенных секций снимаются: иначе удаление order_keys
+// каскадно удалило бы архив, а ссылки из архива мешали бы удалять оплаты.
+func retirePartition(ctx context.Context, tx pgx.Tx, month time.Time, archive bool) error {
+	for _, table := range partitionedTables {
+		part := partitionName(table, month)
+		if _, err := tx.Exec(ctx, fmt.Sprintf(`ALTER TABLE %s DETACH PARTITION %s`,
+			pgx.Identifier{table}.Sanitize(), pgx.Identifier{part}.Sanitize())); err != nil {
+			return err
+		}
+		if err := dropForeignKeys(ctx, tx, part); err != nil {
+			return err
+		}
+	}
+
+	if _, err := retireOrders(ctx, tx, month, month.AddDate(0, 1, 0), archive); err != nil {
+		return err
+	}
+
+	if archive {
+		if _, err := tx.Exec(ctx, `CREATE SCHEMA IF NOT EXISTS `+archiveSchema); err != nil {
+			return err
+		}
+		for _, table := range partitionedTables {
+			if _, err := tx.Exec(ctx, fmt.Sprintf(`ALTER TABLE %s SET SCHEMA %s`,
+				pgx.Identifier{partitionName(table, month)}.Sanitize(), archiveSchema)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	orders := pgx.Identifier{partitionName("orders", month)}.Sanitize()
+	if _, err := tx.Exec(ctx, `DELETE FROM transactions WHERE transactions_uid IN (SELECT payment_id FROM `+orders+`)`); err != nil {
+		return err
+	}
+	for _, table := range partitionedTables {
+		if _, err := tx.Exec(ctx, `DROP TABLE `+pgx.Identifier{partitionName(table, month)}.Sanitize()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retireDefault убирает заказы старше cutoff из секций <таблица>_default
+// (их date_created не попал ни в одну созданную секцию). В режиме архива
+// строки копируются в order_archive.<таблица>_default.
+func retireDefault(ctx context.Context, tx pgx.Tx, cutoff time.Time, archive bool) (int, error) {
+	if archive {
+		for _, table := range partitionedTables {
+			src := pgx.Identifier{table + "_default"}.Sanitize()
+			if err := archiveRows(ctx, tx, table+"_default",
+				`SELECT * FROM `+src+` WHERE date_created < $1`, cutoff); err != nil {
+				return 0, err
+			}
+		}
+		// строки секций default удаляются каскадом от order_keys
+		return retireOrders(ctx, tx, time.Time{}, cutoff, true)
+	}
+
+	// оплаты удаляются после заказов, которые на них ссылаются
+	rows, err := tx.Query(ctx, `SELECT payment_id FROM orders_default WHERE date_created < $1`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	payments, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return 0, err
+	}
+	n, err := retireOrders(ctx, tx, time.Time{}, cutoff, false)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(ctx, `DELETE FROM transactions WHERE transactions_uid = ANY($1)`, payments)
+	return n, err
+}
+
+// retireOrders убирает заказы с date_created в [from, to) из несекционированных
+// таблиц. В режиме архива строки orderTables сначала копируются в
+// order_archive. Исходные сообщения, метаданные и документы удаляются явно,
+// а удаление order_keys (с записью в журнал изменений) каскадом удаляет
+// историю, возвраты и строки еще присоединенных секций.
+func retireOrders(ctx context.Context, tx pgx.Tx, from, to time.Time, archive bool) (int, error) {
+	const keys = `SELECT order_uid FROM order_keys WHERE date_created >= $1 AND date_created < $2`
+	if archive {
+		for _, table := range orderTables {
+			src := pgx.Identifier{table}.Sanitize()
+			if err := archiveRows(ctx, tx, table,
+				`SELECT * FROM `+src+` WHERE order_uid IN (`+keys+`)`, from, to); err != nil {
+				return 0, err
+			}
+		}
+	}
+	for _, table := range []string{"raw_messages", "ingest_meta", "order_documents"} {
+		if _, err := tx.Exec(ctx, `DELETE FROM `+pgx.Identifier{table}.Sanitize()+` WHERE order_uid IN (`+keys+`)`, from, to); err != nil {
+			return 0, err
+		}
+	}
+	tag, err := tx.Exec(ctx, `
+		WITH d AS (DELETE FROM order_keys WHERE date_created >= $1 AND date_created < $2 RETURNING order_uid)
+		INSERT INTO order_changes (order_uid, kind) SELECT order_uid, $3 FROM d
+	`, from, to, ChangeRetire)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// archiveRows копирует строки запроса query в order_archive.<table>,
+// создавая таблицу по образцу table.
+func archiveRows(ctx context.Context, tx pgx.Tx, table, query string, args ...any) error {
+	if _, err := tx.Exec(ctx, `CREATE SCHEMA IF NOT EXISTS `+archiveSchema); err != nil {
+		return err
+	}
+	dst := pgx.Identifier{archiveSchema, table}.Sanitize()
+	if _, err := tx.Exec(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (LIKE %s)`,
+		dst, pgx.Identifier{table}.Sanitize())); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx, `INSERT INTO `+dst+` `+query, args...)
+	return err
+}
+
+func dropForeignKeys(ctx context.Context, tx pgx.Tx, table string) error {
+	rows, err := tx.Query(ctx, `
+		SELECT conname FROM pg_constraint
+		WHERE conrelid = $1::regclass AND contype = 'f'
+	`, table)
+	if err != nil {
+		return err
+	}
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, err := tx.Exec(ctx, fmt.Sprintf(`ALTER TABLE %s DROP CONSTRAINT %s`,
+			pgx.Identifier{table}.Sanitize(), pgx.Identifier{name}.Sanitize())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
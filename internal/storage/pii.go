@@ -0,0 +1,267 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/dws33/WB_ZeroProj/internal/model"
+	"github.com/dws33/WB_ZeroProj/internal/pii"
+)
+
+// rotateBatch — сколько доставок перешифровывается за один запрос RotatePII.
+const rotateBatch = 500
+
+// sealedDelivery — служебные колонки зашифрованной доставки (миграция 0010).
+// Без WithPII все поля nil и в базу пишутся NULL.
+type sealedDelivery struct {
+	keyID      *string
+	phoneIndex []byte
+	emailIndex []byte
+}
+
+// sealDelivery строит слепые индексы по открытым значениям d и шифрует d
+// на месте текущим ключом. Уже зашифрованные значения (заказ, переносимый
+// Rebalance) сначала расшифровываются.
+func (s *Storage) sealDelivery(ctx context.Context, d *model.Delivery) (sealedDelivery, error) {
+	if s.pii == nil {
+		return sealedDelivery{}, nil
+	}
+	if err := s.pii.OpenDelivery(ctx, d); err != nil {
+		return sealedDelivery{}, err
+	}
+	sealed := sealedDelivery{
+		phoneIndex: s.pii.BlindIndex(pii.FieldPhone, d.Phone),
+		emailIndex: s.pii.BlindIndex(pii.FieldEmail, d.Email),
+	}
+	if err := s.pii.SealDelivery(ctx, d); err != nil {
+		return sealedDelivery{}, err
+	}
+	keyID := s.pii.CurrentKey()
+	sealed.keyID = &keyID
+	return sealed, nil
+}
+
+// RotatePII перешифровывает текущим ключом доставки, исходные сообщения
+// архива и доставки в документах order_documents (остаются от документного
+// режима и SyncDocuments), зашифрованные другим ключом или еще не
+// зашифрованные, и заново строит слепые индексы доставок. Возвращает число
+// перешифрованных записей. Без WithPII ничего не делает. Перешифрованные
+// заказы попадают в журнал ChangeFeed, и кэши сервисов их вытесняют.
+func (s *Storage) RotatePII(ctx context.Context) (int, error) {
+	if s.pii == nil {
+		return 0, nil
+	}
+	deliveries, err := s.rotateDeliveries(ctx)
+	if err != nil {
+		return deliveries, err
+	}
+	messages, err := s.rotateRawMessages(ctx)
+	if err != nil {
+		return deliveries + messages, err
+	}
+	documents, err := s.rotateDocuments(ctx)
+	return deliveries + messages + documents, err
+}
+
+func (s *Storage) rotateDeliveries(ctx context.Context) (int, error) {
+	current := s.pii.CurrentKey()
+	rotated, last := 0, ""
+	for {
+		rows, err := s.pool.Query(ctx, `
+			SELECT order_uid, date_created, pii_key_id, name, phone, address, email
+			FROM deliveries
+			WHERE pii_key_id IS DISTINCT FROM $1 AND order_uid > $2
+			ORDER BY order_uid
+			LIMIT $3
+		`, current, last, rotateBatch)
+		if err != nil {
+			return rotated, wrapErr(err)
+		}
+		type row struct {
+			uid         string
+			dateCreated time.Time
+			keyID       *string
+			d           model.Delivery
+		}
+		batch, err := pgx.CollectRows(rows, func(r pgx.CollectableRow) (row, error) {
+			var v row
+			err := r.Scan(&v.uid, &v.dateCreated, &v.keyID, &v.d.Name, &v.d.Phone, &v.d.Address, &v.d.Email)
+			return v, err
+		})
+		if err != nil {
+			return rotated, wrapErr(err)
+		}
+
+		for _, v := range batch {
+			sealed, err := s.sealDelivery(ctx, &v.d)
+			if err != nil {
+				return rotated, err
+			}
+			// запись, измененную параллельно (другим экземпляром или
+			// удалением данных), не трогаем
+			tag, err := s.pool.Exec(ctx, `
+				WITH u AS (
+					UPDATE deliveries
+					SET name = $3, phone = $4, address = $5, email = $6,
+					    pii_key_id = $7, phone_bidx = $8, email_bidx = $9
+					WHERE order_uid = $1 AND date_created = $2 AND pii_key_id IS NOT DISTINCT FROM $10
+					RETURNING order_uid
+				)
+				INSERT INTO order_changes (order_uid, kind) SELECT order_uid, $11 FROM u
+			`, v.uid, v.dateCreated, v.d.Name, v.d.Phone, v.d.Address, v.d.Email,
+				sealed.keyID, sealed.phoneIndex, sealed.emailIndex, v.keyID, ChangeRotate)
+			if err != nil {
+				return rotated, wrapErr(err)
+			}
+			rotated += int(tag.RowsAffected())
+		}
+		if len(batch) > 0 {
+			s.replicas.wrote(ctx, s.pool)
+		}
+		if len(batch) < rotateBatch {
+			return rotated, nil
+		}
+		last = batch[len(batch)-1].uid
+	}
+}
+
+func (s *Storage) rotateRawMessages(ctx context.Context) (int, error) {
+	current := s.pii.CurrentKey()
+	rotated, last := 0, int64(0)
+	for {
+		rows, err := s.pool.Query(ctx, `
+			SELECT id, pii_key_id, payload FROM raw_messages
+			WHERE pii_key_id IS DISTINCT FROM $1 AND id > $2
+			ORDER BY id
+			LIMIT $3
+		`, current, last, rotateBatch)
+		if err != nil {
+			return rotated, wrapErr(err)
+		}
+		type row struct {
+			id      int64
+			keyID   *string
+			payload []byte
+		}
+		batch, err := pgx.CollectRows(rows, func(r pgx.CollectableRow) (row, error) {
+			var v row
+			err := r.Scan(&v.id, &v.keyID, &v.payload)
+			return v, err
+		})
+		if err != nil {
+			return rotated, wrapErr(err)
+		}
+
+		for _, v := range batch {
+			opened, err := s.pii.Open(ctx, pii.FieldRawPayload, string(v.payload))
+			if err != nil {
+				return rotated, fmt.Errorf("raw message %d: %w", v.id, err)
+			}
+			payload, keyID, err := sealPayload(ctx, s.pii, []byte(opened))
+			if err != nil {
+				return rotated, err
+			}
+			// сообщение, стертое или перешифрованное параллельно, не трогаем
+			tag, err := s.pool.Exec(ctx, `
+				UPDATE raw_messages SET payload = $2, pii_key_id = $3
+				WHERE id = $1 AND pii_key_id IS NOT DISTINCT FROM $4
+			`, v.id, payload, keyID, v.keyID)
+			if err != nil {
+				return rotated, wrapErr(err)
+			}
+			rotated += int(tag.RowsAffected())
+		}
+		if len(batch) < rotateBatch {
+			return rotated, nil
+		}
+		last = batch[len(batch)-1].id
+	}
+}
+
+// rotateDocuments шифрует текущим ключом поля доставки в order_documents.
+// Нормализованный режим документы не читает, поэтому в журнал изменений
+// они не попадают.
+func (s *Storage) rotateDocuments(ctx context.Context) (int, error) {
+	current := pii.KeyPrefix(s.pii.CurrentKey())
+	rotated, last := 0, ""
+	for {
+		rows, err := s.pool.Query(ctx, `
+			SELECT order_uid, doc->'delivery' FROM order_documents
+			WHERE order_uid > $2 AND EXISTS (
+				SELECT 1 FROM jsonb_each_text(doc->'delivery') f
+				WHERE f.key IN ('name', 'phone', 'address', 'email')
+				  AND f.value <> '' AND NOT starts_with(f.value, $1)
+			)
+			ORDER BY order_uid
+			LIMIT $3
+		`, current, last, rotateBatch)
+		if err != nil {
+			return rotated, wrapErr(err)
+		}
+		type row struct {
+			uid      string
+			delivery []byte
+		}
+		batch, err := pgx.CollectRows(rows, func(r pgx.CollectableRow) (row, error) {
+			var v row
+			err := r.Scan(&v.uid, &v.delivery)
+			return v, err
+		})
+		if err != nil {
+			return rotated, wrapErr(err)
+		}
+
+		for _, v := range batch {
+			d := new(model.Delivery)
+			if err := json.Unmarshal(v.delivery, d); err != nil {
+				return rotated, fmt.Errorf("document %s: %w", v.uid, err)
+			}
+			if err := s.pii.Reseal(ctx, d); err != nil {
+				return rotated, fmt.Errorf("document %s: %w", v.uid, err)
+			}
+			sealed, err := json.Marshal(d)
+			if err != nil {
+				return rotated, err
+			}
+			// документ, измененный параллельно (стиранием данных), не трогаем
+			tag, err := s.pool.Exec(ctx, `
+				UPDATE order_documents SET doc = jsonb_set(doc, '{delivery}', $2)
+				WHERE order_uid = $1 AND doc->'delivery' = $3
+			`, v.uid, sealed, v.delivery)
+			if err != nil {
+				return rotated, wrapErr(err)
+			}
+			rotated += int(tag.RowsAffected())
+		}
+		if len(batch) < rotateBatch {
+			return rotated, nil
+		}
+		last = batch[len(batch)-1].uid
+	}
+}
+
+// RunPIIRotation выполняет RotatePII сразу и затем каждые interval,
+// пока не отменен ctx. Ошибки пишутся в лог.
+func RunPIIRotation(ctx context.Context, s *Storage, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		rotated, err := s.RotatePII(ctx)
+		if err != nil {
+			log.Println("fail to rotate delivery PII:", err)
+		}
+		if rotated > 0 {
+			log.Printf("PII of %d deliveries, raw messages and order documents re-encrypted with key %s", rotated, s.pii.CurrentKey())
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/dws33/WB_ZeroProj/internal/pii"
+)
+
+// Тип события сообщения — значение заголовка Kafka EventTypeHeader;
+// сообщение без заголовка — новый заказ.
+const (
+	EventTypeHeader   = "event_type"
+	EventOrderCreated = "order.created"
+)
+
+// RawHeader — заголовок сообщения Kafka.
+type RawHeader struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// RawMessage — сообщение Kafka в том виде, в каком его прислал продюсер.
+// OrderUID пуст, если order_uid из сообщения извлечь не удалось.
+type RawMessage struct {
+	OrderUID   string      `json:"order_uid"`
+	Topic      string      `json:"topic"`
+	Partition  int         `json:"partition"`
+	Offset     int64       `json:"offset"`
+	Headers    []RawHeader `json:"headers"`
+	Payload    []byte      `json:"-"`
+	ReceivedAt time.Time   `json:"received_at"`
+}
+
+// EventType возвращает тип события сообщения: в архив заказа попадают
+// и другие события с его order_uid (возвраты, статусы товаров).
+func (m *RawMessage) EventType() string {
+	for _, h := range m.Headers {
+		if h.Key == EventTypeHeader {
+			return string(h.Value)
+		}
+	}
+	return EventOrderCreated
+}
+
+// RawStore — архив исходных сообщений. Сообщение однозначно определяется
+// топиком, партицией и смещением: повторное архивирование ничего не меняет.
+type RawStore interface {
+	ArchiveRaw(ctx context.Context, m *RawMessage) error
+	// GetRawMessages возвращает сообщения заказа от старых к новым
+	// или ErrNotFound, если их нет.
+	GetRawMessages(ctx context.Context, uid string) ([]*RawMessage, error)
+}
+
+func compressPayload(p []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(p); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompressPayload(p []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// encodeHeaders кодирует заголовки в JSON; без заголовков — пустой массив.
+func encodeHeaders(headers []RawHeader) ([]byte, error) {
+	if headers == nil {
+		headers = []RawHeader{}
+	}
+	return json.Marshal(headers)
+}
+
+func noRawMessages(uid string) error {
+	return fmt.Errorf("%w: no raw messages for order %q", ErrNotFound, uid)
+}
+
+// sealPayload шифрует сжатый payload и возвращает id ключа;
+// без шифра payload остается открытым, id — nil.
+func sealPayload(ctx context.Context, c *pii.Cipher, payload []byte) ([]byte, *string, error) {
+	if c == nil {
+		return payload, nil, nil
+	}
+	sealed, err := c.Seal(ctx, pii.FieldRawPayload, string(payload))
+	if err != nil {
+		return nil, nil, err
+	}
+	keyID := pii.KeyID(sealed)
+	return []byte(sealed), &keyID, nil
+}
+
+// openPayload расшифровывает (если нужно) и распаковывает payload архива.
+func openPayload(ctx context.Context, c *pii.Cipher, payload []byte) ([]byte, error) {
+	if pii.IsSealed(string(payload)) {
+		if c == nil {
+			return nil, errors.New("payload is encrypted, PII keys are not configured")
+		}
+		opened, err := c.Open(ctx, pii.FieldRawPayload, string(payload))
+		if err != nil {
+			return nil, err
+		}
+		payload = []byte(opened)
+	}
+	return decompressPayload(payload)
+}
+
+// С WithPII payload архивируется зашифрованным (миграция 0015).
+
+func (s *Storage) ArchiveRaw(ctx context.Context, m *RawMessage) error {
+	return archiveRaw(ctx, s.pool, m, s.pii)
+}
+
+func (s *Storage) GetRawMessages(ctx context.Context, uid string) ([]*RawMessage, error) {
+	return getRawMessages(ctx, s.pool, uid, s.pii)
+}
+
+func (s *DocumentStorage) ArchiveRaw(ctx context.Context, m *RawMessage) error {
+	return archiveRaw(ctx, s.pool, m, nil)
+}
+
+func (s *DocumentStorage) GetRawMessages(ctx context.Context, uid string) ([]*RawMessage, error) {
+	return getRawMessages(ctx, s.pool, uid, nil)
+}
+
+// archiveRaw и getRawMessages работают с таблицей raw_messages (миграция 0005),
+// общей для нормализованного и документного режимов.
+func archiveRaw(ctx context.Context, pool *pgxpool.Pool, m *RawMessage, c *pii.Cipher) error {
+	payload, err := compressPayload(m.Payload)
+	if err != nil {
+		return err
+	}
+	payload, keyID, err := sealPayload(ctx, c, payload)
+	if err != nil {
+		return err
+	}
+	headers, err := encodeHeaders(m.Headers)
+	if err != nil {
+		return err
+	}
+	_, err = pool.Exec(ctx, `
+		INSERT INTO raw_messages (
+			order_uid, topic, kafka_partition, kafka_offset, headers, payload, received_at, pii_key_id
+		) VALUES ($1,$2,$3,$4,$5,$6,$7,$8)
+		ON CONFLICT (topic, kafka_partition, kafka_offset) DO NOTHING
+	`, m.OrderUID, m.Topic, m.Partition, m.Offset, headers, payload, m.ReceivedAt, keyID)
+	return wrapErr(err)
+}
+
+func getRawMessages(ctx context.Context, pool *pgxpool.Pool, uid string, c *pii.Cipher) ([]*RawMessage, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT order_uid, topic, kafka_partition, kafka_offset, headers, payload, received_at
+		FROM raw_messages
+		WHERE order_uid = $1
+		ORDER BY received_at, id
+	`, uid)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	defer rows.Close()
+
+	var messages []*RawMessage
+	for rows.Next() {
+		m := new(RawMessage)
+		var headers, payload []byte
+		if err := rows.Scan(&m.OrderUID, &m.Topic, &m.Partition, &m.Offset, &headers, &payload, &m.ReceivedAt); err != nil {
+			return nil, wrapErr(err)
+		}
+		if err := json.Unmarshal(headers, &m.Headers); err != nil {
+			return nil, fmt.Errorf("raw message %s/%d/%d: headers: %w", m.Topic, m.Partition, m.Offset, err)
+		}
+		if m.Payload, err = openPayload(ctx, c, payload); err != nil {
+			return nil, fmt.Errorf("raw message %s/%d/%d: payload: %w", m.Topic, m.Partition, m.Offset, err)
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr(err)
+	}
+	if len(messages) == 0 {
+		return nil, noRawMessages(uid)
+	}
+	return messages, nil
+}
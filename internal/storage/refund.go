@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/dws33/WB_ZeroProj/internal/model"
+)
+
+// RefundSummary — возвраты заказа от старых к новым и итог: оплата,
+// сумма возвратов и остаток (Net = Paid - Refunded).
+type RefundSummary struct {
+	Currency string          `json:"currency"`
+	Paid     int             `json:"paid"`
+	Refunded int             `json:"refunded"`
+	Net      int             `json:"net"`
+	Refunds  []*model.Refund `json:"refunds"`
+}
+
+// RefundStore — возвраты денег по заказам.
+type RefundStore interface {
+	// CreateRefund проверяет возврат (model.CheckRefund) и сохраняет его
+	// с дополненными суммами. Возврат больше остатка оплаты или товара —
+	// ErrInvalidArgument, оборачивающая model.ErrInvalidRefund; повтор
+	// refund_id — ErrConflict; ErrNotFound — заказа нет или он удален.
+	CreateRefund(ctx context.Context, refund *model.Refund) (*model.Refund, error)
+	// Refunds возвращает возвраты заказа с итогом. ErrNotFound — заказа нет.
+	Refunds(ctx context.Context, uid string) (*RefundSummary, error)
+}
+
+func refundSummary(order *model.Order, refunds []*model.Refund) *RefundSummary {
+	summary := &RefundSummary{
+		Refunded: model.Refunded(refunds),
+		Net:      model.NetAmount(order, refunds),
+		Refunds:  refunds,
+	}
+	if order.Payment != nil {
+		summary.Currency, summary.Paid = order.Payment.Currency, order.Payment.Amount
+	}
+	if summary.Refunds == nil {
+		summary.Refunds = []*model.Refund{}
+	}
+	return summary
+}
+
+// checkRefund проверяет возврат и возвращает ошибку хранилища. Повтор
+// проверяется первым: повторное сообщение о возврате, уже исчерпавшем
+// остаток, — ErrConflict, а не ErrInvalidArgument.
+func checkRefund(order *model.Order, prior []*model.Refund, refund *model.Refund) error {
+	for _, p := range prior {
+		if p.RefundID == refund.RefundID {
+			return fmt.Errorf("%w: refund %q of order %q", ErrConflict, refund.RefundID, refund.OrderUID)
+		}
+	}
+	if err := refund.Validate(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidArgument, err)
+	}
+	if err := model.CheckRefund(order, prior, refund); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidArgument, err)
+	}
+	return nil
+}
+
+// checkRefunded не дает исправлению заказа уменьшить оплату ниже
+// суммы уже сделанных возвратов.
+func checkRefunded(order *model.Order, refunds []*model.Refund) error {
+	if refunded := model.Refunded(refunds); order.Payment != nil && order.Payment.Amount < refunded {
+		return fmt.Errorf("%w: %w: payment amount %d is less than refunded %d",
+			ErrInvalidArgument, model.ErrInvalidRefund, order.Payment.Amount, refunded)
+	}
+	return nil
+}
+
+func (s *Storage) CreateRefund(ctx context.Context, refund *model.Refund) (*model.Refund, error) {
+	refund, err := s.createRefund(ctx, refund)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	s.replicas.wrote(ctx, s.pool)
+	return refund, nil
+}
+
+func (s *Storage) createRefund(ctx context.Context, refund *model.Refund) (*model.Refund, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// возвраты и исправления одного заказа выполняются по очереди:
+	// иначе два возврата вместе могли бы превысить оплату
+	var locked string
+	if err := tx.QueryRow(ctx, `
+		SELECT order_uid FROM order_keys
+		WHERE order_uid = $1 AND deleted_at IS NULL
+		FOR UPDATE
+	`, refund.OrderUID).Scan(&locked); err != nil {
+		return nil, err
+	}
+	order := new(model.Order)
+	if err := tx.QueryRow(ctx, selectOrdersQuery+` WHERE o.order_uid = $1`, refund.OrderUID).
+		Scan(orderToPtrs(order)...); err != nil {
+		return nil, err
+	}
+	prior, err := queryRefunds(ctx, tx, refund.OrderUID)
+	if err != nil {
+		return nil, err
+	}
+
+	refund = cloneRefund(refund)
+	if err := checkRefund(order, prior, refund); err != nil {
+		return nil, err
+	}
+	items, err := refundItemsJSON(refund)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.QueryRow(ctx, `
+		INSERT INTO refunds (order_uid, refund_id, kind, amount, items, reason, actor)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING created_at
+	`, refund.OrderUID, refund.RefundID, refund.Kind, refund.Amount, items, refund.Reason, refund.Actor).
+		Scan(&refund.CreatedAt); err != nil {
+		return nil, err
+	}
+	return refund, tx.Commit(ctx)
+}
+
+func (s *Storage) Refunds(ctx context.Context, uid string) (*RefundSummary, error) {
+	order, err := s.GetOrder(ReadPrimary(ctx), uid)
+	if err != nil {
+		return nil, err
+	}
+	refunds, err := queryRefunds(ctx, s.pool, uid)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	return refundSummary(order, refunds), nil
+}
+
+func queryRefunds(ctx context.Context, q interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}, uid string) ([]*model.Refund, error) {
+	rows, err := q.Query(ctx, `
+		SELECT refund_id, order_uid, kind, amount, items, reason, actor, created_at FROM refunds
+		WHERE order_uid = $1
+		ORDER BY created_at, refund_id
+	`, uid)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (*model.Refund, error) {
+		r := new(model.Refund)
+		err := row.Scan(&r.RefundID, &r.OrderUID, &r.Kind, &r.Amount, &r.Items, &r.Reason, &r.Actor, &r.CreatedAt)
+		if len(r.Items) == 0 {
+			r.Items = nil
+		}
+		return r, err
+	})
+}
+
+// importRefunds копирует возвраты заказа, перенесенного Rebalance.
+func (s *Storage) importRefunds(ctx context.Context, refunds []*model.Refund) error {
+	for _, r := range refunds {
+		items, err := refundItemsJSON(r)
+		if err != nil {
+			return err
+		}
+		if _, err := s.pool.Exec(ctx, `
+			INSERT INTO refunds (order_uid, refund_id, kind, amount, items, reason, actor, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			ON CONFLICT DO NOTHING
+		`, r.OrderUID, r.RefundID, r.Kind, r.Amount, items, r.Reason, r.Actor, r.CreatedAt); err != nil {
+			return wrapErr(err)
+		}
+	}
+	return nil
+}
+
+// refundItemsJSON — значение колонки items: массив, а не null.
+func refundItemsJSON(r *model.Refund) ([]byte, error) {
+	if r.Items == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(r.Items)
+}
+
+func cloneRefund(r *model.Refund) *model.Refund {
+	c := *r
+	if r.Items != nil {
+		c.Items = append([]model.RefundItem(nil), r.Items...)
+	}
+	return &c
+}
+
+// Возвраты в шардах хранятся в шарде заказа.
+
+func (s *ShardedStorage) CreateRefund(ctx context.Context, refund *model.Refund) (*model.Refund, error) {
+	shard, err := s.shardOfOrder(ctx, refund.OrderUID)
+	if err != nil {
+		return nil, err
+	}
+	return shard.CreateRefund(ctx, refund)
+}
+
+func (s *ShardedStorage) Refunds(ctx context.Context, uid string) (*RefundSummary, error) {
+	shard, err := s.shardOfOrder(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	return shard.Refunds(ctx, uid)
+}
+
+func (m *MemoryStore) CreateRefund(_ context.Context, refund *model.Refund) (*model.Refund, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	order, ok := m.orders[refund.OrderUID]
+	if !ok {
+		return nil, fmt.Errorf("%w: order %q", ErrNotFound, refund.OrderUID)
+	}
+	prior := m.refunds[refund.OrderUID]
+	refund = cloneRefund(refund)
+	if err := checkRefund(order, prior, refund); err != nil {
+		return nil, err
+	}
+	refund.CreatedAt = time.Now()
+	m.refunds[refund.OrderUID] = append(prior, refund)
+	return cloneRefund(refund), nil
+}
+
+func (m *MemoryStore) Refunds(_ context.Context, uid string) (*RefundSummary, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	order, ok := m.orders[uid]
+	if !ok {
+		return nil, fmt.Errorf("%w: order %q", ErrNotFound, uid)
+	}
+	refunds := make([]*model.Refund, len(m.refunds[uid]))
+	for i, r := range m.refunds[uid] {
+		refunds[i] = cloneRefund(r)
+	}
+	return refundSummary(order, refunds), nil
+}
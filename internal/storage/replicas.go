@@ -0,0 +1,279 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	// DefaultMaxReplicaLag — отставание реплики, после которого чтение идет в primary.
+	DefaultMaxReplicaLag = 5 * time.Second
+	// replicaCheckInterval — период проверки состояния реплик.
+	replicaCheckInterval = 2 * time.Second
+	// unknownLSN — позиция последней записи неизвестна, реплики не подходят.
+	unknownLSN = ^uint64(0)
+)
+
+type (
+	primaryKey struct{}
+	afterKey   struct{}
+	writesKey  struct{}
+)
+
+// ReadPrimary возвращает контекст, чтения в котором идут только в primary.
+func ReadPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+// writes — позиция WAL primary после последней записи в контексте TrackWrites.
+type writes struct {
+	lsn atomic.Uint64
+}
+
+// TrackWrites возвращает контекст, в котором Storage запоминает позицию WAL
+// primary после каждой записи; ее возвращает WrittenLSN. Чтения в этом же
+// контексте идут только в реплики, проигравшие WAL до этой позиции.
+func TrackWrites(ctx context.Context) context.Context {
+	return context.WithValue(ctx, writesKey{}, new(writes))
+}
+
+// WrittenLSN возвращает позицию WAL (вида "16/B374D848") после последней
+// записи в контексте TrackWrites или "", если записей не было или позиция
+// неизвестна. Клиент передает ее в следующих запросах, см. ReadAfter.
+func WrittenLSN(ctx context.Context) string {
+	w, _ := ctx.Value(writesKey{}).(*writes)
+	if w == nil {
+		return ""
+	}
+	lsn := w.lsn.Load()
+	if lsn == 0 || lsn == unknownLSN {
+		return ""
+	}
+	return formatLSN(lsn)
+}
+
+// ReadAfter возвращает контекст, чтения в котором идут только в реплики,
+// проигравшие WAL до позиции lsn (значение WrittenLSN) — read-your-writes
+// для клиента, записавшего заказ в другом запросе или другом экземпляре
+// сервиса.
+func ReadAfter(ctx context.Context, lsn string) (context.Context, error) {
+	pos, err := parseLSN(lsn)
+	if err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, afterKey{}, pos), nil
+}
+
+// readAfter возвращает позицию WAL, до которой реплика должна проиграть
+// журнал, чтобы читать из нее в контексте ctx.
+func readAfter(ctx context.Context) uint64 {
+	after, _ := ctx.Value(afterKey{}).(uint64)
+	if w, _ := ctx.Value(writesKey{}).(*writes); w != nil {
+		after = max(after, w.lsn.Load())
+	}
+	return after
+}
+
+// replica — пул реплики и ее состояние по последней проверке.
+type replica struct {
+	pool  *pgxpool.Pool
+	owned bool
+
+	mu      sync.RWMutex
+	healthy bool
+	lsn     uint64        // pg_last_wal_replay_lsn
+	lag     time.Duration // возраст последней проигранной транзакции, если WAL проигран не весь
+}
+
+// replicaSet выбирает реплику для чтения. Реплика подходит, если последняя
+// проверка прошла, отставание не больше maxLag и она проиграла WAL не меньше
+// позиции, которую требует запрос (TrackWrites, ReadAfter). Иначе — primary.
+type replicaSet struct {
+	replicas []*replica
+	maxLag   time.Duration
+	next     atomic.Uint64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newReplicaSet(ctx context.Context, o *options) (*replicaSet, error) {
+	rs := &replicaSet{maxLag: o.maxLag}
+	if rs.maxLag <= 0 {
+		rs.maxLag = DefaultMaxReplicaLag
+	}
+	for _, pool := range o.replicas {
+		rs.replicas = append(rs.replicas, &replica{pool: pool})
+	}
+	for _, dsn := range o.replicaDSNs {
+		pool, err := pgxpool.New(ctx, dsn)
+		if err != nil {
+			rs.closePools()
+			return nil, fmt.Errorf("replica: %w", err)
+		}
+		rs.replicas = append(rs.replicas, &replica{pool: pool, owned: true})
+	}
+	if len(rs.replicas) == 0 {
+		return rs, nil
+	}
+
+	rs.checkAll(ctx)
+	rs.stop = make(chan struct{})
+	rs.done = make(chan struct{})
+	go rs.checkLoop()
+	return rs, nil
+}
+
+// pick возвращает реплику для чтения или nil, если читать нужно из primary.
+func (rs *replicaSet) pick(ctx context.Context) *replica {
+	if len(rs.replicas) == 0 || ctx.Value(primaryKey{}) != nil {
+		return nil
+	}
+	after := readAfter(ctx)
+	start := rs.next.Add(1)
+	for i := range rs.replicas {
+		r := rs.replicas[(int(start)+i)%len(rs.replicas)]
+		r.mu.RLock()
+		ok := r.healthy && r.lag <= rs.maxLag && r.lsn >= after
+		r.mu.RUnlock()
+		if ok {
+			return r
+		}
+	}
+	return nil
+}
+
+// markDown исключает реплику из выбора до следующей успешной проверки.
+func (rs *replicaSet) markDown(r *replica, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.healthy {
+		log.Println("replica marked down:", err)
+	}
+	r.healthy = false
+}
+
+// wrote запоминает позицию WAL primary после записи в контексте TrackWrites.
+// Позиция нужна и без реплик: ее получает клиент, а читать он может
+// через другой экземпляр сервиса, у которого реплики есть.
+func (rs *replicaSet) wrote(ctx context.Context, primary *pgxpool.Pool) {
+	w, _ := ctx.Value(writesKey{}).(*writes)
+	if w == nil {
+		return
+	}
+	var s string
+	err := primary.QueryRow(ctx, `SELECT pg_current_wal_lsn()::text`).Scan(&s)
+	lsn, perr := parseLSN(s)
+	if err != nil || perr != nil {
+		// позиция неизвестна: дальше в этом контексте читаем только из primary
+		w.lsn.Store(unknownLSN)
+		return
+	}
+	for {
+		cur := w.lsn.Load()
+		if cur == unknownLSN || cur >= lsn || w.lsn.CompareAndSwap(cur, lsn) {
+			return
+		}
+	}
+}
+
+func (rs *replicaSet) checkLoop() {
+	defer close(rs.done)
+	ticker := time.NewTicker(replicaCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), replicaCheckInterval)
+			rs.checkAll(ctx)
+			cancel()
+		case <-rs.stop:
+			return
+		}
+	}
+}
+
+func (rs *replicaSet) checkAll(ctx context.Context) {
+	for _, r := range rs.replicas {
+		var (
+			inRecovery bool
+			lsn        *string
+			lag        *float64
+		)
+		err := r.pool.QueryRow(ctx, `
+			SELECT pg_is_in_recovery(),
+			       pg_last_wal_replay_lsn()::text,
+			       CASE WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+			            ELSE extract(epoch FROM now() - pg_last_xact_replay_timestamp())
+			       END::float8
+		`).Scan(&inRecovery, &lsn, &lag)
+		if err == nil && (!inRecovery || lsn == nil) {
+			err = fmt.Errorf("%s is not a streaming replica", r.pool.Config().ConnConfig.Host)
+		}
+		var pos uint64
+		if err == nil {
+			pos, err = parseLSN(*lsn)
+		}
+		if err != nil {
+			rs.markDown(r, err)
+			continue
+		}
+
+		r.mu.Lock()
+		if !r.healthy {
+			log.Println("replica is up:", r.pool.Config().ConnConfig.Host)
+		}
+		// реплика, проигравшая весь полученный WAL, не отстает,
+		// даже если на primary давно не было транзакций
+		r.healthy, r.lsn, r.lag = true, pos, 0
+		if lag != nil {
+			r.lag = time.Duration(*lag * float64(time.Second))
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (rs *replicaSet) close() {
+	if rs.stop != nil {
+		close(rs.stop)
+		<-rs.done
+	}
+	rs.closePools()
+}
+
+func (rs *replicaSet) closePools() {
+	for _, r := range rs.replicas {
+		if r.owned {
+			r.pool.Close()
+		}
+	}
+}
+
+// parseLSN разбирает позицию WAL вида "16/B374D848".
+func parseLSN(s string) (uint64, error) {
+	hi, lo, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, fmt.Errorf("invalid LSN %q", s)
+	}
+	h, err := strconv.ParseUint(hi, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q", s)
+	}
+	l, err := strconv.ParseUint(lo, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q", s)
+	}
+	return h<<32 | l, nil
+}
+
+func formatLSN(lsn uint64) string {
+	return fmt.Sprintf("%X/%X", lsn>>32, uint32(lsn))
+}
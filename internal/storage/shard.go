@@ -0,0 +1,490 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/dws33/WB_ZeroProj/internal/model"
+)
+
+// maxLocated — сколько соответствий order_uid → шард помнит ShardedStorage.
+const maxLocated = 100_000
+
+// ShardRange — диапазон shardkey [From, To], хранящийся на шарде Shard.
+type ShardRange struct {
+	From  int    `json:"from"`
+	To    int    `json:"to"`
+	Shard string `json:"shard"`
+}
+
+// ShardMap — карта шардов: строки подключения PostgreSQL по именам шардов
+// и диапазоны shardkey. Home — шард архива сообщений и метаданных
+// получения (по умолчанию шард первого диапазона).
+type ShardMap struct {
+	Shards map[string]string `json:"shards"`
+	Ranges []ShardRange      `json:"ranges"`
+	Home   string            `json:"home,omitempty"`
+}
+
+// LoadShardMap читает карту шардов из JSON-файла.
+func LoadShardMap(path string) (*ShardMap, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := new(ShardMap)
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("shard map %s: %w", path, err)
+	}
+	if err := m.validate(); err != nil {
+		return nil, fmt.Errorf("shard map %s: %w", path, err)
+	}
+	return m, nil
+}
+
+func (m *ShardMap) validate() error {
+	if len(m.Ranges) == 0 {
+		return errors.New("no ranges")
+	}
+	ranges := slices.Clone(m.Ranges)
+	slices.SortFunc(ranges, func(a, b ShardRange) int { return a.From - b.From })
+	for i, r := range ranges {
+		if r.From > r.To {
+			return fmt.Errorf("range [%d, %d] is empty", r.From, r.To)
+		}
+		if _, ok := m.Shards[r.Shard]; !ok {
+			return fmt.Errorf("range [%d, %d]: unknown shard %q", r.From, r.To, r.Shard)
+		}
+		if i > 0 && ranges[i-1].To >= r.From {
+			return fmt.Errorf("ranges [%d, %d] and [%d, %d] overlap",
+				ranges[i-1].From, ranges[i-1].To, r.From, r.To)
+		}
+	}
+	if m.Home == "" {
+		m.Home = m.Ranges[0].Shard
+	}
+	if _, ok := m.Shards[m.Home]; !ok {
+		return fmt.Errorf("unknown home shard %q", m.Home)
+	}
+	return nil
+}
+
+// shardOf возвращает имя шарда заказа с ключом shardKey.
+func (m *ShardMap) shardOf(shardKey string) (string, error) {
+	key, err := strconv.Atoi(shardKey)
+	if err != nil {
+		return "", fmt.Errorf("%w: shardkey %q is not a number", ErrInvalidArgument, shardKey)
+	}
+	for _, r := range m.Ranges {
+		if r.From <= key && key <= r.To {
+			return r.Shard, nil
+		}
+	}
+	return "", fmt.Errorf("%w: shardkey %d is not mapped to a shard", ErrInvalidArgument, key)
+}
+
+// ShardedStorage распределяет заказы по шардам PostgreSQL (нормализованная
+// схема) по shardkey. CreateOrder пишет в шард своего диапазона; GetOrder
+// ищет заказ в запомненном шарде, а если его там нет — во всех шардах
+// параллельно, поэтому заказы находятся и во время Rebalance.
+// Уникальность order_uid и transaction CreateOrder проверяет во всех шардах.
+type ShardedStorage struct {
+	m      *ShardMap
+	names  []string
+	shards map[string]*Storage
+	pools  []*pgxpool.Pool
+
+	mu      sync.Mutex
+	located map[string]string
+}
+
+// NewSharded подключается ко всем шардам карты m. Из opts учитывается
+// только WithPII: реплики у шардов свои и через карту не задаются.
+func NewSharded(ctx context.Context, m *ShardMap, opts ...Option) (*ShardedStorage, error) {
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	s := &ShardedStorage{
+		m:       m,
+		shards:  make(map[string]*Storage, len(m.Shards)),
+		located: make(map[string]string),
+	}
+	for name, dsn := range m.Shards {
+		s.names = append(s.names, name)
+		pool, err := pgxpool.New(ctx, dsn)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("shard %s: %w", name, err)
+		}
+		s.pools = append(s.pools, pool)
+		shard, err := New(ctx, pool, WithPII(o.pii))
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("shard %s: %w", name, err)
+		}
+		s.shards[name] = shard
+	}
+	slices.Sort(s.names)
+	return s, nil
+}
+
+// Close закрывает соединения со всеми шардами.
+func (s *ShardedStorage) Close() {
+	for _, pool := range s.pools {
+		pool.Close()
+	}
+}
+
+// Shards возвращает хранилища шардов (например, для миграций и секций).
+func (s *ShardedStorage) Shards() []*Storage {
+	shards := make([]*Storage, 0, len(s.names))
+	for _, name := range s.names {
+		shards = append(shards, s.shards[name])
+	}
+	return shards
+}
+
+func (s *ShardedStorage) home() *Storage {
+	return s.shards[s.m.Home]
+}
+
+func (s *ShardedStorage) remember(uid, shard string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.located) >= maxLocated {
+		clear(s.located)
+	}
+	s.located[uid] = shard
+}
+
+// CreateOrder проверяет, что order_uid и transaction нет ни в одном шарде:
+// заказ с тем же order_uid, но другим shardkey попал бы в другой шард, где
+// ограничения БД его не остановят. Проверка и запись выполняются под
+// блокировкой order_uid (lockOrder), поэтому два экземпляра сервиса
+// не запишут такие заказы одновременно.
+func (s *ShardedStorage) CreateOrder(ctx context.Context, order *model.Order) error {
+	name, err := s.m.shardOf(order.ShardKey)
+	if err != nil {
+		return err
+	}
+	err = s.lockOrder(ctx, order.OrderUID, func() error {
+		exists, err := scatter(ctx, s, func(ctx context.Context, shard *Storage) (bool, error) {
+			var exists bool
+			err := shard.pool.QueryRow(ctx, `
+				SELECT EXISTS (SELECT 1 FROM order_keys WHERE order_uid = $1)
+				    OR EXISTS (SELECT 1 FROM transactions WHERE transactions_uid = $2)
+			`, order.OrderUID, order.Payment.Transaction).Scan(&exists)
+			return exists, wrapErr(err)
+		})
+		if err != nil {
+			return err
+		}
+		if i := slices.Index(exists, true); i >= 0 {
+			return fmt.Errorf("%w: order %q or transaction %q already exists on shard %s",
+				ErrConflict, order.OrderUID, order.Payment.Transaction, s.names[i])
+		}
+		return s.shards[name].CreateOrder(ctx, order)
+	})
+	if err != nil {
+		return err
+	}
+	s.remember(order.OrderUID, name)
+	return nil
+}
+
+// orderLockClass — первый ключ pg_advisory_xact_lock для блокировок
+// заказов; второй — hashtext(order_uid).
+const orderLockClass = 0x5742 // "WB"
+
+// lockOrder выполняет fn под advisory-блокировкой order_uid, которую держит
+// транзакция на шарде Home.
+func (s *ShardedStorage) lockOrder(ctx context.Context, uid string, fn func() error) error {
+	tx, err := s.home().pool.Begin(ctx)
+	if err != nil {
+		return wrapErr(err)
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1, hashtext($2))`, orderLockClass, uid); err != nil {
+		return wrapErr(err)
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	return wrapErr(tx.Commit(ctx))
+}
+
+func (s *ShardedStorage) GetOrder(ctx context.Context, uid string) (*model.Order, error) {
+	s.mu.Lock()
+	name, ok := s.located[uid]
+	s.mu.Unlock()
+	if ok {
+		order, err := s.shards[name].GetOrder(ctx, uid)
+		if !errors.Is(err, ErrNotFound) {
+			return order, err
+		}
+	}
+
+	type found struct{ order *model.Order }
+	results, err := scatter(ctx, s, func(ctx context.Context, shard *Storage) (*found, error) {
+		order, err := shard.GetOrder(ctx, uid)
+		if errors.Is(err, ErrNotFound) {
+			return nil, nil
+		}
+		return &found{order: order}, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, f := range results {
+		if f != nil {
+			s.remember(uid, s.names[i])
+			return f.order, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: order %q", ErrNotFound, uid)
+}
+
+func (s *ShardedStorage) GetAllOrders(ctx context.Context) ([]*model.Order, error) {
+	return s.gather(ctx, func(ctx context.Context, shard *Storage) ([]*model.Order, error) {
+		return shard.GetAllOrders(ctx)
+	})
+}
+
+// AllOrders — потоковый вариант GetAllOrders: шарды читаются по очереди.
+func (s *ShardedStorage) AllOrders(ctx context.Context) iter.Seq2[*model.Order, error] {
+	return func(yield func(*model.Order, error) bool) {
+		for _, shard := range s.Shards() {
+			for order, err := range shard.AllOrders(ctx) {
+				if !yield(order, err) || err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// ListOrders запрашивает страницу у каждого шарда и сливает их: курсор —
+// позиция в общем порядке, поэтому следующая страница собирается так же.
+func (s *ShardedStorage) ListOrders(ctx context.Context, f OrderFilter) (*OrderPage, error) {
+	limit := listLimit(f.Limit)
+	f.Limit = limit
+	more := false
+	var mu sync.Mutex
+	orders, err := s.gather(ctx, func(ctx context.Context, shard *Storage) ([]*model.Order, error) {
+		page, err := shard.ListOrders(ctx, f)
+		if err != nil {
+			return nil, err
+		}
+		if page.NextCursor != "" {
+			mu.Lock()
+			more = true
+			mu.Unlock()
+		}
+		return page.Orders, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	page := newPage(orders, limit)
+	if page.NextCursor == "" && more {
+		last := page.Orders[len(page.Orders)-1]
+		page.NextCursor = cursor{DateCreated: last.DateCreated, OrderUID: last.OrderUID}.encode()
+	}
+	return page, nil
+}
+
+func (s *ShardedStorage) FindOrders(ctx context.Context, field LookupField, value string) ([]*model.Order, error) {
+	orders, err := s.gather(ctx, func(ctx context.Context, shard *Storage) ([]*model.Order, error) {
+		return shard.FindOrders(ctx, field, value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return orders[:min(len(orders), MaxListLimit)], nil
+}
+
+// gather выполняет запрос на всех шардах и возвращает заказы от новых
+// к старым. Заказ, который Rebalance уже скопировал, но еще не удалил
+// из старого шарда, возвращается один раз.
+func (s *ShardedStorage) gather(ctx context.Context, query func(context.Context, *Storage) ([]*model.Order, error)) ([]*model.Order, error) {
+	results, err := scatter(ctx, s, query)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var orders []*model.Order
+	for _, part := range results {
+		for _, order := range part {
+			if !seen[order.OrderUID] {
+				seen[order.OrderUID] = true
+				orders = append(orders, order)
+			}
+		}
+	}
+	sortNewestFirst(orders)
+	return orders, nil
+}
+
+// scatter выполняет query на всех шардах параллельно; результаты — в порядке
+// s.names. Первая ошибка отменяет остальные запросы.
+func scatter[T any](ctx context.Context, s *ShardedStorage, query func(context.Context, *Storage) (T, error)) ([]T, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]T, len(s.names))
+	errs := make([]error, len(s.names))
+	var wg sync.WaitGroup
+	for i, name := range s.names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = query(ctx, s.shards[name])
+			if errs[i] != nil {
+				errs[i] = fmt.Errorf("shard %s: %w", name, errs[i])
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return nil, err
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Архив сообщений и метаданные получения хранятся на шарде Home:
+// сообщение архивируется до разбора, когда shardkey еще неизвестен.
+
+func (s *ShardedStorage) ArchiveRaw(ctx context.Context, m *RawMessage) error {
+	return s.home().ArchiveRaw(ctx, m)
+}
+
+func (s *ShardedStorage) GetRawMessages(ctx context.Context, uid string) ([]*RawMessage, error) {
+	return s.home().GetRawMessages(ctx, uid)
+}
+
+func (s *ShardedStorage) SaveIngestMeta(ctx context.Context, uid string, meta *IngestMeta) error {
+	return s.home().SaveIngestMeta(ctx, uid, meta)
+}
+
+func (s *ShardedStorage) GetIngestMeta(ctx context.Context, uid string) (*IngestMeta, error) {
+	return s.home().GetIngestMeta(ctx, uid)
+}
+
+// Rebalance переносит заказы, лежащие не в шарде своего диапазона
+// (например, после добавления шарда в карту), и возвращает их число.
+// Сервисы могут работать во время переноса: заказ сначала копируется,
+// затем удаляется из старого шарда, а GetOrder ищет его во всех шардах.
+func Rebalance(ctx context.Context, s *ShardedStorage) (moved int, err error) {
+	for _, name := range s.names {
+		src := s.shards[name]
+		// удаленные заказы не переносятся: их очистит PurgeDeleted
+		rows, err := src.pool.Query(ctx, `
+			SELECT o.order_uid, o.shardkey
+			FROM orders o
+			JOIN order_keys k ON k.order_uid = o.order_uid AND k.deleted_at IS NULL
+		`)
+		if err != nil {
+			return moved, fmt.Errorf("shard %s: %w", name, wrapErr(err))
+		}
+		type placement struct{ uid, shardKey string }
+		placements, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (placement, error) {
+			var p placement
+			return p, row.Scan(&p.uid, &p.shardKey)
+		})
+		if err != nil {
+			return moved, fmt.Errorf("shard %s: %w", name, wrapErr(err))
+		}
+
+		for _, p := range placements {
+			target, err := s.m.shardOf(p.shardKey)
+			if err != nil {
+				log.Printf("order %s left on shard %s: %s", p.uid, name, err)
+				continue
+			}
+			if target == name {
+				continue
+			}
+			if err := moveOrder(ctx, src, s.shards[target], p.uid); err != nil {
+				return moved, fmt.Errorf("move order %s from shard %s to %s: %w", p.uid, name, target, err)
+			}
+			s.remember(p.uid, target)
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+func moveOrder(ctx context.Context, src, dst *Storage, uid string) error {
+	ctx = ReadPrimary(ctx)
+	order, err := src.GetOrder(ctx, uid)
+	if err != nil {
+		return err
+	}
+	err = dst.CreateOrder(ctx, order)
+	if errors.Is(err, ErrConflict) {
+		// копия осталась от прерванного переноса
+		if _, err = dst.GetOrder(ctx, uid); err != nil {
+			return fmt.Errorf("%w: order or transaction %s already exists on target shard", ErrConflict, order.Payment.Transaction)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	history, err := src.OrderHistory(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if err := dst.importHistory(ctx, history); err != nil {
+		return err
+	}
+	status, err := src.OrderStatus(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if err := dst.importStatusHistory(ctx, uid, status.History); err != nil {
+		return err
+	}
+	itemStatuses, err := src.ItemStatusHistory(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if err := dst.importItemStatusHistory(ctx, uid, itemStatuses); err != nil {
+		return err
+	}
+	events, err := src.itemStatusEvents(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if err := dst.importItemStatusEvents(ctx, uid, events); err != nil {
+		return err
+	}
+	refunds, err := src.Refunds(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if err := dst.importRefunds(ctx, refunds.Refunds); err != nil {
+		return err
+	}
+	return src.deleteOrder(ctx, uid)
+}
@@ -0,0 +1,416 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+
+	"github.com/dws33/WB_ZeroProj/internal/model"
+)
+
+//go:embed sqlite_schema.sql
+var sqliteSchema string
+
+// sqliteTimeLayout — фиксированная ширина и UTC, чтобы строки сравнивались
+// как время; точность — микросекунды, как у TIMESTAMP в Postgres.
+const sqliteTimeLayout = "2006-01-02T15:04:05.000000Z"
+
+// SQLiteStore — OrderStore в локальном файле SQLite (чистый Go, без cgo).
+// Предназначен для разработки: httpserver и website без Docker.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// NewSQLite открывает (и при необходимости создает) базу в файле path.
+func NewSQLite(ctx context.Context, path string) (*SQLiteStore, error) {
+	q := url.Values{}
+	q.Add("_pragma", "foreign_keys(1)")
+	q.Add("_pragma", "journal_mode(WAL)")
+	q.Add("_pragma", "busy_timeout(5000)")
+	db, err := sql.Open("sqlite", "file:"+path+"?"+q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.ExecContext(ctx, sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("init sqlite schema: %w", err)
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+func sqliteTime(t time.Time) any {
+	return t.UTC().Truncate(time.Microsecond).Format(sqliteTimeLayout)
+}
+
+func (s *SQLiteStore) CreateOrder(ctx context.Context, order *model.Order) error {
+	return wrapSQLiteErr(s.createOrder(ctx, order))
+}
+
+func (s *SQLiteStore) createOrder(ctx context.Context, order *model.Order) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO transactions (
+			transactions_uid, request_id, currency, provider, amount,
+			payment_dt, bank, delivery_cost, goods_total, custom_fee
+		) VALUES (?,?,?,?,?,?,?,?,?,?)
+	`,
+		order.Payment.Transaction, order.Payment.RequestID, order.Payment.Currency,
+		order.Payment.Provider, order.Payment.Amount, order.Payment.PaymentDT,
+		order.Payment.Bank, order.Payment.DeliveryCost, order.Payment.GoodsTotal,
+		order.Payment.CustomFee,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO orders (
+			order_uid, track_number, entry, locale, internal_signature, customer_id,
+			delivery_service, shardkey, sm_id, date_created, oof_shard, payment_id
+		) VALUES (?,?,?,?,?,?,?,?,?,?,?,?)
+	`,
+		order.OrderUID, order.TrackNumber, order.Entry, order.Locale, order.InternalSignature,
+		order.CustomerID, order.DeliveryService, order.ShardKey, order.SmID,
+		sqliteTime(order.DateCreated), order.OofShard, order.Payment.Transaction,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO deliveries (
+			order_uid, name, phone, zip, city, address, region, email
+		) VALUES (?,?,?,?,?,?,?,?)
+	`,
+		order.OrderUID,
+		order.Delivery.Name, order.Delivery.Phone, order.Delivery.Zip,
+		order.Delivery.City, order.Delivery.Address, order.Delivery.Region,
+		order.Delivery.Email,
+	)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO items (
+			order_uid, chrt_id, track_number, price, rid, name,
+			sale, size, total_price, nm_id, brand, status
+		) VALUES (?,?,?,?,?,?,?,?,?,?,?,?)
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, item := range order.Items {
+		_, err = stmt.ExecContext(ctx,
+			order.OrderUID, item.ChrtID, item.TrackNumber, item.Price, item.RID, item.Name,
+			item.Sale, item.Size, item.TotalPrice, item.NmID, item.Brand, item.Status,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO order_changes (order_uid, kind, at) VALUES (?,?,?)`,
+		order.OrderUID, ChangeCreate, sqliteTime(time.Now()))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// sqliteSelectOrdersQuery — аналог selectOrdersQuery на функциях JSON1.
+const sqliteSelectOrdersQuery = `
+       SELECT
+           o.order_uid, o.track_number, o.entry, o.locale, o.internal_signature, o.customer_id,
+           o.delivery_service, o.shardkey, o.sm_id, o.date_created, o.oof_shard,
+           d.name, d.phone, d.zip, d.city, d.address, d.region, d.email,
+           t.transactions_uid, t.request_id, t.currency, t.provider, t.amount, t.payment_dt, t.bank, t.delivery_cost, t.goods_total, t.custom_fee,
+           COALESCE((
+               SELECT json_group_array(json_object(
+                   'chrt_id', i.chrt_id, 'track_number', i.track_number, 'price', i.price,
+                   'rid', i.rid, 'name', i.name, 'sale', i.sale, 'size', i.size,
+                   'total_price', i.total_price, 'nm_id', i.nm_id, 'brand', i.brand,
+                   'status', i.status
+               ))
+               FROM (SELECT * FROM items WHERE order_uid = o.order_uid ORDER BY id) i
+           ), '[]')
+       FROM orders o
+       LEFT JOIN deliveries d ON o.order_uid = d.order_uid
+       LEFT JOIN transactions t ON o.payment_id = t.transactions_uid
+    `
+
+func (s *SQLiteStore) GetOrder(ctx context.Context, uid string) (*model.Order, error) {
+	orders, err := s.queryOrders(ctx, sqliteSelectOrdersQuery+` WHERE o.order_uid = ?1`, uid)
+	if err != nil {
+		return nil, err
+	}
+	if len(orders) == 0 {
+		return nil, fmt.Errorf("%w: %w", ErrNotFound, sql.ErrNoRows)
+	}
+	return orders[0], nil
+}
+
+func (s *SQLiteStore) GetAllOrders(ctx context.Context) ([]*model.Order, error) {
+	return s.queryOrders(ctx, sqliteSelectOrdersQuery)
+}
+
+func (s *SQLiteStore) ListOrders(ctx context.Context, f OrderFilter) (*OrderPage, error) {
+	clause, args, limit, err := listClause(f,
+		func(n int) string { return "?" + strconv.Itoa(n) },
+		sqliteTime)
+	if err != nil {
+		return nil, err
+	}
+	orders, err := s.queryOrders(ctx, sqliteSelectOrdersQuery+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	return newPage(orders, limit), nil
+}
+
+func (s *SQLiteStore) FindOrders(ctx context.Context, field LookupField, value string) ([]*model.Order, error) {
+	cond, arg, err := lookupCondition(field, value)
+	if err != nil {
+		return nil, err
+	}
+	query := sqliteSelectOrdersQuery + " WHERE " + strings.ReplaceAll(cond, "$1", "?1") +
+		fmt.Sprintf(" ORDER BY o.date_created DESC, o.order_uid DESC LIMIT %d", MaxListLimit)
+	return s.queryOrders(ctx, query, arg)
+}
+
+func (s *SQLiteStore) queryOrders(ctx context.Context, query string, args ...any) ([]*model.Order, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, wrapSQLiteErr(err)
+	}
+	defer rows.Close()
+
+	var orders []*model.Order
+	for rows.Next() {
+		order := new(model.Order)
+		var dateCreated, items string
+		ptrs := orderToPtrs(order)
+		ptrs[9] = &dateCreated     // o.date_created
+		ptrs[len(ptrs)-1] = &items // товары JSON-массивом
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, wrapSQLiteErr(err)
+		}
+		if order.DateCreated, err = time.Parse(sqliteTimeLayout, dateCreated); err != nil {
+			return nil, fmt.Errorf("order %s: date_created: %w", order.OrderUID, err)
+		}
+		if err := json.Unmarshal([]byte(items), &order.Items); err != nil {
+			return nil, fmt.Errorf("order %s: items: %w", order.OrderUID, err)
+		}
+		orders = append(orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapSQLiteErr(err)
+	}
+	return orders, nil
+}
+
+// wrapSQLiteErr — аналог wrapErr для кодов ошибок SQLite.
+func wrapSQLiteErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	var sqlErr *sqlite.Error
+	if errors.As(err, &sqlErr) {
+		switch code := sqlErr.Code(); {
+		case code == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY, code == sqlite3.SQLITE_CONSTRAINT_UNIQUE:
+			return fmt.Errorf("%w: %w", ErrConflict, err)
+		case code == sqlite3.SQLITE_CONSTRAINT_NOTNULL, code == sqlite3.SQLITE_CONSTRAINT_CHECK,
+			code == sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY:
+			return fmt.Errorf("%w: %w", ErrInvalidArgument, err)
+		case code&0xff == sqlite3.SQLITE_BUSY, code&0xff == sqlite3.SQLITE_LOCKED,
+			code&0xff == sqlite3.SQLITE_CANTOPEN, code&0xff == sqlite3.SQLITE_FULL:
+			return fmt.Errorf("%w: %w", ErrUnavailable, err)
+		}
+		return err
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, sql.ErrConnDone) {
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	return err
+}
+
+func (s *SQLiteStore) ArchiveRaw(ctx context.Context, m *RawMessage) error {
+	payload, err := compressPayload(m.Payload)
+	if err != nil {
+		return err
+	}
+	headers, err := encodeHeaders(m.Headers)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO raw_messages (
+			order_uid, topic, kafka_partition, kafka_offset, headers, payload, received_at
+		) VALUES (?,?,?,?,?,?,?)
+		ON CONFLICT (topic, kafka_partition, kafka_offset) DO NOTHING
+	`, m.OrderUID, m.Topic, m.Partition, m.Offset, string(headers), payload, sqliteTime(m.ReceivedAt))
+	return wrapSQLiteErr(err)
+}
+
+func (s *SQLiteStore) GetRawMessages(ctx context.Context, uid string) ([]*RawMessage, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT order_uid, topic, kafka_partition, kafka_offset, headers, payload, received_at
+		FROM raw_messages
+		WHERE order_uid = ?
+		ORDER BY received_at, id
+	`, uid)
+	if err != nil {
+		return nil, wrapSQLiteErr(err)
+	}
+	defer rows.Close()
+
+	var messages []*RawMessage
+	for rows.Next() {
+		m := new(RawMessage)
+		var headers, receivedAt string
+		var payload []byte
+		if err := rows.Scan(&m.OrderUID, &m.Topic, &m.Partition, &m.Offset, &headers, &payload, &receivedAt); err != nil {
+			return nil, wrapSQLiteErr(err)
+		}
+		if m.ReceivedAt, err = time.Parse(sqliteTimeLayout, receivedAt); err != nil {
+			return nil, fmt.Errorf("raw message %s/%d/%d: received_at: %w", m.Topic, m.Partition, m.Offset, err)
+		}
+		if err := json.Unmarshal([]byte(headers), &m.Headers); err != nil {
+			return nil, fmt.Errorf("raw message %s/%d/%d: headers: %w", m.Topic, m.Partition, m.Offset, err)
+		}
+		if m.Payload, err = decompressPayload(payload); err != nil {
+			return nil, fmt.Errorf("raw message %s/%d/%d: payload: %w", m.Topic, m.Partition, m.Offset, err)
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapSQLiteErr(err)
+	}
+	if len(messages) == 0 {
+		return nil, noRawMessages(uid)
+	}
+	return messages, nil
+}
+
+func (s *SQLiteStore) ChangeCursor(ctx context.Context) (string, error) {
+	var seq int64
+	err := s.db.QueryRowContext(ctx, `SELECT COALESCE(max(seq), 0) FROM order_changes`).Scan(&seq)
+	if err != nil {
+		return "", wrapSQLiteErr(err)
+	}
+	// журнал может быть очищен целиком: конец не раньше границы очистки
+	var pruned int64
+	if err := s.db.QueryRowContext(ctx, `SELECT seq FROM order_change_horizon`).Scan(&pruned); err != nil {
+		return "", wrapSQLiteErr(err)
+	}
+	return strconv.FormatInt(max(seq, pruned), 10), nil
+}
+
+func (s *SQLiteStore) ChangesSince(ctx context.Context, cursor string, limit int) ([]*OrderChange, string, error) {
+	after, err := strconv.ParseInt(cursor, 10, 64)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: malformed change cursor %q", ErrInvalidArgument, cursor)
+	}
+	if limit <= 0 {
+		limit = changeBatch
+	}
+	var pruned int64
+	if err := s.db.QueryRowContext(ctx, `SELECT seq FROM order_change_horizon`).Scan(&pruned); err != nil {
+		return nil, "", wrapSQLiteErr(err)
+	}
+	if after < pruned {
+		return nil, "", fmt.Errorf("%w: %s", ErrCursorExpired, cursor)
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT seq, order_uid, kind, at FROM order_changes
+		WHERE seq > ?
+		ORDER BY seq
+		LIMIT ?
+	`, after, limit)
+	if err != nil {
+		return nil, "", wrapSQLiteErr(err)
+	}
+	defer rows.Close()
+
+	var changes []*OrderChange
+	next := after
+	for rows.Next() {
+		c := new(OrderChange)
+		var at string
+		if err := rows.Scan(&next, &c.OrderUID, &c.Kind, &at); err != nil {
+			return nil, "", wrapSQLiteErr(err)
+		}
+		if c.At, err = time.Parse(sqliteTimeLayout, at); err != nil {
+			return nil, "", fmt.Errorf("order change %d: at: %w", next, err)
+		}
+		changes = append(changes, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", wrapSQLiteErr(err)
+	}
+	return changes, strconv.FormatInt(next, 10), nil
+}
+
+func (s *SQLiteStore) ChangeLag(ctx context.Context, cursor string) (time.Duration, error) {
+	after, err := strconv.ParseInt(cursor, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: malformed change cursor %q", ErrInvalidArgument, cursor)
+	}
+	var at sql.NullString
+	if err := s.db.QueryRowContext(ctx, `SELECT min(at) FROM order_changes WHERE seq > ?`, after).
+		Scan(&at); err != nil || !at.Valid {
+		return 0, wrapSQLiteErr(err)
+	}
+	t, err := time.Parse(sqliteTimeLayout, at.String)
+	if err != nil {
+		return 0, fmt.Errorf("order change at: %w", err)
+	}
+	return time.Since(t), nil
+}
+
+func (s *SQLiteStore) PruneChanges(ctx context.Context, before time.Time) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, wrapSQLiteErr(err)
+	}
+	defer tx.Rollback()
+
+	var last sql.NullInt64
+	if err := tx.QueryRowContext(ctx, `SELECT max(seq) FROM order_changes WHERE at < ?`,
+		sqliteTime(before)).Scan(&last); err != nil || !last.Valid {
+		return 0, wrapSQLiteErr(err)
+	}
+	res, err := tx.ExecContext(ctx, `DELETE FROM order_changes WHERE seq <= ?`, last.Int64)
+	if err != nil {
+		return 0, wrapSQLiteErr(err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE order_change_horizon SET seq = max(seq, ?)`, last.Int64); err != nil {
+		return 0, wrapSQLiteErr(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), wrapSQLiteErr(tx.Commit())
+}
@@ -0,0 +1,114 @@
+-- Схема SQLite для локальной разработки: те же таблицы, что в
+-- migrations/sql/0001_init.up.sql с ограничениями из 0007, и индексы из 0002/0003.
+-- Ограничения действуют только для новых файлов базы: SQLite не умеет
+-- добавлять их в существующие таблицы.
+-- date_created хранится текстом в UTC фиксированной ширины
+-- (см. sqliteTimeLayout), поэтому сравнивается и сортируется как строка.
+
+CREATE TABLE IF NOT EXISTS transactions (
+    transactions_uid TEXT PRIMARY KEY,
+    request_id TEXT NOT NULL,
+    currency TEXT NOT NULL,
+    provider TEXT NOT NULL,
+    amount INT NOT NULL,
+    payment_dt BIGINT NOT NULL,
+    bank TEXT NOT NULL,
+    delivery_cost INT NOT NULL,
+    goods_total INT NOT NULL,
+    custom_fee INT NOT NULL DEFAULT 0,
+    CHECK (amount = delivery_cost + goods_total),
+    CHECK (amount >= 1),
+    CHECK (delivery_cost >= 0 AND goods_total >= 0 AND custom_fee >= 0)
+);
+
+CREATE TABLE IF NOT EXISTS orders (
+    order_uid TEXT PRIMARY KEY,
+    track_number TEXT NOT NULL,
+    entry TEXT NOT NULL,
+    locale TEXT NOT NULL,
+    internal_signature TEXT NOT NULL DEFAULT '',
+    customer_id TEXT NOT NULL,
+    delivery_service TEXT NOT NULL,
+    shardkey TEXT NOT NULL,
+    sm_id INT NOT NULL,
+    date_created TEXT NOT NULL,
+    oof_shard TEXT NOT NULL,
+    payment_id TEXT NOT NULL REFERENCES transactions ON DELETE RESTRICT
+);
+
+CREATE TABLE IF NOT EXISTS deliveries (
+    order_uid TEXT PRIMARY KEY REFERENCES orders ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    phone TEXT NOT NULL,
+    zip TEXT NOT NULL,
+    city TEXT NOT NULL,
+    address TEXT NOT NULL,
+    region TEXT NOT NULL,
+    email TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS items (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    order_uid TEXT NOT NULL REFERENCES orders ON DELETE CASCADE,
+    chrt_id INT NOT NULL,
+    track_number TEXT NOT NULL,
+    price INT NOT NULL,
+    rid TEXT NOT NULL,
+    name TEXT NOT NULL,
+    sale INT NOT NULL,
+    size TEXT NOT NULL,
+    total_price INT NOT NULL,
+    nm_id INT NOT NULL,
+    brand TEXT NOT NULL,
+    status INT NOT NULL,
+    CHECK (price >= 0 AND total_price >= 0),
+    CHECK (sale BETWEEN 0 AND 100)
+);
+
+CREATE INDEX IF NOT EXISTS orders_date_created_idx ON orders (date_created DESC, order_uid DESC);
+CREATE INDEX IF NOT EXISTS orders_customer_id_idx ON orders (customer_id, date_created DESC);
+CREATE INDEX IF NOT EXISTS orders_track_number_idx ON orders (track_number);
+CREATE INDEX IF NOT EXISTS orders_payment_id_idx ON orders (payment_id);
+CREATE INDEX IF NOT EXISTS items_order_uid_idx ON items (order_uid);
+CREATE INDEX IF NOT EXISTS items_brand_idx ON items (brand, order_uid);
+CREATE INDEX IF NOT EXISTS items_rid_idx ON items (rid);
+CREATE INDEX IF NOT EXISTS items_chrt_id_idx ON items (chrt_id);
+CREATE INDEX IF NOT EXISTS items_nm_id_idx ON items (nm_id);
+
+CREATE TABLE IF NOT EXISTS raw_messages (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    order_uid TEXT NOT NULL,
+    topic TEXT NOT NULL,
+    kafka_partition INT NOT NULL,
+    kafka_offset INT NOT NULL,
+    headers TEXT NOT NULL DEFAULT '[]',
+    payload BLOB NOT NULL,
+    received_at TEXT NOT NULL,
+    UNIQUE (topic, kafka_partition, kafka_offset)
+);
+
+CREATE INDEX IF NOT EXISTS raw_messages_order_uid_idx ON raw_messages (order_uid);
+
+CREATE TABLE IF NOT EXISTS ingest_meta (
+    order_uid TEXT PRIMARY KEY,
+    meta TEXT NOT NULL
+);
+
+-- Журнал изменений заказов (storage.ChangeFeed, см. 0016). SQLite выполняет
+-- пишущие транзакции по одной, поэтому seq растет в порядке их фиксации.
+CREATE TABLE IF NOT EXISTS order_changes (
+    seq INTEGER PRIMARY KEY AUTOINCREMENT,
+    order_uid TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    at TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS order_changes_at_idx ON order_changes (at);
+
+-- последний удаленный PruneChanges seq
+CREATE TABLE IF NOT EXISTS order_change_horizon (
+    seq INTEGER NOT NULL
+);
+
+INSERT INTO order_change_horizon (seq)
+SELECT 0 WHERE NOT EXISTS (SELECT 1 FROM order_change_horizon);
@@ -0,0 +1,256 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/dws33/WB_ZeroProj/internal/model"
+)
+
+// StatusChange — переход заказа между статусами.
+type StatusChange struct {
+	OrderUID string            `json:"order_uid"`
+	From     model.OrderStatus `json:"from"`
+	To       model.OrderStatus `json:"to"`
+	Actor    string            `json:"actor"`
+	Reason   string            `json:"reason"`
+	At       time.Time         `json:"at"`
+}
+
+// StatusReport — статус заказа, статус, выведенный из его товаров
+// (model.DeriveStatus), и переходы от старых к новым.
+type StatusReport struct {
+	Status  model.OrderStatus `json:"status"`
+	Derived model.OrderStatus `json:"derived,omitempty"`
+	History []*StatusChange   `json:"history"`
+}
+
+// StatusStore — жизненный цикл заказов. Пока переходов не было, статус
+// заказа выводится из статусов товаров, а если их коды неизвестны — created.
+type StatusStore interface {
+	// OrderStatus возвращает статус заказа. ErrNotFound — заказа нет.
+	OrderStatus(ctx context.Context, uid string) (*StatusReport, error)
+	// TransitionOrder переводит заказ в статус to; пустой to — в статус,
+	// выведенный из товаров (он может пропускать этапы). nil без ошибки —
+	// заказ уже в этом статусе. Неразрешенный переход — ErrInvalidArgument,
+	// оборачивающая model.ErrInvalidTransition.
+	TransitionOrder(ctx context.Context, uid string, to model.OrderStatus, actor, reason string) (*StatusChange, error)
+}
+
+// currentStatus возвращает статус заказа по последнему переходу last
+// (пустой — переходов не было) и статусам товаров.
+func currentStatus(last model.OrderStatus, items []*model.Item) (status, derived model.OrderStatus) {
+	derived, _ = model.DeriveStatus(items)
+	switch {
+	case last != "":
+		return last, derived
+	case derived != "":
+		return derived, derived
+	default:
+		return model.StatusCreated, derived
+	}
+}
+
+// nextStatus проверяет переход из from в to (пустой to — в derived) и
+// возвращает целевой статус; пустой — переход не нужен.
+func nextStatus(from, to, derived model.OrderStatus) (model.OrderStatus, error) {
+	if to == "" {
+		if derived == "" {
+			return "", fmt.Errorf("%w: %w: item statuses are unknown", ErrInvalidArgument, model.ErrInvalidTransition)
+		}
+		if derived == from {
+			return "", nil
+		}
+		if !from.CanReach(derived) {
+			return "", fmt.Errorf("%w: %w: %s -> %s", ErrInvalidArgument, model.ErrInvalidTransition, from, derived)
+		}
+		return derived, nil
+	}
+	if to == from {
+		return "", nil
+	}
+	if err := model.ValidateTransition(from, to); err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidArgument, err)
+	}
+	return to, nil
+}
+
+func (s *Storage) OrderStatus(ctx context.Context, uid string) (*StatusReport, error) {
+	order, err := s.GetOrder(ReadPrimary(ctx), uid)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.pool.Query(ctx, `
+		SELECT order_uid, from_status, to_status, actor, reason, at FROM order_status_history
+		WHERE order_uid = $1
+		ORDER BY id
+	`, uid)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	history, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByPos[StatusChange])
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	report := &StatusReport{History: history}
+	if report.History == nil {
+		report.History = []*StatusChange{}
+	}
+	var last model.OrderStatus
+	if len(history) > 0 {
+		last = history[len(history)-1].To
+	}
+	report.Status, report.Derived = currentStatus(last, order.Items)
+	return report, nil
+}
+
+func (s *Storage) TransitionOrder(ctx context.Context, uid string, to model.OrderStatus, actor, reason string) (*StatusChange, error) {
+	change, err := s.transitionOrder(ctx, uid, to, actor, reason)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	if change != nil {
+		s.replicas.wrote(ctx, s.pool)
+	}
+	return change, nil
+}
+
+func (s *Storage) transitionOrder(ctx context.Context, uid string, to model.OrderStatus, actor, reason string) (*StatusChange, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// переходы одного заказа выполняются по очереди
+	var dateCreated time.Time
+	if err := tx.QueryRow(ctx, `
+		SELECT date_created FROM order_keys
+		WHERE order_uid = $1 AND deleted_at IS NULL
+		FOR UPDATE
+	`, uid).Scan(&dateCreated); err != nil {
+		return nil, err
+	}
+	var last model.OrderStatus
+	err = tx.QueryRow(ctx, `
+		SELECT to_status FROM order_status_history
+		WHERE order_uid = $1
+		ORDER BY id DESC
+		LIMIT 1
+	`, uid).Scan(&last)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+	rows, err := tx.Query(ctx, `SELECT status FROM items WHERE order_uid = $1 AND date_created = $2`, uid, dateCreated)
+	if err != nil {
+		return nil, err
+	}
+	items, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*model.Item, error) {
+		item := new(model.Item)
+		return item, row.Scan(&item.Status)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	from, derived := currentStatus(last, items)
+	next, err := nextStatus(from, to, derived)
+	if err != nil || next == "" {
+		return nil, err
+	}
+	change := &StatusChange{OrderUID: uid, From: from, To: next, Actor: actor, Reason: reason}
+	if err := tx.QueryRow(ctx, `
+		INSERT INTO order_status_history (order_uid, from_status, to_status, actor, reason)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING at
+	`, uid, from, next, actor, reason).Scan(&change.At); err != nil {
+		return nil, err
+	}
+	return change, tx.Commit(ctx)
+}
+
+// importStatusHistory копирует переходы заказа, перенесенного Rebalance.
+func (s *Storage) importStatusHistory(ctx context.Context, uid string, history []*StatusChange) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return wrapErr(err)
+	}
+	defer tx.Rollback(ctx)
+	// история копируется целиком: копия от прерванного переноса заменяется
+	if _, err := tx.Exec(ctx, `DELETE FROM order_status_history WHERE order_uid = $1`, uid); err != nil {
+		return wrapErr(err)
+	}
+	for _, c := range history {
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO order_status_history (order_uid, from_status, to_status, actor, reason, at)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		`, c.OrderUID, c.From, c.To, c.Actor, c.Reason, c.At); err != nil {
+			return wrapErr(err)
+		}
+	}
+	return wrapErr(tx.Commit(ctx))
+}
+
+// Статус в шардах хранится в шарде заказа.
+
+func (s *ShardedStorage) OrderStatus(ctx context.Context, uid string) (*StatusReport, error) {
+	shard, err := s.shardOfOrder(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	return shard.OrderStatus(ctx, uid)
+}
+
+func (s *ShardedStorage) TransitionOrder(ctx context.Context, uid string, to model.OrderStatus, actor, reason string) (*StatusChange, error) {
+	shard, err := s.shardOfOrder(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	return shard.TransitionOrder(ctx, uid, to, actor, reason)
+}
+
+func (m *MemoryStore) OrderStatus(_ context.Context, uid string) (*StatusReport, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	order, ok := m.orders[uid]
+	if !ok {
+		return nil, fmt.Errorf("%w: order %q", ErrNotFound, uid)
+	}
+	report := &StatusReport{History: make([]*StatusChange, 0, len(m.statuses[uid]))}
+	for _, c := range m.statuses[uid] {
+		c := *c
+		report.History = append(report.History, &c)
+	}
+	var last model.OrderStatus
+	if n := len(report.History); n > 0 {
+		last = report.History[n-1].To
+	}
+	report.Status, report.Derived = currentStatus(last, order.Items)
+	return report, nil
+}
+
+func (m *MemoryStore) TransitionOrder(_ context.Context, uid string, to model.OrderStatus, actor, reason string) (*StatusChange, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	order, ok := m.orders[uid]
+	if !ok {
+		return nil, fmt.Errorf("%w: order %q", ErrNotFound, uid)
+	}
+	var last model.OrderStatus
+	if n := len(m.statuses[uid]); n > 0 {
+		last = m.statuses[uid][n-1].To
+	}
+	from, derived := currentStatus(last, order.Items)
+	next, err := nextStatus(from, to, derived)
+	if err != nil || next == "" {
+		return nil, err
+	}
+	change := &StatusChange{OrderUID: uid, From: from, To: next, Actor: actor, Reason: reason, At: time.Now()}
+	m.statuses[uid] = append(m.statuses[uid], change)
+	c := *change
+	return &c, nil
+}
@@ -0,0 +1,77 @@
+package storagetest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/dws33/WB_ZeroProj/internal/storage/migrations"
+)
+
+// PostgresDSNEnv — переменная окружения со строкой подключения к тестовой
+// базе PostgreSQL. Без нее тесты и бенчмарки на PostgreSQL пропускаются.
+const PostgresDSNEnv = "TEST_POSTGRES_DSN"
+
+var schemaSeq atomic.Int64
+
+// RequirePostgres пропускает тест без PostgresDSNEnv и возвращает строку
+// подключения.
+func RequirePostgres(tb testing.TB) string {
+	tb.Helper()
+	dsn := os.Getenv(PostgresDSNEnv)
+	if dsn == "" {
+		tb.Skipf("%s is not set", PostgresDSNEnv)
+	}
+	return dsn
+}
+
+// PostgresPool возвращает пул к пустой схеме тестовой базы со всеми
+// миграциями. Схема создается заново для каждого вызова и удаляется
+// после теста, поэтому тесты не мешают друг другу и данным базы.
+func PostgresPool(tb testing.TB) *pgxpool.Pool {
+	tb.Helper()
+	dsn := RequirePostgres(tb)
+	ctx := context.Background()
+	schema := fmt.Sprintf("storagetest_%d_%d", os.Getpid(), schemaSeq.Add(1))
+
+	admin, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer admin.Close(ctx)
+	if _, err := admin.Exec(ctx, `CREATE SCHEMA `+pgx.Identifier{schema}.Sanitize()); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		conn, err := pgx.Connect(context.Background(), dsn)
+		if err != nil {
+			tb.Error(err)
+			return
+		}
+		defer conn.Close(context.Background())
+		if _, err := conn.Exec(context.Background(),
+			`DROP SCHEMA `+pgx.Identifier{schema}.Sanitize()+` CASCADE`); err != nil {
+			tb.Error(err)
+		}
+	})
+
+	cfg, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	cfg.ConnConfig.RuntimeParams["search_path"] = schema
+	pool, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(pool.Close)
+	if err := migrations.Up(ctx, pool); err != nil {
+		tb.Fatal(err)
+	}
+	return pool
+}
@@ -0,0 +1,459 @@
+// Package storagetest — общий набор проверок для реализаций storage.OrderStore.
+//
+// Каждая реализация подключает его в своем тесте:
+//
+//	func TestMemoryStore(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) storage.OrderStore {
+//			return storage.NewMemoryStore()
+//		})
+//	}
+//
+// newStore должен возвращать пустое хранилище для каждого подтеста.
+package storagetest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dws33/WB_ZeroProj/internal/model"
+	"github.com/dws33/WB_ZeroProj/internal/storage"
+)
+
+// base — опорное время тестовых заказов (с точностью TIMESTAMP в Postgres).
+var base = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// NewOrder возвращает заказ по образцу из задания с уникальными order_uid,
+// транзакцией, трек-номером и rid, созданный в base+minutes.
+func NewOrder(uid string, minutes int) *model.Order {
+	return &model.Order{
+		OrderUID:    uid,
+		TrackNumber: "WBTRACK" + uid,
+		Entry:       "WBIL",
+		Delivery: &model.Delivery{
+			Name:    "Test Testov",
+			Phone:   "+9720000000",
+			Zip:     "2639809",
+			City:    "Kiryat Mozkin",
+			Address: "Ploshad Mira 15",
+			Region:  "Kraiot",
+			Email:   "test@gmail.com",
+		},
+		Payment: &model.Payment{
+			Transaction:  "tx-" + uid,
+			Currency:     "USD",
+			Provider:     "wbpay",
+			Amount:       1817,
+			PaymentDT:    1637907727,
+			Bank:         "alpha",
+			DeliveryCost: 1500,
+			GoodsTotal:   317,
+		},
+		Items: []*model.Item{{
+			ChrtID:      9934930,
+			TrackNumber: "WBTRACK" + uid,
+			Price:       453,
+			RID:         "rid-" + uid,
+			Name:        "Mascaras",
+			Sale:        30,
+			Size:        "0",
+			TotalPrice:  317,
+			NmID:        2389212,
+			Brand:       "Vivienne Sabo",
+			Status:      202,
+		}},
+		Locale:          "en",
+		CustomerID:      "customer",
+		DeliveryService: "meest",
+		ShardKey:        "9",
+		SmID:            99,
+		DateCreated:     base.Add(time.Duration(minutes) * time.Minute),
+		OofShard:        "1",
+	}
+}
+
+// Run выполняет все проверки для хранилища, создаваемого newStore.
+func Run(t *testing.T, newStore func(t *testing.T) storage.OrderStore) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s storage.OrderStore)
+	}{
+		{"CreateAndGet", testCreateAndGet},
+		{"NotFound", testNotFound},
+		{"Conflict", testConflict},
+		{"Isolation", testIsolation},
+		{"GetAllOrders", testGetAll},
+		{"ListFilters", testListFilters},
+		{"ListPagination", testListPagination},
+		{"ListInvalidCursor", testListInvalidCursor},
+		{"FindOrders", testFindOrders},
+		{"UpdateItemStatuses", testUpdateItemStatuses},
+		{"ChangeFeed", testChangeFeed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newStore(t))
+		})
+	}
+}
+
+func create(t *testing.T, s storage.OrderStore, orders ...*model.Order) {
+	t.Helper()
+	for _, o := range orders {
+		if err := s.CreateOrder(context.Background(), o); err != nil {
+			t.Fatalf("CreateOrder(%s): %v", o.OrderUID, err)
+		}
+	}
+}
+
+func uids(orders []*model.Order) []string {
+	out := make([]string, len(orders))
+	for i, o := range orders {
+		out[i] = o.OrderUID
+	}
+	return out
+}
+
+func equalUIDs(t *testing.T, what string, got []*model.Order, want ...string) {
+	t.Helper()
+	if g := uids(got); fmt.Sprint(g) != fmt.Sprint(want) {
+		t.Errorf("%s: got %v, want %v", what, g, want)
+	}
+}
+
+func testCreateAndGet(t *testing.T, s storage.OrderStore) {
+	want := NewOrder("a", 0)
+	create(t, s, want)
+
+	got, err := s.GetOrder(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotJSON, _ := json.Marshal(got)
+	wantJSON, _ := json.Marshal(want)
+	if string(gotJSON) != string(wantJSON) {
+		t.Errorf("GetOrder returned a different order:\n got %s\nwant %s", gotJSON, wantJSON)
+	}
+}
+
+func testNotFound(t *testing.T, s storage.OrderStore) {
+	_, err := s.GetOrder(context.Background(), "missing")
+	if !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("GetOrder(missing): got %v, want ErrNotFound", err)
+	}
+}
+
+func testConflict(t *testing.T, s storage.OrderStore) {
+	create(t, s, NewOrder("a", 0))
+
+	err := s.CreateOrder(context.Background(), NewOrder("a", 1))
+	if !errors.Is(err, storage.ErrConflict) {
+		t.Errorf("duplicate order_uid: got %v, want ErrConflict", err)
+	}
+
+	dupTx := NewOrder("b", 1)
+	dupTx.Payment.Transaction = "tx-a"
+	err = s.CreateOrder(context.Background(), dupTx)
+	if !errors.Is(err, storage.ErrConflict) {
+		t.Errorf("duplicate transaction: got %v, want ErrConflict", err)
+	}
+	if _, err := s.GetOrder(context.Background(), "b"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("rejected order must not be stored, GetOrder: %v", err)
+	}
+}
+
+// testIsolation проверяет, что изменения переданных и полученных заказов
+// не попадают в хранилище.
+func testIsolation(t *testing.T, s storage.OrderStore) {
+	o := NewOrder("a", 0)
+	create(t, s, o)
+	o.Items[0].Name = "mutated"
+
+	got, err := s.GetOrder(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got.Delivery.Name = "mutated"
+
+	again, err := s.GetOrder(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Items[0].Name == "mutated" || again.Delivery.Name == "mutated" {
+		t.Error("stored order was mutated through a caller's pointer")
+	}
+}
+
+func testGetAll(t *testing.T, s storage.OrderStore) {
+	all, err := s.GetAllOrders(context.Background())
+	if err != nil || len(all) != 0 {
+		t.Fatalf("empty store: got %d orders, err %v", len(all), err)
+	}
+	create(t, s, NewOrder("a", 0), NewOrder("b", 1))
+	all, err = s.GetAllOrders(context.Background())
+	if err != nil || len(all) != 2 {
+		t.Fatalf("got %d orders, err %v; want 2", len(all), err)
+	}
+}
+
+func testListFilters(t *testing.T, s storage.OrderStore) {
+	a, b, c := NewOrder("a", 0), NewOrder("b", 10), NewOrder("c", 20)
+	b.CustomerID = "other"
+	b.Payment.Bank = "sber"
+	c.Items[0].Brand = "Acme"
+	c.Locale = "ru"
+	create(t, s, a, b, c)
+
+	ctx := context.Background()
+	cases := []struct {
+		name string
+		f    storage.OrderFilter
+		want []string
+	}{
+		{"all newest first", storage.OrderFilter{}, []string{"c", "b", "a"}},
+		{"customer", storage.OrderFilter{CustomerID: "other"}, []string{"b"}},
+		{"bank", storage.OrderFilter{PaymentBank: "alpha"}, []string{"c", "a"}},
+		{"brand", storage.OrderFilter{ItemBrand: "Acme"}, []string{"c"}},
+		{"locale", storage.OrderFilter{Locale: "en"}, []string{"b", "a"}},
+		{"range", storage.OrderFilter{CreatedFrom: base.Add(10 * time.Minute), CreatedTo: base.Add(20 * time.Minute)}, []string{"b"}},
+		{"no match", storage.OrderFilter{Entry: "nope"}, []string{}},
+	}
+	for _, tc := range cases {
+		page, err := s.ListOrders(ctx, tc.f)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if page.Orders == nil {
+			t.Errorf("%s: Orders must be non-nil", tc.name)
+		}
+		equalUIDs(t, tc.name, page.Orders, tc.want...)
+	}
+}
+
+func testListPagination(t *testing.T, s storage.OrderStore) {
+	// два заказа с одинаковым date_created проверяют порядок по order_uid
+	create(t, s, NewOrder("a", 0), NewOrder("b", 10), NewOrder("c", 10), NewOrder("d", 20), NewOrder("e", 30))
+
+	var got []*model.Order
+	f := storage.OrderFilter{Limit: 2}
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("pagination does not terminate")
+		}
+		page, err := s.ListOrders(context.Background(), f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, page.Orders...)
+		if page.NextCursor == "" {
+			break
+		}
+		f.Cursor = page.NextCursor
+	}
+	equalUIDs(t, "pages", got, "e", "d", "c", "b", "a")
+}
+
+func testListInvalidCursor(t *testing.T, s storage.OrderStore) {
+	_, err := s.ListOrders(context.Background(), storage.OrderFilter{Cursor: "!!not-a-cursor"})
+	if !errors.Is(err, storage.ErrInvalidArgument) {
+		t.Errorf("got %v, want ErrInvalidArgument", err)
+	}
+}
+
+func testFindOrders(t *testing.T, s storage.OrderStore) {
+	a, b := NewOrder("a", 0), NewOrder("b", 10)
+	b.Items[0].NmID = 42
+	create(t, s, a, b)
+
+	ctx := context.Background()
+	cases := []struct {
+		field storage.LookupField
+		value string
+		want  []string
+	}{
+		{storage.ByOrderUID, "a", []string{"a"}},
+		{storage.ByTrackNumber, "WBTRACKb", []string{"b"}},
+		{storage.ByTransaction, "tx-a", []string{"a"}},
+		{storage.ByRID, "rid-b", []string{"b"}},
+		{storage.ByChrtID, "9934930", []string{"b", "a"}},
+		{storage.ByNmID, "42", []string{"b"}},
+		{storage.ByRID, "missing", []string{}},
+	}
+	for _, tc := range cases {
+		got, err := s.FindOrders(ctx, tc.field, tc.value)
+		if err != nil {
+			t.Errorf("%s=%s: %v", tc.field, tc.value, err)
+			continue
+		}
+		equalUIDs(t, fmt.Sprintf("%s=%s", tc.field, tc.value), got, tc.want...)
+	}
+
+	if _, err := s.FindOrders(ctx, storage.ByNmID, "abc"); !errors.Is(err, storage.ErrInvalidArgument) {
+		t.Errorf("non-numeric nm_id: got %v, want ErrInvalidArgument", err)
+	}
+	if _, err := s.FindOrders(ctx, "color", "red"); !errors.Is(err, storage.ErrInvalidArgument) {
+		t.Errorf("unknown field: got %v, want ErrInvalidArgument", err)
+	}
+}
+
+func testUpdateItemStatuses(t *testing.T, s storage.OrderStore) {
+	updater, ok := s.(storage.ItemStatusUpdater)
+	history, ok2 := s.(storage.ItemStatusStore)
+	revisions, ok3 := s.(storage.HistoryStore)
+	if !ok || !ok2 || !ok3 {
+		t.Skip("order corrections are not supported")
+	}
+	ctx := context.Background()
+	create(t, s, NewOrder("a", 0))
+	event := func(offset int64, status int) *storage.ItemStatusEvent {
+		return &storage.ItemStatusEvent{
+			OrderUID: "a", Items: []storage.ItemStatusUpdate{{RID: "rid-a", Status: status}},
+			Actor: "test", Reason: "shipped",
+			Topic: "orders", Partition: 0, Offset: offset,
+		}
+	}
+
+	rev, err := updater.UpdateItemStatuses(ctx, event(10, 301))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev == nil || rev.Version != 2 {
+		t.Fatalf("revision: got %+v, want version 2", rev)
+	}
+	got, err := s.GetOrder(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Items[0].Status != 301 {
+		t.Errorf("item status: got %d, want 301", got.Items[0].Status)
+	}
+	changes, err := history.ItemStatusHistory(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || *changes[0].From != 202 || *changes[0].To != 301 || changes[0].Reason != "shipped" {
+		t.Errorf("item status history: got %+v", changes)
+	}
+
+	// повтор того же сообщения после перезапуска eventhandler
+	if rev, err := updater.UpdateItemStatuses(ctx, event(10, 301)); err != nil || rev != nil {
+		t.Errorf("replayed event: got %+v, %v; want nil, nil", rev, err)
+	}
+	if revs, err := revisions.OrderHistory(ctx, "a"); err != nil || len(revs) != 1 {
+		t.Errorf("order history after replay: got %d revisions, %v; want 1", len(revs), err)
+	}
+	if changes, err := history.ItemStatusHistory(ctx, "a"); err != nil || len(changes) != 1 {
+		t.Errorf("item status history after replay: got %d changes, %v; want 1", len(changes), err)
+	}
+
+	// повтор всего топика: старое событие не откатывает более новое
+	if _, err := updater.UpdateItemStatuses(ctx, event(11, 302)); err != nil {
+		t.Fatal(err)
+	}
+	for _, offset := range []int64{10, 11} {
+		if rev, err := updater.UpdateItemStatuses(ctx, event(offset, 0)); err != nil || rev != nil {
+			t.Errorf("replayed event %d: got %+v, %v; want nil, nil", offset, rev, err)
+		}
+	}
+	if got, err := s.GetOrder(ctx, "a"); err != nil || got.Items[0].Status != 302 {
+		t.Errorf("after replay: got %+v, %v; want item status 302", got, err)
+	}
+
+	unchanged := event(12, 302)
+	unchanged.Topic = ""
+	if rev, err := updater.UpdateItemStatuses(ctx, unchanged); err != nil || rev != nil {
+		t.Errorf("unchanged statuses: got %+v, %v; want nil, nil", rev, err)
+	}
+	missing := event(13, 301)
+	missing.Items[0].RID = "missing"
+	if _, err := updater.UpdateItemStatuses(ctx, missing); !errors.Is(err, storage.ErrInvalidArgument) {
+		t.Errorf("unknown rid: got %v, want ErrInvalidArgument", err)
+	}
+}
+
+// changesSince дочитывает журнал до len(want) изменений: в PostgreSQL
+// изменения видны после завершения более ранних пишущих транзакций.
+func changesSince(t *testing.T, feed storage.ChangeFeed, cursor string, want ...string) string {
+	t.Helper()
+	ctx := context.Background()
+	var got []string
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		changes, next, err := feed.ChangesSince(ctx, cursor, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range changes {
+			got = append(got, c.OrderUID+":"+c.Kind)
+		}
+		cursor = next
+		if len(got) >= len(want) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("changes: got %v, want %v", got, want)
+	}
+	return cursor
+}
+
+func testChangeFeed(t *testing.T, s storage.OrderStore) {
+	feed, ok := s.(storage.ChangeFeed)
+	if !ok {
+		t.Skip("change feed is not supported")
+	}
+	ctx := context.Background()
+	start, err := feed.ChangeCursor(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// заказ с давним date_created, полученный позже остальных, тоже виден
+	create(t, s, NewOrder("a", 0), NewOrder("b", -100000))
+	if lag, err := feed.ChangeLag(ctx, start); err != nil || lag <= 0 {
+		t.Errorf("lag before reading: got %v, %v; want > 0", lag, err)
+	}
+	cursor := changesSince(t, feed, start, "a:create", "b:create")
+	changesSince(t, feed, cursor)
+	if lag, err := feed.ChangeLag(ctx, cursor); err != nil || lag != 0 {
+		t.Errorf("lag after reading: got %v, %v; want 0", lag, err)
+	}
+
+	want := []string{}
+	if hs, ok := s.(storage.HistoryStore); ok {
+		order := NewOrder("a", 0)
+		order.TrackNumber = "CHANGED"
+		if _, err := hs.UpdateOrder(ctx, order, "test", "feed"); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, "a:update")
+	}
+	if ds, ok := s.(storage.DeleteStore); ok {
+		if err := ds.EraseOrderPII(ctx, "a", "test"); err != nil {
+			t.Fatal(err)
+		}
+		if err := ds.DeleteOrder(ctx, "b", "test"); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, "a:erase", "b:delete")
+	}
+	changesSince(t, feed, cursor, want...)
+
+	if _, _, err := feed.ChangesSince(ctx, "not a cursor", 0); !errors.Is(err, storage.ErrInvalidArgument) {
+		t.Errorf("malformed cursor: got %v, want ErrInvalidArgument", err)
+	}
+	if _, err := feed.PruneChanges(ctx, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := feed.ChangesSince(ctx, start, 0); !errors.Is(err, storage.ErrCursorExpired) {
+		t.Errorf("pruned cursor: got %v, want ErrCursorExpired", err)
+	}
+	end, err := feed.ChangeCursor(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changesSince(t, feed, end)
+}
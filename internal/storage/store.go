@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/dws33/WB_ZeroProj/internal/model"
+)
+
+// OrderStore — хранилище заказов. Реализации: Storage (PostgreSQL),
+// DocumentStorage (PostgreSQL, JSONB), ShardedStorage (шарды PostgreSQL по shardkey), SQLiteStore (локальный файл) и MemoryStore (в памяти, для тестов и демо). Все реализации обязаны
+// проходить storagetest.Run и возвращать одинаковые ошибки:
+// ErrNotFound, ErrConflict, ErrInvalidArgument, ErrUnavailable.
+type OrderStore interface {
+	CreateOrder(ctx context.Context, order *model.Order) error
+	GetOrder(ctx context.Context, uid string) (*model.Order, error)
+	GetAllOrders(ctx context.Context) ([]*model.Order, error)
+	ListOrders(ctx context.Context, f OrderFilter) (*OrderPage, error)
+	FindOrders(ctx context.Context, field LookupField, value string) ([]*model.Order, error)
+}
+
+var (
+	_ OrderStore = (*Storage)(nil)
+	_ OrderStore = (*DocumentStorage)(nil)
+	_ OrderStore = (*MemoryStore)(nil)
+	_ OrderStore = (*SQLiteStore)(nil)
+	_ OrderStore = (*ShardedStorage)(nil)
+
+	_ RawStore = (*Storage)(nil)
+	_ RawStore = (*DocumentStorage)(nil)
+	_ RawStore = (*MemoryStore)(nil)
+	_ RawStore = (*SQLiteStore)(nil)
+	_ RawStore = (*ShardedStorage)(nil)
+
+	_ MetaStore = (*Storage)(nil)
+	_ MetaStore = (*DocumentStorage)(nil)
+	_ MetaStore = (*MemoryStore)(nil)
+	_ MetaStore = (*SQLiteStore)(nil)
+	_ MetaStore = (*ShardedStorage)(nil)
+
+	_ DeleteStore = (*Storage)(nil)
+	_ DeleteStore = (*ShardedStorage)(nil)
+	_ DeleteStore = (*MemoryStore)(nil)
+
+	_ HistoryStore = (*Storage)(nil)
+	_ HistoryStore = (*ShardedStorage)(nil)
+	_ HistoryStore = (*MemoryStore)(nil)
+
+	_ StatusStore = (*Storage)(nil)
+	_ StatusStore = (*ShardedStorage)(nil)
+	_ StatusStore = (*MemoryStore)(nil)
+
+	_ ItemStatusStore = (*Storage)(nil)
+	_ ItemStatusStore = (*ShardedStorage)(nil)
+	_ ItemStatusStore = (*MemoryStore)(nil)
+
+	_ RefundStore = (*Storage)(nil)
+	_ RefundStore = (*ShardedStorage)(nil)
+	_ RefundStore = (*MemoryStore)(nil)
+
+	_ ChangeFeed = (*Storage)(nil)
+	_ ChangeFeed = (*DocumentStorage)(nil)
+	_ ChangeFeed = (*MemoryStore)(nil)
+	_ ChangeFeed = (*SQLiteStore)(nil)
+	_ ChangeFeed = (*ShardedStorage)(nil)
+)